@@ -1,12 +1,15 @@
 package vey
 
 import (
+	"context"
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"sync"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/service/dynamodb"
 	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
 )
@@ -20,6 +23,12 @@ type MemCache struct {
 	// might not be the correct implementation of memory cache expiry but don't want to put it in Cached
 	expires   map[string]time.Time
 	expiresIn time.Duration
+	failures  map[string]memFailures
+}
+
+type memFailures struct {
+	Failures
+	expires time.Time
 }
 
 func NewMemCache(expiresIn time.Duration) Cache {
@@ -27,15 +36,20 @@ func NewMemCache(expiresIn time.Duration) Cache {
 		values:    make(map[string]Cached),
 		expires:   make(map[string]time.Time),
 		expiresIn: expiresIn,
+		failures:  make(map[string]memFailures),
 	}
 }
 
 func (c *MemCache) Set(key []byte, val Cached) error {
+	return c.SetWithExpiry(context.Background(), key, val, c.expiresIn)
+}
+
+func (c *MemCache) SetWithExpiry(ctx context.Context, key []byte, val Cached, expiresIn time.Duration) error {
 	c.m.Lock()
 	defer c.m.Unlock()
 	str := base64.StdEncoding.EncodeToString(key)
 	c.values[str] = val
-	c.expires[str] = time.Now().Add(c.expiresIn)
+	c.expires[str] = time.Now().Add(expiresIn)
 	return nil
 }
 
@@ -60,6 +74,39 @@ func (c *MemCache) Del(key []byte) error {
 	return nil
 }
 
+func (c *MemCache) AddFailure(ctx context.Context, key []byte, window time.Duration) (Failures, error) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	str := base64.StdEncoding.EncodeToString(key)
+	now := time.Now()
+	f := c.failures[str]
+	if now.After(f.expires) {
+		f = memFailures{}
+	}
+	f.Count++
+	f.Last = now
+	f.expires = now.Add(window)
+	c.failures[str] = f
+	return f.Failures, nil
+}
+
+func (c *MemCache) Failures(ctx context.Context, key []byte) (Failures, error) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	f := c.failures[base64.StdEncoding.EncodeToString(key)]
+	if time.Now().After(f.expires) {
+		return Failures{}, nil
+	}
+	return f.Failures, nil
+}
+
+func (c *MemCache) ResetFailures(ctx context.Context, key []byte) error {
+	c.m.Lock()
+	defer c.m.Unlock()
+	delete(c.failures, base64.StdEncoding.EncodeToString(key))
+	return nil
+}
+
 type DynamoDbCache struct {
 	TableName string
 	D         *dynamodb.DynamoDB
@@ -85,6 +132,13 @@ func NewDynamoDbCache(tableName string, svc *dynamodb.DynamoDB, expiresIn time.D
 }
 
 func (s *DynamoDbCache) Get(b []byte) (Cached, error) {
+	return s.GetContext(context.Background(), b)
+}
+
+func (s *DynamoDbCache) GetContext(ctx context.Context, b []byte) (_ Cached, err error) {
+	ctx, span := startDynamoDbSpan(ctx, "DynamoDbCache.Get", "GetItem", s.TableName)
+	defer func() { endSpan(span, err) }()
+
 	k, err := dynamodbattribute.MarshalMap(map[string][]byte{
 		"ID": b,
 	})
@@ -95,12 +149,13 @@ func (s *DynamoDbCache) Get(b []byte) (Cached, error) {
 		TableName: aws.String(s.TableName),
 		Key:       k,
 	}
-	result, err := s.D.GetItem(input)
+	result, err := s.D.GetItemWithContext(ctx, input)
 	if err != nil {
 		Log.Error(fmt.Errorf("GetItem: input: %v, err: %w", input, err))
 		return Cached{}, fmt.Errorf("GetItem: %w", err)
 	}
-	if result.Item == nil {
+	if _, ok := result.Item["Cached"]; !ok {
+		// including the DynamoDbFailuresItems
 		return Cached{}, ErrNotFound
 	}
 	var item DynamoDbCacheItem
@@ -118,10 +173,22 @@ func (s *DynamoDbCache) Get(b []byte) (Cached, error) {
 
 // Set caches the value for the key.
 func (s *DynamoDbCache) Set(b []byte, cached Cached) error {
+	return s.SetContext(context.Background(), b, cached)
+}
+
+func (s *DynamoDbCache) SetContext(ctx context.Context, b []byte, cached Cached) error {
+	return s.SetWithExpiry(ctx, b, cached, s.expiresIn)
+}
+
+// SetWithExpiry caches the value for the key, which expires after expiresIn instead of the expiry of the cache.
+func (s *DynamoDbCache) SetWithExpiry(ctx context.Context, b []byte, cached Cached, expiresIn time.Duration) (err error) {
+	ctx, span := startDynamoDbSpan(ctx, "DynamoDbCache.Set", "PutItem", s.TableName)
+	defer func() { endSpan(span, err) }()
+
 	item := DynamoDbCacheItem{
 		ID:        b,
 		Cached:    cached,
-		ExpiresAt: time.Now().Add(s.expiresIn),
+		ExpiresAt: time.Now().Add(expiresIn),
 	}
 	i, err := dynamodbattribute.MarshalMap(item)
 	if err != nil {
@@ -132,7 +199,7 @@ func (s *DynamoDbCache) Set(b []byte, cached Cached) error {
 		Item:                i,
 		ConditionExpression: aws.String("attribute_not_exists(ID)"),
 	}
-	_, err = s.D.PutItem(input)
+	_, err = s.D.PutItemWithContext(ctx, input)
 	if err != nil {
 		Log.Error(fmt.Errorf("PutItem: input: %v, err: %w", input, err))
 		return fmt.Errorf("PutItem: %w", err)
@@ -141,6 +208,13 @@ func (s *DynamoDbCache) Set(b []byte, cached Cached) error {
 }
 
 func (s *DynamoDbCache) Del(b []byte) error {
+	return s.DelContext(context.Background(), b)
+}
+
+func (s *DynamoDbCache) DelContext(ctx context.Context, b []byte) (err error) {
+	ctx, span := startDynamoDbSpan(ctx, "DynamoDbCache.Del", "DeleteItem", s.TableName)
+	defer func() { endSpan(span, err) }()
+
 	k, err := dynamodbattribute.MarshalMap(map[string][]byte{
 		"ID": b,
 	})
@@ -151,10 +225,101 @@ func (s *DynamoDbCache) Del(b []byte) error {
 		TableName: aws.String(s.TableName),
 		Key:       k,
 	}
-	_, err = s.D.DeleteItem(input)
+	_, err = s.D.DeleteItemWithContext(ctx, input)
 	if err != nil {
 		Log.Error(fmt.Errorf("DeleteItem: input: %v, err: %w", input, err))
 		return fmt.Errorf("DeleteItem: %w", err)
 	}
 	return nil
 }
+
+// Ping checks that the table exists and is active.
+func (s *DynamoDbCache) Ping(ctx context.Context) error {
+	return pingDynamoDb(ctx, s.D, s.TableName)
+}
+
+// DynamoDbFailuresItem represents the failures of a key in the DynamoDB cache table. See FailureCounter.
+type DynamoDbFailuresItem struct {
+	ID       []byte
+	Failures int       `dynamodbav:"failures"`
+	Last     time.Time `dynamodbav:"last,unixtime"`
+	// ExpiresAt is used by DynamoDB TTL to forget the failures after the window.
+	ExpiresAt time.Time `dynamodbav:",unixtime"`
+}
+
+// AddFailure atomically counts a failure of key.
+// The failures that have expired, but not yet been deleted by TTL, are overwritten.
+func (s *DynamoDbCache) AddFailure(ctx context.Context, key []byte, window time.Duration) (_ Failures, err error) {
+	ctx, span := startDynamoDbSpan(ctx, "DynamoDbCache.AddFailure", "UpdateItem", s.TableName)
+	defer func() { endSpan(span, err) }()
+
+	now := time.Now()
+	input := &dynamodb.UpdateItemInput{
+		TableName:           aws.String(s.TableName),
+		Key:                 map[string]*dynamodb.AttributeValue{"ID": {B: key}},
+		UpdateExpression:    aws.String("ADD failures :one SET #last = :now, ExpiresAt = :expires"),
+		ConditionExpression: aws.String("attribute_not_exists(ID) OR ExpiresAt > :now"),
+		ExpressionAttributeNames: map[string]*string{
+			"#last": aws.String("last"),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":one":     {N: aws.String("1")},
+			":now":     unixTime(now),
+			":expires": unixTime(now.Add(window)),
+		},
+		ReturnValues: aws.String(dynamodb.ReturnValueAllNew),
+	}
+	out, err := s.D.UpdateItemWithContext(ctx, input)
+	var aerr awserr.Error
+	if errors.As(err, &aerr) && aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException {
+		item := DynamoDbFailuresItem{ID: key, Failures: 1, Last: now, ExpiresAt: now.Add(window)}
+		i, err := dynamodbattribute.MarshalMap(item)
+		if err != nil {
+			return Failures{}, fmt.Errorf("MarshalMap: %w", err)
+		}
+		if _, err := s.D.PutItemWithContext(ctx, &dynamodb.PutItemInput{TableName: aws.String(s.TableName), Item: i}); err != nil {
+			Log.Error(fmt.Errorf("PutItem: %w", err))
+			return Failures{}, fmt.Errorf("PutItem: %w", err)
+		}
+		return Failures{Count: 1, Last: now}, nil
+	}
+	if err != nil {
+		Log.Error(fmt.Errorf("UpdateItem: input: %v, err: %w", input, err))
+		return Failures{}, fmt.Errorf("UpdateItem: %w", err)
+	}
+	var item DynamoDbFailuresItem
+	if err := dynamodbattribute.UnmarshalMap(out.Attributes, &item); err != nil {
+		return Failures{}, fmt.Errorf("UnmarshalMap: %w", err)
+	}
+	return Failures{Count: item.Failures, Last: item.Last}, nil
+}
+
+func (s *DynamoDbCache) Failures(ctx context.Context, key []byte) (_ Failures, err error) {
+	ctx, span := startDynamoDbSpan(ctx, "DynamoDbCache.Failures", "GetItem", s.TableName)
+	defer func() { endSpan(span, err) }()
+
+	input := &dynamodb.GetItemInput{
+		TableName: aws.String(s.TableName),
+		Key:       map[string]*dynamodb.AttributeValue{"ID": {B: key}},
+	}
+	result, err := s.D.GetItemWithContext(ctx, input)
+	if err != nil {
+		Log.Error(fmt.Errorf("GetItem: input: %v, err: %w", input, err))
+		return Failures{}, fmt.Errorf("GetItem: %w", err)
+	}
+	if result.Item == nil {
+		return Failures{}, nil
+	}
+	var item DynamoDbFailuresItem
+	if err := dynamodbattribute.UnmarshalMap(result.Item, &item); err != nil {
+		return Failures{}, fmt.Errorf("UnmarshalMap: %w", err)
+	}
+	if time.Now().After(item.ExpiresAt) {
+		return Failures{}, nil
+	}
+	return Failures{Count: item.Failures, Last: item.Last}, nil
+}
+
+func (s *DynamoDbCache) ResetFailures(ctx context.Context, key []byte) error {
+	return s.DelContext(ctx, key)
+}
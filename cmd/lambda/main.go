@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"encoding/base64"
+	"encoding/json"
 	"errors"
 	"net/url"
 	"os"
@@ -15,10 +16,12 @@ import (
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/dynamodb"
 	"github.com/aws/aws-sdk-go/service/ses"
+	"github.com/aws/aws-sdk-go/service/sqs"
 	"github.com/awslabs/aws-lambda-go-api-proxy/httpadapter"
 	"github.com/mash/vey"
 	"github.com/mash/vey/email"
 	vhttp "github.com/mash/vey/http"
+	"github.com/mash/vey/tracing"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 	"go.mozilla.org/sops/v3/decrypt"
@@ -27,18 +30,141 @@ import (
 
 var (
 	adapter *httpadapter.HandlerAdapterV2
+	tp      *tracing.Provider
+	// worker sends the emails in the outbox, if configured.
+	worker *email.Worker
+	// maintainer and reconfirms run the maintenance on the scheduled events, if the stale policy is configured.
+	maintainer vey.Maintainer
+	reconfirms vey.ChallengeSender
 	// injected via go build -ldflags
 	Version   string
 	BuildDate string
 )
 
+// deadlineMargin is reserved before the Lambda deadline to respond and flush spans,
+// instead of being killed while waiting for DynamoDB or SES.
+const deadlineMargin = 500 * time.Millisecond
+
 // API Gateway uses Payload format version v2.0.
+// The Lambda deadline is propagated to the DynamoDB and SES calls through the request context.
 func Handler(ctx context.Context, req events.APIGatewayV2HTTPRequest) (events.APIGatewayV2HTTPResponse, error) {
-	return adapter.ProxyWithContext(ctx, req)
+	rctx := ctx
+	if deadline, ok := ctx.Deadline(); ok {
+		var cancel context.CancelFunc
+		rctx, cancel = context.WithDeadline(ctx, deadline.Add(-deadlineMargin))
+		defer cancel()
+	}
+	res, err := adapter.ProxyWithContext(rctx, req)
+	if tp != nil {
+		// Lambda may freeze the process after returning, so export the spans now.
+		if er := tp.ForceFlush(ctx); er != nil {
+			log.Error().Err(er).Msg("failed to flush spans")
+		}
+	}
+	return res, err
+}
+
+// SQSHandler sends the emails in the outbox, delivered by the SQS event source.
+// The emails failed to be sent are reported in batchItemFailures to be received again after the backoff,
+// which requires ReportBatchItemFailures in the event source mapping.
+func SQSHandler(ctx context.Context, ev events.SQSEvent) (SQSEventResponse, error) {
+	var res SQSEventResponse
+	for _, r := range ev.Records {
+		m, err := email.ParseSQSMessage(r.Body, r.ReceiptHandle, r.Attributes["ApproximateReceiveCount"])
+		if err == nil {
+			err = worker.Process(ctx, m)
+		}
+		if err != nil {
+			log.Error().Err(err).Str("messageId", r.MessageId).Msg("failed to send email")
+			res.BatchItemFailures = append(res.BatchItemFailures, SQSBatchItemFailure{ItemIdentifier: r.MessageId})
+		}
+	}
+	if tp != nil {
+		if er := tp.ForceFlush(ctx); er != nil {
+			log.Error().Err(er).Msg("failed to flush spans")
+		}
+	}
+	return res, nil
+}
+
+// SQSEventResponse is the partial batch response of the SQS event source.
+type SQSEventResponse struct {
+	BatchItemFailures []SQSBatchItemFailure `json:"batchItemFailures"`
+}
+
+type SQSBatchItemFailure struct {
+	ItemIdentifier string `json:"itemIdentifier"`
+}
+
+// MaintenanceHandler applies the stale policy to the keys, triggered by an EventBridge schedule such as rate(1 day).
+func MaintenanceHandler(ctx context.Context, ev events.CloudWatchEvent) (vey.MaintenanceReport, error) {
+	rctx := ctx
+	if deadline, ok := ctx.Deadline(); ok {
+		var cancel context.CancelFunc
+		rctx, cancel = context.WithDeadline(ctx, deadline.Add(-deadlineMargin))
+		defer cancel()
+	}
+	report, err := maintainer.Maintain(rctx, reconfirms)
+	entry := log.Info()
+	if err != nil {
+		entry = log.Error().Err(err)
+	}
+	entry.Int("keys", report.Keys).
+		Int("reconfirming", report.Reconfirming).
+		Int("dropped", report.Dropped).
+		Int("unreachable", report.Unreachable).
+		Int("failed", report.Failed).
+		Msg("maintenance")
+	if tp != nil {
+		if er := tp.ForceFlush(ctx); er != nil {
+			log.Error().Err(er).Msg("failed to flush spans")
+		}
+	}
+	return report, err
+}
+
+// Dispatch calls SQSHandler for the SQS events, MaintenanceHandler for the scheduled events, and Handler for the others.
+func Dispatch(ctx context.Context, raw json.RawMessage) (interface{}, error) {
+	var probe struct {
+		Records []struct {
+			EventSource string `json:"eventSource"`
+		} `json:"Records"`
+		Source     string `json:"source"`
+		DetailType string `json:"detail-type"`
+	}
+	if err := json.Unmarshal(raw, &probe); err != nil {
+		return nil, err
+	}
+	if probe.Source == "aws.events" && probe.DetailType == "Scheduled Event" {
+		if maintainer == nil {
+			return nil, errors.New("received scheduled event but stale is not configured")
+		}
+		var ev events.CloudWatchEvent
+		if err := json.Unmarshal(raw, &ev); err != nil {
+			return nil, err
+		}
+		return MaintenanceHandler(ctx, ev)
+	}
+	if len(probe.Records) > 0 && probe.Records[0].EventSource == "aws:sqs" {
+		if worker == nil {
+			return nil, errors.New("received SQS event but outbox is not configured")
+		}
+		var ev events.SQSEvent
+		if err := json.Unmarshal(raw, &ev); err != nil {
+			return nil, err
+		}
+		return SQSHandler(ctx, ev)
+	}
+
+	var req events.APIGatewayV2HTTPRequest
+	if err := json.Unmarshal(raw, &req); err != nil {
+		return nil, err
+	}
+	return Handler(ctx, req)
 }
 
 func main() {
-	lambda.Start(Handler)
+	lambda.Start(Dispatch)
 }
 
 func init() {
@@ -57,6 +183,11 @@ func setup() {
 		log.Debug().Msg("debug logging enabled")
 	}
 
+	tp, err = tracing.Setup(cfg.Trace)
+	if err != nil {
+		log.Fatal().Err(err).Msg("failed to setup tracing")
+	}
+
 	var open *url.URL
 	if cfg.OpenURL != "" {
 		u, err := url.Parse(cfg.OpenURL)
@@ -79,20 +210,171 @@ func setup() {
 	if err != nil {
 		log.Fatal().Err(err).Msg("failed to decode salt")
 	}
-	k := vey.NewVey(vey.NewDigester(salt), cache, store)
-
-	emailConfig, err := loadEmailConfig("email.yml")
-	if err != nil {
-		log.Fatal().Err(err).Msg("failed to load email.yml")
+	vopts := []vey.Option{vey.WithOrigin(cfg.Origin), vey.WithChallengeExpiry(cfg.CacheExpiry)}
+	if cfg.LegacyChallenge {
+		vopts = append(vopts, vey.WithLegacyChallenge())
+	}
+	var suppressions vey.SuppressionList
+	if cfg.SuppressionTableName != "" {
+		suppressions = vey.NewDynamoDbSuppressionList(cfg.SuppressionTableName, svc)
+		vopts = append(vopts, vey.WithSuppressionList(suppressions))
+	}
+	var revocations vey.RevocationList
+	if cfg.RevocationTableName != "" {
+		revocations = vey.NewDynamoDbRevocationList(cfg.RevocationTableName, svc)
+		vopts = append(vopts, vey.WithRevocationList(revocations))
+		if cfg.RefuseRevoked {
+			vopts = append(vopts, vey.WithRefuseRevoked())
+		}
+	}
+	var sender email.Sender
+	if cfg.MultiSender {
+		multiConfig, err := loadMultiConfig("email.yml")
+		if err != nil {
+			log.Fatal().Err(err).Msg("failed to load email.yml")
+		}
+		if sender, err = email.NewMultiSenderFromConfig(multiConfig, sess); err != nil {
+			log.Fatal().Err(err).Msg("failed to setup email providers")
+		}
+	} else {
+		emailConfig, err := loadEmailConfig("email.yml")
+		if err != nil {
+			log.Fatal().Err(err).Msg("failed to load email.yml")
+		}
+		sender = email.NewSESSender(emailConfig, ses.New(sess))
+	}
+	opts := []vhttp.Option{
+		vhttp.WithVersion(Version, BuildDate),
+		// API Gateway adds the source IP address to the rightmost
+		vhttp.WithClientHeader("X-Forwarded-For"),
+		vhttp.WithPinger("store", store.(vey.Pinger)),
+		vhttp.WithPinger("cache", cache.(vey.Pinger)),
+	}
+	if p, ok := sender.(vey.Pinger); ok {
+		opts = append(opts, vhttp.WithPinger("email", p))
 	}
-
-	sender := email.NewSESSender(emailConfig, ses.New(sess))
 	if cfg.Debug {
 		sender = email.NewLogSender(sender)
 	}
-	h := vhttp.NewHandler(k, sender, open)
+	if cfg.CORS != nil {
+		opts = append(opts, vhttp.WithCORS(*cfg.CORS))
+	}
+	if cfg.Outbox != nil {
+		worker = email.NewWorker(email.NewSQSOutbox(*cfg.Outbox, sqs.New(sess)), sender)
+		worker.MaxAttempts = cfg.OutboxMaxAttempts
+		worker.MaxAge = cfg.CacheExpiry
+		opts = append(opts, vhttp.WithOutbox(worker.Outbox))
+	}
+	if revocations != nil {
+		opts = append(opts, vhttp.WithPinger("revocation", revocations.(vey.Pinger)))
+	}
+	if cfg.RevocationFeedKey != "" {
+		if revocations == nil {
+			log.Fatal().Msg("revocation_feed_key requires revocation_table_name")
+		}
+		key, err := vhttp.DecodeFeedKey(cfg.RevocationFeedKey)
+		if err != nil {
+			log.Fatal().Err(err).Msg("failed to decode revocation_feed_key")
+		}
+		opts = append(opts, vhttp.WithRevocationFeed(revocations, key))
+	}
+	if suppressions != nil {
+		opts = append(opts, vhttp.WithPinger("suppression", suppressions.(vey.Pinger)))
+	}
+	if cfg.SESFeedback != nil {
+		if suppressions == nil {
+			log.Fatal().Msg("ses_feedback requires suppression_table_name")
+		}
+		v, err := email.NewSNSVerifier(*cfg.SESFeedback)
+		if err != nil {
+			log.Fatal().Err(err).Msg("failed to setup ses_feedback")
+		}
+		opts = append(opts, vhttp.WithSESFeedback(v))
+	}
+	if cfg.Link != nil {
+		if cfg.Link.Expiry == 0 {
+			cfg.Link.Expiry = cfg.CacheExpiry
+		}
+		links, err := vhttp.NewLinkSigner(*cfg.Link)
+		if err != nil {
+			log.Fatal().Err(err).Msg("failed to setup link")
+		}
+		opts = append(opts, vhttp.WithLinks(links))
+	}
+	var notifiers vey.Notifiers
+	if cfg.NotifyEmail {
+		notices := sender
+		if worker != nil {
+			notices = email.NewOutboxSender(worker.Outbox)
+		}
+		notifiers = append(notifiers, email.NewNotifier(notices))
+	}
+	if cfg.NotifyWebhook != nil {
+		notifiers = append(notifiers, vey.NewWebhookNotifier(cfg.NotifyWebhook.URL, []byte(cfg.NotifyWebhook.Secret)))
+	}
+	if len(notifiers) > 0 {
+		vopts = append(vopts, vey.WithNotifier(notifiers))
+	}
+	if cfg.Stale != nil {
+		key, err := base64.StdEncoding.DecodeString(cfg.StaleKey)
+		if err != nil {
+			log.Fatal().Err(err).Msg("failed to decode stale_key")
+		}
+		switch len(key) {
+		case 16, 24, 32:
+		default:
+			log.Fatal().Int("length", len(key)).Msg("stale requires stale_key of 16, 24 or 32 bytes")
+		}
+		cfg.Stale.Key = key
+		vopts = append(vopts, vey.WithStalePolicy(*cfg.Stale))
+	}
+	if cfg.KeyPolicy != nil {
+		if cfg.KeyDenyList != "" {
+			if cfg.KeyPolicy.DenyList, err = loadKeyDenyList(cfg.KeyDenyList); err != nil {
+				log.Fatal().Err(err).Msg("failed to load key_deny_list")
+			}
+		}
+		vopts = append(vopts, vey.WithKeyPolicy(*cfg.KeyPolicy))
+	}
+	if cfg.DomainPolicy != nil {
+		if cfg.DomainDenyList != "" {
+			denied, err := loadDomainList(cfg.DomainDenyList)
+			if err != nil {
+				log.Fatal().Err(err).Msg("failed to load domain_deny_list")
+			}
+			cfg.DomainPolicy.Deny = append(cfg.DomainPolicy.Deny, denied...)
+		}
+		vopts = append(vopts, vey.WithDomainPolicy(*cfg.DomainPolicy))
+	}
+	if cfg.Lockout != nil {
+		vopts = append(vopts, vey.WithLockout(*cfg.Lockout))
+	}
+	if cfg.ProofOfPossessionSkew > 0 {
+		vopts = append(vopts, vey.WithProofOfPossession(cfg.ProofOfPossessionSkew))
+	}
+	if cfg.Lookup != nil {
+		if cfg.LookupSecret != "" {
+			secret, err := base64.StdEncoding.DecodeString(cfg.LookupSecret)
+			if err != nil {
+				log.Fatal().Err(err).Msg("failed to decode lookup_secret")
+			}
+			cfg.Lookup.Secret = secret
+		}
+		vopts = append(vopts, vey.WithLookupPolicy(*cfg.Lookup))
+	}
+	k := vey.NewVey(vey.NewDigester(salt), cache, store, vopts...)
+	h := vhttp.NewHandler(k, sender, open, opts...)
+	if cfg.Stale != nil {
+		maintainer = k.(vey.Maintainer)
+		reconfirms = email.SenderWithContext(sender)
+		if worker != nil {
+			reconfirms = email.SenderWithContext(email.NewOutboxSender(worker.Outbox))
+		}
+	}
 
 	vhttp.Log = NewLogger()
+	email.Log = logger{}
+	vey.Log = logger{}
 
 	log.Info().Msg("starting")
 	adapter = httpadapter.NewV2(h)
@@ -106,6 +388,68 @@ type Config struct {
 	CacheTableName string        `yaml:"cache_table_name"`
 	CacheExpiry    time.Duration `yaml:"cache_expiry"`
 	OpenURL        string        `yaml:"open_url"`
+	// Origin is in the signed challenges, such as the public URL of the API. See vey.WithOrigin.
+	Origin string `yaml:"origin"`
+	// LegacyChallenge signs the raw 32 byte challenge instead of the signed payload, for old clients.
+	LegacyChallenge bool `yaml:"legacy_challenge"`
+	// CORS enables CORS headers for the listed origins, to call the APIs from web apps.
+	CORS *vhttp.CORSConfig `yaml:"cors"`
+	// Trace configures the span exporter. Use the "stdout" exporter to write spans to CloudWatch Logs.
+	Trace tracing.Config `yaml:"trace"`
+	// Outbox queues the emails in SQS instead of sending them within the request.
+	// Subscribe this function to the queue to send them.
+	// Set DeadLetterQueueURL, because the messages reported as succeeded are deleted by the event source.
+	Outbox *email.SQSConfig `yaml:"outbox"`
+	// OutboxMaxAttempts is the number of sends before dead lettering an email. Defaults to 5.
+	OutboxMaxAttempts int `yaml:"outbox_max_attempts"`
+	// SuppressionTableName enables the suppression list, which rejects beginDelete and beginPut for the suppressed addresses.
+	SuppressionTableName string `yaml:"suppression_table_name"`
+	// RevocationTableName enables the revocation list, which records the deleted and revoked keys.
+	RevocationTableName string `yaml:"revocation_table_name"`
+	// RevocationFeedKey is the base64 encoded Ed25519 seed to sign the feed at /revocations. Requires RevocationTableName.
+	RevocationFeedKey string `yaml:"revocation_feed_key"`
+	// RefuseRevoked refuses to add the keys revoked from the email address as compromised again. Requires RevocationTableName.
+	RefuseRevoked bool `yaml:"refuse_revoked"`
+	// SESFeedback accepts the SES bounce and complaint notifications from SNS at /sesFeedback,
+	// to suppress the addresses. Requires SuppressionTableName, and ses_feedback.topicArns.
+	SESFeedback *email.SNSConfig `yaml:"ses_feedback"`
+	// Link adds the signed links to the put emails, and serves the landing page at /open
+	// that hands off to OpenURL, the universal link, or the browser. Expiry defaults to CacheExpiry.
+	Link *vhttp.LinkConfig `yaml:"link"`
+	// MultiSender reads email.yml as email.MultiConfig, to route the emails across providers with failover.
+	MultiSender bool `yaml:"multi_sender"`
+	// NotifyEmail emails the address when a key is added to or deleted from it.
+	NotifyEmail bool `yaml:"notify_email"`
+	// NotifyWebhook posts the key changes to the URL, signed with the secret. See vey.VerifyWebhook.
+	NotifyWebhook *WebhookConfig `yaml:"notify_webhook"`
+	// Stale keeps the email addresses of the keys sealed with StaleKey, and reconfirms the keys that have not been
+	// verified for stale.after on the scheduled events. The keys not reconfirmed within stale.grace are dropped.
+	Stale *vey.StalePolicy `yaml:"stale"`
+	// StaleKey is the base64 encoded AES key of 16, 24 or 32 bytes to seal the email addresses with. Requires Stale.
+	StaleKey string `yaml:"stale_key"`
+	// KeyPolicy limits the number of keys per address, and the types and sizes of the keys.
+	KeyPolicy *vey.KeyPolicy `yaml:"key_policy"`
+	// KeyDenyList is the file bundled with the function, of the fingerprints of the denied keys. Requires KeyPolicy.
+	KeyDenyList string `yaml:"key_deny_list"`
+	// DomainPolicy accepts or refuses the email addresses by their domains.
+	DomainPolicy *vey.DomainPolicy `yaml:"domain_policy"`
+	// DomainDenyList is the file bundled with the function, of the denied domains such as the disposable ones. Requires DomainPolicy.
+	DomainDenyList string `yaml:"domain_deny_list"`
+	// Lockout locks out the clients and the email addresses after the failed commits, counted in the cache table.
+	Lockout *vey.LockoutPolicy `yaml:"lockout"`
+	// ProofOfPossessionSkew requires beginPut to carry a proof of possession of the key, made within the skew. 0 disables it.
+	// It does not rate limit beginPut, because anyone can prove the possession of a fresh key. See vey.WithProofOfPossession.
+	ProofOfPossessionSkew time.Duration `yaml:"proof_of_possession_skew"`
+	// Lookup stops getKeys from telling whether the email addresses have keys.
+	Lookup *vey.LookupPolicy `yaml:"lookup"`
+	// LookupSecret is the base64 encoded secret of the lookup tokens. getKeys requires the tokens if set. Requires Lookup.
+	LookupSecret string `yaml:"lookup_secret"`
+}
+
+// WebhookConfig configures vey.WebhookNotifier.
+type WebhookConfig struct {
+	URL    string `yaml:"url"`
+	Secret string `yaml:"secret"`
 }
 
 // loadConfig loads config from file encrypted with sops.
@@ -137,6 +481,35 @@ func loadEmailConfig(file string) (email.SESConfig, error) {
 	return emailConfig, nil
 }
 
+func loadMultiConfig(file string) (email.MultiConfig, error) {
+	var c email.MultiConfig
+	f, err := os.Open(file)
+	if err != nil {
+		return c, err
+	}
+	defer f.Close()
+	err = yaml.NewDecoder(f).Decode(&c)
+	return c, err
+}
+
+func loadKeyDenyList(file string) (vey.KeyDenyList, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return vey.ReadFingerprintDenyList(f)
+}
+
+func loadDomainList(file string) ([]string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return vey.ReadDomainList(f)
+}
+
 type logger struct{}
 
 // NewLogger returns a new default Logger that logs to stderr.
@@ -160,3 +533,33 @@ func (l logger) Error(err error) {
 
 	log.Error().Err(err).Msg("error")
 }
+
+// Attempt implements email.Logger.
+func (l logger) Attempt(a email.Attempt) {
+	ev := log.Info()
+	if a.Err != nil {
+		ev = log.Warn().Err(a.Err)
+	}
+	ev.Str("provider", a.Provider).
+		Str("action", a.Action).
+		Str("domain", a.Domain).
+		Int("attempt", a.Number).
+		Dur("duration", a.Duration).
+		Msg("email send attempt")
+}
+
+// Security implements vey.SecurityLogger.
+func (l logger) Security(e vey.SecurityEvent) {
+	ev := log.Warn().
+		Str("type", e.Type).
+		Str("operation", e.Operation).
+		Str("client", e.Client).
+		Int("failures", e.Failures)
+	if e.EmailDigest != nil {
+		ev = ev.Str("digest", base64.StdEncoding.EncodeToString(e.EmailDigest))
+	}
+	if !e.LockedUntil.IsZero() {
+		ev = ev.Time("lockedUntil", e.LockedUntil)
+	}
+	ev.Msg("security event")
+}
@@ -1,9 +1,16 @@
 package main
 
 import (
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
 	"errors"
-	"net/http"
+	"fmt"
+	"io"
+	"net/url"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
@@ -11,9 +18,11 @@ import (
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/dynamodb"
 	"github.com/aws/aws-sdk-go/service/ses"
+	"github.com/aws/aws-sdk-go/service/sqs"
 	"github.com/mash/vey"
 	"github.com/mash/vey/email"
 	vhttp "github.com/mash/vey/http"
+	"github.com/mash/vey/tracing"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 	"gopkg.in/alecthomas/kingpin.v2"
@@ -31,13 +40,88 @@ var (
 	debug   = app.Flag("debug", "Debug level logging turns on.").Bool()
 	version = app.Command("version", "Show version")
 
-	serve               = app.Command("serve", "Start server")
-	servePort           = serve.Flag("port", "Server listens on this port").Default("8000").Envar("VEY_PORT").String()
-	serveEmailConfig    = serve.Flag("emailConfig", "Email configuration file").Default("email.yml").Envar("VEY_EMAIL_CONFIG").String()
-	serveStore          = serve.Flag("store", "Store implementation. Can be \"dynamodb\" or \"memory\".").Default("memory").String()
-	serveStoreDynDBName = serve.Flag("store-dyndb-name", "DynamoDB table name used to implement Store interface").Default("veystore").String()
-	serveCache          = serve.Flag("cache", "Cache implementation").Default("memory").String()
-	serveCacheDynDBName = serve.Flag("cache-dyndb-name", "DynamoDB table name used to implement Cache interface").Default("veycache").String()
+	emailCmd           = app.Command("email", "Email templates")
+	emailPreview       = emailCmd.Command("preview", "Render an email template with sample values to stdout")
+	emailPreviewName   = emailPreview.Arg("template", "Template to render").Default(email.TemplatePut).Enum(email.TemplatePut, email.TemplateDelete, email.TemplateNotice)
+	emailPreviewDir    = emailPreview.Flag("templates", "Template directory. The embedded templates are used if empty.").String()
+	emailPreviewEmail  = emailPreview.Flag("email", "Recipient email address").Default("test@example.com").String()
+	emailPreviewFormat = emailPreview.Flag("format", "Output format").Default("text").Enum("text", "html", "raw")
+
+	migrate               = app.Command("migrate", "Add the key metadata to the DynamoDB store items written before it was introduced")
+	migrateStoreDynDBName = migrate.Flag("store-dyndb-name", "DynamoDB table name used to implement Store interface").Default("veystore").String()
+
+	maintenance                = app.Command("maintenance", "Send the reconfirm challenges for the stale keys, and drop the keys not reconfirmed")
+	maintenanceStoreDynDBName  = maintenance.Flag("store-dyndb-name", "DynamoDB table name used to implement Store interface").Default("veystore").String()
+	maintenanceCacheDynDBName  = maintenance.Flag("cache-dyndb-name", "DynamoDB table name used to implement Cache interface").Default("veycache").String()
+	maintenanceSuppDynDBName   = maintenance.Flag("suppression-dyndb-name", "DynamoDB table name used to implement SuppressionList interface. The suppressed addresses are not sent the challenges if set.").String()
+	maintenanceRevDynDBName    = maintenance.Flag("revocation-dyndb-name", "DynamoDB table name used to implement RevocationList interface. The dropped keys are revoked if set.").String()
+	maintenanceEmailConfig     = maintenance.Flag("emailConfig", "Email configuration file").Default("email.yml").Envar("VEY_EMAIL_CONFIG").String()
+	maintenanceSender          = maintenance.Flag("sender", "Sender implementation. Can be \"ses\", \"smtp\", \"file\" or \"multi\". emailConfig should match.").Default("ses").Envar("VEY_SENDER").String()
+	maintenanceOrigin          = maintenance.Flag("origin", "Origin in the signed challenges. Should match the server's.").Envar("VEY_ORIGIN").String()
+	maintenanceLegacyChallenge = maintenance.Flag("legacy-challenge", "Sign the raw 32 byte challenge instead of the signed payload, for old clients").Bool()
+	maintenanceStaleAfter      = maintenance.Flag("stale-after", "Keys become stale after this duration without verification").Default("2160h").Duration()
+	maintenanceStaleGrace      = maintenance.Flag("stale-grace", "Stale keys are dropped unless reconfirmed within this duration").Default("336h").Duration()
+	maintenanceStaleKey        = maintenance.Flag("stale-key", "Base64 encoded AES key of 16, 24 or 32 bytes that sealed the email addresses of the keys. Should match the server's.").Envar("VEY_STALE_KEY").Required().String()
+
+	serve                = app.Command("serve", "Start server")
+	servePort            = serve.Flag("port", "Server listens on this port").Default("8000").Envar("VEY_PORT").String()
+	serveSocket          = serve.Flag("socket", "Server listens on this unix socket path instead of the port").Envar("VEY_SOCKET").String()
+	serveReadTimeout     = serve.Flag("read-timeout", "Maximum duration for reading the entire request").Default("10s").Duration()
+	serveWriteTimeout    = serve.Flag("write-timeout", "Maximum duration before timing out writes of the response").Default("30s").Duration()
+	serveIdleTimeout     = serve.Flag("idle-timeout", "Maximum amount of time to wait for the next request on keep-alive connections").Default("120s").Duration()
+	serveShutdownTimeout = serve.Flag("shutdown-timeout", "Maximum duration to wait for in-flight requests on SIGINT or SIGTERM").Default("30s").Duration()
+	serveTLSCert         = serve.Flag("tls-cert", "PEM encoded certificate file to serve TLS. Reloaded on SIGHUP.").Envar("VEY_TLS_CERT").String()
+	serveTLSKey          = serve.Flag("tls-key", "PEM encoded private key file to serve TLS. Reloaded on SIGHUP.").Envar("VEY_TLS_KEY").String()
+	serveEmailConfig     = serve.Flag("emailConfig", "Email configuration file").Default("email.yml").Envar("VEY_EMAIL_CONFIG").String()
+	serveSender          = serve.Flag("sender", "Sender implementation. Can be \"ses\", \"smtp\", \"file\" or \"multi\". emailConfig should match.").Default("ses").Envar("VEY_SENDER").String()
+	serveOutbox          = serve.Flag("outbox", "Queue the emails and send them in background workers. Can be \"none\", \"memory\" or \"sqs\".").Default("none").Envar("VEY_OUTBOX").Enum("none", "memory", "sqs")
+	serveOutboxQueueURL  = serve.Flag("outbox-queue-url", "SQS queue URL of the outbox").Envar("VEY_OUTBOX_QUEUE_URL").String()
+	serveOutboxDLQURL    = serve.Flag("outbox-dead-letter-queue-url", "SQS queue URL for the emails that failed to be sent").Envar("VEY_OUTBOX_DEAD_LETTER_QUEUE_URL").String()
+	serveOutboxWorkers   = serve.Flag("outbox-workers", "Number of emails sent in parallel from the outbox").Default("4").Int()
+	serveOutboxAttempts  = serve.Flag("outbox-max-attempts", "Number of sends before dead lettering an email").Default("5").Int()
+	serveStore           = serve.Flag("store", "Store implementation. Can be \"dynamodb\" or \"memory\".").Default("memory").String()
+	serveStoreDynDBName  = serve.Flag("store-dyndb-name", "DynamoDB table name used to implement Store interface").Default("veystore").String()
+	serveCache           = serve.Flag("cache", "Cache implementation").Default("memory").String()
+	serveCacheDynDBName  = serve.Flag("cache-dyndb-name", "DynamoDB table name used to implement Cache interface").Default("veycache").String()
+	serveSuppression     = serve.Flag("suppression", "Suppression list implementation. Can be \"none\", \"memory\" or \"dynamodb\".").Default("none").Enum("none", "memory", "dynamodb")
+	serveSuppDynDBName   = serve.Flag("suppression-dyndb-name", "DynamoDB table name used to implement SuppressionList interface").Default("veysuppression").String()
+	serveRevocation      = serve.Flag("revocation", "Revocation list implementation. Can be \"none\", \"memory\" or \"dynamodb\".").Default("none").Enum("none", "memory", "dynamodb")
+	serveRevDynDBName    = serve.Flag("revocation-dyndb-name", "DynamoDB table name used to implement RevocationList interface").Default("veyrevocation").String()
+	serveRevFeedKey      = serve.Flag("revocation-feed-key", "Base64 encoded Ed25519 seed to sign the /revocations feed. Serves the feed if set.").Envar("VEY_REVOCATION_FEED_KEY").String()
+	serveRefuseRevoked   = serve.Flag("refuse-revoked", "Refuse to add the keys revoked from the email address as compromised again. Requires revocation.").Bool()
+	serveSESFeedback     = serve.Flag("ses-feedback", "Accept the SES bounce and complaint notifications from SNS at /sesFeedback. Requires suppression.").Bool()
+	serveSESFeedbackARNs = serve.Flag("ses-feedback-topic-arn", "SNS topic ARN to accept the SES notifications from. Repeatable. Required with ses-feedback.").Strings()
+	serveOrigin          = serve.Flag("origin", "Origin in the signed challenges, such as the public URL of this server. Defaults to link-base-url.").Envar("VEY_ORIGIN").String()
+	serveLegacyChallenge = serve.Flag("legacy-challenge", "Sign the raw 32 byte challenge instead of the signed payload, for old clients").Bool()
+	serveStaleAfter      = serve.Flag("stale-after", "Keep the email addresses of the keys sealed with stale-key, to reconfirm them after this duration without verification. See maintenance.").Duration()
+	serveStaleKey        = serve.Flag("stale-key", "Base64 encoded AES key of 16, 24 or 32 bytes to seal the email addresses of the keys with. Required with stale-after.").Envar("VEY_STALE_KEY").String()
+	serveMaxKeys         = serve.Flag("max-keys", "Maximum number of keys of an email address. 0 is unlimited.").Int()
+	serveMinKeyBits      = serve.Flag("min-key-bits", "Minimum size of the keys in bits").Int()
+	serveKeyDenyList     = serve.Flag("key-deny-list", "File of the fingerprints of the denied keys, one per line").String()
+	serveAllowDomains    = serve.Flag("allow-domain", "Accept only the email addresses of the domain, such as example.com or *.example.com. Repeatable.").Strings()
+	serveDenyDomains     = serve.Flag("deny-domain", "Refuse the email addresses of the domain, such as example.com or *.example.com. Repeatable.").Strings()
+	serveDenyDomainList  = serve.Flag("deny-domain-list", "File of the denied domains, one per line, such as a disposable email domain list").String()
+	serveIgnoreDomains   = serve.Flag("ignore-denied-domains", "Silently ignore the refused email addresses instead of responding the error").Bool()
+	serveLockout         = serve.Flag("lockout", "Lock out the clients and the email addresses after the failed commits").Bool()
+	serveLockThreshold   = serve.Flag("lockout-threshold", "Number of failed commits before the lockout").Default("5").Int()
+	serveLockBackoff     = serve.Flag("lockout-backoff", "First lockout, doubled by each following failure").Default("1s").Duration()
+	serveLockMaxBackoff  = serve.Flag("lockout-max-backoff", "Longest lockout").Default("1h").Duration()
+	serveProofSkew       = serve.Flag("proof-of-possession-skew", "Require beginPut to carry a proof of possession of the key, made within this duration of the server time").Duration()
+	serveLookupSecret    = serve.Flag("lookup-secret", "Require getKeys to carry the lookup token of the email address, made with this secret and responded by commitPut").Envar("VEY_LOOKUP_SECRET").String()
+	serveLookupMinDur    = serve.Flag("lookup-min-duration", "Delay the getKeys responses to take at least this long, not to tell whether the email address has keys").Duration()
+	serveClientHeader    = serve.Flag("client-header", "Header of the client address added by the proxy, such as X-Forwarded-For").Envar("VEY_CLIENT_HEADER").String()
+	serveNotifyEmail     = serve.Flag("notify-email", "Email the address when a key is added to or deleted from it").Bool()
+	serveNotifyWebhook   = serve.Flag("notify-webhook-url", "URL to post the key changes to").Envar("VEY_NOTIFY_WEBHOOK_URL").String()
+	serveNotifySecret    = serve.Flag("notify-webhook-secret", "Secret to sign the webhook requests with").Envar("VEY_NOTIFY_WEBHOOK_SECRET").String()
+	serveOpenURL         = serve.Flag("open-url", "Custom scheme URL of the app that /open hands off to, such as exampleapp://open").Envar("VEY_OPEN_URL").String()
+	serveLinkBaseURL     = serve.Flag("link-base-url", "Public URL of this server. Adds the signed links to the put emails if set.").Envar("VEY_LINK_BASE_URL").String()
+	serveLinkSecret      = serve.Flag("link-secret", "Base64 encoded key of at least 32 bytes to sign the links").Envar("VEY_LINK_SECRET").String()
+	serveLinkUniversal   = serve.Flag("link-universal-url", "Universal link URL of the app that /open hands off to").Envar("VEY_LINK_UNIVERSAL_URL").String()
+	serveLinkWebSigner   = serve.Flag("link-web-signer", "Sign the challenge in the browser in the /open landing page").Bool()
+	serveCORSOrigins     = serve.Flag("cors-origin", "Origin allowed to call the APIs from browsers. Repeatable. \"*\" allows any origin.").Strings()
+	serveCORSCreds       = serve.Flag("cors-credentials", "Allow credentials in CORS requests").Bool()
+	serveTraceExporter   = serve.Flag("trace-exporter", "Trace exporter. Can be \"none\", \"stdout\" or \"file\".").Default("none").Envar("VEY_TRACE_EXPORTER").String()
+	serveTraceFile       = serve.Flag("trace-file", "File to write spans to when trace-exporter is \"file\"").Default("traces.json").Envar("VEY_TRACE_FILE").String()
 )
 
 func main() {
@@ -50,14 +134,88 @@ func main() {
 	}
 
 	vhttp.Log = NewLogger()
+	email.Log = logger{}
+	vey.Log = logger{}
 
 	switch cmd {
 	case version.FullCommand():
 		log.Info().Str("buildDate", BuildDate).Str("version", Version).Msg("")
 
+	case emailPreview.FullCommand():
+		if err := preview(os.Stdout); err != nil {
+			log.Fatal().Err(err).Msg("failed to preview")
+		}
+
+	case migrate.FullCommand():
+		sess, err := session.NewSession(&aws.Config{})
+		if err != nil {
+			log.Fatal().Err(err).Msg("failed to create aws session")
+		}
+		store := vey.NewDynamoDbStore(*migrateStoreDynDBName, dynamodb.New(sess)).(*vey.DynamoDbStore)
+		migrated, err := store.MigrateMetadata(context.Background(), time.Now())
+		if err != nil {
+			log.Fatal().Err(err).Int("migrated", migrated).Msg("failed to migrate")
+		}
+		log.Info().Int("migrated", migrated).Msg("migrated")
+
+	case maintenance.FullCommand():
+		salt := []byte("salt")
+		sess, err := session.NewSession(&aws.Config{})
+		if err != nil {
+			log.Fatal().Err(err).Msg("failed to create aws session")
+		}
+		svc := dynamodb.New(sess)
+		store := vey.NewDynamoDbStore(*maintenanceStoreDynDBName, svc)
+		cache := vey.NewDynamoDbCache(*maintenanceCacheDynDBName, svc, 15*time.Minute)
+		vopts := []vey.Option{
+			vey.WithOrigin(*maintenanceOrigin),
+			vey.WithChallengeExpiry(15 * time.Minute),
+			vey.WithStalePolicy(vey.StalePolicy{After: *maintenanceStaleAfter, Grace: *maintenanceStaleGrace, Key: decodeStaleKey(*maintenanceStaleKey)}),
+		}
+		if *maintenanceLegacyChallenge {
+			vopts = append(vopts, vey.WithLegacyChallenge())
+		}
+		if *maintenanceSuppDynDBName != "" {
+			vopts = append(vopts, vey.WithSuppressionList(vey.NewDynamoDbSuppressionList(*maintenanceSuppDynDBName, svc)))
+		}
+		if *maintenanceRevDynDBName != "" {
+			vopts = append(vopts, vey.WithRevocationList(vey.NewDynamoDbRevocationList(*maintenanceRevDynDBName, svc)))
+		}
+		sender := newSender(*maintenanceSender, *maintenanceEmailConfig, sess)
+		if cl, ok := sender.(io.Closer); ok {
+			defer cl.Close()
+		}
+		k := vey.NewVey(vey.NewDigester(salt), cache, store, vopts...)
+
+		ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+		defer stop()
+		report, err := k.(vey.Maintainer).Maintain(ctx, email.SenderWithContext(sender))
+		ev := log.Info()
+		if err != nil {
+			ev = log.Error().Err(err)
+		}
+		ev.Int("keys", report.Keys).
+			Int("reconfirming", report.Reconfirming).
+			Int("dropped", report.Dropped).
+			Int("unreachable", report.Unreachable).
+			Int("failed", report.Failed).
+			Msg("maintenance")
+
 	case serve.FullCommand():
 		salt := []byte("salt")
 
+		tp, err := tracing.Setup(tracing.Config{
+			Exporter: *serveTraceExporter,
+			File:     *serveTraceFile,
+		})
+		if err != nil {
+			log.Fatal().Err(err).Msg("failed to setup tracing")
+		}
+		if tp != nil {
+			log.Debug().Msgf("tracing with exporter: %s", *serveTraceExporter)
+			defer tp.Shutdown(context.Background())
+		}
+
 		sess, err := session.NewSession(&aws.Config{})
 		if err != nil {
 			log.Fatal().Err(err).Msg("failed to create aws session")
@@ -83,24 +241,389 @@ func main() {
 			cache = vey.NewMemCache(15 * time.Minute)
 		}
 
-		k := vey.NewVey(vey.NewDigester(salt), cache, store)
+		var suppressions vey.SuppressionList
+		switch *serveSuppression {
+		case "memory":
+			log.Debug().Msg("using memory suppression list")
+			suppressions = vey.NewMemSuppressionList()
+		case "dynamodb":
+			log.Debug().Msgf("using dynamodb suppression list: %s", *serveSuppDynDBName)
+			suppressions = vey.NewDynamoDbSuppressionList(*serveSuppDynDBName, dynamodb.New(sess))
+		}
+		origin := *serveOrigin
+		if origin == "" {
+			origin = *serveLinkBaseURL
+		}
+		vopts := []vey.Option{vey.WithOrigin(origin), vey.WithChallengeExpiry(15 * time.Minute)}
+		if *serveLegacyChallenge {
+			vopts = append(vopts, vey.WithLegacyChallenge())
+		}
+		if suppressions != nil {
+			vopts = append(vopts, vey.WithSuppressionList(suppressions))
+		}
+		var revocations vey.RevocationList
+		switch *serveRevocation {
+		case "memory":
+			log.Debug().Msg("using memory revocation list")
+			revocations = vey.NewMemRevocationList()
+		case "dynamodb":
+			log.Debug().Msgf("using dynamodb revocation list: %s", *serveRevDynDBName)
+			revocations = vey.NewDynamoDbRevocationList(*serveRevDynDBName, dynamodb.New(sess))
+		}
+		if revocations != nil {
+			vopts = append(vopts, vey.WithRevocationList(revocations))
+		}
+		if *serveRefuseRevoked {
+			if revocations == nil {
+				log.Fatal().Msg("refuse-revoked requires revocation")
+			}
+			vopts = append(vopts, vey.WithRefuseRevoked())
+		}
+
+		sender := newSender(*serveSender, *serveEmailConfig, sess)
+		s := email.NewLogSender(sender)
+		opts := []vhttp.Option{vhttp.WithVersion(Version, BuildDate)}
 
-		f, err := os.Open(*serveEmailConfig)
+		var worker *email.Worker
+		switch *serveOutbox {
+		case "memory":
+			log.Debug().Msg("using memory outbox")
+			worker = email.NewWorker(email.NewMemOutbox(), s)
+		case "sqs":
+			log.Debug().Msgf("using sqs outbox: %s", *serveOutboxQueueURL)
+			worker = email.NewWorker(email.NewSQSOutbox(email.SQSConfig{
+				QueueURL:           *serveOutboxQueueURL,
+				DeadLetterQueueURL: *serveOutboxDLQURL,
+			}, sqs.New(sess)), s)
+		}
+		if worker != nil {
+			worker.Concurrency = *serveOutboxWorkers
+			worker.MaxAttempts = *serveOutboxAttempts
+			// the challenge and token expire from the cache in 15 minutes
+			worker.MaxAge = 15 * time.Minute
+			opts = append(opts, vhttp.WithOutbox(worker.Outbox))
+		}
+		if p, ok := store.(vey.Pinger); ok {
+			opts = append(opts, vhttp.WithPinger("store", p))
+		}
+		if p, ok := cache.(vey.Pinger); ok {
+			opts = append(opts, vhttp.WithPinger("cache", p))
+		}
+		if p, ok := sender.(vey.Pinger); ok {
+			opts = append(opts, vhttp.WithPinger("email", p))
+		}
+		if p, ok := suppressions.(vey.Pinger); ok {
+			opts = append(opts, vhttp.WithPinger("suppression", p))
+		}
+		if p, ok := revocations.(vey.Pinger); ok {
+			opts = append(opts, vhttp.WithPinger("revocation", p))
+		}
+		if *serveRevFeedKey != "" {
+			if revocations == nil {
+				log.Fatal().Msg("revocation-feed-key requires revocation")
+			}
+			key, err := vhttp.DecodeFeedKey(*serveRevFeedKey)
+			if err != nil {
+				log.Fatal().Err(err).Msg("failed to decode revocation-feed-key")
+			}
+			log.Info().Str("publicKey", base64.StdEncoding.EncodeToString(key.Public().(ed25519.PublicKey))).Msg("serving the revocation feed at /revocations")
+			opts = append(opts, vhttp.WithRevocationFeed(revocations, key))
+		}
+		if *serveSESFeedback {
+			if suppressions == nil {
+				log.Fatal().Msg("ses-feedback requires suppression")
+			}
+			v, err := email.NewSNSVerifier(email.SNSConfig{TopicARNs: *serveSESFeedbackARNs})
+			if err != nil {
+				log.Fatal().Err(err).Msg("failed to setup ses-feedback")
+			}
+			opts = append(opts, vhttp.WithSESFeedback(v))
+		}
+		if m, ok := sender.(email.Mailbox); ok && *debug {
+			log.Debug().Msg("serving the captured emails at /dev/inbox")
+			opts = append(opts, vhttp.WithInbox(m))
+		}
+		if *serveLinkBaseURL != "" {
+			links, err := vhttp.NewLinkSigner(vhttp.LinkConfig{
+				BaseURL:          *serveLinkBaseURL,
+				Secret:           *serveLinkSecret,
+				Expiry:           15 * time.Minute,
+				UniversalLinkURL: *serveLinkUniversal,
+				WebSigner:        *serveLinkWebSigner,
+			})
+			if err != nil {
+				log.Fatal().Err(err).Msg("failed to setup links")
+			}
+			opts = append(opts, vhttp.WithLinks(links))
+		}
+		if len(*serveCORSOrigins) > 0 {
+			opts = append(opts, vhttp.WithCORS(vhttp.CORSConfig{
+				AllowedOrigins:   *serveCORSOrigins,
+				AllowCredentials: *serveCORSCreds,
+			}))
+		}
+		var open *url.URL
+		if *serveOpenURL != "" {
+			if open, err = url.Parse(*serveOpenURL); err != nil {
+				log.Fatal().Err(err).Msg("failed to parse open-url")
+			}
+		}
+		var notifiers vey.Notifiers
+		if *serveNotifyEmail {
+			var notices email.Sender = s
+			if worker != nil {
+				notices = email.NewOutboxSender(worker.Outbox)
+			}
+			notifiers = append(notifiers, email.NewNotifier(notices))
+		}
+		if *serveNotifyWebhook != "" {
+			if *serveNotifySecret == "" {
+				log.Fatal().Msg("notify-webhook-url requires notify-webhook-secret")
+			}
+			notifiers = append(notifiers, vey.NewWebhookNotifier(*serveNotifyWebhook, []byte(*serveNotifySecret)))
+		}
+		if len(notifiers) > 0 {
+			vopts = append(vopts, vey.WithNotifier(notifiers))
+		}
+		if *serveMaxKeys > 0 || *serveMinKeyBits > 0 || *serveKeyDenyList != "" {
+			policy := vey.KeyPolicy{MaxKeys: *serveMaxKeys, MinBits: *serveMinKeyBits}
+			if *serveKeyDenyList != "" {
+				if policy.DenyList, err = readKeyDenyList(*serveKeyDenyList); err != nil {
+					log.Fatal().Err(err).Msg("failed to read key-deny-list")
+				}
+			}
+			vopts = append(vopts, vey.WithKeyPolicy(policy))
+		}
+		if len(*serveAllowDomains) > 0 || len(*serveDenyDomains) > 0 || *serveDenyDomainList != "" {
+			policy := vey.DomainPolicy{Allow: *serveAllowDomains, Deny: *serveDenyDomains, Ignore: *serveIgnoreDomains}
+			if *serveDenyDomainList != "" {
+				denied, err := readDomainList(*serveDenyDomainList)
+				if err != nil {
+					log.Fatal().Err(err).Msg("failed to read deny-domain-list")
+				}
+				policy.Deny = append(policy.Deny, denied...)
+			}
+			vopts = append(vopts, vey.WithDomainPolicy(policy))
+		}
+		if *serveLockout {
+			vopts = append(vopts, vey.WithLockout(vey.LockoutPolicy{
+				Threshold:  *serveLockThreshold,
+				Backoff:    *serveLockBackoff,
+				MaxBackoff: *serveLockMaxBackoff,
+			}))
+		}
+		if *serveProofSkew > 0 {
+			vopts = append(vopts, vey.WithProofOfPossession(*serveProofSkew))
+		}
+		if *serveLookupSecret != "" || *serveLookupMinDur > 0 {
+			vopts = append(vopts, vey.WithLookupPolicy(vey.LookupPolicy{Secret: []byte(*serveLookupSecret), MinDuration: *serveLookupMinDur}))
+		}
+		if *serveClientHeader != "" {
+			opts = append(opts, vhttp.WithClientHeader(*serveClientHeader))
+		}
+		if *serveStaleAfter > 0 {
+			if *serveStaleKey == "" {
+				log.Fatal().Msg("stale-after requires stale-key")
+			}
+			vopts = append(vopts, vey.WithStalePolicy(vey.StalePolicy{After: *serveStaleAfter, Key: decodeStaleKey(*serveStaleKey)}))
+		}
+
+		k := vey.NewVey(vey.NewDigester(salt), cache, store, vopts...)
+		h := vhttp.NewHandler(k, s, open, opts...)
+
+		c := vhttp.ServerConfig{
+			Network:           "tcp",
+			Addr:              ":" + *servePort,
+			ReadTimeout:       *serveReadTimeout,
+			ReadHeaderTimeout: *serveReadTimeout,
+			WriteTimeout:      *serveWriteTimeout,
+			IdleTimeout:       *serveIdleTimeout,
+			ShutdownTimeout:   *serveShutdownTimeout,
+			CertFile:          *serveTLSCert,
+			KeyFile:           *serveTLSKey,
+		}
+		if *serveSocket != "" {
+			c.Network = "unix"
+			c.Addr = *serveSocket
+		}
+		var closers []io.Closer
+		for _, v := range []interface{}{store, cache} {
+			if cl, ok := v.(io.Closer); ok {
+				closers = append(closers, cl)
+			}
+		}
+		if cl, ok := sender.(io.Closer); ok && worker == nil {
+			closers = append(closers, cl)
+		}
+		server, err := vhttp.NewServer(c, h, closers...)
+		if err != nil {
+			log.Fatal().Err(err).Msg("failed to create server")
+		}
+
+		ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+		defer stop()
+		go reloadOnHangup(ctx, server)
+
+		workerDone := make(chan struct{})
+		if worker != nil {
+			go func() {
+				defer close(workerDone)
+				_ = worker.Run(ctx)
+			}()
+		} else {
+			close(workerDone)
+		}
+
+		log.Info().Str("network", c.Network).Str("addr", c.Addr).Bool("tls", c.CertFile != "").Msg("listening")
+		if err := server.Run(ctx); err != nil {
+			log.Fatal().Err(err).Msg("server failed")
+		}
+		<-workerDone
+		if cl, ok := sender.(io.Closer); ok && worker != nil {
+			cl.Close()
+		}
+		log.Info().Msg("shut down")
+	}
+}
+
+// newSender returns the Sender of the kind configured by the file.
+func newSender(kind, file string, sess *session.Session) email.Sender {
+	switch kind {
+	case "smtp":
+		var emailConfig email.SMTPConfig
+		decodeEmailConfig(file, &emailConfig)
+		log.Debug().Str("email config file", file).Msgf("smtp host: %s:%d", emailConfig.Host, emailConfig.Port)
+		return email.NewSMTPSender(emailConfig)
+	case "file":
+		var emailConfig email.FileConfig
+		decodeEmailConfig(file, &emailConfig)
+		log.Debug().Str("email config file", file).Msgf("writing emails to %s: %s", emailConfig.Format, emailConfig.Path)
+		return email.NewFileSender(emailConfig)
+	case "multi":
+		var emailConfig email.MultiConfig
+		decodeEmailConfig(file, &emailConfig)
+		log.Debug().Str("email config file", file).Msgf("email providers: %d", len(emailConfig.Providers))
+		sender, err := email.NewMultiSenderFromConfig(emailConfig, sess)
 		if err != nil {
-			log.Fatal().Err(err).Msg("failed to open email config file: " + *serveEmailConfig)
+			log.Fatal().Err(err).Msg("failed to setup email providers")
 		}
-		dec := yaml.NewDecoder(f)
+		return sender
+	default:
 		var emailConfig email.SESConfig
-		if err := dec.Decode(&emailConfig); err != nil {
-			log.Fatal().Err(err).Msg("failed to decode email config file: " + *serveEmailConfig)
+		decodeEmailConfig(file, &emailConfig)
+		log.Debug().Str("email config file", file).Msgf("config: %+v", emailConfig)
+		return email.NewSESSender(emailConfig, ses.New(sess))
+	}
+}
+
+func readKeyDenyList(file string) (vey.KeyDenyList, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return vey.ReadFingerprintDenyList(f)
+}
+
+func readDomainList(file string) ([]string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return vey.ReadDomainList(f)
+}
+
+// preview renders the email template with a random token, challenge or key fingerprint.
+func preview(w io.Writer) error {
+	ts := email.DefaultTemplates()
+	if *emailPreviewDir != "" {
+		var err error
+		if ts, err = email.LoadTemplatesDir(*emailPreviewDir); err != nil {
+			return err
+		}
+	}
+	b, err := vey.NewToken()
+	if err != nil {
+		return err
+	}
+	sample := base64.StdEncoding.EncodeToString(b)
+	data := email.TemplateData{Email: *emailPreviewEmail}
+	switch *emailPreviewName {
+	case email.TemplateDelete:
+		data.Token, data.TokenEscaped = sample, url.QueryEscape(sample)
+	case email.TemplateNotice:
+		// the notice of an added key, with a sample fingerprint
+		data.Added, data.KeyFingerprint = true, "SHA256:"+base64.RawStdEncoding.EncodeToString(b)
+	default:
+		data.Challenge, data.ChallengeEscaped = sample, url.QueryEscape(sample)
+	}
+	m, err := ts.Render(*emailPreviewName, data)
+	if err != nil {
+		return err
+	}
+
+	switch *emailPreviewFormat {
+	case "html":
+		_, err = io.WriteString(w, m.HTML)
+	case "raw":
+		m.From = "Vey <vey@example.com>"
+		m.To = data.Email
+		var raw []byte
+		if raw, err = m.Bytes(); err == nil {
+			_, err = w.Write(raw)
 		}
-		log.Debug().Str("email config file", *serveEmailConfig).Msgf("config: %+v", emailConfig)
+	default:
+		_, err = fmt.Fprintf(w, "Subject: %s\n\n%s", m.Subject, m.Text)
+	}
+	return err
+}
+
+// decodeStaleKey decodes the base64 encoded key of StalePolicy, or exits.
+func decodeStaleKey(s string) []byte {
+	key, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		log.Fatal().Err(err).Msg("failed to decode stale-key")
+	}
+	switch len(key) {
+	case 16, 24, 32:
+	default:
+		log.Fatal().Int("length", len(key)).Msg("stale-key should be 16, 24 or 32 bytes")
+	}
+	return key
+}
 
-		svc := ses.New(sess)
-		s := email.NewLogSender(email.NewSESSender(emailConfig, svc))
-		h := vhttp.NewHandler(k, s, nil)
-		log.Info().Msg("listening on port " + *servePort)
-		http.ListenAndServe(":"+*servePort, h)
+// decodeEmailConfig decodes the yaml file into c, or exits.
+func decodeEmailConfig(file string, c interface{}) {
+	f, err := os.Open(file)
+	if err != nil {
+		log.Fatal().Err(err).Msg("failed to open email config file: " + file)
+	}
+	defer f.Close()
+	if err := yaml.NewDecoder(f).Decode(c); err != nil {
+		log.Fatal().Err(err).Msg("failed to decode email config file: " + file)
+	}
+}
+
+// reloadOnHangup reloads the TLS certificate on SIGHUP until ctx is done.
+func reloadOnHangup(ctx context.Context, server *vhttp.Server) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			if server.Config.CertFile == "" {
+				continue
+			}
+			if err := server.ReloadCert(); err != nil {
+				log.Error().Err(err).Msg("failed to reload certificate")
+				continue
+			}
+			log.Info().Msg("reloaded certificate")
+		}
 	}
 }
 
@@ -127,3 +650,33 @@ func (l logger) Error(err error) {
 
 	log.Error().Err(err).Msg("error")
 }
+
+// Attempt implements email.Logger.
+func (l logger) Attempt(a email.Attempt) {
+	ev := log.Info()
+	if a.Err != nil {
+		ev = log.Warn().Err(a.Err)
+	}
+	ev.Str("provider", a.Provider).
+		Str("action", a.Action).
+		Str("domain", a.Domain).
+		Int("attempt", a.Number).
+		Dur("duration", a.Duration).
+		Msg("email send attempt")
+}
+
+// Security implements vey.SecurityLogger.
+func (l logger) Security(e vey.SecurityEvent) {
+	ev := log.Warn().
+		Str("type", e.Type).
+		Str("operation", e.Operation).
+		Str("client", e.Client).
+		Int("failures", e.Failures)
+	if e.EmailDigest != nil {
+		ev = ev.Str("digest", base64.StdEncoding.EncodeToString(e.EmailDigest))
+	}
+	if !e.LockedUntil.IsZero() {
+		ev = ev.Time("lockedUntil", e.LockedUntil)
+	}
+	ev.Msg("security event")
+}
@@ -0,0 +1,152 @@
+package vey
+
+import (
+	"context"
+	"time"
+)
+
+// VeyWithContext returns v as a ContextVey.
+// If v does not implement ContextVey, the returned ContextVey checks the context before calling v
+// but can't cancel v's calls in progress.
+func VeyWithContext(v Vey) ContextVey {
+	if c, ok := v.(ContextVey); ok {
+		return c
+	}
+	return contextVey{v}
+}
+
+type contextVey struct {
+	Vey
+}
+
+func (v contextVey) GetKeysContext(ctx context.Context, email string) ([]PublicKey, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return v.Vey.GetKeys(email)
+}
+
+func (v contextVey) BeginDeleteContext(ctx context.Context, email string, publicKey PublicKey) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return v.Vey.BeginDelete(email, publicKey)
+}
+
+func (v contextVey) CommitDeleteContext(ctx context.Context, token []byte) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return v.Vey.CommitDelete(token)
+}
+
+func (v contextVey) BeginPutContext(ctx context.Context, email string, publicKey PublicKey) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return v.Vey.BeginPut(email, publicKey)
+}
+
+func (v contextVey) CommitPutContext(ctx context.Context, challenge, signature []byte) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return v.Vey.CommitPut(challenge, signature)
+}
+
+func (v contextVey) BeginDeleteWithSignatureContext(ctx context.Context, email string, publicKey PublicKey) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return v.Vey.BeginDeleteWithSignature(email, publicKey)
+}
+
+func (v contextVey) CommitDeleteWithSignatureContext(ctx context.Context, challenge, signature []byte) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return v.Vey.CommitDeleteWithSignature(challenge, signature)
+}
+
+// CacheWithContext returns c as a ContextCache.
+// If c does not implement ContextCache, the returned ContextCache checks the context before calling c.
+func CacheWithContext(c Cache) ContextCache {
+	if cc, ok := c.(ContextCache); ok {
+		return cc
+	}
+	return contextCache{c}
+}
+
+type contextCache struct {
+	Cache
+}
+
+func (c contextCache) SetContext(ctx context.Context, key []byte, val Cached) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return c.Cache.Set(key, val)
+}
+
+func (c contextCache) GetContext(ctx context.Context, key []byte) (Cached, error) {
+	if err := ctx.Err(); err != nil {
+		return Cached{}, err
+	}
+	return c.Cache.Get(key)
+}
+
+func (c contextCache) DelContext(ctx context.Context, key []byte) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return c.Cache.Del(key)
+}
+
+// StoreWithContext returns s as a ContextStore.
+// If s does not implement ContextStore, the returned ContextStore checks the context before calling s.
+func StoreWithContext(s Store) ContextStore {
+	if cs, ok := s.(ContextStore); ok {
+		return cs
+	}
+	return contextStore{s}
+}
+
+type contextStore struct {
+	Store
+}
+
+func (s contextStore) GetContext(ctx context.Context, d EmailDigest) ([]PublicKey, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return s.Store.Get(d)
+}
+
+func (s contextStore) DeleteContext(ctx context.Context, d EmailDigest, publicKey PublicKey) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.Store.Delete(d, publicKey)
+}
+
+func (s contextStore) PutContext(ctx context.Context, d EmailDigest, publicKey PublicKey) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.Store.Put(d, publicKey)
+}
+
+// detach returns a context that carries ctx's values, including the trace span, but is never canceled.
+// Use it for cleanups that must run even after the request is canceled.
+func detach(ctx context.Context) context.Context {
+	return detachedContext{ctx}
+}
+
+type detachedContext struct {
+	parent context.Context
+}
+
+func (c detachedContext) Deadline() (time.Time, bool)       { return time.Time{}, false }
+func (c detachedContext) Done() <-chan struct{}             { return nil }
+func (c detachedContext) Err() error                        { return nil }
+func (c detachedContext) Value(key interface{}) interface{} { return c.parent.Value(key) }
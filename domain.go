@@ -0,0 +1,102 @@
+package vey
+
+import (
+	"io"
+	"net/mail"
+	"strings"
+)
+
+// DomainPolicy restricts the email addresses by their domains.
+//
+// The rules are either exact domains, such as "example.com", or wildcards, such as "*.example.com",
+// which match the subdomains but not example.com itself. The domains are compared case insensitively.
+type DomainPolicy struct {
+	// Allow are the rules of the accepted domains. Any domain is accepted if empty.
+	Allow []string `yaml:"allow"`
+	// Deny are the rules of the refused domains, such as the disposable email domains. Deny takes precedence over Allow.
+	// See ReadDomainList to load them from a file.
+	Deny []string `yaml:"deny"`
+	// Ignore makes GetKeys return no keys, and BeginPut and BeginDelete return ErrIgnored for the refused domains,
+	// instead of ErrDomainNotAllowed, so that the callers can not tell them from the accepted ones.
+	Ignore bool `yaml:"ignore"`
+}
+
+// domainRules is the compiled rules of DomainPolicy.
+type domainRules struct {
+	exact    map[string]struct{}
+	wildcard map[string]struct{}
+}
+
+func compileDomainRules(rules []string) domainRules {
+	r := domainRules{
+		exact:    make(map[string]struct{}),
+		wildcard: make(map[string]struct{}),
+	}
+	for _, rule := range rules {
+		rule = strings.ToLower(strings.TrimSpace(rule))
+		if strings.HasPrefix(rule, "*.") {
+			r.wildcard[rule[2:]] = struct{}{}
+		} else if rule != "" {
+			r.exact[rule] = struct{}{}
+		}
+	}
+	return r
+}
+
+func (r domainRules) empty() bool {
+	return len(r.exact) == 0 && len(r.wildcard) == 0
+}
+
+func (r domainRules) match(domain string) bool {
+	if _, ok := r.exact[domain]; ok {
+		return true
+	}
+	for i := strings.IndexByte(domain, '.'); i >= 0; i = strings.IndexByte(domain, '.') {
+		domain = domain[i+1:]
+		if _, ok := r.wildcard[domain]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+type domainPolicy struct {
+	allow, deny domainRules
+	ignore      bool
+}
+
+// WithDomainPolicy makes GetKeys, BeginPut and BeginDelete refuse the email addresses of the domains that p does not accept.
+func WithDomainPolicy(p DomainPolicy) Option {
+	return func(k *vey) {
+		k.domains = &domainPolicy{
+			allow:  compileDomainRules(p.Allow),
+			deny:   compileDomainRules(p.Deny),
+			ignore: p.Ignore,
+		}
+	}
+}
+
+// ReadDomainList reads a rule of DomainPolicy per line. The empty lines and the lines starting with "#" are ignored.
+func ReadDomainList(r io.Reader) ([]string, error) {
+	return readList(r)
+}
+
+// checkDomain returns ErrDomainNotAllowed, or ErrIgnored with DomainPolicy.Ignore, if the domain of the valid email is refused.
+func (k vey) checkDomain(email string) error {
+	p := k.domains
+	if p == nil {
+		return nil
+	}
+	addr, err := mail.ParseAddress(email)
+	if err != nil {
+		return ErrInvalidEmail
+	}
+	domain := strings.ToLower(addr.Address[strings.LastIndexByte(addr.Address, '@')+1:])
+	if p.deny.match(domain) || (!p.allow.empty() && !p.allow.match(domain)) {
+		if p.ignore {
+			return ErrIgnored
+		}
+		return ErrDomainNotAllowed
+	}
+	return nil
+}
@@ -1,11 +1,14 @@
 package email
 
 import (
+	"context"
 	"encoding/json"
 	"net/url"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/ses"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // See https://pkg.go.dev/github.com/aws/aws-sdk-go/service/ses#SendTemplatedEmailInput for details.
@@ -32,6 +35,8 @@ type SESConfig struct {
 	// The ReturnPath parameter is never overwritten. This email address must be
 	// either individually verified with Amazon SES, or from a domain that has been
 	// verified with Amazon SES.
+	// With LocalTemplates, it is also the Source of the raw messages, which SES forwards the bounces to,
+	// and written as the Return-Path header.
 	ReturnPath string `yaml:"returnPath"`
 	// This parameter is used only for sending authorization. It is the ARN of the
 	// identity that is associated with the sending authorization policy that permits
@@ -39,58 +44,112 @@ type SESConfig struct {
 	ReturnPathArn string `yaml:"returnPathArn"`
 	// AWS SES email template to use when sending the delete confirmation email.
 	// The {{email}}, {{token}} and {{tokenEscaped}} variables in the template are replaced with values set by Vey.
+	// Defaults to "vey_delete". Not used if LocalTemplates is true.
 	DeleteTemplate string `yaml:"deleteTemplate"`
 	// AWS SES email template to use when sending the put confirmation email.
 	// The {{email}}, {{challenge}} and {{challengeEscaped}} variables in the template are replaced with values set by Vey.
+	// Defaults to "vey_put". Not used if LocalTemplates is true.
 	PutTemplate string `yaml:"putTemplate"`
+	// AWS SES email template to use when sending the email that notifies a key was added or deleted.
+	// The {{email}}, {{added}} and {{keyFingerprint}} variables in the template are replaced with values set by Vey.
+	// Defaults to "vey_notice". Not used if LocalTemplates is true.
+	NoticeTemplate string `yaml:"noticeTemplate"`
+	// LocalTemplates renders the emails with the local templates instead of the SES templates,
+	// and sends them with SendRawEmail.
+	LocalTemplates bool `yaml:"localTemplates"`
+	// TemplateDir is the directory of the local templates. See LoadTemplates for the files.
+	// The templates embedded in the package are used if empty.
+	TemplateDir string `yaml:"templateDir"`
+	// Locales lists the locales that have localized SES templates, such as "ja" or "pt-BR".
+	// The localized template is named with the locale appended, such as "vey_put_ja",
+	// and is used when the locale matches the recipient's languages. See Negotiate.
+	// Not used if LocalTemplates is true; the local templates have their own localized sets.
+	Locales []string `yaml:"locales"`
 }
 
 // NewSESSender returns a SESSender which sends email via Amazon SES.
-// If the templates have an error, NewSESSender may panic.
+// If the local templates have an error, NewSESSender panics.
 func NewSESSender(c SESConfig, ses *ses.SES) Sender {
-	return SESSender{
+	s := SESSender{
 		Config: c,
 		SES:    ses,
 	}
+	if c.LocalTemplates {
+		s.Templates = mustTemplates(c.TemplateDir)
+	}
+	return s
 }
 
 // SESSender implements Sender interface using AWS SES.
 type SESSender struct {
 	Config SESConfig
 	SES    *ses.SES
-}
-
-type sesData struct {
-	Email            string `json:"email"`
-	Token            string `json:"token,omitempty"`
-	TokenEscaped     string `json:"tokenEscaped,omitempty"`
-	Challenge        string `json:"challenge,omitempty"`
-	ChallengeEscaped string `json:"challengeEscaped,omitempty"`
+	// Templates renders the emails if Config.LocalTemplates is true. DefaultTemplates is used if nil.
+	Templates *Templates
 }
 
 // SendToken sends the token to the dst email address.
 func (s SESSender) SendToken(dst, token string) error {
+	return s.SendTokenContext(context.Background(), dst, token)
+}
+
+func (s SESSender) SendTokenContext(ctx context.Context, dst, token string) error {
 	// use tokenEscaped in template if token is added in query parameter in the template.
-	data := sesData{
+	data := TemplateData{
 		Email:        dst,
 		Token:        token,
 		TokenEscaped: url.QueryEscape(token),
 	}
-	return s.send(dst, "delete", "vey_delete", data)
+	return s.send(ctx, dst, TemplateDelete, data)
 }
 
 // SendChallenge sends the challenge to the dst email address.
 func (s SESSender) SendChallenge(dst, challenge string) error {
+	return s.SendChallengeContext(context.Background(), dst, challenge)
+}
+
+func (s SESSender) SendChallengeContext(ctx context.Context, dst, challenge string) error {
 	// use challengeEscaped in template if token is added in query parameter.
-	data := sesData{
+	data := TemplateData{
 		Email:            dst,
 		Challenge:        challenge,
 		ChallengeEscaped: url.QueryEscape(challenge),
+		Link:             Link(ctx),
 	}
-	return s.send(dst, "put", "vey_put", data)
+	return s.send(ctx, dst, TemplatePut, data)
+}
+
+// SendNoticeContext sends the notice to the dst email address.
+func (s SESSender) SendNoticeContext(ctx context.Context, dst string, n Notice) error {
+	return s.send(ctx, dst, TemplateNotice, n.data(dst))
 }
 
-func (s SESSender) send(email, action, template string, data sesData) error {
+func (s SESSender) send(ctx context.Context, email, action string, data TemplateData) (err error) {
+	method := "SendTemplatedEmail"
+	if s.Config.LocalTemplates {
+		method = "SendRawEmail"
+	}
+	ctx, span := tracer.Start(ctx, "SESSender.send",
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("rpc.system", "aws-api"),
+			attribute.String("rpc.service", "SES"),
+			attribute.String("rpc.method", method),
+			attribute.String("vey.email.action", action),
+		),
+	)
+	defer func() { endSpan(span, err) }()
+
+	tags := []*ses.MessageTag{
+		{
+			Name:  aws.String("action"),
+			Value: aws.String(action),
+		},
+	}
+	if s.Config.LocalTemplates {
+		return s.sendRaw(ctx, email, action, data, tags)
+	}
+
 	j, err := json.Marshal(data)
 	if err != nil {
 		return err
@@ -102,14 +161,9 @@ func (s SESSender) send(email, action, template string, data sesData) error {
 			},
 		},
 		Source:       aws.String(s.Config.Source),
-		Template:     aws.String(template),
+		Template:     aws.String(s.template(ctx, action)),
 		TemplateData: aws.String(string(j)),
-		Tags: []*ses.MessageTag{
-			{
-				Name:  aws.String("action"),
-				Value: aws.String(action),
-			},
-		},
+		Tags:         tags,
 	}
 	if s.Config.SourceArn != "" {
 		input.SourceArn = aws.String(s.Config.SourceArn)
@@ -128,6 +182,88 @@ func (s SESSender) send(email, action, template string, data sesData) error {
 	}
 
 	// Attempt to send the email.
-	_, err = s.SES.SendTemplatedEmail(input)
+	_, err = s.SES.SendTemplatedEmailWithContext(ctx, input)
+	return err
+}
+
+// sendRaw renders the local templates and sends the MIME message.
+func (s SESSender) sendRaw(ctx context.Context, email, action string, data TemplateData, tags []*ses.MessageTag) error {
+	input, err := s.rawInput(ctx, email, action, data, tags)
+	if err != nil {
+		return err
+	}
+	_, err = s.SES.SendRawEmailWithContext(ctx, input)
 	return err
 }
+
+func (s SESSender) rawInput(ctx context.Context, email, action string, data TemplateData, tags []*ses.MessageTag) (*ses.SendRawEmailInput, error) {
+	ts := s.Templates
+	if ts == nil {
+		ts = DefaultTemplates()
+	}
+	m, err := ts.RenderContext(ctx, action, data)
+	if err != nil {
+		return nil, err
+	}
+	m.From = s.Config.Source
+	m.To = email
+	m.ReplyTo = s.Config.ReplyToAddresses
+	m.ReturnPath = s.Config.ReturnPath
+	b, err := m.Bytes()
+	if err != nil {
+		return nil, err
+	}
+
+	// SES forwards the bounces to Source, which takes precedence over the Return-Path header
+	source, sourceArn := s.Config.Source, s.Config.SourceArn
+	if s.Config.ReturnPath != "" {
+		source, sourceArn = s.Config.ReturnPath, s.Config.ReturnPathArn
+	}
+	input := &ses.SendRawEmailInput{
+		Destinations: []*string{
+			aws.String(email),
+		},
+		Source:     aws.String(source),
+		RawMessage: &ses.RawMessage{Data: b},
+		Tags:       tags,
+	}
+	if sourceArn != "" {
+		input.SourceArn = aws.String(sourceArn)
+	}
+	if s.Config.SourceArn != "" {
+		input.FromArn = aws.String(s.Config.SourceArn)
+	}
+	if s.Config.ConfigurationSetName != "" {
+		input.ConfigurationSetName = aws.String(s.Config.ConfigurationSetName)
+	}
+	if s.Config.ReturnPathArn != "" {
+		input.ReturnPathArn = aws.String(s.Config.ReturnPathArn)
+	}
+	return input, nil
+}
+
+// template returns the SES template name for the action,
+// localized for the recipient's languages in ctx if available.
+func (s SESSender) template(ctx context.Context, action string) string {
+	name := "vey_put"
+	switch action {
+	case TemplateDelete:
+		name = "vey_delete"
+		if s.Config.DeleteTemplate != "" {
+			name = s.Config.DeleteTemplate
+		}
+	case TemplateNotice:
+		name = "vey_notice"
+		if s.Config.NoticeTemplate != "" {
+			name = s.Config.NoticeTemplate
+		}
+	default:
+		if s.Config.PutTemplate != "" {
+			name = s.Config.PutTemplate
+		}
+	}
+	if locale := Negotiate(Languages(ctx), s.Config.Locales); locale != "" {
+		name += "_" + locale
+	}
+	return name
+}
@@ -0,0 +1,51 @@
+package email
+
+import (
+	"context"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+func TestSESRawReturnPath(t *testing.T) {
+	s := SESSender{Config: SESConfig{
+		Source:        "Vey <vey@example.com>",
+		SourceArn:     "arn:aws:ses:us-east-1:123456789012:identity/example.com",
+		ReturnPath:    "bounces@example.com",
+		ReturnPathArn: "arn:aws:ses:us-east-1:123456789012:identity/bounces@example.com",
+	}}
+	input, err := s.rawInput(context.Background(), "test@example.com", TemplatePut, TemplateData{Email: "test@example.com", Challenge: "challenge"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e, g := "bounces@example.com", aws.StringValue(input.Source); e != g {
+		t.Errorf("Source expected %v but got %v", e, g)
+	}
+	if e, g := s.Config.ReturnPathArn, aws.StringValue(input.SourceArn); e != g {
+		t.Errorf("SourceArn expected %v but got %v", e, g)
+	}
+	if e, g := s.Config.SourceArn, aws.StringValue(input.FromArn); e != g {
+		t.Errorf("FromArn expected %v but got %v", e, g)
+	}
+	h, _ := parseMessage(t, input.RawMessage.Data)
+	if e, g := "<bounces@example.com>", h.Get("Return-Path"); e != g {
+		t.Errorf("Return-Path expected %v but got %v", e, g)
+	}
+	if e, g := "Vey <vey@example.com>", h.Get("From"); e != g {
+		t.Errorf("From expected %v but got %v", e, g)
+	}
+
+	// without ReturnPath, the bounces go to Source
+	s.Config.ReturnPath, s.Config.ReturnPathArn = "", ""
+	input, err = s.rawInput(context.Background(), "test@example.com", TemplatePut, TemplateData{Email: "test@example.com", Challenge: "challenge"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e, g := s.Config.Source, aws.StringValue(input.Source); e != g {
+		t.Errorf("Source expected %v but got %v", e, g)
+	}
+	h, _ = parseMessage(t, input.RawMessage.Data)
+	if g := h.Get("Return-Path"); g != "" {
+		t.Errorf("Return-Path expected none but got %v", g)
+	}
+}
@@ -0,0 +1,30 @@
+package email
+
+import "context"
+
+// SenderWithContext returns s as a ContextSender.
+// If s does not implement ContextSender, the returned ContextSender checks the context before calling s.
+func SenderWithContext(s Sender) ContextSender {
+	if c, ok := s.(ContextSender); ok {
+		return c
+	}
+	return contextSender{s}
+}
+
+type contextSender struct {
+	Sender
+}
+
+func (s contextSender) SendTokenContext(ctx context.Context, email, token string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.Sender.SendToken(email, token)
+}
+
+func (s contextSender) SendChallengeContext(ctx context.Context, email, challenge string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.Sender.SendChallenge(email, challenge)
+}
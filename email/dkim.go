@@ -0,0 +1,528 @@
+package email
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	DKIMRSASHA256     = "rsa-sha256"
+	DKIMEd25519SHA256 = "ed25519-sha256"
+)
+
+// DefaultDKIMHeaders are the header fields signed if DKIMConfig.Headers is empty.
+// Fields that are not in the message are skipped.
+var DefaultDKIMHeaders = []string{"From", "To", "Subject", "Date", "Message-ID", "Reply-To", "MIME-Version", "Content-Type", "Content-Language"}
+
+// DKIMConfig configures DKIMSigner.
+type DKIMConfig struct {
+	// Domain is the signing domain, the d= tag.
+	Domain string `yaml:"domain"`
+	// Selector is the s= tag. The public key is published in the TXT record of "<selector>._domainkey.<domain>".
+	Selector string `yaml:"selector"`
+	// PrivateKeyFile is the PEM encoded RSA (PKCS #1 or PKCS #8) or Ed25519 (PKCS #8) private key.
+	// The algorithm is rsa-sha256 or ed25519-sha256 by the type of the key.
+	PrivateKeyFile string `yaml:"privateKeyFile"`
+	// Headers are the header fields to sign. Defaults to DefaultDKIMHeaders.
+	Headers []string `yaml:"headers"`
+	// Expiration sets the x= tag to the signing time plus Expiration. No expiration if 0.
+	Expiration time.Duration `yaml:"expiration"`
+}
+
+// DKIMSigner signs messages with DKIM (RFC 6376), using the relaxed/relaxed canonicalization.
+// Ed25519 keys sign with ed25519-sha256 (RFC 8463).
+type DKIMSigner struct {
+	Domain     string
+	Selector   string
+	Headers    []string
+	Expiration time.Duration
+	// Key is *rsa.PrivateKey or ed25519.PrivateKey.
+	Key crypto.Signer
+
+	now func() time.Time
+}
+
+// NewDKIMSigner returns a DKIMSigner with the private key read from c.PrivateKeyFile.
+func NewDKIMSigner(c DKIMConfig) (*DKIMSigner, error) {
+	if c.Domain == "" || c.Selector == "" {
+		return nil, errors.New("dkim: domain and selector are required")
+	}
+	b, err := os.ReadFile(c.PrivateKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	key, err := ParseDKIMPrivateKey(b)
+	if err != nil {
+		return nil, err
+	}
+	return &DKIMSigner{
+		Domain:     c.Domain,
+		Selector:   c.Selector,
+		Headers:    c.Headers,
+		Expiration: c.Expiration,
+		Key:        key,
+	}, nil
+}
+
+// ParseDKIMPrivateKey parses a PEM encoded RSA or Ed25519 private key.
+func ParseDKIMPrivateKey(b []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, errors.New("dkim: no PEM block in private key")
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("dkim: %w", err)
+	}
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		return k, nil
+	case ed25519.PrivateKey:
+		return k, nil
+	default:
+		return nil, fmt.Errorf("dkim: unsupported private key type: %T", key)
+	}
+}
+
+// Algorithm returns the a= tag for the key.
+func (s *DKIMSigner) Algorithm() string {
+	if _, ok := s.Key.(ed25519.PrivateKey); ok {
+		return DKIMEd25519SHA256
+	}
+	return DKIMRSASHA256
+}
+
+// DNSRecord returns the TXT record to publish at "<selector>._domainkey.<domain>".
+func (s *DKIMSigner) DNSRecord() (string, error) {
+	switch k := s.Key.Public().(type) {
+	case ed25519.PublicKey:
+		return "v=DKIM1; k=ed25519; p=" + base64.StdEncoding.EncodeToString(k), nil
+	case *rsa.PublicKey:
+		der, err := x509.MarshalPKIXPublicKey(k)
+		if err != nil {
+			return "", err
+		}
+		return "v=DKIM1; k=rsa; p=" + base64.StdEncoding.EncodeToString(der), nil
+	default:
+		return "", fmt.Errorf("dkim: unsupported public key type: %T", k)
+	}
+}
+
+// Sign returns msg with the DKIM-Signature header field prepended.
+// msg should be a RFC 5322 message with CRLF line endings, such as the one returned by Message.Bytes.
+func (s *DKIMSigner) Sign(msg []byte) ([]byte, error) {
+	fields, body := splitMessage(msg)
+
+	names := s.Headers
+	if len(names) == 0 {
+		names = DefaultDKIMHeaders
+	}
+	var signed []string
+	for _, name := range names {
+		if len(findFields(fields, name)) > 0 {
+			signed = append(signed, strings.ToLower(name))
+		}
+	}
+	if len(findFields(fields, "From")) == 0 {
+		return nil, errors.New("dkim: message has no From header")
+	}
+
+	now := time.Now
+	if s.now != nil {
+		now = s.now
+	}
+	t := now().Unix()
+	bh := sha256.Sum256(relaxedBody(body))
+
+	tags := []string{
+		"v=1",
+		"a=" + s.Algorithm(),
+		"c=relaxed/relaxed",
+		"d=" + s.Domain,
+		"s=" + s.Selector,
+		"t=" + strconv.FormatInt(t, 10),
+	}
+	if s.Expiration > 0 {
+		tags = append(tags, "x="+strconv.FormatInt(t+int64(s.Expiration/time.Second), 10))
+	}
+	tags = append(tags,
+		"h="+strings.Join(signed, ":"),
+		"bh="+base64.StdEncoding.EncodeToString(bh[:]),
+		"b=",
+	)
+	h := &foldWriter{}
+	h.WriteString("DKIM-Signature:", "")
+	for i, tag := range tags {
+		// the header list can be folded after each colon
+		parts := []string{tag}
+		if strings.HasPrefix(tag, "h=") {
+			parts = strings.SplitAfter(tag, ":")
+		}
+		for j, p := range parts {
+			if j == len(parts)-1 && i < len(tags)-1 {
+				p += ";"
+			}
+			sep := " "
+			if j > 0 {
+				sep = ""
+			}
+			h.WriteString(p, sep)
+		}
+	}
+
+	sig, err := s.sign(dkimSigningData(fields, signed, h.String(), true))
+	if err != nil {
+		return nil, err
+	}
+	b := base64.StdEncoding.EncodeToString(sig)
+	for len(b) > 0 {
+		n := foldWidth - h.line
+		if n <= 0 {
+			h.fold()
+			n = foldWidth - h.line
+		}
+		if n > len(b) {
+			n = len(b)
+		}
+		h.WriteString(b[:n], "")
+		b = b[n:]
+	}
+	h.buf.WriteString("\r\n")
+
+	return append(h.buf.Bytes(), msg...), nil
+}
+
+// foldWidth is the maximum length of a folded header line.
+const foldWidth = 78
+
+// foldWriter writes a header field, folding the line before a string that does not fit in foldWidth.
+type foldWriter struct {
+	buf  bytes.Buffer
+	line int
+}
+
+// WriteString writes sep and s, or folds the line and writes s.
+func (w *foldWriter) WriteString(s, sep string) {
+	if w.line > 0 && w.line+len(sep)+len(s) > foldWidth {
+		w.fold()
+		sep = ""
+	}
+	w.buf.WriteString(sep + s)
+	w.line += len(sep) + len(s)
+}
+
+func (w *foldWriter) fold() {
+	w.buf.WriteString("\r\n\t")
+	w.line = 1
+}
+
+func (w *foldWriter) String() string {
+	return w.buf.String()
+}
+
+func (s *DKIMSigner) sign(data []byte) ([]byte, error) {
+	hashed := sha256.Sum256(data)
+	if _, ok := s.Key.(ed25519.PrivateKey); ok {
+		// ed25519-sha256 signs the SHA-256 hash with PureEdDSA.
+		return s.Key.Sign(rand.Reader, hashed[:], crypto.Hash(0))
+	}
+	return s.Key.Sign(rand.Reader, hashed[:], crypto.SHA256)
+}
+
+// DKIMLookup returns the TXT records of the domain, such as net.LookupTXT.
+type DKIMLookup func(domain string) ([]string, error)
+
+// VerifyDKIM verifies all the DKIM-Signature header fields in msg,
+// looking up the public keys with lookup.
+// VerifyDKIM returns an error if msg has no signature or any of the signatures does not verify.
+func VerifyDKIM(msg []byte, lookup DKIMLookup) error {
+	fields, body := splitMessage(msg)
+	sigs := findFields(fields, "DKIM-Signature")
+	if len(sigs) == 0 {
+		return errors.New("dkim: no signature")
+	}
+	for _, i := range sigs {
+		if err := verifyDKIM(fields, fields[i], body, lookup); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func verifyDKIM(fields []string, field string, body []byte, lookup DKIMLookup) error {
+	tags, err := parseTags(fieldValue(field))
+	if err != nil {
+		return err
+	}
+	for _, t := range []string{"v", "a", "b", "bh", "d", "h", "s"} {
+		if _, ok := tags[t]; !ok {
+			return fmt.Errorf("dkim: missing tag: %s", t)
+		}
+	}
+	if tags["v"] != "1" {
+		return fmt.Errorf("dkim: unsupported version: %s", tags["v"])
+	}
+	if _, ok := tags["l"]; ok {
+		return errors.New("dkim: l= is not supported")
+	}
+	if x, ok := tags["x"]; ok {
+		exp, err := strconv.ParseInt(x, 10, 64)
+		if err != nil {
+			return fmt.Errorf("dkim: invalid x=: %w", err)
+		}
+		if time.Now().Unix() > exp {
+			return errors.New("dkim: signature expired")
+		}
+	}
+
+	headerCanon, bodyCanon := "simple", "simple"
+	if c, ok := tags["c"]; ok {
+		parts := strings.SplitN(c, "/", 2)
+		headerCanon = parts[0]
+		if len(parts) == 2 {
+			bodyCanon = parts[1]
+		}
+	}
+	relaxed := map[string]bool{"simple": false, "relaxed": true}
+	relaxedHeader, ok := relaxed[headerCanon]
+	if !ok {
+		return fmt.Errorf("dkim: unknown canonicalization: %s", headerCanon)
+	}
+	relaxedB, ok := relaxed[bodyCanon]
+	if !ok {
+		return fmt.Errorf("dkim: unknown canonicalization: %s", bodyCanon)
+	}
+
+	var cb []byte
+	if relaxedB {
+		cb = relaxedBody(body)
+	} else {
+		cb = simpleBody(body)
+	}
+	bh := sha256.Sum256(cb)
+	if base64.StdEncoding.EncodeToString(bh[:]) != tags["bh"] {
+		return errors.New("dkim: body hash does not match")
+	}
+
+	var signed []string
+	for _, name := range strings.Split(tags["h"], ":") {
+		signed = append(signed, strings.TrimSpace(name))
+	}
+	data := dkimSigningData(fields, signed, stripSignature(field), relaxedHeader)
+	hashed := sha256.Sum256(data)
+	sig, err := base64.StdEncoding.DecodeString(tags["b"])
+	if err != nil {
+		return fmt.Errorf("dkim: invalid b=: %w", err)
+	}
+
+	records, err := lookup(tags["s"] + "._domainkey." + tags["d"])
+	if err != nil {
+		return fmt.Errorf("dkim: lookup: %w", err)
+	}
+	key, err := parseDKIMRecord(strings.Join(records, ""))
+	if err != nil {
+		return err
+	}
+
+	switch tags["a"] {
+	case DKIMRSASHA256:
+		k, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return errors.New("dkim: key type does not match the algorithm")
+		}
+		if err := rsa.VerifyPKCS1v15(k, crypto.SHA256, hashed[:], sig); err != nil {
+			return fmt.Errorf("dkim: %w", err)
+		}
+	case DKIMEd25519SHA256:
+		k, ok := key.(ed25519.PublicKey)
+		if !ok {
+			return errors.New("dkim: key type does not match the algorithm")
+		}
+		if !ed25519.Verify(k, hashed[:], sig) {
+			return errors.New("dkim: ed25519 verification error")
+		}
+	default:
+		return fmt.Errorf("dkim: unsupported algorithm: %s", tags["a"])
+	}
+	return nil
+}
+
+func parseDKIMRecord(record string) (crypto.PublicKey, error) {
+	tags, err := parseTags(record)
+	if err != nil {
+		return nil, err
+	}
+	p := tags["p"]
+	if p == "" {
+		return nil, errors.New("dkim: key is revoked")
+	}
+	b, err := base64.StdEncoding.DecodeString(p)
+	if err != nil {
+		return nil, fmt.Errorf("dkim: invalid p=: %w", err)
+	}
+	switch tags["k"] {
+	case "", "rsa":
+		if key, err := x509.ParsePKIXPublicKey(b); err == nil {
+			if k, ok := key.(*rsa.PublicKey); ok {
+				return k, nil
+			}
+			return nil, errors.New("dkim: not a RSA key")
+		}
+		key, err := x509.ParsePKCS1PublicKey(b)
+		if err != nil {
+			return nil, fmt.Errorf("dkim: %w", err)
+		}
+		return key, nil
+	case "ed25519":
+		if len(b) != ed25519.PublicKeySize {
+			return nil, errors.New("dkim: invalid ed25519 key size")
+		}
+		return ed25519.PublicKey(b), nil
+	default:
+		return nil, fmt.Errorf("dkim: unsupported key type: %s", tags["k"])
+	}
+}
+
+// dkimSigningData returns the input of the signature hash:
+// the signed header fields and the DKIM-Signature field with an empty b= tag.
+func dkimSigningData(fields, signed []string, sigField string, relaxed bool) []byte {
+	canon := simpleHeader
+	if relaxed {
+		canon = relaxedHeader
+	}
+	buf := &bytes.Buffer{}
+	used := make(map[string]int)
+	for _, name := range signed {
+		key := strings.ToLower(name)
+		// use the instances from the bottom, and skip the nonexisting instances
+		found := findFields(fields, name)
+		n := len(found) - 1 - used[key]
+		used[key]++
+		if n < 0 {
+			continue
+		}
+		buf.WriteString(canon(fields[found[n]]))
+		buf.WriteString("\r\n")
+	}
+	buf.WriteString(canon(strings.TrimSuffix(sigField, "\r\n")))
+	return buf.Bytes()
+}
+
+// splitMessage returns the header fields, each including the folding CRLFs but not the last CRLF, and the body.
+func splitMessage(msg []byte) ([]string, []byte) {
+	header, body := msg, []byte(nil)
+	if i := bytes.Index(msg, []byte("\r\n\r\n")); i >= 0 {
+		header, body = msg[:i+2], msg[i+4:]
+	}
+	var fields []string
+	for _, line := range strings.SplitAfter(string(header), "\r\n") {
+		if line == "" {
+			continue
+		}
+		if (line[0] == ' ' || line[0] == '\t') && len(fields) > 0 {
+			fields[len(fields)-1] += line
+			continue
+		}
+		fields = append(fields, line)
+	}
+	for i, f := range fields {
+		fields[i] = strings.TrimSuffix(f, "\r\n")
+	}
+	return fields, body
+}
+
+// findFields returns the indexes of the fields named name, in order.
+func findFields(fields []string, name string) []int {
+	var ret []int
+	for i, f := range fields {
+		if j := strings.Index(f, ":"); j >= 0 && strings.EqualFold(strings.TrimSpace(f[:j]), name) {
+			ret = append(ret, i)
+		}
+	}
+	return ret
+}
+
+func fieldValue(field string) string {
+	if i := strings.Index(field, ":"); i >= 0 {
+		return field[i+1:]
+	}
+	return ""
+}
+
+var (
+	wsp       = regexp.MustCompile(`[ \t]+`)
+	fws       = regexp.MustCompile(`[ \t\r\n]+`)
+	signature = regexp.MustCompile(`([:;][ \t\r\n]*b[ \t\r\n]*=)[^;]*`)
+)
+
+// stripSignature removes the value of the b= tag.
+func stripSignature(field string) string {
+	return signature.ReplaceAllString(field, "$1")
+}
+
+func parseTags(s string) (map[string]string, error) {
+	tags := make(map[string]string)
+	for _, t := range strings.Split(s, ";") {
+		if strings.TrimSpace(t) == "" {
+			continue
+		}
+		kv := strings.SplitN(t, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("dkim: invalid tag: %s", t)
+		}
+		// FWS is allowed anywhere in base64 and the header list values
+		tags[strings.TrimSpace(kv[0])] = fws.ReplaceAllString(kv[1], "")
+	}
+	return tags, nil
+}
+
+func simpleHeader(field string) string {
+	return field
+}
+
+func relaxedHeader(field string) string {
+	i := strings.Index(field, ":")
+	name := strings.ToLower(strings.TrimSpace(field[:i]))
+	value := strings.ReplaceAll(field[i+1:], "\r\n", "")
+	value = strings.TrimSpace(wsp.ReplaceAllString(value, " "))
+	return name + ":" + value
+}
+
+func simpleBody(body []byte) []byte {
+	for bytes.HasSuffix(body, []byte("\r\n")) {
+		body = body[:len(body)-2]
+	}
+	return append(append([]byte{}, body...), '\r', '\n')
+}
+
+func relaxedBody(body []byte) []byte {
+	lines := strings.Split(string(body), "\r\n")
+	for i, l := range lines {
+		lines[i] = strings.TrimRight(wsp.ReplaceAllString(l, " "), " ")
+	}
+	for len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	buf := &bytes.Buffer{}
+	for _, l := range lines {
+		buf.WriteString(l + "\r\n")
+	}
+	return buf.Bytes()
+}
@@ -0,0 +1,244 @@
+package email
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// rfc8463Message is the ed25519-sha256 signed example message in RFC 8463 Appendix A.3.
+const rfc8463Message = "DKIM-Signature: v=1; a=ed25519-sha256; c=relaxed/relaxed;\r\n" +
+	" d=football.example.com; i=@football.example.com;\r\n" +
+	" q=dns/txt; s=brisbane; t=1528637909; h=from : to :\r\n" +
+	" subject : date : message-id : from : subject : date;\r\n" +
+	" bh=2jUSOH9NhtVGCQWNr9BrIAPreKQjO6Sn7XIkfJVOzv8=;\r\n" +
+	" b=/gCrinpcQOoIfuHNQIbq4pgh9kyIK3AQUdt9OdqQehSwhEIug4D11Bus\r\n" +
+	" Fa3bT3FY5OsU7ZbnKELq+eXdp1Q1Dw==\r\n" +
+	"From: Joe SixPack <joe@football.example.com>\r\n" +
+	"To: Suzie Q <suzie@shopping.example.net>\r\n" +
+	"Subject: Is dinner ready?\r\n" +
+	"Date: Fri, 11 Jul 2003 21:00:37 -0700 (PDT)\r\n" +
+	"Message-ID: <20030712040037.46341.5F8J@football.example.com>\r\n" +
+	"\r\n" +
+	"Hi.\r\n" +
+	"\r\n" +
+	"We lost the game.  Are you hungry yet?\r\n" +
+	"\r\n" +
+	"Joe.\r\n"
+
+func rfc8463Lookup(domain string) ([]string, error) {
+	switch domain {
+	case "brisbane._domainkey.football.example.com":
+		return []string{"v=DKIM1; k=ed25519; p=11qYAYKxCrfVS/7TyWQHOg7hcvPapiMlrwIaaPcHURo="}, nil
+	}
+	return nil, errors.New("not found")
+}
+
+func TestVerifyDKIMRFC8463(t *testing.T) {
+	if err := VerifyDKIM([]byte(rfc8463Message), rfc8463Lookup); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func writeKey(t *testing.T, key interface{}) string {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(t.TempDir(), "dkim.pem")
+	if err := os.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func signerLookup(t *testing.T, s *DKIMSigner) DKIMLookup {
+	record, err := s.DNSRecord()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return func(domain string) ([]string, error) {
+		if e, g := s.Selector+"._domainkey."+s.Domain, domain; e != g {
+			t.Errorf("lookup expected %v but got %v", e, g)
+		}
+		return []string{record}, nil
+	}
+}
+
+func TestDKIMSign(t *testing.T) {
+	seed, _ := base64.StdEncoding.DecodeString("nWGxne/9WmC6hEr0kuwsxERJxWl7MmkZcDusAxyuf2A=")
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := Message{
+		From:     "Vey <vey@example.com>",
+		To:       "test@example.com",
+		ReplyTo:  []string{"support@example.com"},
+		Subject:  "Confirm adding your public key",
+		Text:     "A public key is going to be added.  \n\n\n",
+		HTML:     "<p>A public key is going to be added.</p>",
+		Language: "en",
+	}
+	msg, err := m.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		key       interface{}
+		algorithm string
+	}{
+		{ed25519.NewKeyFromSeed(seed), DKIMEd25519SHA256},
+		{rsaKey, DKIMRSASHA256},
+	} {
+		s, err := NewDKIMSigner(DKIMConfig{
+			Domain:         "example.com",
+			Selector:       "vey",
+			PrivateKeyFile: writeKey(t, tt.key),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if e, g := tt.algorithm, s.Algorithm(); e != g {
+			t.Errorf("algorithm expected %v but got %v", e, g)
+		}
+		signed, err := s.Sign(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		header := string(signed[:len(signed)-len(msg)])
+		if !strings.HasPrefix(header, "DKIM-Signature: v=1; a="+tt.algorithm+"; c=relaxed/relaxed;") {
+			t.Errorf("unexpected signature header: %s", header)
+		}
+		for _, line := range strings.Split(header, "\r\n") {
+			if len(line) > 78 {
+				t.Errorf("line should be folded but got %v", line)
+			}
+		}
+		lookup := signerLookup(t, s)
+		if err := VerifyDKIM(signed, lookup); err != nil {
+			t.Errorf("%s: %v", tt.algorithm, err)
+		}
+
+		// relaxed canonicalization tolerates whitespace changes
+		relaxed := strings.Replace(string(signed), "Subject: ", "subject:   ", 1)
+		relaxed = strings.Replace(relaxed, "To: test@example.com", "To: test@example.com \r\n ", 1)
+		if err := VerifyDKIM([]byte(relaxed+"\r\n\r\n"), lookup); err != nil {
+			t.Errorf("%s: relaxed: %v", tt.algorithm, err)
+		}
+
+		for name, tampered := range map[string]string{
+			"subject": strings.Replace(string(signed), "Subject: ", "Subject: Re: ", 1),
+			"body":    strings.Replace(string(signed), "added.", "removed.", 1),
+			"from":    strings.Replace(string(signed), "\r\n\r\n", "\r\nFrom: evil@example.com\r\n\r\n", 1),
+		} {
+			if err := VerifyDKIM([]byte(tampered), lookup); err == nil {
+				t.Errorf("%s: tampered %s should not verify", tt.algorithm, name)
+			}
+		}
+	}
+}
+
+func TestDKIMSignVector(t *testing.T) {
+	seed, _ := base64.StdEncoding.DecodeString("nWGxne/9WmC6hEr0kuwsxERJxWl7MmkZcDusAxyuf2A=")
+	s := &DKIMSigner{
+		Domain:   "football.example.com",
+		Selector: "brisbane",
+		Headers:  []string{"From", "To", "Subject", "Date", "Message-ID"},
+		Key:      ed25519.NewKeyFromSeed(seed),
+		now:      func() time.Time { return time.Unix(1528637909, 0) },
+	}
+	// the RFC 8463 message without the signatures
+	msg := rfc8463Message[strings.Index(rfc8463Message, "From: "):]
+	signed, err := s.Sign([]byte(msg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Ed25519 signatures are deterministic
+	e := "DKIM-Signature: v=1; a=ed25519-sha256; c=relaxed/relaxed;\r\n" +
+		"\td=football.example.com; s=brisbane; t=1528637909; h=from:to:subject:date:\r\n" +
+		"\tmessage-id; bh=2jUSOH9NhtVGCQWNr9BrIAPreKQjO6Sn7XIkfJVOzv8=; b=P3nKdE3vb1y7yL\r\n" +
+		"\tkHzbXh8FEkKkl4xh9yJe62j90fkt/9wuhnDxafDHGMTqFgPNXZDKTQLL2nYcRfxAUIFw8ZBQ==\r\n"
+	if g := string(signed[:len(signed)-len(msg)]); e != g {
+		t.Errorf("expected %v but got %v", e, g)
+	}
+	if err := VerifyDKIM(signed, rfc8463Lookup); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestVerifyDKIMExpired(t *testing.T) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &DKIMSigner{
+		Domain:     "example.com",
+		Selector:   "vey",
+		Expiration: time.Hour,
+		Key:        key,
+		now:        func() time.Time { return time.Now().Add(-2 * time.Hour) },
+	}
+	signed, err := s.Sign([]byte("From: vey@example.com\r\n\r\nbody\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := VerifyDKIM(signed, signerLookup(t, s)); err == nil || !strings.Contains(err.Error(), "expired") {
+		t.Errorf("expected an expired error but got %v", err)
+	}
+
+	s.now = nil
+	signed, err = s.Sign([]byte("From: vey@example.com\r\n\r\nbody\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := VerifyDKIM(signed, signerLookup(t, s)); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestSMTPSenderDKIM(t *testing.T) {
+	serverTLS, clientTLS := testTLS(t)
+	srv := newSMTPServer(t, serverTLS, false)
+
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewSMTPSender(SMTPConfig{
+		Host:     "127.0.0.1",
+		Port:     srv.port(),
+		Auth:     SMTPAuthPlain,
+		Username: "user",
+		Password: "pass",
+		From:     "Vey <vey@example.com>",
+		DKIM: &DKIMConfig{
+			Domain:         "example.com",
+			Selector:       "vey",
+			PrivateKeyFile: writeKey(t, key),
+		},
+	}).(*SMTPSender)
+	s.TLSConfig = clientTLS
+	defer s.Close()
+
+	if err := s.SendChallenge("test@example.com", "Y2hhbGxlbmdl+/="); err != nil {
+		t.Fatal(err)
+	}
+	msgs := srv.captured()
+	if e, g := 1, len(msgs); e != g {
+		t.Fatalf("expected %v messages but got %v", e, g)
+	}
+	if err := VerifyDKIM(msgs[0].Data, signerLookup(t, s.DKIM)); err != nil {
+		t.Error(err)
+	}
+}
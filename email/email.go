@@ -1,6 +1,7 @@
 package email
 
 import (
+	"context"
 	"log"
 )
 
@@ -15,9 +16,23 @@ type Sender interface {
 	SendChallenge(email, challenge string) error
 }
 
+// ContextSender is the context aware version of Sender.
+// The context carries the trace span, the request deadline and cancellation.
+// Use SenderWithContext to adapt a Sender that does not implement ContextSender.
+type ContextSender interface {
+	SendTokenContext(ctx context.Context, email, token string) error
+	SendChallengeContext(ctx context.Context, email, challenge string) error
+}
+
 // MemEmail implements Sender interface to be used for testing.
 type MemSender struct {
 	Email, Token, Challenge string
+	// Languages are the recipient's preferred languages of the last email. See WithLanguages.
+	Languages []string
+	// Link is the link to confirm the put of the last challenge. See WithLink.
+	Link string
+	// Notice is the last notice.
+	Notice Notice
 }
 
 func NewMemSender() Sender {
@@ -36,6 +51,24 @@ func (s *MemSender) SendChallenge(email, challenge string) error {
 	return nil
 }
 
+func (s *MemSender) SendTokenContext(ctx context.Context, email, token string) error {
+	s.Languages = Languages(ctx)
+	return s.SendToken(email, token)
+}
+
+func (s *MemSender) SendChallengeContext(ctx context.Context, email, challenge string) error {
+	s.Languages = Languages(ctx)
+	s.Link = Link(ctx)
+	return s.SendChallenge(email, challenge)
+}
+
+func (s *MemSender) SendNoticeContext(ctx context.Context, email string, n Notice) error {
+	s.Languages = Languages(ctx)
+	s.Email = email
+	s.Notice = n
+	return nil
+}
+
 // LogSender implements Sender interface which logs the email, token and challenge to stderr and forwards to the wrapped Sender.
 type LogSender struct {
 	Sender
@@ -48,13 +81,30 @@ func NewLogSender(s Sender) Sender {
 }
 
 func (s LogSender) SendToken(email, token string) error {
+	return s.SendTokenContext(context.Background(), email, token)
+}
+
+func (s LogSender) SendTokenContext(ctx context.Context, email, token string) error {
 	log.Printf("send token: %s to email: %s", token, email)
-	return s.Sender.SendToken(email, token)
+	return SenderWithContext(s.Sender).SendTokenContext(ctx, email, token)
 }
 
 func (s LogSender) SendChallenge(email, challenge string) error {
+	return s.SendChallengeContext(context.Background(), email, challenge)
+}
+
+func (s LogSender) SendChallengeContext(ctx context.Context, email, challenge string) error {
 	log.Printf("send challenge: %s to email: %s", challenge, email)
-	return s.Sender.SendChallenge(email, challenge)
+	return SenderWithContext(s.Sender).SendChallengeContext(ctx, email, challenge)
+}
+
+// SendNoticeContext logs the notice, and forwards it if the wrapped Sender implements NoticeSender.
+func (s LogSender) SendNoticeContext(ctx context.Context, email string, n Notice) error {
+	log.Printf("send notice: added=%v %s to email: %s", n.Added, n.KeyFingerprint, email)
+	if ns, ok := s.Sender.(NoticeSender); ok {
+		return ns.SendNoticeContext(ctx, email, n)
+	}
+	return nil
 }
 
 type NullSender struct{}
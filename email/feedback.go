@@ -0,0 +1,85 @@
+package email
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+const (
+	// SuppressBounce is the suppression reason for the permanent bounces.
+	SuppressBounce = "bounce"
+	// SuppressComplaint is the suppression reason for the complaints.
+	SuppressComplaint = "complaint"
+)
+
+// SESNotification is the bounce or complaint notification of Amazon SES,
+// in the Message of the SNS notification.
+// Both the identity notifications and the configuration set event publishing are supported.
+type SESNotification struct {
+	// NotificationType is set by the identity notifications.
+	NotificationType string `json:"notificationType"`
+	// EventType is set by the configuration set event publishing.
+	EventType string        `json:"eventType"`
+	Bounce    *SESBounce    `json:"bounce"`
+	Complaint *SESComplaint `json:"complaint"`
+}
+
+type SESBounce struct {
+	// BounceType is "Permanent", "Transient" or "Undetermined".
+	BounceType        string         `json:"bounceType"`
+	BounceSubType     string         `json:"bounceSubType"`
+	BouncedRecipients []SESRecipient `json:"bouncedRecipients"`
+}
+
+type SESComplaint struct {
+	ComplaintFeedbackType string         `json:"complaintFeedbackType"`
+	ComplainedRecipients  []SESRecipient `json:"complainedRecipients"`
+}
+
+type SESRecipient struct {
+	EmailAddress string `json:"emailAddress"`
+}
+
+// ParseSESNotification parses the SES notification in the Message of the SNS notification.
+func ParseSESNotification(message string) (SESNotification, error) {
+	var n SESNotification
+	err := json.Unmarshal([]byte(message), &n)
+	return n, err
+}
+
+// Type returns "Bounce", "Complaint", or the other type of the notification.
+func (n SESNotification) Type() string {
+	if n.NotificationType != "" {
+		return n.NotificationType
+	}
+	return n.EventType
+}
+
+// Suppressions returns the recipients that should not receive emails any more, and the reason.
+// The recipients of the permanent bounces and the complaints are suppressed,
+// while the transient bounces are retried by SES and not suppressed.
+func (n SESNotification) Suppressions() (reason string, recipients []string) {
+	switch {
+	case n.Type() == "Bounce" && n.Bounce != nil && n.Bounce.BounceType == "Permanent":
+		reason = SuppressBounce
+		for _, r := range n.Bounce.BouncedRecipients {
+			recipients = append(recipients, address(r.EmailAddress))
+		}
+	case n.Type() == "Complaint" && n.Complaint != nil && n.Complaint.ComplaintFeedbackType != "not-spam":
+		reason = SuppressComplaint
+		for _, r := range n.Complaint.ComplainedRecipients {
+			recipients = append(recipients, address(r.EmailAddress))
+		}
+	}
+	return
+}
+
+// address strips the display name, which SES may include as in "Name <test@example.com>".
+func address(s string) string {
+	if i := strings.LastIndex(s, "<"); i >= 0 {
+		if j := strings.LastIndex(s, ">"); j > i {
+			return s[i+1 : j]
+		}
+	}
+	return strings.TrimSpace(s)
+}
@@ -0,0 +1,393 @@
+package email
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// FileMaildir writes each message to a file in the maildir's new directory.
+	FileMaildir = "maildir"
+	// FileMbox appends the messages to a single mboxrd file.
+	FileMbox = "mbox"
+)
+
+const (
+	// headerAction, headerToken and headerChallenge are added to the captured messages,
+	// so that the inbox can show them without parsing the localized bodies.
+	headerAction    = "X-Vey-Action"
+	headerToken     = "X-Vey-Token"
+	headerChallenge = "X-Vey-Challenge"
+)
+
+// FileConfig configures FileSender.
+type FileConfig struct {
+	// Path is the maildir directory or the mbox file. It is created if it does not exist.
+	Path string `yaml:"path"`
+	// Format is "maildir" or "mbox". Defaults to "maildir".
+	Format string `yaml:"format"`
+	// From is the From header. Defaults to "Vey <vey@localhost>".
+	From string `yaml:"from"`
+	// TemplateDir is the directory of the email templates. See LoadTemplates for the files.
+	// The templates embedded in the package are used if empty.
+	TemplateDir string `yaml:"templateDir"`
+}
+
+// FileSender implements Sender and ContextSender interface by writing the RFC 5322 messages
+// to a maildir or a mbox, to be read by mail clients or the development inbox.
+// FileSender is for development purposes only.
+type FileSender struct {
+	Config FileConfig
+	// Templates renders the emails. DefaultTemplates is used if nil.
+	Templates *Templates
+
+	m sync.Mutex
+}
+
+// NewFileSender returns a FileSender which writes the emails to c.Path.
+// If the templates in c.TemplateDir have an error, NewFileSender panics.
+func NewFileSender(c FileConfig) Sender {
+	return &FileSender{
+		Config:    c,
+		Templates: mustTemplates(c.TemplateDir),
+	}
+}
+
+func (s *FileSender) SendToken(dst, token string) error {
+	return s.SendTokenContext(context.Background(), dst, token)
+}
+
+func (s *FileSender) SendTokenContext(ctx context.Context, dst, token string) error {
+	data := TemplateData{
+		Email:        dst,
+		Token:        token,
+		TokenEscaped: url.QueryEscape(token),
+	}
+	return s.send(ctx, dst, TemplateDelete, data)
+}
+
+func (s *FileSender) SendChallenge(dst, challenge string) error {
+	return s.SendChallengeContext(context.Background(), dst, challenge)
+}
+
+func (s *FileSender) SendChallengeContext(ctx context.Context, dst, challenge string) error {
+	data := TemplateData{
+		Email:            dst,
+		Challenge:        challenge,
+		ChallengeEscaped: url.QueryEscape(challenge),
+		Link:             Link(ctx),
+	}
+	return s.send(ctx, dst, TemplatePut, data)
+}
+
+// SendNoticeContext sends the notice to the dst email address.
+func (s *FileSender) SendNoticeContext(ctx context.Context, dst string, n Notice) error {
+	return s.send(ctx, dst, TemplateNotice, n.data(dst))
+}
+
+func (s *FileSender) send(ctx context.Context, dst, action string, data TemplateData) (err error) {
+	ctx, span := tracer.Start(ctx, "FileSender.send")
+	defer func() { endSpan(span, err) }()
+
+	ts := s.Templates
+	if ts == nil {
+		ts = DefaultTemplates()
+	}
+	m, err := ts.RenderContext(ctx, action, data)
+	if err != nil {
+		return err
+	}
+	m.From = s.Config.From
+	if m.From == "" {
+		m.From = "Vey <vey@localhost>"
+	}
+	m.To = dst
+	b, err := m.Bytes()
+	if err != nil {
+		return err
+	}
+	h := fmt.Sprintf("%s: %s\r\n", headerAction, action)
+	if data.Token != "" {
+		h += fmt.Sprintf("%s: %s\r\n", headerToken, data.Token)
+	}
+	if data.Challenge != "" {
+		h += fmt.Sprintf("%s: %s\r\n", headerChallenge, data.Challenge)
+	}
+	b = append([]byte(h), b...)
+
+	s.m.Lock()
+	defer s.m.Unlock()
+	if s.Config.Format == FileMbox {
+		return appendMbox(s.Config.Path, b, time.Now())
+	}
+	return writeMaildir(s.Config.Path, b)
+}
+
+// Messages returns the messages written by s, the newest first.
+func (s *FileSender) Messages() ([]CapturedMessage, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if s.Config.Format == FileMbox {
+		return ReadMbox(s.Config.Path)
+	}
+	return ReadMaildir(s.Config.Path)
+}
+
+// Mailbox lists the captured messages. FileSender implements it.
+type Mailbox interface {
+	Messages() ([]CapturedMessage, error)
+}
+
+// CapturedMessage is a message read from a maildir or a mbox.
+type CapturedMessage struct {
+	// ID is the file name in the maildir, or the position in the mbox.
+	ID      string
+	Date    time.Time
+	From    string
+	To      string
+	Subject string
+	// Action is "put" or "delete".
+	Action    string
+	Token     string
+	Challenge string
+	// Text is the text/plain body.
+	Text string
+	// Links are the URLs in Text.
+	Links []string
+}
+
+// ReadMaildir reads the messages in the new and cur directories of the maildir, the newest first.
+// A maildir that does not exist has no messages.
+func ReadMaildir(dir string) ([]CapturedMessage, error) {
+	var ms []CapturedMessage
+	for _, sub := range []string{"new", "cur"} {
+		entries, err := os.ReadDir(filepath.Join(dir, sub))
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range entries {
+			if e.IsDir() || strings.HasPrefix(e.Name(), ".") {
+				continue
+			}
+			b, err := os.ReadFile(filepath.Join(dir, sub, e.Name()))
+			if err != nil {
+				return nil, err
+			}
+			m, err := parseCaptured(b)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", e.Name(), err)
+			}
+			m.ID = e.Name()
+			ms = append(ms, m)
+		}
+	}
+	sortCaptured(ms)
+	return ms, nil
+}
+
+// ReadMbox reads the messages in the mboxrd file, the newest first.
+// A mbox that does not exist has no messages.
+func ReadMbox(file string) ([]CapturedMessage, error) {
+	b, err := os.ReadFile(file)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		ms    []CapturedMessage
+		cur   *bytes.Buffer
+		flush = func() error {
+			if cur == nil {
+				return nil
+			}
+			m, err := parseCaptured(cur.Bytes())
+			if err != nil {
+				return fmt.Errorf("message %d: %w", len(ms)+1, err)
+			}
+			m.ID = fmt.Sprint(len(ms) + 1)
+			ms = append(ms, m)
+			return nil
+		}
+	)
+	sc := bufio.NewScanner(bytes.NewReader(b))
+	sc.Buffer(nil, 1024*1024)
+	for sc.Scan() {
+		line := sc.Text()
+		if strings.HasPrefix(line, "From ") {
+			if err := flush(); err != nil {
+				return nil, err
+			}
+			cur = &bytes.Buffer{}
+			continue
+		}
+		if cur == nil {
+			return nil, errors.New("mbox: no From line")
+		}
+		if mboxQuoted.MatchString(line) {
+			line = line[1:]
+		}
+		cur.WriteString(line + "\r\n")
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	if err := flush(); err != nil {
+		return nil, err
+	}
+	sortCaptured(ms)
+	return ms, nil
+}
+
+// mboxQuoted matches the lines quoted by mboxrd.
+var mboxQuoted = regexp.MustCompile(`^>+From `)
+
+// links matches the URLs, including the custom schemes of the apps.
+var links = regexp.MustCompile(`[a-z][a-z0-9+.-]*://[^\s<>"]+`)
+
+func writeMaildir(dir string, b []byte) error {
+	for _, sub := range []string{"tmp", "new", "cur"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0o700); err != nil {
+			return err
+		}
+	}
+	// the unique name, as in https://cr.yp.to/proto/maildir.html
+	r := make([]byte, 8)
+	if _, err := rand.Read(r); err != nil {
+		return err
+	}
+	host, _ := os.Hostname()
+	host = strings.NewReplacer("/", `\057`, ":", `\072`).Replace(host)
+	name := fmt.Sprintf("%d.%s.%s", time.Now().UnixNano(), hex.EncodeToString(r), host)
+
+	tmp := filepath.Join(dir, "tmp", name)
+	if err := os.WriteFile(tmp, b, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(dir, "new", name))
+}
+
+func appendMbox(file string, b []byte, now time.Time) error {
+	if err := os.MkdirAll(filepath.Dir(file), 0o700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return err
+	}
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(buf, "From MAILER-DAEMON %s\n", now.UTC().Format(time.ANSIC))
+	sc := bufio.NewScanner(bytes.NewReader(b))
+	sc.Buffer(nil, 1024*1024)
+	for sc.Scan() {
+		line := strings.TrimSuffix(sc.Text(), "\r")
+		if strings.HasPrefix(line, "From ") || mboxQuoted.MatchString(line) {
+			line = ">" + line
+		}
+		buf.WriteString(line + "\n")
+	}
+	if err := sc.Err(); err != nil {
+		f.Close()
+		return err
+	}
+	buf.WriteString("\n")
+	if _, err := f.Write(buf.Bytes()); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func parseCaptured(b []byte) (CapturedMessage, error) {
+	msg, err := mail.ReadMessage(bytes.NewReader(b))
+	if err != nil {
+		return CapturedMessage{}, err
+	}
+	dec := new(mime.WordDecoder)
+	subject, err := dec.DecodeHeader(msg.Header.Get("Subject"))
+	if err != nil {
+		subject = msg.Header.Get("Subject")
+	}
+	date, _ := msg.Header.Date()
+	m := CapturedMessage{
+		Date:      date,
+		From:      msg.Header.Get("From"),
+		To:        msg.Header.Get("To"),
+		Subject:   subject,
+		Action:    msg.Header.Get(headerAction),
+		Token:     msg.Header.Get(headerToken),
+		Challenge: msg.Header.Get(headerChallenge),
+	}
+	m.Text, err = textBody(msg.Header.Get("Content-Type"), msg.Header.Get("Content-Transfer-Encoding"), msg.Body)
+	if err != nil {
+		return m, err
+	}
+	m.Links = links.FindAllString(m.Text, -1)
+	return m, nil
+}
+
+// textBody returns the first text/plain part of the body.
+func textBody(contentType, encoding string, body io.Reader) (string, error) {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		mediaType = "text/plain"
+	}
+	if strings.HasPrefix(mediaType, "multipart/") {
+		mr := multipart.NewReader(body, params["boundary"])
+		for {
+			p, err := mr.NextPart()
+			if err == io.EOF {
+				return "", nil
+			}
+			if err != nil {
+				return "", err
+			}
+			// multipart.Reader decodes quoted-printable parts and removes the header
+			text, err := textBody(p.Header.Get("Content-Type"), "", p)
+			if err != nil || text != "" {
+				return text, err
+			}
+		}
+	}
+	if mediaType != "text/plain" {
+		return "", nil
+	}
+	if strings.EqualFold(encoding, "quoted-printable") {
+		body = quotedprintable.NewReader(body)
+	}
+	b, err := io.ReadAll(body)
+	return strings.ReplaceAll(string(b), "\r\n", "\n"), err
+}
+
+// sortCaptured sorts the messages read in the written order, the newest first.
+func sortCaptured(ms []CapturedMessage) {
+	for i, j := 0, len(ms)-1; i < j; i, j = i+1, j-1 {
+		ms[i], ms[j] = ms[j], ms[i]
+	}
+	sort.SliceStable(ms, func(i, j int) bool {
+		return ms[i].Date.After(ms[j].Date)
+	})
+}
@@ -0,0 +1,87 @@
+package email
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFileSender(t *testing.T) {
+	for _, format := range []string{FileMaildir, FileMbox} {
+		t.Run(format, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "mail")
+			s := NewFileSender(FileConfig{Path: path, Format: format}).(*FileSender)
+
+			ms, err := s.Messages()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if e, g := 0, len(ms); e != g {
+				t.Fatalf("expected %v messages but got %v", e, g)
+			}
+
+			if err := s.SendChallenge("test@example.com", "c+/="); err != nil {
+				t.Fatal(err)
+			}
+			ctx := WithLanguages(context.Background(), "ja")
+			if err := s.SendTokenContext(ctx, "test@example.com", "t+/="); err != nil {
+				t.Fatal(err)
+			}
+
+			ms, err = s.Messages()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if e, g := 2, len(ms); e != g {
+				t.Fatalf("expected %v messages but got %v", e, g)
+			}
+			// the newest first
+			if e, g := TemplateDelete, ms[0].Action; e != g {
+				t.Errorf("Action expected %v but got %v", e, g)
+			}
+			if e, g := "t+/=", ms[0].Token; e != g {
+				t.Errorf("Token expected %v but got %v", e, g)
+			}
+			if !strings.Contains(ms[0].Text, "t+/=") {
+				t.Errorf("Text should contain the token but got %v", ms[0].Text)
+			}
+			if e, g := TemplatePut, ms[1].Action; e != g {
+				t.Errorf("Action expected %v but got %v", e, g)
+			}
+			if e, g := "c+/=", ms[1].Challenge; e != g {
+				t.Errorf("Challenge expected %v but got %v", e, g)
+			}
+			if e, g := "test@example.com", ms[1].To; e != g {
+				t.Errorf("To expected %v but got %v", e, g)
+			}
+			if ms[0].Subject == ms[1].Subject || ms[0].Subject == "" {
+				t.Errorf("Subject expected to be decoded and localized but got %v and %v", ms[0].Subject, ms[1].Subject)
+			}
+		})
+	}
+}
+
+func TestMboxQuoting(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "mbox")
+	body := "Subject: test\r\n\r\nFrom here\r\n>From there\r\nlink https://example.com/open?x=1\r\n"
+	for i := 0; i < 2; i++ {
+		if err := appendMbox(file, []byte(body), time.Now()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ms, err := ReadMbox(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e, g := 2, len(ms); e != g {
+		t.Fatalf("expected %v messages but got %v", e, g)
+	}
+	if e, g := "From here\n>From there\nlink https://example.com/open?x=1\n", strings.TrimRight(ms[0].Text, "\n")+"\n"; e != g {
+		t.Errorf("expected %q but got %q", e, g)
+	}
+	if e, g := "https://example.com/open?x=1", strings.Join(ms[0].Links, ","); e != g {
+		t.Errorf("Links expected %v but got %v", e, g)
+	}
+}
@@ -0,0 +1,16 @@
+package email
+
+import "context"
+
+type linkKey struct{}
+
+// WithLink returns a context that carries the link to confirm the put, which is rendered as Link in the put email.
+func WithLink(ctx context.Context, link string) context.Context {
+	return context.WithValue(ctx, linkKey{}, link)
+}
+
+// Link returns the link set by WithLink, or "".
+func Link(ctx context.Context) string {
+	l, _ := ctx.Value(linkKey{}).(string)
+	return l
+}
@@ -0,0 +1,109 @@
+package email
+
+import (
+	"context"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+type languagesKey struct{}
+
+// WithLanguages returns a context that carries the recipient's preferred languages, most preferred first.
+// Senders pick the template set for the recipient with Negotiate.
+func WithLanguages(ctx context.Context, languages ...string) context.Context {
+	return context.WithValue(ctx, languagesKey{}, languages)
+}
+
+// Languages returns the preferred languages set by WithLanguages.
+func Languages(ctx context.Context) []string {
+	l, _ := ctx.Value(languagesKey{}).([]string)
+	return l
+}
+
+// ParseAcceptLanguage parses the Accept-Language header value,
+// and returns the language tags ordered by quality, most preferred first.
+// Tags with q=0 and the "*" wildcard are dropped.
+func ParseAcceptLanguage(header string) []string {
+	type weighted struct {
+		tag string
+		q   float64
+	}
+	var ws []weighted
+	for _, part := range strings.Split(header, ",") {
+		fields := strings.Split(part, ";")
+		tag := strings.TrimSpace(fields[0])
+		if tag == "" || tag == "*" {
+			continue
+		}
+		q := 1.0
+		for _, f := range fields[1:] {
+			f = strings.TrimSpace(f)
+			if strings.HasPrefix(f, "q=") {
+				v, err := strconv.ParseFloat(f[2:], 64)
+				if err != nil {
+					v = 0
+				}
+				q = v
+			}
+		}
+		if q <= 0 {
+			continue
+		}
+		ws = append(ws, weighted{tag: tag, q: q})
+	}
+	sort.SliceStable(ws, func(i, j int) bool {
+		return ws[i].q > ws[j].q
+	})
+	ret := make([]string, len(ws))
+	for i, w := range ws {
+		ret[i] = w.tag
+	}
+	return ret
+}
+
+// Negotiate returns the locale in available that best matches the preferred languages,
+// or an empty string if none matches, in which case the caller should use its default.
+//
+// For each preferred language in order, Negotiate tries:
+//  1. the exact locale, ignoring case and "_" vs "-", such as "pt-BR" for "pt_br"
+//  2. the base language, such as "de" for "de-AT"
+//  3. a regional locale of the same base language, such as "pt-BR" for "pt"
+//
+// before moving on to the next preferred language.
+func Negotiate(preferred, available []string) string {
+	for _, p := range preferred {
+		p = normalizeLocale(p)
+		base := baseLanguage(p)
+		var regional string
+		for _, a := range available {
+			n := normalizeLocale(a)
+			if n == p {
+				return a
+			}
+			if regional == "" && baseLanguage(n) == base && n != base {
+				regional = a
+			}
+		}
+		for _, a := range available {
+			if normalizeLocale(a) == base {
+				return a
+			}
+		}
+		if regional != "" {
+			return regional
+		}
+	}
+	return ""
+}
+
+func normalizeLocale(l string) string {
+	return strings.ToLower(strings.ReplaceAll(strings.TrimSpace(l), "_", "-"))
+}
+
+func baseLanguage(l string) string {
+	if i := strings.Index(l, "-"); i >= 0 {
+		return l[:i]
+	}
+	return l
+}
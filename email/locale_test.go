@@ -0,0 +1,70 @@
+package email
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+func TestParseAcceptLanguage(t *testing.T) {
+	tests := []struct {
+		header   string
+		expected []string
+	}{
+		{"", []string{}},
+		{"ja", []string{"ja"}},
+		{"de-DE,de;q=0.9,en;q=0.8", []string{"de-DE", "de", "en"}},
+		{"en;q=0.5, pt-BR, ja;q=0.8", []string{"pt-BR", "ja", "en"}},
+		{"fr;q=0, *;q=0.1, de", []string{"de"}},
+		{"ja;q=0.8, ko;q=0.8", []string{"ja", "ko"}},
+		{"en;q=invalid, ja", []string{"ja"}},
+	}
+	for _, tt := range tests {
+		if e, g := tt.expected, ParseAcceptLanguage(tt.header); !reflect.DeepEqual(e, g) {
+			t.Errorf("%q expected %v but got %v", tt.header, e, g)
+		}
+	}
+}
+
+func TestNegotiate(t *testing.T) {
+	available := []string{"de", "ja", "pt-BR"}
+	tests := []struct {
+		preferred []string
+		expected  string
+	}{
+		{nil, ""},
+		{[]string{"ja"}, "ja"},
+		{[]string{"JA-jp"}, "ja"},
+		{[]string{"de-AT"}, "de"},
+		{[]string{"pt_br"}, "pt-BR"},
+		{[]string{"pt"}, "pt-BR"},
+		{[]string{"pt-PT"}, "pt-BR"},
+		{[]string{"fr", "de"}, "de"},
+		{[]string{"en", "ja"}, "ja"},
+		{[]string{"fr", "ko"}, ""},
+	}
+	for _, tt := range tests {
+		if e, g := tt.expected, Negotiate(tt.preferred, available); e != g {
+			t.Errorf("%v expected %v but got %v", tt.preferred, e, g)
+		}
+	}
+
+	// the exact regional locale is preferred over the base language
+	if e, g := "pt-PT", Negotiate([]string{"pt-PT"}, []string{"pt", "pt-BR", "pt-PT"}); e != g {
+		t.Errorf("expected %v but got %v", e, g)
+	}
+	if e, g := "pt", Negotiate([]string{"pt-AO"}, []string{"pt-BR", "pt"}); e != g {
+		t.Errorf("expected %v but got %v", e, g)
+	}
+}
+
+func TestLanguages(t *testing.T) {
+	ctx := context.Background()
+	if g := Languages(ctx); g != nil {
+		t.Errorf("expected nil but got %v", g)
+	}
+	ctx = WithLanguages(ctx, "ja", "en")
+	if e, g := []string{"ja", "en"}, Languages(ctx); !reflect.DeepEqual(e, g) {
+		t.Errorf("expected %v but got %v", e, g)
+	}
+}
@@ -0,0 +1,60 @@
+package email
+
+import (
+	"log"
+	"time"
+)
+
+// Log is package global variable that holds Logger.
+var Log Logger = NewLogger()
+
+// Logger logs the send attempts and errors.
+type Logger interface {
+	// Attempt logs a send attempt through a provider of MultiSender.
+	Attempt(a Attempt)
+	// Error logs an error, such as of the outbox Worker.
+	Error(err error)
+}
+
+// Attempt is a send attempt through a provider of MultiSender.
+// It has the recipient's domain instead of the address, so that the logs do not have the addresses.
+type Attempt struct {
+	Provider string
+	// Action is TemplatePut or TemplateDelete.
+	Action string
+	Domain string
+	// Number is 1 for the first attempt of the email, and increments on failover.
+	Number   int
+	Duration time.Duration
+	// Err is nil if the email was sent.
+	Err error
+}
+
+type logger struct{}
+
+// NewLogger returns a new default Logger that logs to stderr.
+func NewLogger() Logger {
+	return logger{}
+}
+
+func (l logger) Attempt(a Attempt) {
+	if a.Err != nil {
+		log.Printf("send attempt %d via %s failed: action: %s, domain: %s, duration: %s, error: %v", a.Number, a.Provider, a.Action, a.Domain, a.Duration, a.Err)
+		return
+	}
+	log.Printf("send attempt %d via %s succeeded: action: %s, domain: %s, duration: %s", a.Number, a.Provider, a.Action, a.Domain, a.Duration)
+}
+
+func (l logger) Error(err error) {
+	log.Printf("error: %v", err)
+}
+
+type nilLogger struct{}
+
+func NilLogger() Logger {
+	return nilLogger{}
+}
+
+func (l nilLogger) Attempt(a Attempt) {}
+
+func (l nilLogger) Error(err error) {}
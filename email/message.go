@@ -0,0 +1,99 @@
+package email
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"time"
+)
+
+// Message is an email with text and HTML alternatives.
+type Message struct {
+	From    string
+	To      string
+	ReplyTo []string
+	Subject string
+	Text    string
+	HTML    string
+	// Language is the Content-Language of the message, if set.
+	Language string
+	// ReturnPath is the address of the bounces, written as the Return-Path header if set.
+	ReturnPath string
+}
+
+// Bytes returns the RFC 5322 formatted message, with a multipart/alternative body
+// that includes the text and HTML parts encoded in quoted-printable.
+func (m Message) Bytes() ([]byte, error) {
+	buf := &bytes.Buffer{}
+	mw := multipart.NewWriter(buf)
+
+	h := []struct{ k, v string }{
+		{"From", m.From},
+		{"To", m.To},
+		{"Subject", mime.QEncoding.Encode("utf-8", m.Subject)},
+		{"Date", time.Now().Format(time.RFC1123Z)},
+		{"Message-ID", messageID(m.From)},
+		{"MIME-Version", "1.0"},
+		{"Content-Type", `multipart/alternative; boundary="` + mw.Boundary() + `"`},
+	}
+	if len(m.ReplyTo) > 0 {
+		h = append(h, struct{ k, v string }{"Reply-To", strings.Join(m.ReplyTo, ", ")})
+	}
+	if m.ReturnPath != "" {
+		h = append(h, struct{ k, v string }{"Return-Path", "<" + m.ReturnPath + ">"})
+	}
+	if m.Language != "" {
+		h = append(h, struct{ k, v string }{"Content-Language", m.Language})
+	}
+	for _, kv := range h {
+		fmt.Fprintf(buf, "%s: %s\r\n", kv.k, kv.v)
+	}
+	buf.WriteString("\r\n")
+
+	for _, p := range []struct{ contentType, body string }{
+		{"text/plain; charset=utf-8", m.Text},
+		{"text/html; charset=utf-8", m.HTML},
+	} {
+		if p.body == "" {
+			continue
+		}
+		pw, err := mw.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {p.contentType},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return nil, err
+		}
+		qw := quotedprintable.NewWriter(pw)
+		if _, err := qw.Write([]byte(p.body)); err != nil {
+			return nil, err
+		}
+		if err := qw.Close(); err != nil {
+			return nil, err
+		}
+	}
+	if err := mw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// messageID returns a unique Message-ID using the domain of the from address.
+func messageID(from string) string {
+	domain := "localhost"
+	if a, err := mail.ParseAddress(from); err == nil {
+		if i := strings.LastIndex(a.Address, "@"); i >= 0 {
+			domain = a.Address[i+1:]
+		}
+	}
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return "<" + hex.EncodeToString(b) + "@" + domain + ">"
+}
@@ -0,0 +1,373 @@
+package email
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/service/ses"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	defaultFailureThreshold = 3
+	defaultCooldown         = 30 * time.Second
+)
+
+// Provider is a Sender routed by MultiSender.
+type Provider struct {
+	// Name identifies the provider in Routes and in the logs.
+	Name   string
+	Sender Sender
+	// Weight is the relative share of the emails that are tried with the provider first,
+	// among the providers that are not routed by domain.
+	// Providers with Weight 0 are tried only after the weighted providers failed, in the listed order.
+	Weight int
+}
+
+// Route routes the emails to the recipient domains to the providers.
+type Route struct {
+	// Domains are the recipient domains, such as "example.com", or "*.example.com" for the subdomains.
+	Domains []string `yaml:"domains"`
+	// Providers are the names of the providers, tried in the listed order.
+	Providers []string `yaml:"providers"`
+}
+
+func (r Route) match(domain string) bool {
+	for _, d := range r.Domains {
+		d = strings.ToLower(d)
+		if strings.HasPrefix(d, "*.") {
+			if strings.HasSuffix(domain, d[1:]) {
+				return true
+			}
+		} else if d == domain {
+			return true
+		}
+	}
+	return false
+}
+
+// MultiSender implements Sender and ContextSender interface by routing the emails across providers.
+// A send fails over to the next provider on error.
+// A provider that failed FailureThreshold times in a row is unhealthy, and tried only after the healthy providers
+// until Cooldown has passed.
+// Every attempt is logged with Log.
+type MultiSender struct {
+	Providers []Provider
+	// Routes are matched in order with the recipient domain. The first matched route decides the providers.
+	// The emails to the other domains are sent with all providers, in the weighted random order.
+	Routes []Route
+	// FailureThreshold defaults to 3.
+	FailureThreshold int
+	// Cooldown defaults to 30s.
+	Cooldown time.Duration
+
+	m      sync.Mutex
+	health map[string]*providerHealth
+	rand   *rand.Rand
+	now    func() time.Time
+}
+
+type providerHealth struct {
+	failures int
+	// until is when the unhealthy provider is tried first again.
+	until time.Time
+}
+
+// NewMultiSender returns a MultiSender that routes the emails across providers.
+// If the provider names are not unique, or routes refer to unknown providers, NewMultiSender panics.
+func NewMultiSender(providers []Provider, routes ...Route) Sender {
+	s := &MultiSender{
+		Providers: providers,
+		Routes:    routes,
+		health:    make(map[string]*providerHealth),
+		rand:      rand.New(rand.NewSource(time.Now().UnixNano())),
+		now:       time.Now,
+	}
+	for _, p := range providers {
+		if _, ok := s.health[p.Name]; ok {
+			panic(fmt.Sprintf("duplicate provider: %s", p.Name))
+		}
+		s.health[p.Name] = &providerHealth{}
+	}
+	for _, r := range routes {
+		for _, name := range r.Providers {
+			if _, ok := s.health[name]; !ok {
+				panic(fmt.Sprintf("unknown provider in route: %s", name))
+			}
+		}
+	}
+	return s
+}
+
+func (s *MultiSender) SendToken(dst, token string) error {
+	return s.SendTokenContext(context.Background(), dst, token)
+}
+
+func (s *MultiSender) SendTokenContext(ctx context.Context, dst, token string) error {
+	return s.send(ctx, TemplateDelete, dst, func(ctx context.Context, p ContextSender) error {
+		return p.SendTokenContext(ctx, dst, token)
+	})
+}
+
+func (s *MultiSender) SendChallenge(dst, challenge string) error {
+	return s.SendChallengeContext(context.Background(), dst, challenge)
+}
+
+func (s *MultiSender) SendChallengeContext(ctx context.Context, dst, challenge string) error {
+	return s.send(ctx, TemplatePut, dst, func(ctx context.Context, p ContextSender) error {
+		return p.SendChallengeContext(ctx, dst, challenge)
+	})
+}
+
+func (s *MultiSender) SendNoticeContext(ctx context.Context, dst string, n Notice) error {
+	return s.send(ctx, TemplateNotice, dst, func(ctx context.Context, p ContextSender) error {
+		ns, ok := p.(NoticeSender)
+		if !ok {
+			return errors.New("the provider does not send the notice emails")
+		}
+		return ns.SendNoticeContext(ctx, dst, n)
+	})
+}
+
+// Ping implements vey.Pinger, and fails when all providers are unhealthy.
+func (s *MultiSender) Ping(ctx context.Context) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	now := s.now()
+	for _, p := range s.Providers {
+		if s.healthy(p.Name, now) {
+			return nil
+		}
+	}
+	return errors.New("all email providers are unhealthy")
+}
+
+// Close closes the providers that implement io.Closer.
+func (s *MultiSender) Close() error {
+	var errs []string
+	for _, p := range s.Providers {
+		if c, ok := p.Sender.(io.Closer); ok {
+			if err := c.Close(); err != nil {
+				errs = append(errs, p.Name+": "+err.Error())
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, ", "))
+	}
+	return nil
+}
+
+func (s *MultiSender) send(ctx context.Context, action, dst string, f func(context.Context, ContextSender) error) (err error) {
+	domain := domainOf(dst)
+	ctx, span := tracer.Start(ctx, "MultiSender.send",
+		trace.WithAttributes(
+			attribute.String("vey.email.action", action),
+		),
+	)
+	defer func() { endSpan(span, err) }()
+
+	var (
+		lastErr error
+		failed  []string
+	)
+	for i, p := range s.order(domain) {
+		start := time.Now()
+		err := f(ctx, SenderWithContext(p.Sender))
+		Log.Attempt(Attempt{
+			Provider: p.Name,
+			Action:   action,
+			Domain:   domain,
+			Number:   i + 1,
+			Duration: time.Since(start),
+			Err:      err,
+		})
+		if ctx.Err() != nil {
+			// the provider is not to blame for our deadline
+			return ctx.Err()
+		}
+		s.record(p.Name, err)
+		if err == nil {
+			span.SetAttributes(attribute.String("vey.email.provider", p.Name), attribute.Int("vey.email.attempts", i+1))
+			return nil
+		}
+		lastErr = err
+		failed = append(failed, p.Name)
+	}
+	if lastErr == nil {
+		return errors.New("no email providers")
+	}
+	return fmt.Errorf("all email providers failed: %s: %w", strings.Join(failed, ", "), lastErr)
+}
+
+// order returns the providers to try for the recipient domain, the healthy ones first.
+func (s *MultiSender) order(domain string) []Provider {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	var candidates []Provider
+	routed := false
+	for _, r := range s.Routes {
+		if r.match(domain) {
+			for _, name := range r.Providers {
+				candidates = append(candidates, s.provider(name))
+			}
+			routed = true
+			break
+		}
+	}
+	if !routed {
+		candidates = s.weighted()
+	}
+
+	now := s.now()
+	healthy := make([]Provider, 0, len(candidates))
+	var unhealthy []Provider
+	for _, p := range candidates {
+		if s.healthy(p.Name, now) {
+			healthy = append(healthy, p)
+		} else {
+			unhealthy = append(unhealthy, p)
+		}
+	}
+	return append(healthy, unhealthy...)
+}
+
+// weighted returns the providers in the weighted random order, followed by the providers with Weight 0.
+func (s *MultiSender) weighted() []Provider {
+	type keyed struct {
+		Provider
+		key float64
+	}
+	var ks []keyed
+	var backups []Provider
+	for _, p := range s.Providers {
+		if p.Weight <= 0 {
+			backups = append(backups, p)
+			continue
+		}
+		// Efraimidis-Spirakis: sorting by u^(1/w) picks each provider first in proportion to its weight
+		ks = append(ks, keyed{Provider: p, key: math.Pow(s.rand.Float64(), 1/float64(p.Weight))})
+	}
+	sort.SliceStable(ks, func(i, j int) bool {
+		return ks[i].key > ks[j].key
+	})
+	ret := make([]Provider, 0, len(s.Providers))
+	for _, k := range ks {
+		ret = append(ret, k.Provider)
+	}
+	return append(ret, backups...)
+}
+
+func (s *MultiSender) provider(name string) Provider {
+	for _, p := range s.Providers {
+		if p.Name == name {
+			return p
+		}
+	}
+	return Provider{}
+}
+
+func (s *MultiSender) healthy(name string, now time.Time) bool {
+	h := s.health[name]
+	return h == nil || h.failures < s.failureThreshold() || !now.Before(h.until)
+}
+
+func (s *MultiSender) record(name string, err error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	h := s.health[name]
+	if h == nil {
+		return
+	}
+	if err == nil {
+		h.failures = 0
+		return
+	}
+	h.failures++
+	if h.failures >= s.failureThreshold() {
+		cooldown := s.Cooldown
+		if cooldown <= 0 {
+			cooldown = defaultCooldown
+		}
+		h.until = s.now().Add(cooldown)
+	}
+}
+
+func (s *MultiSender) failureThreshold() int {
+	if s.FailureThreshold <= 0 {
+		return defaultFailureThreshold
+	}
+	return s.FailureThreshold
+}
+
+func domainOf(email string) string {
+	return strings.ToLower(email[strings.LastIndex(email, "@")+1:])
+}
+
+// MultiConfig configures MultiSender in the email config file.
+type MultiConfig struct {
+	Providers        []ProviderConfig `yaml:"providers"`
+	Routes           []Route          `yaml:"routes"`
+	FailureThreshold int              `yaml:"failureThreshold"`
+	Cooldown         time.Duration    `yaml:"cooldown"`
+}
+
+// ProviderConfig configures a provider of MultiSender.
+type ProviderConfig struct {
+	Name string `yaml:"name"`
+	// Type is "ses", "smtp" or "file", and the config of the type should be set.
+	Type   string `yaml:"type"`
+	Weight int    `yaml:"weight"`
+	// Region is the AWS region of the "ses" provider. The session's region is used if empty.
+	Region string      `yaml:"region"`
+	SES    *SESConfig  `yaml:"ses"`
+	SMTP   *SMTPConfig `yaml:"smtp"`
+	File   *FileConfig `yaml:"file"`
+}
+
+// NewMultiSenderFromConfig returns a MultiSender with the providers in c.
+// The "ses" providers use sess.
+func NewMultiSenderFromConfig(c MultiConfig, sess client.ConfigProvider) (s Sender, err error) {
+	defer func() {
+		// the senders and NewMultiSender panic on the config errors
+		if r := recover(); r != nil {
+			err = fmt.Errorf("email providers: %v", r)
+		}
+	}()
+
+	var providers []Provider
+	for _, pc := range c.Providers {
+		p := Provider{Name: pc.Name, Weight: pc.Weight}
+		switch {
+		case pc.Type == "ses" && pc.SES != nil:
+			cfg := aws.NewConfig()
+			if pc.Region != "" {
+				cfg = cfg.WithRegion(pc.Region)
+			}
+			p.Sender = NewSESSender(*pc.SES, ses.New(sess, cfg))
+		case pc.Type == "smtp" && pc.SMTP != nil:
+			p.Sender = NewSMTPSender(*pc.SMTP)
+		case pc.Type == "file" && pc.File != nil:
+			p.Sender = NewFileSender(*pc.File)
+		default:
+			return nil, fmt.Errorf("email provider %s: type %q should have its config", pc.Name, pc.Type)
+		}
+		providers = append(providers, p)
+	}
+	ms := NewMultiSender(providers, c.Routes...).(*MultiSender)
+	ms.FailureThreshold = c.FailureThreshold
+	ms.Cooldown = c.Cooldown
+	return ms, nil
+}
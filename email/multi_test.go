@@ -0,0 +1,169 @@
+package email
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// flakySender fails while err is set, and counts the sends.
+type flakySender struct {
+	Token, Challenge string
+	err              error
+	sends            int
+}
+
+func (s *flakySender) SendToken(email, token string) error {
+	s.sends++
+	if s.err != nil {
+		return s.err
+	}
+	s.Token = token
+	return nil
+}
+
+func (s *flakySender) SendChallenge(email, challenge string) error {
+	s.sends++
+	if s.err != nil {
+		return s.err
+	}
+	s.Challenge = challenge
+	return nil
+}
+
+type memLogger struct {
+	m        sync.Mutex
+	attempts []Attempt
+	errors   []error
+}
+
+func (l *memLogger) Attempt(a Attempt) {
+	l.m.Lock()
+	defer l.m.Unlock()
+	l.attempts = append(l.attempts, a)
+}
+
+func (l *memLogger) Error(err error) {
+	l.m.Lock()
+	defer l.m.Unlock()
+	l.errors = append(l.errors, err)
+}
+
+func (l *memLogger) Errors() []error {
+	l.m.Lock()
+	defer l.m.Unlock()
+	return append([]error(nil), l.errors...)
+}
+
+func TestMultiSenderFailover(t *testing.T) {
+	l := &memLogger{}
+	Log = l
+	defer func() { Log = NewLogger() }()
+
+	primary, backup := &flakySender{err: errors.New("throttled")}, &flakySender{}
+	s := NewMultiSender([]Provider{
+		{Name: "primary", Sender: primary, Weight: 1},
+		{Name: "backup", Sender: backup},
+	}).(*MultiSender)
+	now := time.Unix(1600000000, 0)
+	s.now = func() time.Time { return now }
+	s.Cooldown = time.Minute
+
+	for i := 0; i < 3; i++ {
+		if err := s.SendChallenge("test@Example.com", "challenge"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if e, g := 3, primary.sends; e != g {
+		t.Errorf("primary expected %v sends but got %v", e, g)
+	}
+	if e, g := "challenge", backup.Challenge; e != g {
+		t.Errorf("backup expected %v but got %v", e, g)
+	}
+	if e, g := 6, len(l.attempts); e != g {
+		t.Fatalf("expected %v attempts but got %v", e, g)
+	}
+	a := l.attempts[1]
+	if a.Provider != "backup" || a.Number != 2 || a.Err != nil || a.Domain != "example.com" || a.Action != TemplatePut {
+		t.Errorf("unexpected attempt: %+v", a)
+	}
+
+	// primary is unhealthy after 3 failures, and tried last
+	if err := s.SendToken("test@example.com", "token"); err != nil {
+		t.Fatal(err)
+	}
+	if e, g := 3, primary.sends; e != g {
+		t.Errorf("primary expected %v sends but got %v", e, g)
+	}
+	if err := s.Ping(context.Background()); err != nil {
+		t.Errorf("Ping: %v", err)
+	}
+
+	// after the cooldown, primary is tried first again
+	primary.err = nil
+	now = now.Add(time.Minute)
+	if err := s.SendToken("test@example.com", "token2"); err != nil {
+		t.Fatal(err)
+	}
+	if e, g := "token2", primary.Token; e != g {
+		t.Errorf("primary expected %v but got %v", e, g)
+	}
+
+	// all failed
+	primary.err, backup.err = errors.New("down"), errors.New("down")
+	if err := s.SendToken("test@example.com", "token"); !errors.Is(err, backup.err) {
+		t.Errorf("expected the last error but got %v", err)
+	}
+}
+
+func TestMultiSenderRoutes(t *testing.T) {
+	Log = NilLogger()
+	defer func() { Log = NewLogger() }()
+
+	ses1, ses2, smtp := &flakySender{}, &flakySender{}, &flakySender{}
+	s := NewMultiSender([]Provider{
+		{Name: "ses1", Sender: ses1, Weight: 3},
+		{Name: "ses2", Sender: ses2, Weight: 1},
+		{Name: "smtp", Sender: smtp},
+	}, Route{Domains: []string{"example.jp", "*.example.jp"}, Providers: []string{"smtp", "ses2"}})
+
+	for _, dst := range []string{"a@example.jp", "b@mail.example.jp"} {
+		if err := s.SendChallenge(dst, "challenge"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if e, g := 2, smtp.sends; e != g {
+		t.Errorf("smtp expected %v sends but got %v", e, g)
+	}
+
+	for i := 0; i < 400; i++ {
+		if err := s.SendChallenge("test@example.com", "challenge"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if e, g := 2, smtp.sends; e != g {
+		t.Errorf("smtp is a backup and expected %v sends but got %v", e, g)
+	}
+	// 3:1, with a wide margin
+	if ses1.sends < 240 || ses2.sends < 50 {
+		t.Errorf("expected weighted sends but got ses1: %v, ses2: %v", ses1.sends, ses2.sends)
+	}
+}
+
+func TestNewMultiSenderFromConfig(t *testing.T) {
+	_, err := NewMultiSenderFromConfig(MultiConfig{
+		Providers: []ProviderConfig{{Name: "smtp", Type: "smtp"}},
+	}, nil)
+	if err == nil {
+		t.Error("expected an error for the provider without config")
+	}
+	_, err = NewMultiSenderFromConfig(MultiConfig{
+		Providers: []ProviderConfig{{Name: "file", Type: "file", File: &FileConfig{Path: t.TempDir()}}},
+		Routes:    []Route{{Domains: []string{"example.com"}, Providers: []string{"unknown"}}},
+	}, nil)
+	if err == nil {
+		t.Error("expected an error for the unknown provider in route")
+	}
+}
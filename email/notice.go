@@ -0,0 +1,52 @@
+package email
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/mash/vey"
+)
+
+// Notice is the content of the email that notifies the owner of the email address that a key was added or deleted.
+type Notice struct {
+	// Added is true if the key was added, and false if it was deleted.
+	Added          bool   `json:"added"`
+	KeyFingerprint string `json:"keyFingerprint"`
+}
+
+func (n Notice) data(dst string) TemplateData {
+	return TemplateData{
+		Email:          dst,
+		Added:          n.Added,
+		KeyFingerprint: n.KeyFingerprint,
+	}
+}
+
+// NoticeSender sends the notice emails. The senders in this package implement it.
+type NoticeSender interface {
+	SendNoticeContext(ctx context.Context, email string, n Notice) error
+}
+
+// Notifier implements vey.Notifier interface by sending the notice email to the email address of the changed key.
+type Notifier struct {
+	Sender NoticeSender
+}
+
+// NewNotifier returns a Notifier that sends the notice emails with s.
+// If s does not implement NoticeSender, NewNotifier panics.
+func NewNotifier(s Sender) vey.Notifier {
+	ns, ok := s.(NoticeSender)
+	if !ok {
+		panic(fmt.Sprintf("%T does not send the notice emails", s))
+	}
+	return Notifier{
+		Sender: ns,
+	}
+}
+
+func (n Notifier) Notify(ctx context.Context, c vey.KeyChange) error {
+	return n.Sender.SendNoticeContext(ctx, c.Email, Notice{
+		Added:          c.Type == vey.KeyAdded,
+		KeyFingerprint: c.Fingerprint,
+	})
+}
@@ -0,0 +1,258 @@
+package email
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// ErrReceipt is returned by Outbox when the receipt is unknown, or the message has been received again after the visibility timeout.
+var ErrReceipt = errors.New("outbox: unknown or expired receipt")
+
+// defaultVisibility is how long a received message is hidden from other receivers by default.
+const defaultVisibility = 30 * time.Second
+
+// OutboxMessage is an email queued in an Outbox.
+type OutboxMessage struct {
+	ID string `json:"id"`
+	// Action is TemplatePut, TemplateDelete or TemplateNotice.
+	Action string `json:"action"`
+	Email  string `json:"email"`
+	// Token is set for TemplateDelete.
+	Token string `json:"token,omitempty"`
+	// Challenge is set for TemplatePut.
+	Challenge string `json:"challenge,omitempty"`
+	// Languages are the recipient's preferred languages. See WithLanguages.
+	Languages []string `json:"languages,omitempty"`
+	// Link is the link to confirm the put. See WithLink.
+	Link string `json:"link,omitempty"`
+	// Notice is set for TemplateNotice.
+	Notice *Notice `json:"notice,omitempty"`
+	// Trace carries the trace context of the request that queued the message.
+	Trace     map[string]string `json:"trace,omitempty"`
+	CreatedAt time.Time         `json:"createdAt"`
+	// Attempts is the number of failed sends.
+	Attempts  int    `json:"attempts"`
+	LastError string `json:"lastError,omitempty"`
+	// Receipt identifies the received message in Ack, Retry and DeadLetter. It is set by Receive.
+	Receipt string `json:"-"`
+}
+
+// Outbox is a durable queue of emails.
+// A received message is hidden from the other receivers until the visibility timeout,
+// and received again if the receiver does not Ack, Retry or DeadLetter it before that.
+type Outbox interface {
+	// Enqueue stores the message.
+	Enqueue(ctx context.Context, m OutboxMessage) error
+	// Receive returns at most n messages that are ready to be sent, or none if there are no messages.
+	Receive(ctx context.Context, n int) ([]OutboxMessage, error)
+	// Ack deletes the sent message.
+	Ack(ctx context.Context, m OutboxMessage) error
+	// Retry makes the message ready to be received again after delay, with m's Attempts and LastError.
+	Retry(ctx context.Context, m OutboxMessage, delay time.Duration) error
+	// DeadLetter moves the message that failed to be sent out of the queue.
+	DeadLetter(ctx context.Context, m OutboxMessage) error
+}
+
+// OutboxSender implements Sender and ContextSender interface by queuing the emails in Outbox.
+// Run a Worker to send them.
+type OutboxSender struct {
+	Outbox Outbox
+}
+
+func NewOutboxSender(o Outbox) Sender {
+	return OutboxSender{
+		Outbox: o,
+	}
+}
+
+// SendToken queues the token to the email address.
+func (s OutboxSender) SendToken(email, token string) error {
+	return s.SendTokenContext(context.Background(), email, token)
+}
+
+func (s OutboxSender) SendTokenContext(ctx context.Context, email, token string) error {
+	m := newOutboxMessage(ctx, TemplateDelete, email)
+	m.Token = token
+	return s.enqueue(ctx, m)
+}
+
+// SendChallenge queues the challenge to the email address.
+func (s OutboxSender) SendChallenge(email, challenge string) error {
+	return s.SendChallengeContext(context.Background(), email, challenge)
+}
+
+func (s OutboxSender) SendChallengeContext(ctx context.Context, email, challenge string) error {
+	m := newOutboxMessage(ctx, TemplatePut, email)
+	m.Challenge = challenge
+	m.Link = Link(ctx)
+	return s.enqueue(ctx, m)
+}
+
+// SendNoticeContext queues the notice to the email address.
+func (s OutboxSender) SendNoticeContext(ctx context.Context, email string, n Notice) error {
+	m := newOutboxMessage(ctx, TemplateNotice, email)
+	m.Notice = &n
+	return s.enqueue(ctx, m)
+}
+
+func (s OutboxSender) enqueue(ctx context.Context, m OutboxMessage) (err error) {
+	ctx, span := tracer.Start(ctx, "OutboxSender.enqueue",
+		trace.WithSpanKind(trace.SpanKindProducer),
+		trace.WithAttributes(
+			attribute.String("vey.email.action", m.Action),
+			attribute.String("vey.outbox.id", m.ID),
+		),
+	)
+	defer func() { endSpan(span, err) }()
+
+	// the worker continues the trace from this span
+	otel.GetTextMapPropagator().Inject(ctx, propagation.MapCarrier(m.Trace))
+	return s.Outbox.Enqueue(ctx, m)
+}
+
+func newOutboxMessage(ctx context.Context, action, email string) OutboxMessage {
+	return OutboxMessage{
+		ID:        newID(),
+		Action:    action,
+		Email:     email,
+		Languages: Languages(ctx),
+		Trace:     make(map[string]string),
+		CreatedAt: time.Now(),
+	}
+}
+
+func newID() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// MemOutbox implements Outbox interface in memory. Use it for testing,
+// or to retry the sends in a single process where losing the queue on restart is acceptable.
+type MemOutbox struct {
+	// Visibility is how long a received message is hidden from the other receivers. Defaults to 30s.
+	Visibility time.Duration
+
+	m        sync.Mutex
+	messages []memOutboxEntry
+	dead     []OutboxMessage
+}
+
+type memOutboxEntry struct {
+	OutboxMessage
+	visibleAt time.Time
+}
+
+func NewMemOutbox() Outbox {
+	return &MemOutbox{}
+}
+
+func (o *MemOutbox) Enqueue(ctx context.Context, m OutboxMessage) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if m.ID == "" {
+		m.ID = newID()
+	}
+	m.Receipt = ""
+	o.m.Lock()
+	defer o.m.Unlock()
+	o.messages = append(o.messages, memOutboxEntry{OutboxMessage: m, visibleAt: time.Now()})
+	return nil
+}
+
+func (o *MemOutbox) Receive(ctx context.Context, n int) ([]OutboxMessage, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	visibility := o.Visibility
+	if visibility == 0 {
+		visibility = defaultVisibility
+	}
+	o.m.Lock()
+	defer o.m.Unlock()
+	now := time.Now()
+	var ret []OutboxMessage
+	for i := range o.messages {
+		if len(ret) >= n {
+			break
+		}
+		e := &o.messages[i]
+		if e.visibleAt.After(now) {
+			continue
+		}
+		e.visibleAt = now.Add(visibility)
+		e.Receipt = newID()
+		ret = append(ret, e.OutboxMessage)
+	}
+	return ret, nil
+}
+
+func (o *MemOutbox) Ack(ctx context.Context, m OutboxMessage) error {
+	o.m.Lock()
+	defer o.m.Unlock()
+	i, err := o.find(m)
+	if err != nil {
+		return err
+	}
+	o.messages = append(o.messages[:i], o.messages[i+1:]...)
+	return nil
+}
+
+func (o *MemOutbox) Retry(ctx context.Context, m OutboxMessage, delay time.Duration) error {
+	o.m.Lock()
+	defer o.m.Unlock()
+	i, err := o.find(m)
+	if err != nil {
+		return err
+	}
+	m.Receipt = ""
+	o.messages[i] = memOutboxEntry{OutboxMessage: m, visibleAt: time.Now().Add(delay)}
+	return nil
+}
+
+func (o *MemOutbox) DeadLetter(ctx context.Context, m OutboxMessage) error {
+	o.m.Lock()
+	defer o.m.Unlock()
+	i, err := o.find(m)
+	if err != nil {
+		return err
+	}
+	o.messages = append(o.messages[:i], o.messages[i+1:]...)
+	m.Receipt = ""
+	o.dead = append(o.dead, m)
+	return nil
+}
+
+// Len returns the number of the queued messages, including the received ones.
+func (o *MemOutbox) Len() int {
+	o.m.Lock()
+	defer o.m.Unlock()
+	return len(o.messages)
+}
+
+// DeadLetters returns the dead lettered messages.
+func (o *MemOutbox) DeadLetters() []OutboxMessage {
+	o.m.Lock()
+	defer o.m.Unlock()
+	return append([]OutboxMessage{}, o.dead...)
+}
+
+// find returns the index of the message received with m.Receipt. o.m should be locked.
+func (o *MemOutbox) find(m OutboxMessage) (int, error) {
+	for i, e := range o.messages {
+		if e.ID == m.ID && e.Receipt != "" && e.Receipt == m.Receipt {
+			return i, nil
+		}
+	}
+	return 0, ErrReceipt
+}
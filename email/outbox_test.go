@@ -0,0 +1,261 @@
+package email
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mash/vey"
+)
+
+func TestMemOutbox(t *testing.T) {
+	OutboxTest(t, NewMemOutbox())
+}
+
+func TestMemOutboxVisibility(t *testing.T) {
+	o := &MemOutbox{Visibility: 10 * time.Millisecond}
+	ctx := context.Background()
+	if err := o.Enqueue(ctx, OutboxMessage{Action: TemplatePut}); err != nil {
+		t.Fatal(err)
+	}
+	first := testReceive(t, o, 1)
+	testReceive(t, o, 0)
+	time.Sleep(20 * time.Millisecond)
+	// the receiver did not ack in time
+	second := testReceive(t, o, 1)
+	if err := o.Ack(ctx, first[0]); !errors.Is(err, ErrReceipt) {
+		t.Errorf("expected %v but got %v", ErrReceipt, err)
+	}
+	if err := o.Ack(ctx, second[0]); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	b := Backoff{Min: 100 * time.Millisecond, Max: time.Second}
+	for _, tt := range []struct {
+		attempts int
+		max      time.Duration
+	}{
+		{1, 100 * time.Millisecond},
+		{2, 200 * time.Millisecond},
+		{3, 400 * time.Millisecond},
+		{4, 800 * time.Millisecond},
+		{5, time.Second},
+		{50, time.Second},
+	} {
+		d := b.Delay(tt.attempts)
+		if d < tt.max/2 || d > tt.max {
+			t.Errorf("attempts %d: expected between %v and %v but got %v", tt.attempts, tt.max/2, tt.max, d)
+		}
+	}
+}
+
+// failingSender fails the first failures sends of each email.
+type failingSender struct {
+	failures int
+
+	m     sync.Mutex
+	sends map[string]int
+	sent  []string
+}
+
+func (s *failingSender) SendToken(email, token string) error {
+	return s.send(email)
+}
+
+func (s *failingSender) SendChallenge(email, challenge string) error {
+	return s.send(email)
+}
+
+func (s *failingSender) send(email string) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if s.sends == nil {
+		s.sends = make(map[string]int)
+	}
+	s.sends[email]++
+	if s.sends[email] <= s.failures {
+		return errors.New("temporary failure")
+	}
+	s.sent = append(s.sent, email)
+	return nil
+}
+
+func (s *failingSender) Sent() []string {
+	s.m.Lock()
+	defer s.m.Unlock()
+	return append([]string{}, s.sent...)
+}
+
+func runWorker(t *testing.T, w *Worker, until func() bool) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- w.Run(ctx)
+	}()
+	deadline := time.Now().Add(5 * time.Second)
+	for !until() {
+		if time.Now().After(deadline) {
+			t.Error("timed out")
+			break
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	cancel()
+	if err := <-done; err != nil {
+		t.Error(err)
+	}
+}
+
+func TestWorkerRetry(t *testing.T) {
+	o := NewMemOutbox().(*MemOutbox)
+	s := NewOutboxSender(o)
+	for _, email := range []string{"a@example.com", "b@example.com", "c@example.com"} {
+		ctx := WithLanguages(context.Background(), "ja")
+		if err := SenderWithContext(s).SendChallengeContext(ctx, email, "challenge"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if e, g := 3, o.Len(); e != g {
+		t.Fatalf("expected %v but got %v", e, g)
+	}
+
+	sender := &failingSender{failures: 2}
+	w := NewWorker(o, sender)
+	w.Concurrency = 2
+	w.Backoff = Backoff{Min: time.Millisecond, Max: 5 * time.Millisecond}
+	w.PollInterval = time.Millisecond
+	runWorker(t, w, func() bool { return len(sender.Sent()) == 3 })
+
+	if e, g := 0, o.Len(); e != g {
+		t.Errorf("expected %v but got %v", e, g)
+	}
+	for email, n := range sender.sends {
+		if e, g := 3, n; e != g {
+			t.Errorf("%s expected %v sends but got %v", email, e, g)
+		}
+	}
+	if e, g := 0, len(o.DeadLetters()); e != g {
+		t.Errorf("expected %v dead letters but got %v", e, g)
+	}
+}
+
+func TestWorkerDeadLetter(t *testing.T) {
+	l := &memLogger{}
+	Log = l
+	defer func() { Log = NewLogger() }()
+
+	o := NewMemOutbox().(*MemOutbox)
+	if err := NewOutboxSender(o).SendToken("test@example.com", "token"); err != nil {
+		t.Fatal(err)
+	}
+
+	sender := &failingSender{failures: 10}
+	w := NewWorker(o, sender)
+	w.MaxAttempts = 3
+	w.Backoff = Backoff{Min: time.Millisecond, Max: time.Millisecond}
+	w.PollInterval = time.Millisecond
+	runWorker(t, w, func() bool { return len(o.DeadLetters()) == 1 })
+
+	dead := o.DeadLetters()[0]
+	if e, g := 3, dead.Attempts; e != g {
+		t.Errorf("expected %v attempts but got %v", e, g)
+	}
+	if e, g := "temporary failure", dead.LastError; e != g {
+		t.Errorf("expected %v but got %v", e, g)
+	}
+	if e, g := "token", dead.Token; e != g {
+		t.Errorf("expected %v but got %v", e, g)
+	}
+	if e, g := 0, o.Len(); e != g {
+		t.Errorf("expected %v but got %v", e, g)
+	}
+	// the failed sends and the dead letter are logged with Log
+	errs := l.Errors()
+	if len(errs) == 0 || !strings.Contains(errs[len(errs)-1].Error(), "dead lettering") {
+		t.Errorf("expected the dead letter logged but got %v", errs)
+	}
+}
+
+func TestWorkerProcess(t *testing.T) {
+	o := NewMemOutbox().(*MemOutbox)
+	ctx := WithLink(WithLanguages(context.Background(), "pt-BR"), "https://vey.example.com/open?c=challenge")
+	if err := SenderWithContext(NewOutboxSender(o)).SendChallengeContext(ctx, "test@example.com", "challenge"); err != nil {
+		t.Fatal(err)
+	}
+	ms := testReceive(t, o, 1)
+
+	sender := NewMemSender().(*MemSender)
+	if err := NewWorker(o, sender).Process(context.Background(), ms[0]); err != nil {
+		t.Fatal(err)
+	}
+	if e, g := "challenge", sender.Challenge; e != g {
+		t.Errorf("expected %v but got %v", e, g)
+	}
+	if e, g := "pt-BR", sender.Languages[0]; e != g {
+		t.Errorf("expected %v but got %v", e, g)
+	}
+	if e, g := "https://vey.example.com/open?c=challenge", sender.Link; e != g {
+		t.Errorf("expected %v but got %v", e, g)
+	}
+
+	// an expired message is dropped without sending
+	m := OutboxMessage{Action: TemplateDelete, Email: "old@example.com", Token: "token", CreatedAt: time.Now().Add(-time.Hour)}
+	if err := o.Enqueue(context.Background(), m); err != nil {
+		t.Fatal(err)
+	}
+	ms = testReceive(t, o, 1)
+	w := NewWorker(o, sender)
+	w.MaxAge = 15 * time.Minute
+	if err := w.Process(context.Background(), ms[0]); err != nil {
+		t.Fatal(err)
+	}
+	if e, g := "test@example.com", sender.Email; e != g {
+		t.Errorf("expected %v but got %v", e, g)
+	}
+	if e, g := 0, o.Len(); e != g {
+		t.Errorf("expected %v but got %v", e, g)
+	}
+}
+
+func TestParseSQSMessage(t *testing.T) {
+	m, err := ParseSQSMessage(`{"id":"1","action":"put","email":"test@example.com","challenge":"c","attempts":0}`, "receipt", "3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e, g := 2, m.Attempts; e != g {
+		t.Errorf("expected %v but got %v", e, g)
+	}
+	if e, g := "receipt", m.Receipt; e != g {
+		t.Errorf("expected %v but got %v", e, g)
+	}
+}
+
+func TestNotifierOutbox(t *testing.T) {
+	o := NewMemOutbox().(*MemOutbox)
+	n := NewNotifier(NewOutboxSender(o))
+	ctx := WithLanguages(context.Background(), "ja")
+	if err := n.Notify(ctx, vey.KeyChange{Type: vey.KeyDeleted, Email: "test@example.com", Fingerprint: "SHA256:fp"}); err != nil {
+		t.Fatal(err)
+	}
+	ms := testReceive(t, o, 1)
+
+	sender := NewMemSender().(*MemSender)
+	if err := NewWorker(o, sender).Process(context.Background(), ms[0]); err != nil {
+		t.Fatal(err)
+	}
+	if e, g := (Notice{Added: false, KeyFingerprint: "SHA256:fp"}), sender.Notice; e != g {
+		t.Errorf("expected %v but got %v", e, g)
+	}
+	if e, g := "test@example.com", sender.Email; e != g {
+		t.Errorf("expected %v but got %v", e, g)
+	}
+	if e, g := "ja", sender.Languages[0]; e != g {
+		t.Errorf("expected %v but got %v", e, g)
+	}
+}
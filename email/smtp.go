@@ -0,0 +1,368 @@
+package email
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	// SMTPStartTLS upgrades the plain connection with STARTTLS. The server must support it.
+	SMTPStartTLS = "starttls"
+	// SMTPImplicitTLS connects with TLS from the start, usually to port 465.
+	SMTPImplicitTLS = "tls"
+	// SMTPNoTLS does not encrypt the connection. Use only for local relays.
+	SMTPNoTLS = "none"
+)
+
+const (
+	SMTPAuthPlain   = "plain"
+	SMTPAuthLogin   = "login"
+	SMTPAuthCRAMMD5 = "cram-md5"
+)
+
+// smtpTimeout bounds a single send if the context has no deadline.
+const smtpTimeout = 30 * time.Second
+
+// SMTPConfig configures SMTPSender.
+type SMTPConfig struct {
+	Host string `yaml:"host"`
+	// Port defaults to 587 for "starttls", 465 for "tls" and 25 for "none".
+	Port int `yaml:"port"`
+	// TLS is "starttls", "tls" or "none". Defaults to "starttls".
+	TLS string `yaml:"tls"`
+	// Auth is "plain", "login", "cram-md5", or empty for no authentication.
+	// "plain" and "login" are refused over unencrypted connections except to localhost.
+	Auth     string `yaml:"auth"`
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+	// LocalName is sent in EHLO. Defaults to "localhost".
+	LocalName string `yaml:"localName"`
+	// From is the From header and the envelope sender.
+	From             string   `yaml:"from"`
+	ReplyToAddresses []string `yaml:"replyToAddresses"`
+	// TemplateDir is the directory of the email templates. See LoadTemplates for the files.
+	// The templates embedded in the package are used if empty.
+	TemplateDir string `yaml:"templateDir"`
+	// DKIM signs the messages if set.
+	DKIM *DKIMConfig `yaml:"dkim"`
+}
+
+// SMTPSender implements Sender and ContextSender interface by sending multipart text and HTML emails via SMTP.
+// SMTPSender reuses the connection across sends. Call Close to quit the connection.
+type SMTPSender struct {
+	Config SMTPConfig
+	// TLSConfig is used for STARTTLS and implicit TLS. ServerName defaults to Config.Host.
+	TLSConfig *tls.Config
+	// Templates renders the emails. DefaultTemplates is used if nil.
+	Templates *Templates
+	// DKIM signs the messages if not nil.
+	DKIM *DKIMSigner
+
+	m      sync.Mutex
+	conn   net.Conn
+	client *smtp.Client
+}
+
+// NewSMTPSender returns a SMTPSender which sends email via SMTP.
+// If the templates in c.TemplateDir or the DKIM config have an error, NewSMTPSender panics.
+func NewSMTPSender(c SMTPConfig) Sender {
+	s := &SMTPSender{
+		Config:    c,
+		Templates: mustTemplates(c.TemplateDir),
+	}
+	if c.DKIM != nil {
+		d, err := NewDKIMSigner(*c.DKIM)
+		if err != nil {
+			panic(err)
+		}
+		s.DKIM = d
+	}
+	return s
+}
+
+// SendToken sends the token to the dst email address.
+func (s *SMTPSender) SendToken(dst, token string) error {
+	return s.SendTokenContext(context.Background(), dst, token)
+}
+
+func (s *SMTPSender) SendTokenContext(ctx context.Context, dst, token string) error {
+	data := TemplateData{
+		Email:        dst,
+		Token:        token,
+		TokenEscaped: url.QueryEscape(token),
+	}
+	return s.send(ctx, dst, TemplateDelete, data)
+}
+
+// SendChallenge sends the challenge to the dst email address.
+func (s *SMTPSender) SendChallenge(dst, challenge string) error {
+	return s.SendChallengeContext(context.Background(), dst, challenge)
+}
+
+func (s *SMTPSender) SendChallengeContext(ctx context.Context, dst, challenge string) error {
+	data := TemplateData{
+		Email:            dst,
+		Challenge:        challenge,
+		ChallengeEscaped: url.QueryEscape(challenge),
+		Link:             Link(ctx),
+	}
+	return s.send(ctx, dst, TemplatePut, data)
+}
+
+// SendNoticeContext sends the notice to the dst email address.
+func (s *SMTPSender) SendNoticeContext(ctx context.Context, dst string, n Notice) error {
+	return s.send(ctx, dst, TemplateNotice, n.data(dst))
+}
+
+// Close quits the reused connection if any.
+func (s *SMTPSender) Close() error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if s.client == nil {
+		return nil
+	}
+	err := s.client.Quit()
+	s.drop()
+	return err
+}
+
+func (s *SMTPSender) send(ctx context.Context, dst, action string, data TemplateData) (err error) {
+	ctx, span := tracer.Start(ctx, "SMTPSender.send",
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("net.peer.name", s.Config.Host),
+			attribute.String("vey.email.action", action),
+		),
+	)
+	defer func() { endSpan(span, err) }()
+
+	ts := s.Templates
+	if ts == nil {
+		ts = DefaultTemplates()
+	}
+	m, err := ts.RenderContext(ctx, action, data)
+	if err != nil {
+		return err
+	}
+	m.From = s.Config.From
+	m.To = dst
+	m.ReplyTo = s.Config.ReplyToAddresses
+	b, err := m.Bytes()
+	if err != nil {
+		return err
+	}
+	if s.DKIM != nil {
+		if b, err = s.DKIM.Sign(b); err != nil {
+			return err
+		}
+	}
+
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	c, err := s.connect(ctx)
+	if err != nil {
+		return err
+	}
+	if err := s.transaction(c, dst, b); err != nil {
+		// The connection state is unknown after a failure.
+		s.drop()
+		return err
+	}
+	return nil
+}
+
+func (s *SMTPSender) transaction(c *smtp.Client, dst string, msg []byte) error {
+	// the envelope sender is the address without the display name
+	from, err := mail.ParseAddress(s.Config.From)
+	if err != nil {
+		return fmt.Errorf("invalid from address: %w", err)
+	}
+	if err := c.Mail(from.Address); err != nil {
+		return fmt.Errorf("MAIL: %w", err)
+	}
+	if err := c.Rcpt(dst); err != nil {
+		return fmt.Errorf("RCPT: %w", err)
+	}
+	w, err := c.Data()
+	if err != nil {
+		return fmt.Errorf("DATA: %w", err)
+	}
+	if _, err := w.Write(msg); err != nil {
+		return fmt.Errorf("DATA: %w", err)
+	}
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("DATA: %w", err)
+	}
+	return nil
+}
+
+// connect returns the reused client if it's still alive, or dials a new one.
+// s.m should be locked.
+func (s *SMTPSender) connect(ctx context.Context) (*smtp.Client, error) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(smtpTimeout)
+	}
+
+	if s.client != nil {
+		_ = s.conn.SetDeadline(deadline)
+		if err := s.client.Reset(); err == nil {
+			return s.client, nil
+		}
+		// the server has closed the idle connection
+		s.drop()
+	}
+
+	c, conn, err := s.dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	_ = conn.SetDeadline(deadline)
+	if err := s.handshake(c); err != nil {
+		c.Close()
+		return nil, err
+	}
+	s.client, s.conn = c, conn
+	return c, nil
+}
+
+func (s *SMTPSender) dial(ctx context.Context) (*smtp.Client, net.Conn, error) {
+	addr := net.JoinHostPort(s.Config.Host, strconv.Itoa(s.port()))
+	d := &net.Dialer{Timeout: smtpTimeout}
+
+	var (
+		conn net.Conn
+		err  error
+	)
+	if s.Config.TLS == SMTPImplicitTLS {
+		conn, err = (&tls.Dialer{NetDialer: d, Config: s.tlsConfig()}).DialContext(ctx, "tcp", addr)
+	} else {
+		conn, err = d.DialContext(ctx, "tcp", addr)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	c, err := smtp.NewClient(conn, s.Config.Host)
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	return c, conn, nil
+}
+
+func (s *SMTPSender) handshake(c *smtp.Client) error {
+	localName := s.Config.LocalName
+	if localName == "" {
+		localName = "localhost"
+	}
+	if err := c.Hello(localName); err != nil {
+		return fmt.Errorf("EHLO: %w", err)
+	}
+	if s.Config.TLS == "" || s.Config.TLS == SMTPStartTLS {
+		if ok, _ := c.Extension("STARTTLS"); !ok {
+			return errors.New("smtp: server does not support STARTTLS")
+		}
+		if err := c.StartTLS(s.tlsConfig()); err != nil {
+			return fmt.Errorf("STARTTLS: %w", err)
+		}
+	}
+
+	var a smtp.Auth
+	switch strings.ToLower(s.Config.Auth) {
+	case "":
+		return nil
+	case SMTPAuthPlain:
+		a = smtp.PlainAuth("", s.Config.Username, s.Config.Password, s.Config.Host)
+	case SMTPAuthLogin:
+		a = loginAuth{username: s.Config.Username, password: s.Config.Password, host: s.Config.Host}
+	case SMTPAuthCRAMMD5:
+		a = smtp.CRAMMD5Auth(s.Config.Username, s.Config.Password)
+	default:
+		return fmt.Errorf("smtp: unknown auth: %s", s.Config.Auth)
+	}
+	if err := c.Auth(a); err != nil {
+		return fmt.Errorf("AUTH: %w", err)
+	}
+	return nil
+}
+
+// drop closes the connection without QUIT. s.m should be locked.
+func (s *SMTPSender) drop() {
+	if s.client != nil {
+		s.client.Close()
+	}
+	s.client, s.conn = nil, nil
+}
+
+func (s *SMTPSender) port() int {
+	if s.Config.Port != 0 {
+		return s.Config.Port
+	}
+	switch s.Config.TLS {
+	case SMTPImplicitTLS:
+		return 465
+	case SMTPNoTLS:
+		return 25
+	default:
+		return 587
+	}
+}
+
+func (s *SMTPSender) tlsConfig() *tls.Config {
+	if s.TLSConfig == nil {
+		return &tls.Config{ServerName: s.Config.Host}
+	}
+	c := s.TLSConfig.Clone()
+	if c.ServerName == "" {
+		c.ServerName = s.Config.Host
+	}
+	return c
+}
+
+// loginAuth implements the LOGIN authentication mechanism, which net/smtp does not provide.
+type loginAuth struct {
+	username, password, host string
+}
+
+func (a loginAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	// Same as smtp.PlainAuth, LOGIN sends the password in clear text.
+	if !server.TLS && !isLocalhost(server.Name) {
+		return "", nil, errors.New("unencrypted connection")
+	}
+	if server.Name != a.host {
+		return "", nil, errors.New("wrong host name")
+	}
+	return "LOGIN", nil, nil
+}
+
+func (a loginAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if !more {
+		return nil, nil
+	}
+	switch strings.ToLower(strings.TrimSpace(string(fromServer))) {
+	case "username:":
+		return []byte(a.username), nil
+	case "password:":
+		return []byte(a.password), nil
+	default:
+		return nil, fmt.Errorf("unexpected server challenge: %s", fromServer)
+	}
+}
+
+func isLocalhost(name string) bool {
+	return name == "localhost" || name == "127.0.0.1" || name == "::1"
+}
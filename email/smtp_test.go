@@ -0,0 +1,447 @@
+package email
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"math/big"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// capturedMessage is a message received by smtpServer.
+type capturedMessage struct {
+	From string
+	To   []string
+	Data []byte
+}
+
+// smtpServer is a minimal in-process SMTP server that captures messages.
+// It supports EHLO, STARTTLS, AUTH PLAIN/LOGIN/CRAM-MD5, MAIL, RCPT, DATA, RSET, NOOP and QUIT.
+type smtpServer struct {
+	l net.Listener
+	// tls enables STARTTLS if implicit is false, otherwise the listener is TLS from the start.
+	tls      *tls.Config
+	implicit bool
+	username string
+	password string
+
+	m           sync.Mutex
+	messages    []capturedMessage
+	connections int
+}
+
+func newSMTPServer(t *testing.T, tlsConfig *tls.Config, implicit bool) *smtpServer {
+	l, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if implicit {
+		l = tls.NewListener(l, tlsConfig)
+	}
+	s := &smtpServer{
+		l:        l,
+		tls:      tlsConfig,
+		implicit: implicit,
+		username: "user",
+		password: "pass",
+	}
+	t.Cleanup(func() {
+		l.Close()
+	})
+	go s.serve()
+	return s
+}
+
+func (s *smtpServer) port() int {
+	return s.l.Addr().(*net.TCPAddr).Port
+}
+
+func (s *smtpServer) captured() []capturedMessage {
+	s.m.Lock()
+	defer s.m.Unlock()
+	return append([]capturedMessage{}, s.messages...)
+}
+
+func (s *smtpServer) serve() {
+	for {
+		conn, err := s.l.Accept()
+		if err != nil {
+			return
+		}
+		s.m.Lock()
+		s.connections++
+		s.m.Unlock()
+		go s.session(conn)
+	}
+}
+
+func (s *smtpServer) session(conn net.Conn) {
+	defer conn.Close()
+	r, w := bufio.NewReader(conn), bufio.NewWriter(conn)
+	reply := func(format string, args ...interface{}) {
+		fmt.Fprintf(w, format+"\r\n", args...)
+		w.Flush()
+	}
+	readLine := func() (string, error) {
+		line, err := r.ReadString('\n')
+		return strings.TrimRight(line, "\r\n"), err
+	}
+
+	tlsActive := s.implicit
+	authed := false
+	var msg capturedMessage
+
+	reply("220 localhost ESMTP test")
+	for {
+		line, err := readLine()
+		if err != nil {
+			return
+		}
+		verb, arg := line, ""
+		if i := strings.Index(line, " "); i >= 0 {
+			verb, arg = line[:i], line[i+1:]
+		}
+		switch strings.ToUpper(verb) {
+		case "EHLO", "HELO":
+			lines := []string{"localhost"}
+			if s.tls != nil && !tlsActive {
+				lines = append(lines, "STARTTLS")
+			}
+			lines = append(lines, "AUTH PLAIN LOGIN CRAM-MD5")
+			for i, l := range lines {
+				sep := "-"
+				if i == len(lines)-1 {
+					sep = " "
+				}
+				fmt.Fprintf(w, "250%s%s\r\n", sep, l)
+			}
+			w.Flush()
+		case "STARTTLS":
+			reply("220 go ahead")
+			tc := tls.Server(conn, s.tls)
+			if err := tc.Handshake(); err != nil {
+				return
+			}
+			conn = tc
+			r, w = bufio.NewReader(conn), bufio.NewWriter(conn)
+			tlsActive = true
+		case "AUTH":
+			authed = s.auth(arg, reply, readLine)
+			if authed {
+				reply("235 authenticated")
+			} else {
+				reply("535 authentication failed")
+			}
+		case "MAIL":
+			if s.username != "" && !authed {
+				reply("530 authentication required")
+				continue
+			}
+			msg = capturedMessage{From: strings.Trim(strings.TrimPrefix(arg, "FROM:"), "<>")}
+			reply("250 ok")
+		case "RCPT":
+			msg.To = append(msg.To, strings.Trim(strings.TrimPrefix(arg, "TO:"), "<>"))
+			reply("250 ok")
+		case "DATA":
+			reply("354 go ahead")
+			var data bytes.Buffer
+			for {
+				l, err := readLine()
+				if err != nil {
+					return
+				}
+				if l == "." {
+					break
+				}
+				data.WriteString(strings.TrimPrefix(l, "."))
+				data.WriteString("\r\n")
+			}
+			msg.Data = data.Bytes()
+			s.m.Lock()
+			s.messages = append(s.messages, msg)
+			s.m.Unlock()
+			reply("250 queued")
+		case "RSET":
+			msg = capturedMessage{}
+			reply("250 ok")
+		case "NOOP":
+			reply("250 ok")
+		case "QUIT":
+			reply("221 bye")
+			return
+		default:
+			reply("502 unknown command")
+		}
+	}
+}
+
+func (s *smtpServer) auth(arg string, reply func(string, ...interface{}), readLine func() (string, error)) bool {
+	fields := strings.Fields(arg)
+	if len(fields) == 0 {
+		return false
+	}
+	decode := func(s string) string {
+		b, _ := base64.StdEncoding.DecodeString(s)
+		return string(b)
+	}
+	switch strings.ToUpper(fields[0]) {
+	case "PLAIN":
+		var resp string
+		if len(fields) > 1 {
+			resp = fields[1]
+		} else {
+			reply("334 ")
+			resp, _ = readLine()
+		}
+		parts := strings.Split(decode(resp), "\x00")
+		return len(parts) == 3 && parts[1] == s.username && parts[2] == s.password
+	case "LOGIN":
+		reply("334 %s", base64.StdEncoding.EncodeToString([]byte("Username:")))
+		u, _ := readLine()
+		reply("334 %s", base64.StdEncoding.EncodeToString([]byte("Password:")))
+		p, _ := readLine()
+		return decode(u) == s.username && decode(p) == s.password
+	case "CRAM-MD5":
+		challenge := fmt.Sprintf("<%d@localhost>", time.Now().UnixNano())
+		reply("334 %s", base64.StdEncoding.EncodeToString([]byte(challenge)))
+		resp, _ := readLine()
+		d := hmac.New(md5.New, []byte(s.password))
+		d.Write([]byte(challenge))
+		return decode(resp) == s.username+" "+hex.EncodeToString(d.Sum(nil))
+	default:
+		return false
+	}
+}
+
+// testTLS returns the server and client TLS configs with a self signed certificate for 127.0.0.1.
+func testTLS(t *testing.T) (*tls.Config, *tls.Config) {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &priv.PublicKey, priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	server := &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: priv}},
+	}
+	client := &tls.Config{RootCAs: pool}
+	return server, client
+}
+
+// parseMessage returns the headers and the decoded parts keyed by media type.
+func parseMessage(t *testing.T, data []byte) (mail.Header, map[string]string) {
+	m, err := mail.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mediaType, params, err := mime.ParseMediaType(m.Header.Get("Content-Type"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e, g := "multipart/alternative", mediaType; e != g {
+		t.Fatalf("Content-Type expected %v but got %v", e, g)
+	}
+	parts := map[string]string{}
+	mr := multipart.NewReader(m.Body, params["boundary"])
+	for {
+		p, err := mr.NextRawPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		mt, _, _ := mime.ParseMediaType(p.Header.Get("Content-Type"))
+		b, err := io.ReadAll(quotedprintable.NewReader(p))
+		if err != nil {
+			t.Fatal(err)
+		}
+		parts[mt] = string(b)
+	}
+	return m.Header, parts
+}
+
+func TestSMTPSenderStartTLS(t *testing.T) {
+	serverTLS, clientTLS := testTLS(t)
+	srv := newSMTPServer(t, serverTLS, false)
+
+	for _, auth := range []string{SMTPAuthPlain, SMTPAuthLogin, SMTPAuthCRAMMD5} {
+		t.Run(auth, func(t *testing.T) {
+			s := &SMTPSender{
+				Config: SMTPConfig{
+					Host:     "127.0.0.1",
+					Port:     srv.port(),
+					TLS:      SMTPStartTLS,
+					Auth:     auth,
+					Username: "user",
+					Password: "pass",
+					From:     "Vey <vey@example.com>",
+				},
+				TLSConfig: clientTLS,
+			}
+			defer s.Close()
+			before := len(srv.captured())
+			if err := s.SendChallenge("test@example.com", "Y2hhbGxlbmdl"); err != nil {
+				t.Fatalf("SendChallenge: %v", err)
+			}
+			if err := s.SendToken("test@example.com", "dG9rZW4="); err != nil {
+				t.Fatalf("SendToken: %v", err)
+			}
+			if e, g := before+2, len(srv.captured()); e != g {
+				t.Fatalf("expected %v messages but got %v", e, g)
+			}
+		})
+	}
+}
+
+func TestSMTPSenderMessage(t *testing.T) {
+	serverTLS, clientTLS := testTLS(t)
+	srv := newSMTPServer(t, serverTLS, true)
+
+	s := &SMTPSender{
+		Config: SMTPConfig{
+			Host:             "127.0.0.1",
+			Port:             srv.port(),
+			TLS:              SMTPImplicitTLS,
+			Auth:             SMTPAuthLogin,
+			Username:         "user",
+			Password:         "pass",
+			From:             "Vey <vey@example.com>",
+			ReplyToAddresses: []string{"support@example.com"},
+		},
+		TLSConfig: clientTLS,
+	}
+	defer s.Close()
+
+	if err := s.SendChallenge("test@example.com", "Y2hhbGxlbmdl+/="); err != nil {
+		t.Fatalf("SendChallenge: %v", err)
+	}
+	if err := s.SendToken("test@example.com", "dG9rZW4="); err != nil {
+		t.Fatalf("SendToken: %v", err)
+	}
+
+	msgs := srv.captured()
+	if e, g := 2, len(msgs); e != g {
+		t.Fatalf("expected %v messages but got %v", e, g)
+	}
+	// the connection is reused
+	srv.m.Lock()
+	connections := srv.connections
+	srv.m.Unlock()
+	if e, g := 1, connections; e != g {
+		t.Errorf("expected %v connection but got %v", e, g)
+	}
+	if e, g := "vey@example.com", msgs[0].From; e != g {
+		t.Errorf("envelope from expected %v but got %v", e, g)
+	}
+	if e, g := "test@example.com", msgs[0].To[0]; e != g {
+		t.Errorf("envelope to expected %v but got %v", e, g)
+	}
+
+	h, parts := parseMessage(t, msgs[0].Data)
+	if e, g := "test@example.com", h.Get("To"); e != g {
+		t.Errorf("To expected %v but got %v", e, g)
+	}
+	if e, g := "support@example.com", h.Get("Reply-To"); e != g {
+		t.Errorf("Reply-To expected %v but got %v", e, g)
+	}
+	if !strings.Contains(parts["text/plain"], "Y2hhbGxlbmdl+/=") {
+		t.Errorf("text part should include the challenge but got %v", parts["text/plain"])
+	}
+	if !strings.Contains(parts["text/html"], "<pre>Y2hhbGxlbmdl&#43;/=</pre>") {
+		t.Errorf("html part should include the escaped challenge but got %v", parts["text/html"])
+	}
+
+	_, parts = parseMessage(t, msgs[1].Data)
+	if !strings.Contains(parts["text/plain"], "dG9rZW4=") {
+		t.Errorf("text part should include the token but got %v", parts["text/plain"])
+	}
+}
+
+func TestSMTPSenderAuthFailure(t *testing.T) {
+	serverTLS, clientTLS := testTLS(t)
+	srv := newSMTPServer(t, serverTLS, false)
+
+	s := &SMTPSender{
+		Config: SMTPConfig{
+			Host:     "127.0.0.1",
+			Port:     srv.port(),
+			Auth:     SMTPAuthPlain,
+			Username: "user",
+			Password: "wrong",
+			From:     "vey@example.com",
+		},
+		TLSConfig: clientTLS,
+	}
+	defer s.Close()
+	if err := s.SendToken("test@example.com", "dG9rZW4="); err == nil {
+		t.Fatal("SendToken: expected an authentication error but got nil")
+	}
+	if e, g := 0, len(srv.captured()); e != g {
+		t.Fatalf("expected %v messages but got %v", e, g)
+	}
+}
+
+func TestSMTPSenderReconnect(t *testing.T) {
+	serverTLS, clientTLS := testTLS(t)
+	srv := newSMTPServer(t, serverTLS, false)
+
+	s := &SMTPSender{
+		Config: SMTPConfig{
+			Host:     "127.0.0.1",
+			Port:     srv.port(),
+			Auth:     SMTPAuthPlain,
+			Username: "user",
+			Password: "pass",
+			From:     "vey@example.com",
+		},
+		TLSConfig: clientTLS,
+	}
+	defer s.Close()
+	if err := s.SendToken("test@example.com", "dG9rZW4="); err != nil {
+		t.Fatal(err)
+	}
+	// the server closes the idle connection
+	s.m.Lock()
+	s.conn.Close()
+	s.m.Unlock()
+
+	if err := s.SendToken("test@example.com", "dG9rZW4="); err != nil {
+		t.Fatalf("SendToken after the connection was closed: %v", err)
+	}
+	if e, g := 2, len(srv.captured()); e != g {
+		t.Fatalf("expected %v messages but got %v", e, g)
+	}
+}
@@ -0,0 +1,301 @@
+package email
+
+import (
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	SNSNotification             = "Notification"
+	SNSSubscriptionConfirmation = "SubscriptionConfirmation"
+	SNSUnsubscribeConfirmation  = "UnsubscribeConfirmation"
+)
+
+// defaultSNSMaxAge is longer than the retries of the SNS HTTP/S deliveries.
+const defaultSNSMaxAge = time.Hour
+
+// ErrNoSNSTopics indicates that SNSConfig has no TopicARNs. Anyone can publish signed messages to their own topics.
+var ErrNoSNSTopics = errors.New("sns: topic ARNs are required")
+
+// snsHost matches the hosts of SigningCertURL and SubscribeURL.
+var snsHost = regexp.MustCompile(`^sns\.[a-z0-9-]+\.amazonaws\.com(\.cn)?$`)
+
+// SNSMessage is the message that Amazon SNS posts to HTTP/S endpoints.
+type SNSMessage struct {
+	Type             string `json:"Type"`
+	MessageId        string `json:"MessageId"`
+	Token            string `json:"Token,omitempty"`
+	TopicArn         string `json:"TopicArn"`
+	Subject          string `json:"Subject,omitempty"`
+	Message          string `json:"Message"`
+	Timestamp        string `json:"Timestamp"`
+	SignatureVersion string `json:"SignatureVersion"`
+	Signature        string `json:"Signature"`
+	SigningCertURL   string `json:"SigningCertURL"`
+	SubscribeURL     string `json:"SubscribeURL,omitempty"`
+	UnsubscribeURL   string `json:"UnsubscribeURL,omitempty"`
+}
+
+// StringToSign returns the string that SNS signs for the message type.
+func (m SNSMessage) StringToSign() (string, error) {
+	var fields [][2]string
+	switch m.Type {
+	case SNSNotification:
+		fields = [][2]string{{"Message", m.Message}, {"MessageId", m.MessageId}}
+		if m.Subject != "" {
+			fields = append(fields, [2]string{"Subject", m.Subject})
+		}
+		fields = append(fields, [][2]string{{"Timestamp", m.Timestamp}, {"TopicArn", m.TopicArn}, {"Type", m.Type}}...)
+	case SNSSubscriptionConfirmation, SNSUnsubscribeConfirmation:
+		fields = [][2]string{
+			{"Message", m.Message},
+			{"MessageId", m.MessageId},
+			{"SubscribeURL", m.SubscribeURL},
+			{"Timestamp", m.Timestamp},
+			{"Token", m.Token},
+			{"TopicArn", m.TopicArn},
+			{"Type", m.Type},
+		}
+	default:
+		return "", fmt.Errorf("sns: unknown message type: %s", m.Type)
+	}
+	var b strings.Builder
+	for _, f := range fields {
+		b.WriteString(f[0] + "\n" + f[1] + "\n")
+	}
+	return b.String(), nil
+}
+
+// SNSConfig configures SNSVerifier.
+type SNSConfig struct {
+	// TopicARNs are the topics to accept the messages from, and to confirm the subscriptions to. Required.
+	TopicARNs []string `yaml:"topicArns"`
+	// MaxAge is how old the messages can be, so that the old signed messages cannot be replayed. Defaults to 1h.
+	MaxAge time.Duration `yaml:"maxAge"`
+	// CertFile is the PEM encoded certificate to verify the signatures with,
+	// instead of the certificate downloaded from SigningCertURL. Use it for testing.
+	CertFile string `yaml:"certFile"`
+}
+
+// SNSVerifier verifies the signatures of SNS messages.
+// The signing certificates are downloaded from the SigningCertURL on the SNS hosts and cached.
+type SNSVerifier struct {
+	// TopicARNs are the topics to accept. Verify refuses all the messages if empty.
+	TopicARNs []string
+	// MaxAge refuses the messages with the Timestamp older than this, or this far in the future. Defaults to 1h.
+	MaxAge time.Duration
+	// Certificate verifies the signatures instead of the certificate at SigningCertURL if set.
+	Certificate *x509.Certificate
+	// Client downloads the certificates and confirms the subscriptions.
+	Client *http.Client
+
+	m     sync.Mutex
+	certs map[string]*x509.Certificate
+}
+
+// NewSNSVerifier returns a SNSVerifier, with the certificate in c.CertFile if set.
+// NewSNSVerifier returns ErrNoSNSTopics if c.TopicARNs is empty.
+func NewSNSVerifier(c SNSConfig) (*SNSVerifier, error) {
+	if len(c.TopicARNs) == 0 {
+		return nil, ErrNoSNSTopics
+	}
+	v := &SNSVerifier{
+		TopicARNs: c.TopicARNs,
+		MaxAge:    c.MaxAge,
+	}
+	if c.CertFile != "" {
+		b, err := os.ReadFile(c.CertFile)
+		if err != nil {
+			return nil, err
+		}
+		cert, err := parseCertificate(b)
+		if err != nil {
+			return nil, err
+		}
+		v.Certificate = cert
+	}
+	return v, nil
+}
+
+// Verify verifies the topic, the timestamp and the signature of m.
+func (v *SNSVerifier) Verify(ctx context.Context, m SNSMessage) error {
+	if err := v.checkTopic(m.TopicArn); err != nil {
+		return err
+	}
+	t, err := time.Parse(time.RFC3339, m.Timestamp)
+	if err != nil {
+		return fmt.Errorf("sns: invalid timestamp: %w", err)
+	}
+	maxAge := v.MaxAge
+	if maxAge <= 0 {
+		maxAge = defaultSNSMaxAge
+	}
+	if d := time.Since(t); d > maxAge || d < -maxAge {
+		return fmt.Errorf("sns: timestamp is out of range: %s", m.Timestamp)
+	}
+
+	s, err := m.StringToSign()
+	if err != nil {
+		return err
+	}
+	sig, err := base64.StdEncoding.DecodeString(m.Signature)
+	if err != nil {
+		return fmt.Errorf("sns: invalid signature: %w", err)
+	}
+	var (
+		hash   crypto.Hash
+		hashed []byte
+	)
+	switch m.SignatureVersion {
+	case "1":
+		h := sha1.Sum([]byte(s))
+		hash, hashed = crypto.SHA1, h[:]
+	case "2":
+		h := sha256.Sum256([]byte(s))
+		hash, hashed = crypto.SHA256, h[:]
+	default:
+		return fmt.Errorf("sns: unsupported signature version: %s", m.SignatureVersion)
+	}
+
+	cert, err := v.certificate(ctx, m.SigningCertURL)
+	if err != nil {
+		return err
+	}
+	pub, ok := cert.PublicKey.(*rsa.PublicKey)
+	if !ok {
+		return errors.New("sns: not a RSA certificate")
+	}
+	if err := rsa.VerifyPKCS1v15(pub, hash, hashed, sig); err != nil {
+		return fmt.Errorf("sns: %w", err)
+	}
+	return nil
+}
+
+// Confirm confirms the subscription by visiting the SubscribeURL of the verified SubscriptionConfirmation message,
+// only to the TopicARNs.
+func (v *SNSVerifier) Confirm(ctx context.Context, m SNSMessage) error {
+	if m.Type != SNSSubscriptionConfirmation {
+		return fmt.Errorf("sns: not a subscription confirmation: %s", m.Type)
+	}
+	if err := v.checkTopic(m.TopicArn); err != nil {
+		return err
+	}
+	u, err := snsURL(m.SubscribeURL)
+	if err != nil {
+		return err
+	}
+	res, err := v.get(ctx, u)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	return nil
+}
+
+// checkTopic returns an error unless arn is one of the TopicARNs.
+func (v *SNSVerifier) checkTopic(arn string) error {
+	for _, topic := range v.TopicARNs {
+		if topic == arn {
+			return nil
+		}
+	}
+	return fmt.Errorf("sns: unexpected topic: %s", arn)
+}
+
+func (v *SNSVerifier) certificate(ctx context.Context, certURL string) (*x509.Certificate, error) {
+	if v.Certificate != nil {
+		return v.Certificate, nil
+	}
+	u, err := snsURL(certURL)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasSuffix(u.Path, ".pem") {
+		return nil, fmt.Errorf("sns: invalid certificate URL: %s", certURL)
+	}
+
+	v.m.Lock()
+	cert, ok := v.certs[certURL]
+	v.m.Unlock()
+	if ok {
+		return cert, nil
+	}
+
+	res, err := v.get(ctx, u)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	b, err := io.ReadAll(io.LimitReader(res.Body, 64*1024))
+	if err != nil {
+		return nil, err
+	}
+	cert, err = parseCertificate(b)
+	if err != nil {
+		return nil, err
+	}
+
+	v.m.Lock()
+	defer v.m.Unlock()
+	if v.certs == nil {
+		v.certs = make(map[string]*x509.Certificate)
+	}
+	v.certs[certURL] = cert
+	return cert, nil
+}
+
+func (v *SNSVerifier) get(ctx context.Context, u *url.URL) (*http.Response, error) {
+	client := v.Client
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusOK {
+		res.Body.Close()
+		return nil, fmt.Errorf("sns: GET %s: %s", u.Host+u.Path, res.Status)
+	}
+	return res, nil
+}
+
+// snsURL parses the URL and checks that it is on the SNS hosts, so that a forged message cannot make us fetch other URLs.
+func snsURL(s string) (*url.URL, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, fmt.Errorf("sns: %w", err)
+	}
+	if u.Scheme != "https" || !snsHost.MatchString(u.Hostname()) || u.Port() != "" {
+		return nil, fmt.Errorf("sns: URL is not on the SNS hosts: %s", s)
+	}
+	return u, nil
+}
+
+func parseCertificate(b []byte) (*x509.Certificate, error) {
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, errors.New("sns: no PEM block in certificate")
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
@@ -0,0 +1,225 @@
+package email
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"io"
+	"math/big"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newSNSCert(t *testing.T) (*rsa.PrivateKey, *x509.Certificate) {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "sns.amazonaws.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key, cert
+}
+
+func signSNS(t *testing.T, key *rsa.PrivateKey, m *SNSMessage) {
+	t.Helper()
+	s, err := m.StringToSign()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sig []byte
+	switch m.SignatureVersion {
+	case "1":
+		h := sha1.Sum([]byte(s))
+		sig, err = rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA1, h[:])
+	default:
+		h := sha256.Sum256([]byte(s))
+		sig, err = rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, h[:])
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.Signature = base64.StdEncoding.EncodeToString(sig)
+}
+
+func TestSNSVerifier(t *testing.T) {
+	key, cert := newSNSCert(t)
+	_, other := newSNSCert(t)
+	ctx := context.Background()
+	topic := "arn:aws:sns:us-east-1:123456789012:ses-feedback"
+
+	for _, version := range []string{"1", "2"} {
+		m := SNSMessage{
+			Type:             SNSNotification,
+			MessageId:        "id",
+			TopicArn:         topic,
+			Subject:          "subject",
+			Message:          `{"notificationType":"Bounce"}`,
+			Timestamp:        time.Now().UTC().Format("2006-01-02T15:04:05.000Z"),
+			SignatureVersion: version,
+			SigningCertURL:   "https://sns.us-east-1.amazonaws.com/SimpleNotificationService-xxx.pem",
+		}
+		signSNS(t, key, &m)
+
+		v := &SNSVerifier{TopicARNs: []string{topic}, Certificate: cert}
+		if err := v.Verify(ctx, m); err != nil {
+			t.Errorf("version %s: Verify: %v", version, err)
+		}
+
+		tampered := m
+		tampered.Message = `{"notificationType":"Complaint"}`
+		if err := v.Verify(ctx, tampered); err == nil {
+			t.Errorf("version %s: tampered message should fail", version)
+		}
+
+		if err := (&SNSVerifier{TopicARNs: []string{topic}, Certificate: other}).Verify(ctx, m); err == nil {
+			t.Errorf("version %s: other certificate should fail", version)
+		}
+
+		if err := (&SNSVerifier{TopicARNs: []string{"arn:other"}, Certificate: cert}).Verify(ctx, m); err == nil {
+			t.Errorf("version %s: unexpected topic should fail", version)
+		}
+
+		if err := (&SNSVerifier{Certificate: cert}).Verify(ctx, m); err == nil {
+			t.Errorf("version %s: no topics should fail", version)
+		}
+
+		old := m
+		old.Timestamp = time.Now().Add(-2 * time.Hour).UTC().Format("2006-01-02T15:04:05.000Z")
+		signSNS(t, key, &old)
+		if err := v.Verify(ctx, old); err == nil {
+			t.Errorf("version %s: replayed old message should fail", version)
+		}
+	}
+
+	if _, err := NewSNSVerifier(SNSConfig{}); err != ErrNoSNSTopics {
+		t.Errorf("expected %v but got %v", ErrNoSNSTopics, err)
+	}
+}
+
+type roundTripper func(*http.Request) (*http.Response, error)
+
+func (f roundTripper) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
+
+func TestSNSVerifierURLs(t *testing.T) {
+	key, _ := newSNSCert(t)
+	ctx := context.Background()
+
+	topic := "arn:aws:sns:us-east-1:123456789012:ses-feedback"
+	var got []string
+	v := &SNSVerifier{
+		TopicARNs: []string{topic},
+		Client: &http.Client{Transport: roundTripper(func(r *http.Request) (*http.Response, error) {
+			got = append(got, r.URL.String())
+			return &http.Response{StatusCode: 200, Body: io.NopCloser(strings.NewReader("")), Request: r}, nil
+		})},
+	}
+
+	for _, u := range []string{
+		"http://sns.us-east-1.amazonaws.com/cert.pem",
+		"https://sns.us-east-1.amazonaws.com.example.com/cert.pem",
+		"https://example.com/cert.pem",
+		"https://sns.us-east-1.amazonaws.com:8443/cert.pem",
+		"https://sns.us-east-1.amazonaws.com/cert.txt",
+	} {
+		m := SNSMessage{
+			Type:             SNSNotification,
+			TopicArn:         topic,
+			Message:          "{}",
+			Timestamp:        time.Now().UTC().Format(time.RFC3339),
+			SignatureVersion: "2",
+			SigningCertURL:   u,
+		}
+		signSNS(t, key, &m)
+		if err := v.Verify(ctx, m); err == nil {
+			t.Errorf("%s: expected error", u)
+		}
+	}
+	if e, g := 0, len(got); e != g {
+		t.Errorf("expected %v requests but got %v", e, g)
+	}
+
+	m := SNSMessage{
+		Type:         SNSSubscriptionConfirmation,
+		TopicArn:     topic,
+		SubscribeURL: "https://example.com/?Action=ConfirmSubscription",
+	}
+	if err := v.Confirm(ctx, m); err == nil {
+		t.Error("expected error for the SubscribeURL not on the SNS hosts")
+	}
+	m.SubscribeURL = "https://sns.us-east-1.amazonaws.com/?Action=ConfirmSubscription&Token=token"
+	other := m
+	other.TopicArn = "arn:aws:sns:us-east-1:210987654321:attacker"
+	if err := v.Confirm(ctx, other); err == nil {
+		t.Error("expected error for the topic not in TopicARNs")
+	}
+	if err := v.Confirm(ctx, m); err != nil {
+		t.Fatal(err)
+	}
+	if e, g := m.SubscribeURL, strings.Join(got, ","); e != g {
+		t.Errorf("expected %v but got %v", e, g)
+	}
+}
+
+func TestSESNotification(t *testing.T) {
+	tests := []struct {
+		message    string
+		reason     string
+		recipients string
+	}{
+		{
+			message:    `{"notificationType":"Bounce","bounce":{"bounceType":"Permanent","bounceSubType":"General","bouncedRecipients":[{"emailAddress":"a@example.com"},{"emailAddress":"B <b@example.com>"}]}}`,
+			reason:     SuppressBounce,
+			recipients: "a@example.com,b@example.com",
+		},
+		{
+			message: `{"notificationType":"Bounce","bounce":{"bounceType":"Transient","bounceSubType":"MailboxFull","bouncedRecipients":[{"emailAddress":"a@example.com"}]}}`,
+		},
+		{
+			message:    `{"eventType":"Complaint","complaint":{"complaintFeedbackType":"abuse","complainedRecipients":[{"emailAddress":"a@example.com"}]}}`,
+			reason:     SuppressComplaint,
+			recipients: "a@example.com",
+		},
+		{
+			message: `{"eventType":"Complaint","complaint":{"complaintFeedbackType":"not-spam","complainedRecipients":[{"emailAddress":"a@example.com"}]}}`,
+		},
+		{
+			message: `{"notificationType":"Delivery","delivery":{"recipients":["a@example.com"]}}`,
+		},
+	}
+	for i, tt := range tests {
+		n, err := ParseSESNotification(tt.message)
+		if err != nil {
+			t.Fatalf("[%d] %v", i, err)
+		}
+		reason, recipients := n.Suppressions()
+		if e, g := tt.reason, reason; e != g {
+			t.Errorf("[%d] reason expected %v but got %v", i, e, g)
+		}
+		if e, g := tt.recipients, strings.Join(recipients, ","); e != g {
+			t.Errorf("[%d] recipients expected %v but got %v", i, e, g)
+		}
+	}
+}
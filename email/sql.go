@@ -0,0 +1,185 @@
+package email
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// SQLOutboxSchema creates the table for SQLOutbox with the default name.
+// Adjust the types for the database if needed.
+const SQLOutboxSchema = `CREATE TABLE vey_outbox (
+	id VARCHAR(64) PRIMARY KEY,
+	message TEXT NOT NULL,
+	visible_at BIGINT NOT NULL,
+	receipt VARCHAR(64) NOT NULL,
+	dead INTEGER NOT NULL DEFAULT 0
+);
+CREATE INDEX vey_outbox_visible_at ON vey_outbox (dead, visible_at);`
+
+// SQLOutbox implements Outbox interface with a database/sql table.
+// The messages are leased to a receiver by updating the receipt column,
+// so multiple workers can share the table.
+// The dead lettered messages stay in the table with dead = 1.
+type SQLOutbox struct {
+	DB *sql.DB
+	// Table defaults to "vey_outbox".
+	Table string
+	// Visibility is how long a received message is hidden from the other receivers. Defaults to 30s.
+	Visibility time.Duration
+	// Placeholder returns the n-th bind parameter, starting from 1.
+	// Defaults to "?" for MySQL and SQLite. Use DollarPlaceholder for PostgreSQL.
+	Placeholder func(n int) string
+}
+
+// DollarPlaceholder returns the PostgreSQL style bind parameter.
+func DollarPlaceholder(n int) string {
+	return fmt.Sprintf("$%d", n)
+}
+
+func NewSQLOutbox(db *sql.DB, table string) Outbox {
+	return &SQLOutbox{
+		DB:    db,
+		Table: table,
+	}
+}
+
+func (o *SQLOutbox) Enqueue(ctx context.Context, m OutboxMessage) error {
+	if m.ID == "" {
+		m.ID = newID()
+	}
+	b, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	_, err = o.DB.ExecContext(ctx,
+		o.query("INSERT INTO %s (id, message, visible_at, receipt, dead) VALUES (?, ?, ?, '', 0)"),
+		m.ID, string(b), time.Now().UnixNano())
+	return err
+}
+
+func (o *SQLOutbox) Receive(ctx context.Context, n int) ([]OutboxMessage, error) {
+	now := time.Now()
+	rows, err := o.DB.QueryContext(ctx,
+		o.query("SELECT id, message, receipt FROM %s WHERE dead = 0 AND visible_at <= ? ORDER BY visible_at LIMIT ?"),
+		now.UnixNano(), n)
+	if err != nil {
+		return nil, err
+	}
+	type row struct {
+		id, message, receipt string
+	}
+	var candidates []row
+	for rows.Next() {
+		var r row
+		if err := rows.Scan(&r.id, &r.message, &r.receipt); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		candidates = append(candidates, r)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	visibility := o.Visibility
+	if visibility == 0 {
+		visibility = defaultVisibility
+	}
+	var ret []OutboxMessage
+	for _, r := range candidates {
+		// lease the message, unless another receiver has leased it since the SELECT
+		receipt := newID()
+		res, err := o.DB.ExecContext(ctx,
+			o.query("UPDATE %s SET visible_at = ?, receipt = ? WHERE id = ? AND receipt = ?"),
+			now.Add(visibility).UnixNano(), receipt, r.id, r.receipt)
+		if err != nil {
+			return ret, err
+		}
+		if n, err := res.RowsAffected(); err != nil || n != 1 {
+			continue
+		}
+		var m OutboxMessage
+		if err := json.Unmarshal([]byte(r.message), &m); err != nil {
+			return ret, err
+		}
+		m.Receipt = receipt
+		ret = append(ret, m)
+	}
+	return ret, nil
+}
+
+func (o *SQLOutbox) Ack(ctx context.Context, m OutboxMessage) error {
+	res, err := o.DB.ExecContext(ctx,
+		o.query("DELETE FROM %s WHERE id = ? AND receipt = ?"),
+		m.ID, m.Receipt)
+	return o.checkReceipt(res, err)
+}
+
+func (o *SQLOutbox) Retry(ctx context.Context, m OutboxMessage, delay time.Duration) error {
+	b, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	res, err := o.DB.ExecContext(ctx,
+		o.query("UPDATE %s SET message = ?, visible_at = ?, receipt = '' WHERE id = ? AND receipt = ?"),
+		string(b), time.Now().Add(delay).UnixNano(), m.ID, m.Receipt)
+	return o.checkReceipt(res, err)
+}
+
+func (o *SQLOutbox) DeadLetter(ctx context.Context, m OutboxMessage) error {
+	b, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	res, err := o.DB.ExecContext(ctx,
+		o.query("UPDATE %s SET message = ?, dead = 1, receipt = '' WHERE id = ? AND receipt = ?"),
+		string(b), m.ID, m.Receipt)
+	return o.checkReceipt(res, err)
+}
+
+// Ping implements vey.Pinger.
+func (o *SQLOutbox) Ping(ctx context.Context) error {
+	return o.DB.PingContext(ctx)
+}
+
+func (o *SQLOutbox) checkReceipt(res sql.Result, err error) error {
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n != 1 {
+		return ErrReceipt
+	}
+	return nil
+}
+
+// query fills the table name and replaces "?" with the placeholders.
+func (o *SQLOutbox) query(q string) string {
+	table := o.Table
+	if table == "" {
+		table = "vey_outbox"
+	}
+	q = fmt.Sprintf(q, table)
+	if o.Placeholder == nil {
+		return q
+	}
+	var b strings.Builder
+	n := 0
+	for _, c := range q {
+		if c == '?' {
+			n++
+			b.WriteString(o.Placeholder(n))
+			continue
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
@@ -0,0 +1,224 @@
+package email
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSQLOutbox(t *testing.T) {
+	db, _ := openOutboxDB(t)
+	OutboxTest(t, NewSQLOutbox(db, ""))
+}
+
+func TestSQLOutboxDollarPlaceholder(t *testing.T) {
+	db, _ := openOutboxDB(t)
+	OutboxTest(t, &SQLOutbox{DB: db, Placeholder: DollarPlaceholder})
+}
+
+func TestSQLOutboxVisibility(t *testing.T) {
+	db, _ := openOutboxDB(t)
+	o := &SQLOutbox{DB: db, Visibility: 10 * time.Millisecond}
+	ctx := context.Background()
+	if err := o.Enqueue(ctx, OutboxMessage{Action: TemplatePut}); err != nil {
+		t.Fatal(err)
+	}
+	first := testReceive(t, o, 1)
+	testReceive(t, o, 0)
+	time.Sleep(20 * time.Millisecond)
+	// the receiver did not ack in time
+	second := testReceive(t, o, 1)
+	if err := o.Ack(ctx, first[0]); !errors.Is(err, ErrReceipt) {
+		t.Errorf("expected %v but got %v", ErrReceipt, err)
+	}
+	if err := o.Ack(ctx, second[0]); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestSQLOutboxLease(t *testing.T) {
+	db, table := openOutboxDB(t)
+	a, b := NewSQLOutbox(db, ""), NewSQLOutbox(db, "")
+	ctx := context.Background()
+	if err := a.Enqueue(ctx, OutboxMessage{Action: TemplatePut}); err != nil {
+		t.Fatal(err)
+	}
+	// b leases the message between the SELECT and the UPDATE of a
+	table.beforeLease = func() {
+		table.beforeLease = nil
+		testReceive(t, b, 1)
+	}
+	testReceive(t, a, 0)
+}
+
+var (
+	registerOutboxDriver sync.Once
+	outboxTables         = map[string]*outboxTable{}
+	outboxTablesM        sync.Mutex
+)
+
+// openOutboxDB opens the database of outboxDriver with an empty table.
+func openOutboxDB(t *testing.T) (*sql.DB, *outboxTable) {
+	registerOutboxDriver.Do(func() {
+		sql.Register("veyoutbox", outboxDriver{})
+	})
+	name := t.Name()
+	table := &outboxTable{rows: map[string]*outboxRow{}}
+	outboxTablesM.Lock()
+	outboxTables[name] = table
+	outboxTablesM.Unlock()
+	db, err := sql.Open("veyoutbox", name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db, table
+}
+
+// outboxDriver is a database/sql driver that runs only the statements of SQLOutbox on the vey_outbox table,
+// as a SQL database would. Other statements fail, so that the tests catch the changed statements.
+type outboxDriver struct{}
+
+func (outboxDriver) Open(name string) (driver.Conn, error) {
+	outboxTablesM.Lock()
+	defer outboxTablesM.Unlock()
+	table, ok := outboxTables[name]
+	if !ok {
+		return nil, fmt.Errorf("no table %s", name)
+	}
+	return outboxConn{table}, nil
+}
+
+type outboxRow struct {
+	id, message, receipt string
+	visibleAt            int64
+	dead                 int64
+}
+
+type outboxTable struct {
+	m    sync.Mutex
+	rows map[string]*outboxRow
+	// beforeLease is called after the SELECT of Receive, to race with another receiver.
+	beforeLease func()
+}
+
+type outboxConn struct {
+	table *outboxTable
+}
+
+func (c outboxConn) Prepare(query string) (driver.Stmt, error) {
+	return nil, errors.New("prepared statements are not supported")
+}
+
+func (c outboxConn) Close() error { return nil }
+
+func (c outboxConn) Begin() (driver.Tx, error) {
+	return nil, errors.New("transactions are not supported")
+}
+
+var dollarPlaceholder = regexp.MustCompile(`\$\d+`)
+
+// outboxArgs returns the query with "?" placeholders and the values of the bind parameters.
+func outboxArgs(query string, named []driver.NamedValue) (string, []driver.Value) {
+	args := make([]driver.Value, len(named))
+	for i, v := range named {
+		args[i] = v.Value
+	}
+	return dollarPlaceholder.ReplaceAllString(query, "?"), args
+}
+
+func (c outboxConn) ExecContext(ctx context.Context, query string, named []driver.NamedValue) (driver.Result, error) {
+	query, args := outboxArgs(query, named)
+	t := c.table
+	if query == "UPDATE vey_outbox SET visible_at = ?, receipt = ? WHERE id = ? AND receipt = ?" && t.beforeLease != nil {
+		t.beforeLease()
+	}
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	// update updates the row of the id and the receipt
+	update := func(id, receipt driver.Value, fn func(r *outboxRow)) (driver.Result, error) {
+		r, ok := t.rows[id.(string)]
+		if !ok || r.receipt != receipt.(string) {
+			return driver.RowsAffected(0), nil
+		}
+		fn(r)
+		return driver.RowsAffected(1), nil
+	}
+	switch query {
+	case "INSERT INTO vey_outbox (id, message, visible_at, receipt, dead) VALUES (?, ?, ?, '', 0)":
+		id := args[0].(string)
+		if _, ok := t.rows[id]; ok {
+			return nil, fmt.Errorf("duplicate id %s", id)
+		}
+		t.rows[id] = &outboxRow{id: id, message: args[1].(string), visibleAt: args[2].(int64)}
+		return driver.RowsAffected(1), nil
+	case "UPDATE vey_outbox SET visible_at = ?, receipt = ? WHERE id = ? AND receipt = ?":
+		return update(args[2], args[3], func(r *outboxRow) {
+			r.visibleAt, r.receipt = args[0].(int64), args[1].(string)
+		})
+	case "DELETE FROM vey_outbox WHERE id = ? AND receipt = ?":
+		return update(args[0], args[1], func(r *outboxRow) {
+			delete(t.rows, r.id)
+		})
+	case "UPDATE vey_outbox SET message = ?, visible_at = ?, receipt = '' WHERE id = ? AND receipt = ?":
+		return update(args[2], args[3], func(r *outboxRow) {
+			r.message, r.visibleAt, r.receipt = args[0].(string), args[1].(int64), ""
+		})
+	case "UPDATE vey_outbox SET message = ?, dead = 1, receipt = '' WHERE id = ? AND receipt = ?":
+		return update(args[1], args[2], func(r *outboxRow) {
+			r.message, r.dead, r.receipt = args[0].(string), 1, ""
+		})
+	}
+	return nil, fmt.Errorf("unexpected statement: %s", query)
+}
+
+func (c outboxConn) QueryContext(ctx context.Context, query string, named []driver.NamedValue) (driver.Rows, error) {
+	query, args := outboxArgs(query, named)
+	if query != "SELECT id, message, receipt FROM vey_outbox WHERE dead = 0 AND visible_at <= ? ORDER BY visible_at LIMIT ?" {
+		return nil, fmt.Errorf("unexpected query: %s", query)
+	}
+	t := c.table
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	var rows []outboxRow
+	for _, r := range t.rows {
+		if r.dead == 0 && r.visibleAt <= args[0].(int64) {
+			rows = append(rows, *r)
+		}
+	}
+	sort.Slice(rows, func(i, j int) bool { return rows[i].visibleAt < rows[j].visibleAt })
+	if limit := int(args[1].(int64)); len(rows) > limit {
+		rows = rows[:limit]
+	}
+	return &outboxRows{rows: rows}, nil
+}
+
+type outboxRows struct {
+	rows []outboxRow
+}
+
+func (r *outboxRows) Columns() []string {
+	return []string{"id", "message", "receipt"}
+}
+
+func (r *outboxRows) Close() error { return nil }
+
+func (r *outboxRows) Next(dest []driver.Value) error {
+	if len(r.rows) == 0 {
+		return io.EOF
+	}
+	row := r.rows[0]
+	r.rows = r.rows[1:]
+	dest[0], dest[1], dest[2] = row.id, row.message, row.receipt
+	return nil
+}
@@ -0,0 +1,150 @@
+package email
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+// sqsMaxVisibility is the maximum visibility timeout of SQS.
+const sqsMaxVisibility = 12 * time.Hour
+
+// SQSConfig configures SQSOutbox.
+type SQSConfig struct {
+	QueueURL string `yaml:"queueUrl"`
+	// DeadLetterQueueURL receives the dead lettered messages.
+	// If empty, the dead lettered messages are left to the queue's redrive policy,
+	// whose maxReceiveCount should be larger than Worker.MaxAttempts.
+	DeadLetterQueueURL string `yaml:"deadLetterQueueUrl"`
+	// Visibility overrides the queue's visibility timeout for the received messages if set.
+	Visibility time.Duration `yaml:"visibility"`
+	// WaitTime is the long polling duration of Receive. Defaults to 20s, which is the maximum.
+	WaitTime time.Duration `yaml:"waitTime"`
+}
+
+// SQSOutbox implements Outbox interface using Amazon SQS.
+// SQS counts the receives, so Attempts of a received message is ApproximateReceiveCount - 1.
+type SQSOutbox struct {
+	Config SQSConfig
+	SQS    *sqs.SQS
+}
+
+func NewSQSOutbox(c SQSConfig, svc *sqs.SQS) Outbox {
+	return SQSOutbox{
+		Config: c,
+		SQS:    svc,
+	}
+}
+
+func (o SQSOutbox) Enqueue(ctx context.Context, m OutboxMessage) error {
+	if m.ID == "" {
+		m.ID = newID()
+	}
+	return o.send(ctx, o.Config.QueueURL, m)
+}
+
+func (o SQSOutbox) Receive(ctx context.Context, n int) ([]OutboxMessage, error) {
+	if n > 10 {
+		n = 10
+	}
+	wait := o.Config.WaitTime
+	if wait == 0 {
+		wait = 20 * time.Second
+	}
+	input := &sqs.ReceiveMessageInput{
+		QueueUrl:            aws.String(o.Config.QueueURL),
+		MaxNumberOfMessages: aws.Int64(int64(n)),
+		WaitTimeSeconds:     aws.Int64(int64(wait / time.Second)),
+		AttributeNames:      aws.StringSlice([]string{sqs.MessageSystemAttributeNameApproximateReceiveCount}),
+	}
+	if o.Config.Visibility > 0 {
+		input.VisibilityTimeout = aws.Int64(int64(o.Config.Visibility / time.Second))
+	}
+	out, err := o.SQS.ReceiveMessageWithContext(ctx, input)
+	if err != nil {
+		return nil, err
+	}
+	ret := make([]OutboxMessage, 0, len(out.Messages))
+	for _, msg := range out.Messages {
+		m, err := ParseSQSMessage(aws.StringValue(msg.Body), aws.StringValue(msg.ReceiptHandle),
+			aws.StringValue(msg.Attributes[sqs.MessageSystemAttributeNameApproximateReceiveCount]))
+		if err != nil {
+			return ret, err
+		}
+		ret = append(ret, m)
+	}
+	return ret, nil
+}
+
+func (o SQSOutbox) Ack(ctx context.Context, m OutboxMessage) error {
+	_, err := o.SQS.DeleteMessageWithContext(ctx, &sqs.DeleteMessageInput{
+		QueueUrl:      aws.String(o.Config.QueueURL),
+		ReceiptHandle: aws.String(m.Receipt),
+	})
+	return err
+}
+
+// Retry changes the visibility timeout of the message to delay.
+// SQS does not update the message body, so the LastError is not kept.
+func (o SQSOutbox) Retry(ctx context.Context, m OutboxMessage, delay time.Duration) error {
+	if delay > sqsMaxVisibility {
+		delay = sqsMaxVisibility
+	}
+	_, err := o.SQS.ChangeMessageVisibilityWithContext(ctx, &sqs.ChangeMessageVisibilityInput{
+		QueueUrl:          aws.String(o.Config.QueueURL),
+		ReceiptHandle:     aws.String(m.Receipt),
+		VisibilityTimeout: aws.Int64(int64(delay / time.Second)),
+	})
+	return err
+}
+
+// DeadLetter sends the message to Config.DeadLetterQueueURL and deletes it from the queue.
+// If Config.DeadLetterQueueURL is empty, DeadLetter does nothing and the queue's redrive policy moves the message.
+func (o SQSOutbox) DeadLetter(ctx context.Context, m OutboxMessage) error {
+	if o.Config.DeadLetterQueueURL == "" {
+		return nil
+	}
+	if err := o.send(ctx, o.Config.DeadLetterQueueURL, m); err != nil {
+		return err
+	}
+	return o.Ack(ctx, m)
+}
+
+// Ping implements vey.Pinger.
+func (o SQSOutbox) Ping(ctx context.Context) error {
+	_, err := o.SQS.GetQueueAttributesWithContext(ctx, &sqs.GetQueueAttributesInput{
+		QueueUrl:       aws.String(o.Config.QueueURL),
+		AttributeNames: aws.StringSlice([]string{sqs.QueueAttributeNameQueueArn}),
+	})
+	return err
+}
+
+func (o SQSOutbox) send(ctx context.Context, queueURL string, m OutboxMessage) error {
+	b, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	_, err = o.SQS.SendMessageWithContext(ctx, &sqs.SendMessageInput{
+		QueueUrl:    aws.String(queueURL),
+		MessageBody: aws.String(string(b)),
+	})
+	return err
+}
+
+// ParseSQSMessage returns the OutboxMessage in the SQS message body.
+// Use it to Process the messages delivered by a Lambda SQS event source.
+func ParseSQSMessage(body, receiptHandle, approximateReceiveCount string) (OutboxMessage, error) {
+	var m OutboxMessage
+	if err := json.Unmarshal([]byte(body), &m); err != nil {
+		return m, err
+	}
+	m.Receipt = receiptHandle
+	if n, err := strconv.Atoi(approximateReceiveCount); err == nil && n > 0 {
+		m.Attempts = n - 1
+	}
+	return m, nil
+}
@@ -0,0 +1,258 @@
+package email
+
+import (
+	"bytes"
+	"context"
+	"embed"
+	"fmt"
+	htemplate "html/template"
+	"io/fs"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	ttemplate "text/template"
+)
+
+const (
+	// TemplatePut is the name of the template for the put confirmation email.
+	TemplatePut = "put"
+	// TemplateDelete is the name of the template for the delete confirmation email.
+	TemplateDelete = "delete"
+	// TemplateNotice is the name of the template for the email that notifies a key was added or deleted.
+	TemplateNotice = "notice"
+)
+
+//go:embed templates/*
+var defaultTemplates embed.FS
+
+// TemplateData is the data passed to the templates.
+// It has the same variables as the SES templates.
+type TemplateData struct {
+	Email string `json:"email"`
+	// Token is set in the delete email.
+	Token string `json:"token,omitempty"`
+	// TokenEscaped is the query escaped Token, to be used in URLs.
+	TokenEscaped string `json:"tokenEscaped,omitempty"`
+	// Challenge is set in the put email.
+	Challenge string `json:"challenge,omitempty"`
+	// ChallengeEscaped is the query escaped Challenge, to be used in URLs.
+	ChallengeEscaped string `json:"challengeEscaped,omitempty"`
+	// Link is the signed link to confirm the put in the app or the browser, if configured. See WithLink.
+	Link string `json:"link,omitempty"`
+	// Added is true in the notice email if the key was added, and false if it was deleted.
+	Added bool `json:"added,omitempty"`
+	// KeyFingerprint is the SHA256 fingerprint of the key in the notice email.
+	KeyFingerprint string `json:"keyFingerprint,omitempty"`
+}
+
+// Template renders the subject, text and HTML bodies of an email.
+// The text and subject use text/template, and the HTML uses html/template.
+type Template struct {
+	subject *ttemplate.Template
+	text    *ttemplate.Template
+	html    *htemplate.Template
+}
+
+// Render executes the templates with data.
+func (t Template) Render(data TemplateData) (Message, error) {
+	var subject, text, html bytes.Buffer
+	if err := t.subject.Execute(&subject, data); err != nil {
+		return Message{}, err
+	}
+	if err := t.text.Execute(&text, data); err != nil {
+		return Message{}, err
+	}
+	if err := t.html.Execute(&html, data); err != nil {
+		return Message{}, err
+	}
+	return Message{
+		Subject: strings.TrimSpace(subject.String()),
+		Text:    text.String(),
+		HTML:    html.String(),
+	}, nil
+}
+
+// Templates is a set of templates for the put and delete emails,
+// with optional localized sets.
+type Templates struct {
+	m map[string]Template
+	// locales maps the locale to the localized set.
+	locales map[string]map[string]Template
+}
+
+// LoadTemplates parses the templates in fsys.
+// For each of "put" and "delete", fsys should have "<name>.subject.txt", "<name>.txt" and "<name>.html".
+// These are the default set, used when no localized set matches the recipient's languages.
+// Each subdirectory named by a locale, such as "ja" or "pt-BR", is a localized set and should have the same files.
+// The "notice" files are optional. A set without them uses the default set's, or the embedded templates'.
+func LoadTemplates(fsys fs.FS) (*Templates, error) {
+	m, err := loadSet(fsys)
+	if err != nil {
+		return nil, err
+	}
+	ts := &Templates{
+		m:       m,
+		locales: make(map[string]map[string]Template),
+	}
+	entries, err := fs.ReadDir(fsys, ".")
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		sub, err := fs.Sub(fsys, e.Name())
+		if err != nil {
+			return nil, err
+		}
+		set, err := loadSet(sub)
+		if err != nil {
+			return nil, fmt.Errorf("locale %s: %w", e.Name(), err)
+		}
+		ts.locales[e.Name()] = set
+	}
+	return ts, nil
+}
+
+func loadSet(fsys fs.FS) (map[string]Template, error) {
+	m := make(map[string]Template)
+	for _, name := range []string{TemplatePut, TemplateDelete} {
+		t, err := loadTemplate(fsys, name)
+		if err != nil {
+			return nil, err
+		}
+		m[name] = t
+	}
+	if _, err := fs.Stat(fsys, TemplateNotice+".txt"); err == nil {
+		t, err := loadTemplate(fsys, TemplateNotice)
+		if err != nil {
+			return nil, err
+		}
+		m[TemplateNotice] = t
+	}
+	return m, nil
+}
+
+// LoadTemplatesDir parses the templates in dir. See LoadTemplates.
+func LoadTemplatesDir(dir string) (*Templates, error) {
+	return LoadTemplates(os.DirFS(dir))
+}
+
+var (
+	defaultOnce sync.Once
+	defaults    *Templates
+)
+
+// DefaultTemplates returns the templates embedded in the package.
+func DefaultTemplates() *Templates {
+	defaultOnce.Do(func() {
+		sub, err := fs.Sub(defaultTemplates, "templates")
+		if err != nil {
+			panic(err)
+		}
+		defaults, err = LoadTemplates(sub)
+		if err != nil {
+			panic(err)
+		}
+	})
+	return defaults
+}
+
+// Locales returns the locales of the localized sets, sorted.
+func (ts *Templates) Locales() []string {
+	ret := make([]string, 0, len(ts.locales))
+	for l := range ts.locales {
+		ret = append(ret, l)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// Render renders the template named name in the default set. name is "put", "delete" or "notice".
+func (ts *Templates) Render(name string, data TemplateData) (Message, error) {
+	return ts.RenderLocale("", name, data)
+}
+
+// RenderLocale renders the template named name in the localized set for locale.
+// The default set is used if locale is empty.
+// The returned Message's Language is set to locale.
+func (ts *Templates) RenderLocale(locale, name string, data TemplateData) (Message, error) {
+	set := ts.m
+	if locale != "" {
+		var ok bool
+		if set, ok = ts.locales[locale]; !ok {
+			return Message{}, fmt.Errorf("locale not found: %s", locale)
+		}
+	}
+	t, ok := set[name]
+	if !ok && name == TemplateNotice {
+		// the templates made before the notice was added do not have it
+		if t, ok = ts.m[name]; !ok && ts != DefaultTemplates() {
+			return DefaultTemplates().RenderContext(WithLanguages(context.Background(), locale), name, data)
+		}
+	}
+	if !ok {
+		return Message{}, fmt.Errorf("template not found: %s", name)
+	}
+	m, err := t.Render(data)
+	if err != nil {
+		return Message{}, err
+	}
+	m.Language = locale
+	return m, nil
+}
+
+// RenderContext renders the template named name in the set that best matches the languages in ctx.
+// See WithLanguages and Negotiate.
+func (ts *Templates) RenderContext(ctx context.Context, name string, data TemplateData) (Message, error) {
+	return ts.RenderLocale(Negotiate(Languages(ctx), ts.Locales()), name, data)
+}
+
+func loadTemplate(fsys fs.FS, name string) (Template, error) {
+	read := func(file string) (string, error) {
+		b, err := fs.ReadFile(fsys, file)
+		if err != nil {
+			return "", fmt.Errorf("template %s: %w", file, err)
+		}
+		return string(b), nil
+	}
+	subject, err := read(name + ".subject.txt")
+	if err != nil {
+		return Template{}, err
+	}
+	text, err := read(name + ".txt")
+	if err != nil {
+		return Template{}, err
+	}
+	html, err := read(name + ".html")
+	if err != nil {
+		return Template{}, err
+	}
+
+	var t Template
+	if t.subject, err = ttemplate.New(name + ".subject.txt").Parse(subject); err != nil {
+		return Template{}, err
+	}
+	if t.text, err = ttemplate.New(name + ".txt").Parse(text); err != nil {
+		return Template{}, err
+	}
+	if t.html, err = htemplate.New(name + ".html").Parse(html); err != nil {
+		return Template{}, err
+	}
+	return t, nil
+}
+
+// mustTemplates returns the templates in dir, or the default templates if dir is empty.
+// mustTemplates panics if the templates have an error.
+func mustTemplates(dir string) *Templates {
+	if dir == "" {
+		return DefaultTemplates()
+	}
+	ts, err := LoadTemplatesDir(dir)
+	if err != nil {
+		panic(err)
+	}
+	return ts
+}
@@ -0,0 +1,189 @@
+package email
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func TestDefaultTemplates(t *testing.T) {
+	ts := DefaultTemplates()
+
+	m, err := ts.Render(TemplatePut, TemplateData{Email: "test@example.com", Challenge: "<challenge>"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e, g := "Confirm adding your public key", m.Subject; e != g {
+		t.Errorf("subject expected %v but got %v", e, g)
+	}
+	if !strings.Contains(m.Text, "<challenge>") {
+		t.Errorf("text should include the challenge as is but got %v", m.Text)
+	}
+	if !strings.Contains(m.HTML, "&lt;challenge&gt;") {
+		t.Errorf("html should include the escaped challenge but got %v", m.HTML)
+	}
+	if strings.Contains(m.Text, "link") {
+		t.Errorf("text should not mention the link without Link but got %v", m.Text)
+	}
+
+	link := "https://vey.example.com/open?v=1&c=challenge"
+	m, err = ts.Render(TemplatePut, TemplateData{Email: "test@example.com", Challenge: "challenge", Link: link})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(m.Text, link) {
+		t.Errorf("text should include the link but got %v", m.Text)
+	}
+	if !strings.Contains(m.HTML, `href="https://vey.example.com/open?v=1&amp;c=challenge"`) {
+		t.Errorf("html should include the link but got %v", m.HTML)
+	}
+
+	m, err = ts.Render(TemplateDelete, TemplateData{Email: "test@example.com", Token: "token"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(m.Text, "token") {
+		t.Errorf("text should include the token but got %v", m.Text)
+	}
+
+	if _, err := ts.Render("unknown", TemplateData{}); err == nil {
+		t.Error("expected an error for an unknown template but got nil")
+	}
+}
+
+func TestLoadTemplates(t *testing.T) {
+	fsys := fstest.MapFS{
+		"put.subject.txt":    {Data: []byte("Put {{.Email}}\n")},
+		"put.txt":            {Data: []byte("https://example.com/put?challenge={{.ChallengeEscaped}}")},
+		"put.html":           {Data: []byte(`<a href="https://example.com/put?challenge={{.ChallengeEscaped}}">put</a>`)},
+		"delete.subject.txt": {Data: []byte("Delete")},
+		"delete.txt":         {Data: []byte("{{.Token}}")},
+		"delete.html":        {Data: []byte("{{.Token}}")},
+	}
+	ts, err := LoadTemplates(fsys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := ts.Render(TemplatePut, TemplateData{Email: "test@example.com", Challenge: "a+b=", ChallengeEscaped: "a%2Bb%3D"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e, g := "Put test@example.com", m.Subject; e != g {
+		t.Errorf("subject expected %v but got %v", e, g)
+	}
+	if e, g := "https://example.com/put?challenge=a%2Bb%3D", m.Text; e != g {
+		t.Errorf("text expected %v but got %v", e, g)
+	}
+
+	delete(fsys, "delete.html")
+	if _, err := LoadTemplates(fsys); err == nil {
+		t.Error("expected an error for a missing file but got nil")
+	}
+
+	fsys["delete.html"] = &fstest.MapFile{Data: []byte("{{.Token")}
+	if _, err := LoadTemplates(fsys); err == nil {
+		t.Error("expected a parse error but got nil")
+	}
+}
+
+func TestLocalizedTemplates(t *testing.T) {
+	ts := DefaultTemplates()
+	if e, g := []string{"de", "ja", "pt-BR"}, ts.Locales(); strings.Join(e, ",") != strings.Join(g, ",") {
+		t.Errorf("locales expected %v but got %v", e, g)
+	}
+
+	tests := []struct {
+		languages []string
+		subject   string
+		language  string
+	}{
+		{nil, "Confirm adding your public key", ""},
+		{[]string{"ja-JP", "en"}, "公開鍵の追加を確認してください", "ja"},
+		{[]string{"de-AT"}, "Hinzufügen Ihres öffentlichen Schlüssels bestätigen", "de"},
+		{[]string{"pt"}, "Confirme a adição da sua chave pública", "pt-BR"},
+		{[]string{"fr"}, "Confirm adding your public key", ""},
+	}
+	for _, tt := range tests {
+		ctx := WithLanguages(context.Background(), tt.languages...)
+		m, err := ts.RenderContext(ctx, TemplatePut, TemplateData{Email: "test@example.com", Challenge: "challenge"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if e, g := tt.subject, m.Subject; e != g {
+			t.Errorf("%v subject expected %v but got %v", tt.languages, e, g)
+		}
+		if e, g := tt.language, m.Language; e != g {
+			t.Errorf("%v language expected %v but got %v", tt.languages, e, g)
+		}
+		if !strings.Contains(m.Text, "challenge") {
+			t.Errorf("%v text should include the challenge but got %v", tt.languages, m.Text)
+		}
+	}
+
+	if _, err := ts.RenderLocale("fr", TemplatePut, TemplateData{}); err == nil {
+		t.Error("expected an error for an unknown locale but got nil")
+	}
+}
+
+func TestLoadTemplatesIncompleteLocale(t *testing.T) {
+	fsys := fstest.MapFS{
+		"put.subject.txt":    {Data: []byte("Put")},
+		"put.txt":            {Data: []byte("put")},
+		"put.html":           {Data: []byte("put")},
+		"delete.subject.txt": {Data: []byte("Delete")},
+		"delete.txt":         {Data: []byte("delete")},
+		"delete.html":        {Data: []byte("delete")},
+		"ja/put.subject.txt": {Data: []byte("追加")},
+	}
+	if _, err := LoadTemplates(fsys); err == nil {
+		t.Error("expected an error for an incomplete locale but got nil")
+	}
+}
+
+func TestNoticeTemplates(t *testing.T) {
+	ts := DefaultTemplates()
+	for _, tt := range []struct {
+		languages []string
+		added     bool
+		subject   string
+	}{
+		{nil, true, "A public key was added"},
+		{nil, false, "A public key was deleted"},
+		{[]string{"ja"}, true, "公開鍵が追加されました"},
+		{[]string{"de"}, false, "Ein öffentlicher Schlüssel wurde gelöscht"},
+	} {
+		ctx := WithLanguages(context.Background(), tt.languages...)
+		m, err := ts.RenderContext(ctx, TemplateNotice, Notice{Added: tt.added, KeyFingerprint: "SHA256:fp"}.data("test@example.com"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if e, g := tt.subject, m.Subject; e != g {
+			t.Errorf("%v subject expected %v but got %v", tt.languages, e, g)
+		}
+		if !strings.Contains(m.Text, "SHA256:fp") {
+			t.Errorf("%v text should include the fingerprint but got %v", tt.languages, m.Text)
+		}
+	}
+
+	// the templates without the notice fall back to the embedded ones
+	fsys := fstest.MapFS{
+		"put.subject.txt":    {Data: []byte("Put")},
+		"put.txt":            {Data: []byte("put")},
+		"put.html":           {Data: []byte("put")},
+		"delete.subject.txt": {Data: []byte("Delete")},
+		"delete.txt":         {Data: []byte("delete")},
+		"delete.html":        {Data: []byte("delete")},
+	}
+	custom, err := LoadTemplates(fsys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := custom.Render(TemplateNotice, TemplateData{Email: "test@example.com", Added: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e, g := "A public key was added", m.Subject; e != g {
+		t.Errorf("fallback subject expected %v but got %v", e, g)
+	}
+}
@@ -0,0 +1,85 @@
+package email
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// OutboxTest tests the Outbox interface.
+// o should be empty, and receive the messages as soon as Retry's delay has passed.
+func OutboxTest(t *testing.T, o Outbox) {
+	ctx := context.Background()
+
+	testReceive(t, o, 0)
+
+	m := OutboxMessage{
+		ID:        newID(),
+		Action:    TemplatePut,
+		Email:     "test@example.com",
+		Challenge: "challenge",
+		Languages: []string{"ja", "en"},
+		CreatedAt: time.Now(),
+	}
+	if err := o.Enqueue(ctx, m); err != nil {
+		t.Fatalf("Enqueue: %v", err)
+	}
+
+	ms := testReceive(t, o, 1)
+	got := ms[0]
+	if e, g := m.ID, got.ID; e != g {
+		t.Errorf("ID expected %v but got %v", e, g)
+	}
+	if e, g := m.Challenge, got.Challenge; e != g {
+		t.Errorf("Challenge expected %v but got %v", e, g)
+	}
+	if e, g := "ja", got.Languages[0]; e != g {
+		t.Errorf("Languages expected %v but got %v", e, g)
+	}
+	if got.Receipt == "" {
+		t.Error("Receipt should be set")
+	}
+	// a received message is hidden from the other receivers
+	testReceive(t, o, 0)
+
+	got.Attempts++
+	got.LastError = "failed"
+	if err := o.Retry(ctx, got, 0); err != nil {
+		t.Fatalf("Retry: %v", err)
+	}
+	ms = testReceive(t, o, 1)
+	if e, g := 1, ms[0].Attempts; e != g {
+		t.Errorf("Attempts expected %v but got %v", e, g)
+	}
+	// the receipt of the previous receive is expired
+	if err := o.Ack(ctx, got); !errors.Is(err, ErrReceipt) {
+		t.Errorf("Ack: expected %v but got %v", ErrReceipt, err)
+	}
+	if err := o.Ack(ctx, ms[0]); err != nil {
+		t.Fatalf("Ack: %v", err)
+	}
+	testReceive(t, o, 0)
+
+	m.ID = newID()
+	if err := o.Enqueue(ctx, m); err != nil {
+		t.Fatalf("Enqueue: %v", err)
+	}
+	ms = testReceive(t, o, 1)
+	if err := o.DeadLetter(ctx, ms[0]); err != nil {
+		t.Fatalf("DeadLetter: %v", err)
+	}
+	testReceive(t, o, 0)
+}
+
+func testReceive(t *testing.T, o Outbox, expected int) []OutboxMessage {
+	t.Helper()
+	ms, err := o.Receive(context.Background(), 10)
+	if err != nil {
+		t.Fatalf("Receive: %v", err)
+	}
+	if e, g := expected, len(ms); e != g {
+		t.Fatalf("Receive: expected %v messages but got %v", e, g)
+	}
+	return ms
+}
@@ -0,0 +1,182 @@
+package email
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	defaultMaxAttempts  = 5
+	defaultPollInterval = time.Second
+)
+
+// Backoff is the exponential backoff between the send attempts, with jitter.
+type Backoff struct {
+	// Min is the delay after the first failure. Defaults to 1s.
+	Min time.Duration
+	// Max caps the delay. Defaults to 5m.
+	Max time.Duration
+}
+
+// Delay returns the delay after attempts failures, which is between half and all of Min * 2^(attempts-1), capped at Max.
+func (b Backoff) Delay(attempts int) time.Duration {
+	min, max := b.Min, b.Max
+	if min <= 0 {
+		min = time.Second
+	}
+	if max <= 0 {
+		max = 5 * time.Minute
+	}
+	d := min
+	for i := 1; i < attempts && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+	// spread the retries of the messages that failed together
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// Worker sends the messages in Outbox with Sender.
+// A failed send is retried with Backoff, and dead lettered after MaxAttempts.
+type Worker struct {
+	Outbox Outbox
+	Sender Sender
+	// Concurrency is the number of the messages sent in parallel. Defaults to 1.
+	Concurrency int
+	// MaxAttempts is the number of sends before dead lettering the message. Defaults to 5.
+	MaxAttempts int
+	Backoff     Backoff
+	// PollInterval is the wait before the next Receive when the outbox is empty. Defaults to 1s.
+	PollInterval time.Duration
+	// MaxAge drops the messages older than MaxAge, because the challenge or token in it has expired from the Cache.
+	// No limit if 0.
+	MaxAge time.Duration
+}
+
+func NewWorker(o Outbox, s Sender) *Worker {
+	return &Worker{
+		Outbox: o,
+		Sender: s,
+	}
+}
+
+// Run receives and sends the messages until ctx is done.
+// Run waits for the sends in progress to finish before returning.
+func (w *Worker) Run(ctx context.Context) error {
+	n := w.Concurrency
+	if n <= 0 {
+		n = 1
+	}
+	poll := w.PollInterval
+	if poll <= 0 {
+		poll = defaultPollInterval
+	}
+
+	messages := make(chan OutboxMessage)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for m := range messages {
+				// finish the send even if ctx is done, instead of leaving it to the visibility timeout
+				if err := w.Process(context.Background(), m); err != nil {
+					Log.Error(fmt.Errorf("outbox: message %s: %w", m.ID, err))
+				}
+			}
+		}()
+	}
+	defer func() {
+		close(messages)
+		wg.Wait()
+	}()
+
+	for {
+		ms, err := w.Outbox.Receive(ctx, n)
+		if ctx.Err() != nil {
+			return nil
+		}
+		if err != nil {
+			Log.Error(fmt.Errorf("outbox: receive: %w", err))
+		}
+		for _, m := range ms {
+			messages <- m
+		}
+		if len(ms) > 0 {
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(poll):
+		}
+	}
+}
+
+// Process sends the received message, and then acks, retries or dead letters it.
+// Process returns an error if the message should be received again, which is when the send failed and is going to be retried.
+func (w *Worker) Process(ctx context.Context, m OutboxMessage) (err error) {
+	ctx = otel.GetTextMapPropagator().Extract(ctx, propagation.MapCarrier(m.Trace))
+	ctx, span := tracer.Start(ctx, "Worker.Process",
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(
+			attribute.String("vey.email.action", m.Action),
+			attribute.String("vey.outbox.id", m.ID),
+			attribute.Int("vey.outbox.attempts", m.Attempts),
+		),
+	)
+	defer func() { endSpan(span, err) }()
+
+	if w.MaxAge > 0 && time.Since(m.CreatedAt) > w.MaxAge {
+		Log.Error(fmt.Errorf("outbox: dropping expired message %s created at %s", m.ID, m.CreatedAt))
+		return w.Outbox.Ack(ctx, m)
+	}
+
+	serr := w.send(WithLink(WithLanguages(ctx, m.Languages...), m.Link), m)
+	if serr == nil {
+		return w.Outbox.Ack(ctx, m)
+	}
+
+	m.Attempts++
+	m.LastError = serr.Error()
+	max := w.MaxAttempts
+	if max <= 0 {
+		max = defaultMaxAttempts
+	}
+	if m.Attempts >= max {
+		Log.Error(fmt.Errorf("outbox: dead lettering message %s after %d attempts: %w", m.ID, m.Attempts, serr))
+		return w.Outbox.DeadLetter(ctx, m)
+	}
+	if err := w.Outbox.Retry(ctx, m, w.Backoff.Delay(m.Attempts)); err != nil {
+		return err
+	}
+	return fmt.Errorf("send failed, attempt %d: %w", m.Attempts, serr)
+}
+
+func (w *Worker) send(ctx context.Context, m OutboxMessage) error {
+	s := SenderWithContext(w.Sender)
+	switch m.Action {
+	case TemplateDelete:
+		return s.SendTokenContext(ctx, m.Email, m.Token)
+	case TemplatePut:
+		return s.SendChallengeContext(ctx, m.Email, m.Challenge)
+	case TemplateNotice:
+		ns, ok := w.Sender.(NoticeSender)
+		if !ok || m.Notice == nil {
+			return fmt.Errorf("cannot send the notice with %T", w.Sender)
+		}
+		return ns.SendNoticeContext(ctx, m.Email, *m.Notice)
+	default:
+		return fmt.Errorf("unknown action: %s", m.Action)
+	}
+}
@@ -10,6 +10,46 @@ var (
 	// ErrVerifyFailed indicates that the signature is invalid.
 	ErrVerifyFailed = errors.New("verify failed")
 	ErrInvalidEmail = errors.New("invalid email")
+	// ErrInvalidMetadata indicates that the comment of the key is too long, or the key expires in the past.
+	ErrInvalidMetadata = errors.New("invalid key metadata")
+	// ErrSuppressed indicates that the email address is in the SuppressionList, and no email is sent to it.
+	ErrSuppressed = errors.New("email address is suppressed")
+	// ErrNoSuppressionList indicates that Suppressor is called on a Vey without a SuppressionList.
+	ErrNoSuppressionList = errors.New("suppression list is not configured")
+	// ErrRevoked indicates that the key has been revoked from the email address as compromised, and cannot be added again.
+	// See WithRefuseRevoked.
+	ErrRevoked = errors.New("key is revoked")
+	// ErrNoRevocationList indicates that Revoker is called on a Vey without a RevocationList.
+	ErrNoRevocationList = errors.New("revocation list is not configured")
+	// ErrTooManyKeys indicates that the email address has the maximum number of keys. See KeyPolicy.
+	ErrTooManyKeys = errors.New("too many keys")
+	// ErrKeyTypeNotAllowed indicates that the type of the key is not allowed by the KeyPolicy.
+	ErrKeyTypeNotAllowed = errors.New("key type is not allowed")
+	// ErrWeakKey indicates that the key is smaller than the KeyPolicy requires.
+	ErrWeakKey = errors.New("key is too weak")
+	// ErrDeniedKey indicates that the key is in the KeyDenyList.
+	ErrDeniedKey = errors.New("key is denied")
+	// ErrDomainNotAllowed indicates that the domain of the email address is refused by the DomainPolicy.
+	ErrDomainNotAllowed = errors.New("email domain is not allowed")
+	// ErrIgnored indicates that the request is silently ignored by the DomainPolicy.
+	// The callers should respond as if it succeeded, without sending the email.
+	ErrIgnored = errors.New("ignored")
+	// ErrLocked indicates that the client or the email address is locked out after too many failed commits. See WithLockout.
+	ErrLocked = errors.New("too many failed attempts")
+	// ErrProofRequired indicates that BeginPut requires the PossessionProof. See WithProofOfPossession.
+	ErrProofRequired = errors.New("proof of possession is required")
+	// ErrInvalidProof indicates that the PossessionProof is not signed by the key, or made too long ago.
+	ErrInvalidProof = errors.New("invalid proof of possession")
+	// ErrLookupTokenRequired indicates that GetKeys requires the lookup token. See WithLookupPolicy.
+	ErrLookupTokenRequired = errors.New("lookup token is required")
+	// ErrNoLookupSecret indicates that LookupToken is called on a Vey without the LookupPolicy.Secret.
+	ErrNoLookupSecret = errors.New("lookup secret is not configured")
+	// ErrNoStalePolicy indicates that Maintain is called on a Vey without the StalePolicy.
+	ErrNoStalePolicy = errors.New("stale policy is not configured")
+	// ErrNoExpiryCache indicates that Maintain is called on a Vey with a Cache that does not implement ExpiryCache.
+	ErrNoExpiryCache = errors.New("cache cannot set the expiry")
+	// ErrNoKeyScanner indicates that Maintain is called on a Vey with a Store that does not implement KeyScanner.
+	ErrNoKeyScanner = errors.New("store cannot scan the keys")
 )
 
 func IsNotFound(err error) bool {
@@ -2,10 +2,12 @@ package http
 
 import (
 	"bytes"
+	"crypto/ed25519"
 	"encoding/base64"
 	"encoding/json"
 	"net/http"
 	"net/url"
+	"strconv"
 
 	"github.com/mash/vey"
 )
@@ -35,7 +37,17 @@ func NewClient(root string) Client {
 
 // GetKeys calls the GetKeys interface on the Vey server and returns a slice of PublicKeys.
 func (c Client) GetKeys(email string) ([]vey.PublicKey, error) {
-	res, err := c.Do("/getKeys", Body{Email: email})
+	return c.getKeys(Body{Email: email})
+}
+
+// GetKeysWithLookupToken calls the GetKeys interface on the Vey server with the lookup token of the email address.
+// See vey.WithLookupPolicy.
+func (c Client) GetKeysWithLookupToken(email string, token []byte) ([]vey.PublicKey, error) {
+	return c.getKeys(Body{Email: email, LookupToken: token})
+}
+
+func (c Client) getKeys(body Body) ([]vey.PublicKey, error) {
+	res, err := c.Do("/getKeys", body)
 	if err != nil {
 		return nil, err
 	}
@@ -81,6 +93,22 @@ func (c Client) BeginPut(email string, publicKey vey.PublicKey) error {
 	return nil
 }
 
+// BeginPutWithProof calls the BeginPut interface on the Vey server, with the proof of possession of the key.
+// proof is made by signing vey.ProofPayload with the private key.
+func (c Client) BeginPutWithProof(email string, publicKey vey.PublicKey, proof vey.PossessionProof) error {
+	res, err := c.Do("/beginPut", Body{
+		Email:     email,
+		PublicKey: publicKey,
+		Proof:     proof.Signature,
+		ProofTime: proof.Time.Unix(),
+	})
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	return nil
+}
+
 // CommitPut calls the CommitPut interface on the Vey server.
 func (c Client) CommitPut(challenge, signature []byte) error {
 	res, err := c.Do("/commitPut", Body{
@@ -94,6 +122,73 @@ func (c Client) CommitPut(challenge, signature []byte) error {
 	return nil
 }
 
+// CommitPutWithLookupToken calls the CommitPut interface on the Vey server, and returns the lookup token of the email address,
+// which is nil if the server does not require it.
+func (c Client) CommitPutWithLookupToken(challenge, signature []byte) ([]byte, error) {
+	res, err := c.Do("/commitPut", Body{
+		Challenge: challenge,
+		Signature: signature,
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	var body LookupTokenResponse
+	if err := json.NewDecoder(res.Body).Decode(&body); err != nil {
+		return nil, err
+	}
+	return body.LookupToken, nil
+}
+
+// BeginDeleteWithSignature calls the BeginDeleteWithSignature interface on the Vey server, and returns the challenge.
+func (c Client) BeginDeleteWithSignature(email string, publicKey vey.PublicKey) ([]byte, error) {
+	res, err := c.Do("/beginDeleteWithSignature", Body{Email: email, PublicKey: publicKey})
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	var b ChallengeResponse
+	dec := json.NewDecoder(res.Body)
+	if err := dec.Decode(&b); err != nil {
+		return nil, err
+	}
+	return b.Challenge, nil
+}
+
+// CommitDeleteWithSignature calls the CommitDeleteWithSignature interface on the Vey server.
+func (c Client) CommitDeleteWithSignature(challenge, signature []byte) error {
+	res, err := c.Do("/commitDeleteWithSignature", Body{
+		Challenge: challenge,
+		Signature: signature,
+	})
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	return nil
+}
+
+// Revocations calls /revocations on the Vey server, and returns the Feed verified with pub.
+func (c Client) Revocations(since int64, limit int, pub ed25519.PublicKey) (Feed, error) {
+	q := url.Values{}
+	q.Set("since", strconv.FormatInt(since, 10))
+	if limit > 0 {
+		q.Set("limit", strconv.Itoa(limit))
+	}
+	res, err := c.Get("/revocations", q)
+	if err != nil {
+		return Feed{}, err
+	}
+	defer res.Body.Close()
+	var buf bytes.Buffer
+	if _, err := buf.ReadFrom(res.Body); err != nil {
+		return Feed{}, err
+	}
+	return VerifyFeed(pub, res.Header.Get(FeedSignatureHeader), buf.Bytes())
+}
+
 // Open calls the /open path on the Vey server, and returns the redirect response's Location header.
 func (c Client) Open(query url.Values) (string, error) {
 	// We're expecting a 302 response
@@ -124,7 +219,7 @@ func (c Client) Do(path string, body Body) (*http.Response, error) {
 	if err != nil {
 		return nil, err
 	}
-	if res.StatusCode != 200 {
+	if res.StatusCode < 200 || res.StatusCode > 299 {
 		defer res.Body.Close()
 
 		body := Error{}
@@ -148,7 +243,7 @@ func (c Client) Get(path string, q url.Values) (*http.Response, error) {
 	if err != nil {
 		return nil, err
 	}
-	if res.StatusCode != 200 {
+	if res.StatusCode < 200 || res.StatusCode > 299 {
 		defer res.Body.Close()
 
 		body := Error{}
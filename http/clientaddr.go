@@ -0,0 +1,40 @@
+package http
+
+import (
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/mash/vey"
+)
+
+// WithClientHeader makes ClientAddr take the client address from the header, such as X-Forwarded-For,
+// when the server is behind a load balancer or API Gateway.
+func WithClientHeader(name string) Option {
+	return func(h *VeyHandler) {
+		h.clientHeader = name
+	}
+}
+
+// ClientAddr tells the client address of the request to Vey with vey.WithClient, to lock out the client. See vey.WithLockout.
+// The address is the rightmost one in the header if set, which is added by the proxy and cannot be forged by the client,
+// or the remote address of the connection.
+func ClientAddr(header string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var addr string
+		if header != "" {
+			values := strings.Split(r.Header.Get(header), ",")
+			addr = strings.TrimSpace(values[len(values)-1])
+		}
+		if addr == "" {
+			addr = r.RemoteAddr
+			if host, _, err := net.SplitHostPort(addr); err == nil {
+				addr = host
+			}
+		}
+		if addr != "" {
+			r = r.WithContext(vey.WithClient(r.Context(), addr))
+		}
+		h.ServeHTTP(w, r)
+	})
+}
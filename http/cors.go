@@ -0,0 +1,100 @@
+package http
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CORSConfig configures the CORS middleware.
+type CORSConfig struct {
+	// AllowedOrigins is a list of origins such as "https://app.example.com" that may call the APIs from browsers.
+	// "*" allows any origin.
+	AllowedOrigins []string `yaml:"allowed_origins"`
+	// AllowedHeaders is a list of request headers allowed in the actual request.
+	// Defaults to "Content-Type".
+	AllowedHeaders []string `yaml:"allowed_headers"`
+	// AllowCredentials allows browsers to send cookies and HTTP authentication.
+	// If true, the request's origin is echoed back instead of "*".
+	AllowCredentials bool `yaml:"allow_credentials"`
+	// MaxAge is how long the preflight response may be cached by browsers.
+	MaxAge time.Duration `yaml:"max_age"`
+}
+
+// WithCORS enables the CORS middleware in NewHandler.
+func WithCORS(c CORSConfig) Option {
+	return func(h *VeyHandler) {
+		h.cors = &c
+	}
+}
+
+var corsAllowedMethods = strings.Join([]string{http.MethodGet, http.MethodPost, http.MethodOptions}, ", ")
+
+// CORS handles preflight requests and adds CORS headers to responses for the allowed origins.
+// Requests from other origins are passed to h without CORS headers, so the browsers block the responses,
+// except preflight requests, which are responded with 403.
+func CORS(c CORSConfig, h http.Handler) http.Handler {
+	headers := "Content-Type"
+	if len(c.AllowedHeaders) > 0 {
+		headers = strings.Join(c.AllowedHeaders, ", ")
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		preflight := r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+
+		w.Header().Add("Vary", "Origin")
+		if origin == "" {
+			h.ServeHTTP(w, r)
+			return
+		}
+		if !c.allowed(origin) {
+			if preflight {
+				_ = WriteJSON(w, http.StatusForbidden, Error{Msg: "origin not allowed"})
+				return
+			}
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		if c.AllowCredentials || !c.wildcard() {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+		} else {
+			w.Header().Set("Access-Control-Allow-Origin", "*")
+		}
+		if c.AllowCredentials {
+			w.Header().Set("Access-Control-Allow-Credentials", "true")
+		}
+		if !preflight {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Add("Vary", "Access-Control-Request-Method")
+		w.Header().Add("Vary", "Access-Control-Request-Headers")
+		w.Header().Set("Access-Control-Allow-Methods", corsAllowedMethods)
+		w.Header().Set("Access-Control-Allow-Headers", headers)
+		if c.MaxAge > 0 {
+			w.Header().Set("Access-Control-Max-Age", strconv.Itoa(int(c.MaxAge.Seconds())))
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+func (c CORSConfig) allowed(origin string) bool {
+	for _, o := range c.AllowedOrigins {
+		if o == "*" || strings.EqualFold(o, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c CORSConfig) wildcard() bool {
+	for _, o := range c.AllowedOrigins {
+		if o == "*" {
+			return true
+		}
+	}
+	return false
+}
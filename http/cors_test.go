@@ -0,0 +1,118 @@
+package http
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mash/vey"
+	"github.com/mash/vey/email"
+)
+
+func corsHandler(c CORSConfig) http.Handler {
+	v := vey.NewVey(vey.NewDigester([]byte("salt")), vey.NewMemCache(time.Second), vey.NewMemStore())
+	return NewHandler(v, email.NewMemSender(), nil, WithCORS(c))
+}
+
+func preflight(h http.Handler, origin string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("OPTIONS", "/beginPut", nil)
+	req.Header.Set("Origin", origin)
+	req.Header.Set("Access-Control-Request-Method", "POST")
+	req.Header.Set("Access-Control-Request-Headers", "content-type")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	return w
+}
+
+func getKeys(h http.Handler, origin string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("POST", "/getKeys", strings.NewReader(`{"email":"test@example.com"}`))
+	if origin != "" {
+		req.Header.Set("Origin", origin)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	return w
+}
+
+func TestCORSPreflight(t *testing.T) {
+	h := corsHandler(CORSConfig{
+		AllowedOrigins: []string{"https://app.example.com"},
+		AllowedHeaders: []string{"Content-Type", "traceparent"},
+		MaxAge:         10 * time.Minute,
+	})
+
+	w := preflight(h, "https://app.example.com")
+	if e, g := http.StatusNoContent, w.Code; e != g {
+		t.Fatalf("expected %v but got %v", e, g)
+	}
+	for k, e := range map[string]string{
+		"Access-Control-Allow-Origin":  "https://app.example.com",
+		"Access-Control-Allow-Methods": "GET, POST, OPTIONS",
+		"Access-Control-Allow-Headers": "Content-Type, traceparent",
+		"Access-Control-Max-Age":       "600",
+	} {
+		if g := w.Header().Get(k); e != g {
+			t.Errorf("%s expected %v but got %v", k, e, g)
+		}
+	}
+	if g := w.Header().Get("Access-Control-Allow-Credentials"); g != "" {
+		t.Errorf("Access-Control-Allow-Credentials expected empty but got %v", g)
+	}
+}
+
+func TestCORSRejectedOrigin(t *testing.T) {
+	Log = NilLogger()
+	h := corsHandler(CORSConfig{
+		AllowedOrigins: []string{"https://app.example.com"},
+	})
+
+	w := preflight(h, "https://evil.example.com")
+	if e, g := http.StatusForbidden, w.Code; e != g {
+		t.Fatalf("expected %v but got %v", e, g)
+	}
+	if g := w.Header().Get("Access-Control-Allow-Origin"); g != "" {
+		t.Errorf("Access-Control-Allow-Origin expected empty but got %v", g)
+	}
+
+	w = getKeys(h, "https://evil.example.com")
+	if e, g := http.StatusOK, w.Code; e != g {
+		t.Fatalf("expected %v but got %v", e, g)
+	}
+	if g := w.Header().Get("Access-Control-Allow-Origin"); g != "" {
+		t.Errorf("Access-Control-Allow-Origin expected empty but got %v", g)
+	}
+
+	w = getKeys(h, "https://app.example.com")
+	if e, g := "https://app.example.com", w.Header().Get("Access-Control-Allow-Origin"); e != g {
+		t.Errorf("Access-Control-Allow-Origin expected %v but got %v", e, g)
+	}
+
+	// same origin or non browser requests
+	w = getKeys(h, "")
+	if e, g := http.StatusOK, w.Code; e != g {
+		t.Fatalf("expected %v but got %v", e, g)
+	}
+	if g := w.Header().Get("Access-Control-Allow-Origin"); g != "" {
+		t.Errorf("Access-Control-Allow-Origin expected empty but got %v", g)
+	}
+}
+
+func TestCORSCredentials(t *testing.T) {
+	Log = NilLogger()
+
+	w := getKeys(corsHandler(CORSConfig{AllowedOrigins: []string{"*"}}), "https://any.example.com")
+	if e, g := "*", w.Header().Get("Access-Control-Allow-Origin"); e != g {
+		t.Errorf("Access-Control-Allow-Origin expected %v but got %v", e, g)
+	}
+
+	// wildcard can't be used with credentials, so the origin is echoed back
+	w = getKeys(corsHandler(CORSConfig{AllowedOrigins: []string{"*"}, AllowCredentials: true}), "https://any.example.com")
+	if e, g := "https://any.example.com", w.Header().Get("Access-Control-Allow-Origin"); e != g {
+		t.Errorf("Access-Control-Allow-Origin expected %v but got %v", e, g)
+	}
+	if e, g := "true", w.Header().Get("Access-Control-Allow-Credentials"); e != g {
+		t.Errorf("Access-Control-Allow-Credentials expected %v but got %v", e, g)
+	}
+}
@@ -1,6 +1,7 @@
 package http
 
 import (
+	"context"
 	"errors"
 	"net/http"
 
@@ -27,9 +28,22 @@ func NewError(err error) Error {
 	if errors.As(err, &er) {
 		return er
 	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return Error{
+			Code: http.StatusGatewayTimeout,
+			Msg:  http.StatusText(http.StatusGatewayTimeout),
+			Err:  err,
+		}
+	}
 
 	switch err {
-	case vey.ErrInvalidEmail:
+	case vey.ErrInvalidEmail, vey.ErrInvalidMetadata:
+		return Error{
+			Code: http.StatusBadRequest,
+			Msg:  err.Error(),
+			Err:  nil,
+		}
+	case vey.ErrProofRequired, vey.ErrInvalidProof, vey.ErrLookupTokenRequired:
 		return Error{
 			Code: http.StatusBadRequest,
 			Msg:  err.Error(),
@@ -47,6 +61,48 @@ func NewError(err error) Error {
 			Msg:  err.Error(),
 			Err:  nil,
 		}
+	case vey.ErrSuppressed:
+		return Error{
+			Code: http.StatusUnprocessableEntity,
+			Msg:  err.Error(),
+			Err:  nil,
+		}
+	case vey.ErrTooManyKeys:
+		return Error{
+			Code: http.StatusConflict,
+			Msg:  err.Error(),
+			Err:  nil,
+		}
+	case vey.ErrKeyTypeNotAllowed, vey.ErrWeakKey:
+		return Error{
+			Code: http.StatusUnprocessableEntity,
+			Msg:  err.Error(),
+			Err:  nil,
+		}
+	case vey.ErrDomainNotAllowed:
+		return Error{
+			Code: http.StatusForbidden,
+			Msg:  err.Error(),
+			Err:  nil,
+		}
+	case vey.ErrLocked:
+		return Error{
+			Code: http.StatusTooManyRequests,
+			Msg:  err.Error(),
+			Err:  nil,
+		}
+	case vey.ErrDeniedKey:
+		return Error{
+			Code: http.StatusForbidden,
+			Msg:  err.Error(),
+			Err:  nil,
+		}
+	case vey.ErrRevoked:
+		return Error{
+			Code: http.StatusConflict,
+			Msg:  err.Error(),
+			Err:  nil,
+		}
 	default:
 		return Error{
 			Code: http.StatusInternalServerError,
@@ -0,0 +1,83 @@
+package http
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+
+	"github.com/mash/vey"
+	"github.com/mash/vey/email"
+)
+
+// maxSNSBody limits the size of the SNS message, which is at most 256KB.
+const maxSNSBody = 256 * 1024
+
+// WithSESFeedback handles the SES bounce and complaint notifications delivered by SNS at /sesFeedback.
+// The messages are verified by v, the subscription is confirmed,
+// and the recipients of the permanent bounces and the complaints are suppressed.
+// Vey should implement vey.Suppressor and be configured with a vey.SuppressionList.
+func WithSESFeedback(v *email.SNSVerifier) Option {
+	return func(h *VeyHandler) {
+		h.sns = v
+	}
+}
+
+// SESFeedback handles the SNS messages.
+// SNS posts the JSON body with the text/plain Content-Type, so it does not use AcceptJSON.
+func (h *VeyHandler) SESFeedback(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodPost {
+		return Error{
+			Code: http.StatusMethodNotAllowed,
+			Msg:  http.StatusText(http.StatusMethodNotAllowed),
+		}
+	}
+	var m email.SNSMessage
+	if err := json.NewDecoder(io.LimitReader(r.Body, maxSNSBody)).Decode(&m); err != nil {
+		return Error{
+			Code: http.StatusBadRequest,
+			Msg:  "json decode failed",
+			Err:  err,
+		}
+	}
+	ctx := r.Context()
+	if err := h.sns.Verify(ctx, m); err != nil {
+		return Error{
+			Code: http.StatusForbidden,
+			Msg:  "SNS message verification failed",
+			Err:  err,
+		}
+	}
+
+	switch m.Type {
+	case email.SNSSubscriptionConfirmation:
+		if err := h.sns.Confirm(ctx, m); err != nil {
+			return err
+		}
+	case email.SNSNotification:
+		n, err := email.ParseSESNotification(m.Message)
+		if err != nil {
+			return Error{
+				Code: http.StatusBadRequest,
+				Msg:  "SES notification decode failed",
+				Err:  err,
+			}
+		}
+		reason, recipients := n.Suppressions()
+		if len(recipients) > 0 {
+			s, ok := h.Vey.(vey.Suppressor)
+			if !ok {
+				return vey.ErrNoSuppressionList
+			}
+			for _, addr := range recipients {
+				if err := s.Suppress(ctx, addr, reason); err != nil {
+					if err == vey.ErrInvalidEmail {
+						// SNS would retry forever, skip it
+						continue
+					}
+					return err
+				}
+			}
+		}
+	}
+	return WriteJSON(w, 200, map[string]interface{}{})
+}
@@ -0,0 +1,109 @@
+package http
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/mash/vey"
+	"github.com/mash/vey/email"
+)
+
+func TestSESFeedback(t *testing.T) {
+	Log = NilLogger()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "sns.amazonaws.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	topic := "arn:aws:sns:us-east-1:123456789012:ses-feedback"
+
+	v := vey.NewVey(vey.NewDigester([]byte("salt")), vey.NewMemCache(time.Second), vey.NewMemStore(),
+		vey.WithSuppressionList(vey.NewMemSuppressionList()))
+	h := NewHandler(v, email.NewMemSender(), nil,
+		WithSESFeedback(&email.SNSVerifier{TopicARNs: []string{topic}, Certificate: cert}))
+	l := serve(t, h)
+	root := "http://" + l.Addr().String()
+
+	post := func(m email.SNSMessage, sign bool) int {
+		t.Helper()
+		if sign {
+			s, err := m.StringToSign()
+			if err != nil {
+				t.Fatal(err)
+			}
+			d := sha256.Sum256([]byte(s))
+			sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, d[:])
+			if err != nil {
+				t.Fatal(err)
+			}
+			m.Signature = base64.StdEncoding.EncodeToString(sig)
+		}
+		b, _ := json.Marshal(m)
+		res, err := http.Post(root+"/sesFeedback", "text/plain; charset=UTF-8", bytes.NewReader(b))
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		return res.StatusCode
+	}
+
+	m := email.SNSMessage{
+		Type:             email.SNSNotification,
+		MessageId:        "id",
+		TopicArn:         topic,
+		Message:          `{"notificationType":"Bounce","bounce":{"bounceType":"Permanent","bouncedRecipients":[{"emailAddress":"test@example.com"}]}}`,
+		Timestamp:        time.Now().UTC().Format("2006-01-02T15:04:05.000Z"),
+		SignatureVersion: "2",
+		Signature:        base64.StdEncoding.EncodeToString([]byte("invalid")),
+	}
+	if e, g := http.StatusForbidden, post(m, false); e != g {
+		t.Fatalf("unsigned: expected %v but got %v", e, g)
+	}
+
+	c := NewClient(root)
+	if err := c.BeginPut("test@example.com", vey.PublicKey{Key: []byte("key")}); err != nil {
+		t.Fatal(err)
+	}
+
+	if e, g := http.StatusOK, post(m, true); e != g {
+		t.Fatalf("expected %v but got %v", e, g)
+	}
+
+	err = c.BeginPut("test@example.com", vey.PublicKey{Key: []byte("key")})
+	var cerr ClientError
+	if !errors.As(err, &cerr) || cerr.Res == nil {
+		t.Fatalf("expected ClientError but got %v", err)
+	}
+	if e, g := http.StatusUnprocessableEntity, cerr.Res.StatusCode; e != g {
+		t.Errorf("expected %v but got %v", e, g)
+	}
+	if err := c.BeginPut("other@example.com", vey.PublicKey{Key: []byte("key")}); err != nil {
+		t.Errorf("other addresses should not be suppressed but got %v", err)
+	}
+}
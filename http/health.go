@@ -0,0 +1,74 @@
+package http
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/mash/vey"
+)
+
+// pingTimeout bounds each readiness check, so that a hanging backend fails the probe instead of blocking it.
+const pingTimeout = 2 * time.Second
+
+// Option configures VeyHandler in NewHandler.
+type Option func(*VeyHandler)
+
+// WithVersion sets the version and build date returned by /version.
+func WithVersion(version, buildDate string) Option {
+	return func(h *VeyHandler) {
+		h.Version = version
+		h.BuildDate = buildDate
+	}
+}
+
+// WithPinger adds a readiness check to /readyz.
+// name identifies the check in the response, such as "store" or "cache".
+func WithPinger(name string, p vey.Pinger) Option {
+	return func(h *VeyHandler) {
+		h.pingers = append(h.pingers, namedPinger{name: name, Pinger: p})
+	}
+}
+
+type namedPinger struct {
+	vey.Pinger
+	name string
+}
+
+// Healthz responds 200 as long as the process is serving requests.
+func (h *VeyHandler) Healthz(w http.ResponseWriter, r *http.Request) error {
+	return WriteJSON(w, 200, map[string]interface{}{
+		"status": "ok",
+	})
+}
+
+// Readyz pings the Store and Cache backends configured by WithPinger,
+// and responds 503 if any of them failed.
+func (h *VeyHandler) Readyz(w http.ResponseWriter, r *http.Request) error {
+	status := http.StatusOK
+	checks := make(map[string]string, len(h.pingers))
+	for _, p := range h.pingers {
+		ctx, cancel := context.WithTimeout(r.Context(), pingTimeout)
+		err := p.Ping(ctx)
+		cancel()
+		if err != nil {
+			Log.Error(err)
+			status = http.StatusServiceUnavailable
+			checks[p.name] = err.Error()
+			continue
+		}
+		checks[p.name] = "ok"
+	}
+	return WriteJSON(w, status, map[string]interface{}{
+		"status": http.StatusText(status),
+		"checks": checks,
+	})
+}
+
+// VersionInfo responds the version and build date injected via go build -ldflags.
+func (h *VeyHandler) VersionInfo(w http.ResponseWriter, r *http.Request) error {
+	return WriteJSON(w, 200, map[string]interface{}{
+		"version":   h.Version,
+		"buildDate": h.BuildDate,
+	})
+}
@@ -0,0 +1,74 @@
+package http
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/mash/vey"
+	"github.com/mash/vey/email"
+)
+
+type pingerFunc func(context.Context) error
+
+func (f pingerFunc) Ping(ctx context.Context) error {
+	return f(ctx)
+}
+
+func TestHealth(t *testing.T) {
+	Log = NilLogger()
+
+	v := vey.NewVey(vey.NewDigester([]byte("salt")), vey.NewMemCache(time.Second), vey.NewMemStore())
+	var storeErr error
+	h := NewHandler(v, email.NewMemSender(), nil,
+		WithVersion("v1.0.0", "2022-10-01"),
+		WithPinger("store", pingerFunc(func(context.Context) error { return storeErr })),
+		WithPinger("cache", pingerFunc(func(context.Context) error { return nil })),
+	)
+
+	get := func(path string) (int, map[string]interface{}) {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		var body map[string]interface{}
+		if err := json.NewDecoder(w.Body).Decode(&body); err != nil {
+			t.Fatalf("%s: %v", path, err)
+		}
+		return w.Code, body
+	}
+
+	if code, _ := get("/healthz"); code != http.StatusOK {
+		t.Errorf("/healthz expected 200 but got %v", code)
+	}
+
+	if code, body := get("/readyz"); code != http.StatusOK {
+		t.Errorf("/readyz expected 200 but got %v: %v", code, body)
+	}
+
+	storeErr = errors.New("table is gone")
+	code, body := get("/readyz")
+	if code != http.StatusServiceUnavailable {
+		t.Errorf("/readyz expected 503 but got %v", code)
+	}
+	checks := body["checks"].(map[string]interface{})
+	if e, g := "table is gone", checks["store"]; e != g {
+		t.Errorf("/readyz store check expected %v but got %v", e, g)
+	}
+	if e, g := "ok", checks["cache"]; e != g {
+		t.Errorf("/readyz cache check expected %v but got %v", e, g)
+	}
+
+	code, body = get("/version")
+	if code != http.StatusOK {
+		t.Errorf("/version expected 200 but got %v", code)
+	}
+	if e, g := "v1.0.0", body["version"]; e != g {
+		t.Errorf("/version expected %v but got %v", e, g)
+	}
+	if e, g := "2022-10-01", body["buildDate"]; e != g {
+		t.Errorf("/version buildDate expected %v but got %v", e, g)
+	}
+}
@@ -0,0 +1,85 @@
+package http
+
+import (
+	"html/template"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/mash/vey/email"
+)
+
+// WithInbox serves the messages in m at /dev/inbox, with the links to commit the deletes.
+// The inbox shows the tokens and challenges to anyone, so enable it only in development.
+func WithInbox(m email.Mailbox) Option {
+	return func(h *VeyHandler) {
+		h.inbox = m
+	}
+}
+
+// Inbox lists the captured messages, the newest first.
+func (h *VeyHandler) Inbox(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return nil
+	}
+	ms, err := h.inbox.Messages()
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	return inboxTemplate.Execute(w, ms)
+}
+
+var unsafeSchemes = map[string]bool{"javascript": true, "vbscript": true, "data": true}
+
+var inboxTemplate = template.Must(template.New("inbox").Funcs(template.FuncMap{
+	"commitDelete": func(token string) string {
+		return "/commitDelete?token=" + url.QueryEscape(token)
+	},
+	"safeURL": func(s string) template.URL {
+		// the links may have the custom schemes of the apps, which html/template would replace
+		if u, err := url.Parse(s); err != nil || unsafeSchemes[strings.ToLower(u.Scheme)] {
+			return "#"
+		}
+		return template.URL(s)
+	},
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Vey inbox</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+article { border-bottom: 1px solid #ccc; padding: 1em 0; }
+pre { background: #f4f4f4; padding: .5em; white-space: pre-wrap; word-break: break-all; }
+.meta { color: #666; }
+</style>
+</head>
+<body>
+<h1>Inbox</h1>
+{{- if not . }}
+<p>No messages.</p>
+{{- end }}
+{{- range . }}
+<article id="{{ .ID }}">
+<h2>{{ .Subject }}</h2>
+<p class="meta">To: {{ .To }}<br>From: {{ .From }}<br>Date: {{ .Date.Format "2006-01-02 15:04:05 MST" }}</p>
+{{- if .Token }}
+<p>Token: <code>{{ .Token }}</code></p>
+<p><a href="{{ commitDelete .Token }}">Commit delete</a></p>
+{{- end }}
+{{- if .Challenge }}
+<p>Challenge: <code>{{ .Challenge }}</code></p>
+<p>Sign the challenge with the private key and call commitPut.</p>
+{{- end }}
+{{- range .Links }}
+<p><a href="{{ safeURL . }}">{{ . }}</a></p>
+{{- end }}
+<details><summary>Text</summary><pre>{{ .Text }}</pre></details>
+</article>
+{{- end }}
+</body>
+</html>
+`))
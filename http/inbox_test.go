@@ -0,0 +1,56 @@
+package http
+
+import (
+	"html"
+	"io"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mash/vey"
+	"github.com/mash/vey/email"
+)
+
+func TestInbox(t *testing.T) {
+	Log = NilLogger()
+
+	v := vey.NewVey(vey.NewDigester([]byte("salt")), vey.NewMemCache(time.Second), vey.NewMemStore())
+	sender := email.NewFileSender(email.FileConfig{Path: filepath.Join(t.TempDir(), "mail")})
+	h := NewHandler(v, sender, nil, WithInbox(sender.(email.Mailbox)))
+	l := serve(t, h)
+	root := "http://" + l.Addr().String()
+	c := NewClient(root)
+
+	key := vey.PublicKey{Key: []byte("key")}
+	if err := c.BeginPut("test@example.com", key); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.BeginDelete("test@example.com", key); err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := http.Get(root + "/dev/inbox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := io.ReadAll(res.Body)
+	res.Body.Close()
+	if e, g := http.StatusOK, res.StatusCode; e != g {
+		t.Fatalf("expected %v but got %v", e, g)
+	}
+	ms, err := sender.(email.Mailbox).Messages()
+	if err != nil {
+		t.Fatal(err)
+	}
+	page := html.UnescapeString(string(b))
+	href := "/commitDelete?token=" + url.QueryEscape(ms[0].Token)
+	if !strings.Contains(page, `href="`+href+`"`) {
+		t.Errorf("expected the commitDelete link %s in %s", href, page)
+	}
+	if !strings.Contains(page, ms[1].Challenge) {
+		t.Errorf("expected the challenge %s in %s", ms[1].Challenge, page)
+	}
+}
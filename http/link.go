@@ -0,0 +1,192 @@
+package http
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mash/vey"
+)
+
+// The link to confirm the put is BaseURL + "open" with the query parameters:
+//
+//	v  the version of the link format, "1"
+//	c  the challenge, base64url encoded without padding
+//	e  EmailHash of the email address
+//	k  KeyFingerprint of the public key to put
+//	x  the expiry in unix seconds
+//	s  HMAC-SHA256 of the other parameters, base64url encoded without padding
+//
+// The apps receive the same parameters when the landing page hands off the link.
+// They should check e and k before signing, and call commitPut with the challenge decoded from c.
+const (
+	linkVersion = "1"
+	// linkDomain separates the link signatures from the other uses of the secret.
+	linkDomain = "vey-link-v1"
+	// minLinkSecret is the minimum length of the HMAC key.
+	minLinkSecret = 32
+	// defaultLinkExpiry matches the default cache expiry of the challenges.
+	defaultLinkExpiry = 15 * time.Minute
+)
+
+var (
+	ErrLinkInvalid = errors.New("link is invalid")
+	ErrLinkExpired = errors.New("link is expired")
+)
+
+// LinkConfig configures the signed links in the put emails, and the landing page at /open.
+type LinkConfig struct {
+	// BaseURL is the public URL of this server, such as "https://vey.example.com/".
+	BaseURL string `yaml:"base_url"`
+	// Secret is the base64 encoded HMAC-SHA256 key of at least 32 bytes.
+	Secret string `yaml:"secret"`
+	// Expiry is how long the links are valid. It should not exceed the cache expiry of the challenges.
+	// Defaults to 15m.
+	Expiry time.Duration `yaml:"expiry"`
+	// UniversalLinkURL is the https URL handled by the app, such as "https://app.example.com/vey/open".
+	// The landing page hands off the link to it, in addition to the custom scheme OpenURL.
+	UniversalLinkURL string `yaml:"universal_link_url"`
+	// WebSigner enables the form in the landing page that signs the challenge with WebCrypto in the browser.
+	WebSigner bool `yaml:"web_signer"`
+}
+
+// Link is the content of the link to confirm the put.
+type Link struct {
+	Challenge      []byte
+	EmailHash      string
+	KeyFingerprint string
+	Expires        time.Time
+}
+
+// Query returns the query parameters of l without the signature.
+func (l Link) Query() url.Values {
+	return url.Values{
+		"v": {linkVersion},
+		"c": {base64.RawURLEncoding.EncodeToString(l.Challenge)},
+		"e": {l.EmailHash},
+		"k": {l.KeyFingerprint},
+		"x": {strconv.FormatInt(l.Expires.Unix(), 10)},
+	}
+}
+
+// ParseLink parses the query parameters of the link without verifying the signature.
+// Apps use it to read the handed off link.
+func ParseLink(q url.Values) (Link, error) {
+	if q.Get("v") != linkVersion {
+		return Link{}, ErrLinkInvalid
+	}
+	c, err := base64.RawURLEncoding.DecodeString(q.Get("c"))
+	if err != nil || len(c) == 0 {
+		return Link{}, ErrLinkInvalid
+	}
+	x, err := strconv.ParseInt(q.Get("x"), 10, 64)
+	if err != nil {
+		return Link{}, ErrLinkInvalid
+	}
+	return Link{
+		Challenge:      c,
+		EmailHash:      q.Get("e"),
+		KeyFingerprint: q.Get("k"),
+		Expires:        time.Unix(x, 0),
+	}, nil
+}
+
+// EmailHash returns the SHA-256 of the email address as given, base64url encoded without padding.
+// Unlike vey.EmailDigest, it is not salted, so that the apps can tell which address the link is for.
+func EmailHash(email string) string {
+	h := sha256.Sum256([]byte(email))
+	return base64.RawURLEncoding.EncodeToString(h[:])
+}
+
+// KeyFingerprint returns the SHA256 fingerprint of the public key. See vey.PublicKey.Fingerprint.
+func KeyFingerprint(k vey.PublicKey) string {
+	return k.Fingerprint()
+}
+
+// LinkSigner signs and verifies the links.
+type LinkSigner struct {
+	Config LinkConfig
+
+	open   *url.URL
+	secret []byte
+	now    func() time.Time
+}
+
+func NewLinkSigner(c LinkConfig) (*LinkSigner, error) {
+	base, err := url.Parse(c.BaseURL)
+	if err != nil || !base.IsAbs() {
+		return nil, fmt.Errorf("link base_url should be an absolute URL: %q", c.BaseURL)
+	}
+	secret, err := base64.StdEncoding.DecodeString(c.Secret)
+	if err != nil {
+		return nil, fmt.Errorf("link secret: %w", err)
+	}
+	if len(secret) < minLinkSecret {
+		return nil, fmt.Errorf("link secret should be at least %d bytes", minLinkSecret)
+	}
+	if c.Expiry <= 0 {
+		c.Expiry = defaultLinkExpiry
+	}
+	open := *base
+	open.Path = strings.TrimSuffix(open.Path, "/") + "/open"
+	open.RawPath = ""
+	return &LinkSigner{
+		Config: c,
+		open:   &open,
+		secret: secret,
+		now:    time.Now,
+	}, nil
+}
+
+// URL returns the signed link to confirm putting the key to the email address with the challenge.
+func (s *LinkSigner) URL(email string, key vey.PublicKey, challenge []byte) string {
+	q := s.Sign(Link{
+		Challenge:      challenge,
+		EmailHash:      EmailHash(email),
+		KeyFingerprint: KeyFingerprint(key),
+		Expires:        s.now().Add(s.Config.Expiry),
+	})
+	u := *s.open
+	u.RawQuery = q.Encode()
+	return u.String()
+}
+
+// Sign returns the query parameters of l with the signature.
+func (s *LinkSigner) Sign(l Link) url.Values {
+	q := l.Query()
+	q.Set("s", base64.RawURLEncoding.EncodeToString(s.mac(q)))
+	return q
+}
+
+// Verify verifies the signature and the expiry of the link, and returns its content.
+func (s *LinkSigner) Verify(q url.Values) (Link, error) {
+	l, err := ParseLink(q)
+	if err != nil {
+		return l, err
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(q.Get("s"))
+	if err != nil || !hmac.Equal(sig, s.mac(l.Query())) {
+		return Link{}, ErrLinkInvalid
+	}
+	if !s.now().Before(l.Expires) {
+		return l, ErrLinkExpired
+	}
+	return l, nil
+}
+
+func (s *LinkSigner) mac(q url.Values) []byte {
+	m := hmac.New(sha256.New, s.secret)
+	m.Write([]byte(linkDomain))
+	for _, k := range []string{"v", "c", "e", "k", "x"} {
+		// length prefixed, so that the values cannot be shifted across the parameters
+		v := q.Get(k)
+		fmt.Fprintf(m, "\n%s=%d:%s", k, len(v), v)
+	}
+	return m.Sum(nil)
+}
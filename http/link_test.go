@@ -0,0 +1,179 @@
+package http
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mash/vey"
+	"github.com/mash/vey/email"
+	"golang.org/x/crypto/ssh"
+)
+
+var testLinkSecret = base64.StdEncoding.EncodeToString(bytes.Repeat([]byte("s"), 32))
+
+func TestLinkSigner(t *testing.T) {
+	if _, err := NewLinkSigner(LinkConfig{BaseURL: "https://vey.example.com", Secret: "c2hvcnQ="}); err == nil {
+		t.Error("short secret should be an error")
+	}
+	if _, err := NewLinkSigner(LinkConfig{BaseURL: "/relative", Secret: testLinkSecret}); err == nil {
+		t.Error("relative base_url should be an error")
+	}
+
+	s, err := NewLinkSigner(LinkConfig{BaseURL: "https://vey.example.com/prod", Secret: testLinkSecret, Expiry: time.Minute})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(1600000000, 0)
+	s.now = func() time.Time { return now }
+
+	key := vey.PublicKey{Key: []byte("key")}
+	link := s.URL("test@example.com", key, []byte("challenge"))
+	u, err := url.Parse(link)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e, g := "https://vey.example.com/prod/open", u.Scheme+"://"+u.Host+u.Path; e != g {
+		t.Errorf("expected %v but got %v", e, g)
+	}
+	l, err := s.Verify(u.Query())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e, g := "challenge", string(l.Challenge); e != g {
+		t.Errorf("Challenge expected %v but got %v", e, g)
+	}
+	if e, g := EmailHash("test@example.com"), l.EmailHash; e != g {
+		t.Errorf("EmailHash expected %v but got %v", e, g)
+	}
+	if e, g := KeyFingerprint(key), l.KeyFingerprint; e != g {
+		t.Errorf("KeyFingerprint expected %v but got %v", e, g)
+	}
+
+	for _, p := range []string{"v", "c", "e", "k", "x", "s"} {
+		q := u.Query()
+		q.Set(p, q.Get(p)+"A")
+		if _, err := s.Verify(q); !errors.Is(err, ErrLinkInvalid) {
+			t.Errorf("tampered %s: expected %v but got %v", p, ErrLinkInvalid, err)
+		}
+	}
+
+	now = now.Add(time.Minute)
+	if _, err := s.Verify(u.Query()); !errors.Is(err, ErrLinkExpired) {
+		t.Errorf("expected %v but got %v", ErrLinkExpired, err)
+	}
+}
+
+func TestKeyFingerprint(t *testing.T) {
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sshpub, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := vey.PublicKey{Type: vey.SSHEd25519, Key: ssh.MarshalAuthorizedKey(sshpub)}
+	if e, g := ssh.FingerprintSHA256(sshpub), KeyFingerprint(key); e != g {
+		t.Errorf("expected %v but got %v", e, g)
+	}
+}
+
+func TestLanding(t *testing.T) {
+	Log = NilLogger()
+
+	v := vey.NewVey(vey.NewDigester([]byte("salt")), vey.NewMemCache(time.Second), vey.NewMemStore())
+	sender := email.NewMemSender().(*email.MemSender)
+	open, _ := url.Parse("exampleapp://open")
+	// the links point to the server, so listen before making the handler
+	l, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		l.Close()
+	})
+	root := "http://" + l.Addr().String()
+	signer, err := NewLinkSigner(LinkConfig{
+		BaseURL:          root,
+		Secret:           testLinkSecret,
+		UniversalLinkURL: "https://app.example.com/vey/open",
+		WebSigner:        true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		_ = http.Serve(l, NewHandler(v, sender, open, WithLinks(signer)))
+	}()
+
+	edpub, edpriv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sshpub, err := ssh.NewPublicKey(edpub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := vey.PublicKey{Type: vey.SSHEd25519, Key: ssh.MarshalAuthorizedKey(sshpub)}
+	c := NewClient(root)
+	if err := c.BeginPut("test@example.com", key); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(sender.Link, root+"/open?") {
+		t.Fatalf("expected the link to be sent but got %v", sender.Link)
+	}
+
+	get := func(link string) (int, string) {
+		t.Helper()
+		res, err := http.Get(link)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		b, _ := io.ReadAll(res.Body)
+		return res.StatusCode, string(b)
+	}
+	status, page := get(sender.Link)
+	if e, g := http.StatusOK, status; e != g {
+		t.Fatalf("expected %v but got %v: %s", e, g, page)
+	}
+	for _, s := range []string{ssh.FingerprintSHA256(sshpub), `href="exampleapp://open?`, `href="https://app.example.com/vey/open?`, `id="signer"`} {
+		if !strings.Contains(page, s) {
+			t.Errorf("expected %s in %s", s, page)
+		}
+	}
+
+	if status, _ := get(sender.Link + "A"); status != http.StatusBadRequest {
+		t.Errorf("tampered link: expected %v but got %v", http.StatusBadRequest, status)
+	}
+
+	// the app signs the handed off challenge
+	u, _ := url.Parse(sender.Link)
+	link, err := ParseLink(u.Query())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e, g := KeyFingerprint(key), link.KeyFingerprint; e != g {
+		t.Errorf("expected %v but got %v", e, g)
+	}
+	b, _ := json.Marshal(Body{Challenge: link.Challenge, Signature: ed25519.Sign(edpriv, link.Challenge)})
+	res, err := http.Post(root+"/commitPut", "application/json", bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if e, g := http.StatusOK, res.StatusCode; e != g {
+		t.Errorf("commitPut expected %v but got %v", e, g)
+	}
+}
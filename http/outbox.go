@@ -0,0 +1,30 @@
+package http
+
+import (
+	"net/http"
+
+	"github.com/mash/vey"
+	"github.com/mash/vey/email"
+)
+
+// WithOutbox queues the emails in o instead of sending them within the request,
+// and beginDelete and beginPut respond 202 Accepted once the email is queued.
+// Run an email.Worker with the Sender to send the queued emails.
+// If o implements vey.Pinger, it is checked by /readyz.
+func WithOutbox(o email.Outbox) Option {
+	return func(h *VeyHandler) {
+		h.Sender = email.NewOutboxSender(o)
+		h.queued = true
+		if p, ok := o.(vey.Pinger); ok {
+			h.pingers = append(h.pingers, namedPinger{name: "outbox", Pinger: p})
+		}
+	}
+}
+
+// sentStatus is the status code after the email is sent or queued.
+func (h *VeyHandler) sentStatus() int {
+	if h.queued {
+		return http.StatusAccepted
+	}
+	return http.StatusOK
+}
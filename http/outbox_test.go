@@ -0,0 +1,68 @@
+package http
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/mash/vey"
+	"github.com/mash/vey/email"
+)
+
+func TestOutbox(t *testing.T) {
+	Log = NilLogger()
+
+	v := vey.NewVey(vey.NewDigester([]byte("salt")), vey.NewMemCache(time.Second), vey.NewMemStore())
+	sender := email.NewMemSender().(*email.MemSender)
+	outbox := email.NewMemOutbox().(*email.MemOutbox)
+	h := NewHandler(v, sender, nil, WithOutbox(outbox))
+	l := serve(t, h)
+	root := "http://" + l.Addr().String()
+
+	b, _ := json.Marshal(Body{
+		Email:     "test@example.com",
+		PublicKey: vey.PublicKey{Key: []byte("key")},
+	})
+	res, err := http.Post(root+"/beginPut", "application/json", bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if e, g := http.StatusAccepted, res.StatusCode; e != g {
+		t.Fatalf("expected %v but got %v", e, g)
+	}
+	if e, g := "", sender.Challenge; e != g {
+		t.Errorf("the email should not be sent within the request but got %v", g)
+	}
+	if e, g := 1, outbox.Len(); e != g {
+		t.Fatalf("expected %v queued but got %v", e, g)
+	}
+
+	// Client accepts 202
+	if err := NewClient(root).BeginDelete("test@example.com", vey.PublicKey{Key: []byte("key")}); err != nil {
+		t.Fatal(err)
+	}
+	if e, g := 2, outbox.Len(); e != g {
+		t.Fatalf("expected %v queued but got %v", e, g)
+	}
+
+	ms, err := outbox.Receive(context.Background(), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := email.NewWorker(outbox, sender)
+	for _, m := range ms {
+		if err := w.Process(context.Background(), m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if sender.Challenge == "" || sender.Token == "" {
+		t.Errorf("expected the challenge and token to be sent but got %v and %v", sender.Challenge, sender.Token)
+	}
+	if e, g := 0, outbox.Len(); e != g {
+		t.Errorf("expected %v queued but got %v", e, g)
+	}
+}
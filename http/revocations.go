@@ -0,0 +1,124 @@
+package http
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/mash/vey"
+)
+
+const (
+	// FeedSignatureHeader is the header of the /revocations response that has the signature of the body.
+	// The value is "ed25519=" followed by the base64 encoded signature of feedDomain and the body.
+	FeedSignatureHeader = "Vey-Feed-Signature"
+	// feedDomain separates the feed signatures from the other uses of the key.
+	feedDomain = "vey-revocation-feed-v1\n"
+
+	defaultFeedLimit = 100
+	maxFeedLimit     = 1000
+)
+
+// ErrFeedSignature indicates that the feed is not signed with the expected key.
+var ErrFeedSignature = errors.New("invalid feed signature")
+
+// WithRevocationFeed serves the Revocations in l at /revocations, signed with key.
+// The relying parties that cache the keys poll it with the "since" parameter set to the Next of the last Feed,
+// and verify it with the public key of key. See VerifyFeed.
+func WithRevocationFeed(l vey.RevocationList, key ed25519.PrivateKey) Option {
+	return func(h *VeyHandler) {
+		h.revocations = l
+		h.feedKey = key
+	}
+}
+
+// DecodeFeedKey returns the key to sign the feed from the base64 encoded Ed25519 seed.
+func DecodeFeedKey(seed string) (ed25519.PrivateKey, error) {
+	b, err := base64.StdEncoding.DecodeString(seed)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) != ed25519.SeedSize {
+		return nil, errors.New("feed key should be a 32 byte Ed25519 seed")
+	}
+	return ed25519.NewKeyFromSeed(b), nil
+}
+
+// Feed is the response of /revocations.
+type Feed struct {
+	Revocations []vey.Revocation `json:"revocations"`
+	// Next is the Seq of the last Revocation, or the requested since if there are none. Poll with it next time.
+	Next int64 `json:"next"`
+}
+
+// Revocations serves the Revocations after the "since" query parameter, at most "limit" of them.
+func (h *VeyHandler) Revocations(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		return Error{
+			Code: http.StatusMethodNotAllowed,
+			Msg:  http.StatusText(http.StatusMethodNotAllowed),
+		}
+	}
+	q := r.URL.Query()
+	var since int64
+	if s := q.Get("since"); s != "" {
+		var err error
+		if since, err = strconv.ParseInt(s, 10, 64); err != nil || since < 0 {
+			return Error{Code: http.StatusBadRequest, Msg: "invalid since", Err: err}
+		}
+	}
+	limit := defaultFeedLimit
+	if s := q.Get("limit"); s != "" {
+		var err error
+		if limit, err = strconv.Atoi(s); err != nil || limit <= 0 {
+			return Error{Code: http.StatusBadRequest, Msg: "invalid limit", Err: err}
+		}
+		if limit > maxFeedLimit {
+			limit = maxFeedLimit
+		}
+	}
+	rs, err := h.revocations.Since(r.Context(), since, limit)
+	if err != nil {
+		return err
+	}
+	f := Feed{Revocations: rs, Next: since}
+	if len(rs) > 0 {
+		f.Next = rs[len(rs)-1].Seq
+	}
+	body, err := json.Marshal(f)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set(FeedSignatureHeader, SignFeed(h.feedKey, body))
+	w.WriteHeader(http.StatusOK)
+	_, err = w.Write(body)
+	return err
+}
+
+// SignFeed returns the FeedSignatureHeader value for body.
+func SignFeed(key ed25519.PrivateKey, body []byte) string {
+	return "ed25519=" + base64.StdEncoding.EncodeToString(ed25519.Sign(key, feedMessage(body)))
+}
+
+// VerifyFeed verifies the FeedSignatureHeader value of the body with pub, and returns the Feed in it.
+func VerifyFeed(pub ed25519.PublicKey, header string, body []byte) (Feed, error) {
+	sig, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(header, "ed25519="))
+	if err != nil || !strings.HasPrefix(header, "ed25519=") || !ed25519.Verify(pub, feedMessage(body), sig) {
+		return Feed{}, ErrFeedSignature
+	}
+	var f Feed
+	if err := json.NewDecoder(bytes.NewReader(body)).Decode(&f); err != nil {
+		return Feed{}, err
+	}
+	return f, nil
+}
+
+func feedMessage(body []byte) []byte {
+	return append([]byte(feedDomain), body...)
+}
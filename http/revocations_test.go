@@ -0,0 +1,85 @@
+package http
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"testing"
+	"time"
+
+	"github.com/mash/vey"
+)
+
+func TestRevocations(t *testing.T) {
+	Log = NilLogger()
+
+	l := vey.NewMemRevocationList()
+	digester := vey.NewDigester([]byte("salt"))
+	store := vey.NewMemStore()
+	v := vey.NewVey(digester, vey.NewMemCache(time.Second), store, vey.WithRevocationList(l))
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := NewHandler(v, nil, nil, WithRevocationFeed(l, priv))
+	c := NewClient("http://" + serve(t, h).Addr().String())
+
+	key := vey.PublicKey{Key: []byte("key")}
+	for _, k := range []vey.PublicKey{key, {Key: []byte("key2")}} {
+		if err := store.Put(digester.Of("test@example.com"), k); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := v.(vey.Revoker).Revoke(context.Background(), "test@example.com", key, vey.RevokeCompromised); err != nil {
+		t.Fatal(err)
+	}
+	if err := v.(vey.Revoker).Revoke(context.Background(), "test@example.com", vey.PublicKey{Key: []byte("key2")}, vey.RevokeCompromised); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := c.Revocations(0, 1, pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e, g := 1, len(f.Revocations); e != g {
+		t.Fatalf("expected %v but got %v", e, g)
+	}
+	if e, g := key.Fingerprint(), f.Revocations[0].KeyFingerprint; e != g {
+		t.Errorf("expected %v but got %v", e, g)
+	}
+	if e, g := vey.RevokeCompromised, f.Revocations[0].Reason; e != g {
+		t.Errorf("expected %v but got %v", e, g)
+	}
+	if f.Revocations[0].EmailDigest != nil {
+		t.Errorf("the digest should not be published but got %v", f.Revocations[0].EmailDigest)
+	}
+
+	// poll with Next
+	f, err = c.Revocations(f.Next, 0, pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e, g := int64(2), f.Next; e != g {
+		t.Errorf("expected %v but got %v", e, g)
+	}
+	f, err = c.Revocations(f.Next, 0, pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e, g := 0, len(f.Revocations); e != g {
+		t.Errorf("expected %v but got %v", e, g)
+	}
+	if e, g := int64(2), f.Next; e != g {
+		t.Errorf("expected %v but got %v", e, g)
+	}
+
+	// signed by another key
+	other, _, _ := ed25519.GenerateKey(rand.Reader)
+	if _, err := c.Revocations(0, 0, other); err != ErrFeedSignature {
+		t.Errorf("expected %v but got %v", ErrFeedSignature, err)
+	}
+	body := []byte(`{"revocations":[],"next":0}`)
+	if _, err := VerifyFeed(pub, SignFeed(priv, body), append(body, ' ')); err != ErrFeedSignature {
+		t.Errorf("expected %v but got %v", ErrFeedSignature, err)
+	}
+}
@@ -0,0 +1,164 @@
+package http
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// ServerConfig configures Server.
+type ServerConfig struct {
+	// Network is "tcp" or "unix". Defaults to "tcp".
+	Network string
+	// Addr is the address to listen on, such as ":8000" for "tcp", or the socket path for "unix".
+	Addr string
+
+	// See http.Server for the timeouts. Zero means no timeout.
+	ReadTimeout       time.Duration
+	ReadHeaderTimeout time.Duration
+	WriteTimeout      time.Duration
+	IdleTimeout       time.Duration
+	// ShutdownTimeout bounds how long Run waits for in-flight requests to finish after ctx is done.
+	// Zero means Run waits until all connections are idle.
+	ShutdownTimeout time.Duration
+
+	// CertFile and KeyFile are PEM encoded files to serve TLS.
+	// TLS is disabled if CertFile is empty.
+	CertFile string
+	KeyFile  string
+}
+
+// Server runs the http.Server with ServerConfig until the context is done.
+type Server struct {
+	Config  ServerConfig
+	Handler http.Handler
+	// Closers are closed after the server has shut down, such as Stores and Caches that implement io.Closer.
+	Closers []io.Closer
+
+	m    sync.RWMutex
+	cert *tls.Certificate
+}
+
+// NewServer returns a Server.
+// NewServer loads the TLS certificate if configured, so that misconfiguration fails fast.
+func NewServer(c ServerConfig, h http.Handler, closers ...io.Closer) (*Server, error) {
+	s := &Server{
+		Config:  c,
+		Handler: h,
+		Closers: closers,
+	}
+	if c.CertFile != "" {
+		if err := s.ReloadCert(); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// ReloadCert loads the certificate and key from CertFile and KeyFile.
+// New TLS connections use the reloaded certificate. Established connections are not affected.
+// If loading fails, the previous certificate is kept.
+func (s *Server) ReloadCert() error {
+	cert, err := tls.LoadX509KeyPair(s.Config.CertFile, s.Config.KeyFile)
+	if err != nil {
+		return fmt.Errorf("LoadX509KeyPair: %w", err)
+	}
+	s.m.Lock()
+	s.cert = &cert
+	s.m.Unlock()
+	return nil
+}
+
+func (s *Server) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	s.m.RLock()
+	defer s.m.RUnlock()
+	return s.cert, nil
+}
+
+// Listen returns the listener for Network and Addr.
+// A stale unix socket file left by a previous process is removed before listening.
+func (s *Server) Listen() (net.Listener, error) {
+	network := s.Config.Network
+	if network == "" {
+		network = "tcp"
+	}
+	if network == "unix" {
+		if err := os.Remove(s.Config.Addr); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+	}
+	return net.Listen(network, s.Config.Addr)
+}
+
+// Run listens and serves until ctx is done, and then gracefully shuts down:
+// it stops accepting connections, waits for in-flight requests up to ShutdownTimeout, and closes the Closers.
+// Run returns nil after a graceful shutdown.
+func (s *Server) Run(ctx context.Context) error {
+	l, err := s.Listen()
+	if err != nil {
+		return err
+	}
+	return s.Serve(ctx, l)
+}
+
+// Serve is the same as Run with a given listener.
+func (s *Server) Serve(ctx context.Context, l net.Listener) (err error) {
+	srv := &http.Server{
+		Handler:           s.Handler,
+		ReadTimeout:       s.Config.ReadTimeout,
+		ReadHeaderTimeout: s.Config.ReadHeaderTimeout,
+		WriteTimeout:      s.Config.WriteTimeout,
+		IdleTimeout:       s.Config.IdleTimeout,
+	}
+	if s.Config.CertFile != "" {
+		srv.TLSConfig = &tls.Config{
+			MinVersion:     tls.VersionTLS12,
+			GetCertificate: s.getCertificate,
+		}
+		l = tls.NewListener(l, srv.TLSConfig)
+	}
+
+	defer func() {
+		for _, c := range s.Closers {
+			if er := c.Close(); er != nil {
+				Log.Error(fmt.Errorf("close: %w", er))
+				if err == nil {
+					err = er
+				}
+			}
+		}
+	}()
+
+	served := make(chan error, 1)
+	go func() {
+		served <- srv.Serve(l)
+	}()
+
+	select {
+	case err := <-served:
+		// Serve failed before shutdown
+		return err
+	case <-ctx.Done():
+	}
+
+	sctx := context.Background()
+	if s.Config.ShutdownTimeout > 0 {
+		var cancel context.CancelFunc
+		sctx, cancel = context.WithTimeout(sctx, s.Config.ShutdownTimeout)
+		defer cancel()
+	}
+	if err := srv.Shutdown(sctx); err != nil {
+		return fmt.Errorf("Shutdown: %w", err)
+	}
+	if err := <-served; !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
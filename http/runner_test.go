@@ -0,0 +1,207 @@
+package http
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type closerFunc func() error
+
+func (f closerFunc) Close() error {
+	return f()
+}
+
+func TestServerUnixSocketGracefulShutdown(t *testing.T) {
+	Log = NilLogger()
+
+	sock := filepath.Join(t.TempDir(), "vey.sock")
+	started := make(chan struct{})
+	release := make(chan struct{})
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		_ = WriteJSON(w, 200, map[string]interface{}{})
+	})
+	closed := false
+	s, err := NewServer(ServerConfig{
+		Network:         "unix",
+		Addr:            sock,
+		ShutdownTimeout: 5 * time.Second,
+	}, h, closerFunc(func() error {
+		closed = true
+		return nil
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	ran := make(chan error, 1)
+	go func() {
+		ran <- s.Run(ctx)
+	}()
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", sock)
+			},
+		},
+	}
+	res := make(chan error, 1)
+	go func() {
+		var (
+			r   *http.Response
+			err error
+		)
+		// wait for the listener
+		for i := 0; i < 50; i++ {
+			r, err = client.Get("http://vey/inflight")
+			if err == nil {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		if err != nil {
+			res <- err
+			return
+		}
+		r.Body.Close()
+		if r.StatusCode != 200 {
+			res <- io.ErrUnexpectedEOF
+			return
+		}
+		res <- nil
+	}()
+
+	<-started
+	// shutdown while the request is in flight
+	cancel()
+	select {
+	case err := <-ran:
+		t.Fatalf("Run returned before the in-flight request finished: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	close(release)
+	if err := <-res; err != nil {
+		t.Fatalf("in-flight request: %v", err)
+	}
+	if err := <-ran; err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if !closed {
+		t.Error("closers should be closed after shutdown")
+	}
+	if _, err := os.Stat(sock); !os.IsNotExist(err) {
+		t.Errorf("socket should be removed but got %v", err)
+	}
+}
+
+func TestServerTLSReload(t *testing.T) {
+	Log = NilLogger()
+
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	writeCert(t, certFile, keyFile, 1)
+
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = WriteJSON(w, 200, map[string]interface{}{})
+	})
+	s, err := NewServer(ServerConfig{
+		CertFile: certFile,
+		KeyFile:  keyFile,
+	}, h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	ran := make(chan error, 1)
+	go func() {
+		ran <- s.Serve(ctx, l)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-ran
+	})
+
+	serial := func() int64 {
+		conn, err := tls.Dial("tcp", l.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		return conn.ConnectionState().PeerCertificates[0].SerialNumber.Int64()
+	}
+
+	if e, g := int64(1), serial(); e != g {
+		t.Fatalf("serial expected %v but got %v", e, g)
+	}
+
+	writeCert(t, certFile, keyFile, 2)
+	if e, g := int64(1), serial(); e != g {
+		t.Fatalf("serial expected %v before reload but got %v", e, g)
+	}
+	if err := s.ReloadCert(); err != nil {
+		t.Fatal(err)
+	}
+	if e, g := int64(2), serial(); e != g {
+		t.Fatalf("serial expected %v after reload but got %v", e, g)
+	}
+
+	// broken files keep the previous certificate
+	if err := os.WriteFile(certFile, []byte("broken"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.ReloadCert(); err == nil {
+		t.Fatal("ReloadCert: expected error but got nil")
+	}
+	if e, g := int64(2), serial(); e != g {
+		t.Fatalf("serial expected %v after failed reload but got %v", e, g)
+	}
+}
+
+func writeCert(t *testing.T, certFile, keyFile string, serial int64) {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &priv.PublicKey, priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := x509.MarshalECPrivateKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: key}), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
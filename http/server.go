@@ -1,9 +1,12 @@
 package http
 
 import (
+	"context"
+	"crypto/ed25519"
 	"encoding/base64"
 	"net/http"
 	"net/url"
+	"time"
 
 	"github.com/mash/vey"
 	"github.com/mash/vey/email"
@@ -14,22 +17,62 @@ type VeyHandler struct {
 	Vey     vey.Vey
 	Sender  email.Sender
 	OpenURL *url.URL
+	// Version and BuildDate are returned by /version.
+	Version, BuildDate string
+	// pingers are checked by /readyz.
+	pingers []namedPinger
+	// cors enables the CORS middleware if not nil.
+	cors *CORSConfig
+	// queued is true if Sender queues the emails, and beginDelete and beginPut respond 202.
+	queued bool
+	// sns verifies the SES feedback notifications at /sesFeedback if not nil.
+	sns *email.SNSVerifier
+	// inbox is served at /dev/inbox if not nil.
+	inbox email.Mailbox
+	// links adds the signed links to the put emails and serves the landing page at /open if not nil.
+	links *LinkSigner
+	// revocations is served at /revocations, signed with feedKey, if not nil.
+	revocations vey.RevocationList
+	feedKey     ed25519.PrivateKey
+	// clientHeader is the header of the client address. See ClientAddr.
+	clientHeader string
 }
 
-func NewHandler(vey vey.Vey, sender email.Sender, open *url.URL) http.Handler {
+func NewHandler(vey vey.Vey, sender email.Sender, open *url.URL, opts ...Option) http.Handler {
 	h := VeyHandler{
 		ServeMux: http.NewServeMux(),
 		Vey:      vey,
 		Sender:   sender,
 		OpenURL:  open,
 	}
+	for _, opt := range opts {
+		opt(&h)
+	}
 	h.Handle("/getKeys", WrapF(AcceptJSON(h.GetKeys)))
 	h.Handle("/beginDelete", WrapF(AcceptJSON(h.BeginDelete)))
 	h.Handle("/commitDelete", WrapF(h.CommitDelete))
 	h.Handle("/beginPut", WrapF(AcceptJSON(h.BeginPut)))
 	h.Handle("/commitPut", WrapF(AcceptJSON(h.CommitPut)))
+	h.Handle("/beginDeleteWithSignature", WrapF(AcceptJSON(h.BeginDeleteWithSignature)))
+	h.Handle("/commitDeleteWithSignature", WrapF(AcceptJSON(h.CommitDeleteWithSignature)))
 	h.Handle("/open", WrapF(h.Open))
-	return &h
+	h.Handle("/healthz", WrapF(h.Healthz))
+	h.Handle("/readyz", WrapF(h.Readyz))
+	h.Handle("/version", WrapF(h.VersionInfo))
+	if h.sns != nil {
+		h.Handle("/sesFeedback", WrapF(h.SESFeedback))
+	}
+	if h.revocations != nil {
+		h.Handle("/revocations", WrapF(h.Revocations))
+	}
+	if h.inbox != nil {
+		h.Handle("/dev/inbox", WrapF(h.Inbox))
+	}
+	handler := ClientAddr(h.clientHeader, &h)
+	if h.cors != nil {
+		return Trace(CORS(*h.cors, handler))
+	}
+	return Trace(handler)
 }
 
 type Body struct {
@@ -38,10 +81,23 @@ type Body struct {
 	Token     []byte        `json:"token,omitempty"`
 	Challenge []byte        `json:"challenge,omitempty"`
 	Signature []byte        `json:"signature,omitempty"`
+	// Locale is the preferred language of the email sent by beginDelete and beginPut, such as "ja" or "pt-BR".
+	// It takes precedence over the Accept-Language header.
+	Locale string `json:"locale,omitempty"`
+	// Proof is the signature of vey.ProofPayload at ProofTime by the key, sent to beginPut. See vey.WithProofOfPossession.
+	Proof []byte `json:"proof,omitempty"`
+	// ProofTime is the time in the proof in unix seconds.
+	ProofTime int64 `json:"proofTime,omitempty"`
+	// LookupToken is sent to getKeys, and responded by commitPut, if the server requires it. See vey.WithLookupPolicy.
+	LookupToken []byte `json:"lookupToken,omitempty"`
 }
 
 func (h *VeyHandler) GetKeys(w http.ResponseWriter, r *http.Request, b Body) error {
-	keys, err := h.Vey.GetKeys(b.Email)
+	ctx := r.Context()
+	if b.LookupToken != nil {
+		ctx = vey.WithLookupToken(ctx, b.LookupToken)
+	}
+	keys, err := vey.VeyWithContext(h.Vey).GetKeysContext(ctx, b.Email)
 	if err != nil {
 		return err
 	}
@@ -49,14 +105,17 @@ func (h *VeyHandler) GetKeys(w http.ResponseWriter, r *http.Request, b Body) err
 }
 
 func (h *VeyHandler) BeginDelete(w http.ResponseWriter, r *http.Request, b Body) error {
-	token, err := h.Vey.BeginDelete(b.Email, b.PublicKey)
+	token, err := vey.VeyWithContext(h.Vey).BeginDeleteContext(r.Context(), b.Email, b.PublicKey)
+	if err == vey.ErrIgnored {
+		return WriteJSON(w, h.sentStatus(), map[string]interface{}{})
+	}
 	if err != nil {
 		return err
 	}
-	if err := h.Sender.SendToken(b.Email, base64.StdEncoding.EncodeToString(token)); err != nil {
+	if err := email.SenderWithContext(h.Sender).SendTokenContext(languages(r, b), b.Email, base64.StdEncoding.EncodeToString(token)); err != nil {
 		return err
 	}
-	return WriteJSON(w, 200, map[string]interface{}{})
+	return WriteJSON(w, h.sentStatus(), map[string]interface{}{})
 }
 
 // CommitDelete handles the final step of deleting the public key.
@@ -72,31 +131,83 @@ func (h *VeyHandler) CommitDelete(w http.ResponseWriter, r *http.Request) error
 			Err:  err,
 		}
 	}
-	if err := h.Vey.CommitDelete(token); err != nil {
+	if err := vey.VeyWithContext(h.Vey).CommitDeleteContext(r.Context(), token); err != nil {
 		return err
 	}
 	return WriteJSON(w, 200, map[string]interface{}{})
 }
 
 func (h *VeyHandler) BeginPut(w http.ResponseWriter, r *http.Request, b Body) error {
-	challenge, err := h.Vey.BeginPut(b.Email, b.PublicKey)
+	ctx := r.Context()
+	if b.Proof != nil {
+		ctx = vey.WithPossessionProof(ctx, vey.PossessionProof{Time: time.Unix(b.ProofTime, 0), Signature: b.Proof})
+	}
+	challenge, err := vey.VeyWithContext(h.Vey).BeginPutContext(ctx, b.Email, b.PublicKey)
+	if err == vey.ErrIgnored {
+		// respond as if sent, not to tell the ignored addresses
+		return WriteJSON(w, h.sentStatus(), map[string]interface{}{})
+	}
 	if err != nil {
 		return err
 	}
-	if err := h.Sender.SendChallenge(b.Email, base64.StdEncoding.EncodeToString(challenge)); err != nil {
+	ctx = languages(r, b)
+	if h.links != nil {
+		ctx = email.WithLink(ctx, h.links.URL(b.Email, b.PublicKey, challenge))
+	}
+	if err := email.SenderWithContext(h.Sender).SendChallengeContext(ctx, b.Email, base64.StdEncoding.EncodeToString(challenge)); err != nil {
 		return err
 	}
-	return WriteJSON(w, 200, map[string]interface{}{})
+	return WriteJSON(w, h.sentStatus(), map[string]interface{}{})
 }
 
+// CommitPut responds the lookup token of the email address, if the Vey requires it.
 func (h *VeyHandler) CommitPut(w http.ResponseWriter, r *http.Request, b Body) error {
-	if err := h.Vey.CommitPut(b.Challenge, b.Signature); err != nil {
+	if l, ok := h.Vey.(vey.Lookuper); ok {
+		token, err := l.CommitPutLookupContext(r.Context(), b.Challenge, b.Signature)
+		if err != nil {
+			return err
+		}
+		return WriteJSON(w, 200, LookupTokenResponse{LookupToken: token})
+	}
+	if err := vey.VeyWithContext(h.Vey).CommitPutContext(r.Context(), b.Challenge, b.Signature); err != nil {
+		return err
+	}
+	return WriteJSON(w, 200, map[string]interface{}{})
+}
+
+// LookupTokenResponse is the response of commitPut.
+type LookupTokenResponse struct {
+	LookupToken []byte `json:"lookupToken,omitempty"`
+}
+
+// BeginDeleteWithSignature responds the challenge to be signed with the key to delete.
+// No email is sent.
+func (h *VeyHandler) BeginDeleteWithSignature(w http.ResponseWriter, r *http.Request, b Body) error {
+	challenge, err := vey.VeyWithContext(h.Vey).BeginDeleteWithSignatureContext(r.Context(), b.Email, b.PublicKey)
+	if err != nil {
+		return err
+	}
+	return WriteJSON(w, 200, ChallengeResponse{Challenge: challenge})
+}
+
+// ChallengeResponse is the response of beginDeleteWithSignature.
+type ChallengeResponse struct {
+	Challenge []byte `json:"challenge"`
+}
+
+func (h *VeyHandler) CommitDeleteWithSignature(w http.ResponseWriter, r *http.Request, b Body) error {
+	if err := vey.VeyWithContext(h.Vey).CommitDeleteWithSignatureContext(r.Context(), b.Challenge, b.Signature); err != nil {
 		return err
 	}
 	return WriteJSON(w, 200, map[string]interface{}{})
 }
 
+// Open serves the landing page of the signed links if WithLinks is set,
+// or redirects to OpenURL with the query.
 func (h *VeyHandler) Open(w http.ResponseWriter, r *http.Request) error {
+	if r.Method == http.MethodGet && h.links != nil {
+		return h.Landing(w, r)
+	}
 	if h.OpenURL == nil || r.Method != http.MethodGet {
 		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
 		return nil
@@ -107,3 +218,14 @@ func (h *VeyHandler) Open(w http.ResponseWriter, r *http.Request) error {
 	http.Redirect(w, r, next.String(), http.StatusFound)
 	return nil
 }
+
+// languages returns the request context with the recipient's preferred languages,
+// the explicit locale in the body first, then the Accept-Language header.
+func languages(r *http.Request, b Body) context.Context {
+	var l []string
+	if b.Locale != "" {
+		l = append(l, b.Locale)
+	}
+	l = append(l, email.ParseAcceptLanguage(r.Header.Get("Accept-Language"))...)
+	return email.WithLanguages(r.Context(), l...)
+}
@@ -2,18 +2,23 @@ package http
 
 import (
 	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
 	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"net"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
+	"reflect"
 	"testing"
 	"time"
 
 	"github.com/mash/vey"
 	"github.com/mash/vey/email"
+	"golang.org/x/crypto/ssh"
 )
 
 func serve(t *testing.T, h http.Handler) net.Listener {
@@ -117,3 +122,325 @@ func TestJSON(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestLocale(t *testing.T) {
+	v := vey.NewVey(vey.NewDigester([]byte("salt")), vey.NewMemCache(time.Second), vey.NewMemStore())
+	sender := email.NewMemSender().(*email.MemSender)
+	h := NewHandler(v, sender, nil)
+
+	tests := []struct {
+		locale   string
+		header   string
+		expected []string
+	}{
+		{"", "", nil},
+		{"", "de-DE,de;q=0.9,en;q=0.8", []string{"de-DE", "de", "en"}},
+		{"ja", "pt-BR", []string{"ja", "pt-BR"}},
+	}
+	for _, tt := range tests {
+		b, _ := json.Marshal(Body{
+			Email:     "test@example.com",
+			PublicKey: vey.PublicKey{Key: []byte("key")},
+			Locale:    tt.locale,
+		})
+		req := httptest.NewRequest("POST", "/beginPut", bytes.NewReader(b))
+		if tt.header != "" {
+			req.Header.Set("Accept-Language", tt.header)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		if e, g := http.StatusOK, w.Code; e != g {
+			t.Fatalf("expected %v but got %v: %s", e, g, w.Body.String())
+		}
+		if e, g := tt.expected, sender.Languages; !reflect.DeepEqual(e, g) {
+			t.Errorf("%q %q expected %v but got %v", tt.locale, tt.header, e, g)
+		}
+	}
+}
+
+func TestKeyPolicy(t *testing.T) {
+	Log = NilLogger()
+
+	keygen := func() vey.PublicKey {
+		pub, _, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sshpub, err := ssh.NewPublicKey(pub)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return vey.PublicKey{Type: vey.SSHEd25519, Key: ssh.MarshalAuthorizedKey(sshpub)}
+	}
+	digester := vey.NewDigester([]byte("salt"))
+	store := vey.NewMemStore()
+	if err := store.Put(digester.Of("full@example.com"), keygen()); err != nil {
+		t.Fatal(err)
+	}
+	denied := keygen()
+	v := vey.NewVey(digester, vey.NewMemCache(time.Second), store, vey.WithKeyPolicy(vey.KeyPolicy{
+		MaxKeys:  1,
+		MinBits:  256,
+		DenyList: vey.NewFingerprintDenyList(denied.Fingerprint()),
+	}))
+	strict := vey.NewVey(digester, vey.NewMemCache(time.Second), vey.NewMemStore(), vey.WithKeyPolicy(vey.KeyPolicy{MinBits: 384}))
+
+	tests := []struct {
+		v         vey.Vey
+		email     string
+		publicKey vey.PublicKey
+		code      int
+		message   string
+	}{
+		{v, "full@example.com", keygen(), http.StatusConflict, vey.ErrTooManyKeys.Error()},
+		{v, "test@example.com", vey.PublicKey{Key: []byte("key")}, http.StatusUnprocessableEntity, vey.ErrKeyTypeNotAllowed.Error()},
+		{strict, "test@example.com", keygen(), http.StatusUnprocessableEntity, vey.ErrWeakKey.Error()},
+		{v, "test@example.com", denied, http.StatusForbidden, vey.ErrDeniedKey.Error()},
+		{v, "test@example.com", keygen(), http.StatusOK, ""},
+	}
+	for _, tt := range tests {
+		b, _ := json.Marshal(Body{Email: tt.email, PublicKey: tt.publicKey})
+		req := httptest.NewRequest("POST", "/beginPut", bytes.NewReader(b))
+		w := httptest.NewRecorder()
+		NewHandler(tt.v, email.NewMemSender(), nil).ServeHTTP(w, req)
+		if e, g := tt.code, w.Code; e != g {
+			t.Errorf("%s expected %v but got %v", tt.message, e, g)
+		}
+		if tt.message == "" {
+			continue
+		}
+		var er Error
+		if err := json.Unmarshal(w.Body.Bytes(), &er); err != nil {
+			t.Fatal(err)
+		}
+		if e, g := tt.message, er.Msg; e != g {
+			t.Errorf("message expected %v but got %v", e, g)
+		}
+	}
+}
+
+func TestDomainPolicy(t *testing.T) {
+	Log = NilLogger()
+
+	tests := []struct {
+		ignore bool
+		code   int
+	}{
+		{false, http.StatusForbidden},
+		{true, http.StatusOK},
+	}
+	for _, tt := range tests {
+		v := vey.NewVey(vey.NewDigester([]byte("salt")), vey.NewMemCache(time.Second), vey.NewMemStore(),
+			vey.WithDomainPolicy(vey.DomainPolicy{Deny: []string{"mailinator.com"}, Ignore: tt.ignore}))
+		sender := email.NewMemSender().(*email.MemSender)
+		h := NewHandler(v, sender, nil)
+		for _, path := range []string{"/beginPut", "/beginDelete"} {
+			b, _ := json.Marshal(Body{Email: "test@mailinator.com", PublicKey: vey.PublicKey{Key: []byte("key")}})
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, httptest.NewRequest("POST", path, bytes.NewReader(b)))
+			if e, g := tt.code, w.Code; e != g {
+				t.Errorf("%s ignore=%v expected %v but got %v", path, tt.ignore, e, g)
+			}
+		}
+		if sender.Email != "" {
+			t.Errorf("ignore=%v expected no email but sent to %v", tt.ignore, sender.Email)
+		}
+	}
+}
+
+func TestLockout(t *testing.T) {
+	Log = NilLogger()
+
+	v := vey.NewVey(vey.NewDigester([]byte("salt")), vey.NewMemCache(time.Second), vey.NewMemStore(),
+		vey.WithLockout(vey.LockoutPolicy{Threshold: 3, Backoff: time.Hour}))
+	h := NewHandler(v, email.NewMemSender(), nil, WithClientHeader("X-Forwarded-For"))
+
+	probe := func(forwardedFor string) int {
+		req := httptest.NewRequest("GET", "/commitDelete?token="+url.QueryEscape(base64.StdEncoding.EncodeToString([]byte("guess"))), nil)
+		req.Header.Set("X-Forwarded-For", forwardedFor)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w.Code
+	}
+	// the attacker forges the addresses added before the proxy's
+	for i := 0; i < 3; i++ {
+		if e, g := http.StatusNotFound, probe(fmt.Sprintf("10.0.0.%d, 192.0.2.1", i)); e != g {
+			t.Fatalf("probe %d: expected %v but got %v", i, e, g)
+		}
+	}
+	if e, g := http.StatusTooManyRequests, probe("10.0.0.9, 192.0.2.1"); e != g {
+		t.Errorf("expected %v but got %v", e, g)
+	}
+	if e, g := http.StatusNotFound, probe("192.0.2.2"); e != g {
+		t.Errorf("other clients expected %v but got %v", e, g)
+	}
+}
+
+func TestProofOfPossession(t *testing.T) {
+	Log = NilLogger()
+
+	origin := "https://vey.example.com"
+	v := vey.NewVey(vey.NewDigester([]byte("salt")), vey.NewMemCache(time.Second), vey.NewMemStore(),
+		vey.WithOrigin(origin), vey.WithProofOfPossession(time.Minute))
+	sender := email.NewMemSender().(*email.MemSender)
+	c := NewClient("http://" + serve(t, NewHandler(v, sender, nil)).Addr().String())
+
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sshpub, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicKey := vey.PublicKey{Type: vey.SSHEd25519, Key: ssh.MarshalAuthorizedKey(sshpub)}
+
+	err = c.BeginPut("test@example.com", publicKey)
+	var cerr ClientError
+	if !errors.As(err, &cerr) || cerr.Res.StatusCode != http.StatusBadRequest || cerr.Msg != vey.ErrProofRequired.Error() {
+		t.Errorf("without proof expected %v but got %v", http.StatusBadRequest, err)
+	}
+	if sender.Email != "" {
+		t.Errorf("expected no email but sent to %v", sender.Email)
+	}
+
+	now := time.Now()
+	proof := vey.PossessionProof{Time: now, Signature: ed25519.Sign(priv, vey.ProofPayload(origin, "test@example.com", publicKey, now))}
+	if err := c.BeginPutWithProof("test@example.com", publicKey, proof); err != nil {
+		t.Fatal(err)
+	}
+	if e, g := "test@example.com", sender.Email; e != g {
+		t.Errorf("expected %v but got %v", e, g)
+	}
+}
+
+func TestLookupPolicy(t *testing.T) {
+	Log = NilLogger()
+
+	v := vey.NewVey(vey.NewDigester([]byte("salt")), vey.NewMemCache(time.Second), vey.NewMemStore(),
+		vey.WithLookupPolicy(vey.LookupPolicy{Secret: []byte("secret")}))
+	sender := email.NewMemSender().(*email.MemSender)
+	c := NewClient("http://" + serve(t, NewHandler(v, sender, nil)).Addr().String())
+
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sshpub, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicKey := vey.PublicKey{Type: vey.SSHEd25519, Key: ssh.MarshalAuthorizedKey(sshpub)}
+
+	_, err = c.GetKeys("test@example.com")
+	var cerr ClientError
+	if !errors.As(err, &cerr) || cerr.Res.StatusCode != http.StatusBadRequest || cerr.Msg != vey.ErrLookupTokenRequired.Error() {
+		t.Errorf("without lookup token expected %v but got %v", http.StatusBadRequest, err)
+	}
+
+	if err := c.BeginPut("test@example.com", publicKey); err != nil {
+		t.Fatal(err)
+	}
+	challenge, err := base64.StdEncoding.DecodeString(sender.Challenge)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := c.CommitPutWithLookupToken(challenge, ed25519.Sign(priv, challenge))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(token) == 0 {
+		t.Fatalf("expected the lookup token")
+	}
+	keys, err := c.GetKeysWithLookupToken("test@example.com", token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e, g := 1, len(keys); e != g {
+		t.Errorf("expected %v keys but got %v", e, g)
+	}
+	keys, err = c.GetKeysWithLookupToken("test@example.com", []byte("wrong"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e, g := 0, len(keys); e != g {
+		t.Errorf("wrong token expected %v keys but got %v", e, g)
+	}
+}
+
+func TestBeginDeleteWithSignatureResponse(t *testing.T) {
+	Log = NilLogger()
+
+	digester := vey.NewDigester([]byte("salt"))
+	store := vey.NewMemStore()
+	publicKey := vey.PublicKey{Type: vey.SSHEd25519, Key: []byte("key")}
+	if err := store.Put(digester.Of("test@example.com"), publicKey); err != nil {
+		t.Fatal(err)
+	}
+	v := vey.NewVey(digester, vey.NewMemCache(time.Second), store)
+
+	b, _ := json.Marshal(Body{Email: "test@example.com", PublicKey: publicKey})
+	req := httptest.NewRequest("POST", "/beginDeleteWithSignature", bytes.NewReader(b))
+	w := httptest.NewRecorder()
+	NewHandler(v, email.NewMemSender(), nil).ServeHTTP(w, req)
+	if e, g := http.StatusOK, w.Code; e != g {
+		t.Fatalf("expected %v but got %v", e, g)
+	}
+	var res map[string]interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := res["challenge"]; !ok || len(res) != 1 {
+		t.Errorf("expected only the challenge but got %v", res)
+	}
+}
+
+func TestCommitPutResponse(t *testing.T) {
+	Log = NilLogger()
+
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sshpub, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicKey := vey.PublicKey{Type: vey.SSHEd25519, Key: ssh.MarshalAuthorizedKey(sshpub)}
+
+	tests := []struct {
+		name     string
+		opts     []vey.Option
+		expected []string
+	}{
+		{"lookup token", []vey.Option{vey.WithLookupPolicy(vey.LookupPolicy{Secret: []byte("secret")})}, []string{"lookupToken"}},
+		{"no lookup secret", []vey.Option{vey.WithLookupPolicy(vey.LookupPolicy{})}, nil},
+		{"no lookup policy", nil, nil},
+	}
+	for _, tt := range tests {
+		v := vey.NewVey(vey.NewDigester([]byte("salt")), vey.NewMemCache(time.Second), vey.NewMemStore(), tt.opts...)
+		challenge, err := v.BeginPut("test@example.com", publicKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := json.Marshal(Body{Challenge: challenge, Signature: ed25519.Sign(priv, challenge)})
+		req := httptest.NewRequest("POST", "/commitPut", bytes.NewReader(b))
+		w := httptest.NewRecorder()
+		NewHandler(v, email.NewMemSender(), nil).ServeHTTP(w, req)
+		if e, g := http.StatusOK, w.Code; e != g {
+			t.Fatalf("%s: expected %v but got %v", tt.name, e, g)
+		}
+		var res map[string]interface{}
+		if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+			t.Fatal(err)
+		}
+		if e, g := len(tt.expected), len(res); e != g {
+			t.Errorf("%s: expected %v but got %v", tt.name, tt.expected, res)
+		}
+		for _, name := range tt.expected {
+			if _, ok := res[name]; !ok {
+				t.Errorf("%s: expected %v but got %v", tt.name, tt.expected, res)
+			}
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package http
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mash/vey"
+	"github.com/mash/vey/email"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestTraceparent(t *testing.T) {
+	Log = NilLogger()
+
+	sr := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(sr))
+	prev := otel.GetTracerProvider()
+	otel.SetTracerProvider(tp)
+	t.Cleanup(func() {
+		otel.SetTracerProvider(prev)
+	})
+
+	v := vey.NewVey(vey.NewDigester([]byte("salt")), vey.NewMemCache(time.Second), vey.NewMemStore())
+	h := NewHandler(v, email.NewMemSender(), nil)
+
+	const (
+		traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+		spanID  = "00f067aa0ba902b7"
+	)
+	req := httptest.NewRequest("POST", "/getKeys", strings.NewReader(`{"email":"test@example.com"}`))
+	req.Header.Set("traceparent", "00-"+traceID+"-"+spanID+"-01")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if e, g := http.StatusOK, w.Code; e != g {
+		t.Fatalf("expected %v but got %v", e, g)
+	}
+
+	spans := map[string]sdktrace.ReadOnlySpan{}
+	for _, s := range sr.Ended() {
+		spans[s.Name()] = s
+	}
+	server, ok := spans["VeyHandler /getKeys"]
+	if !ok {
+		t.Fatalf("server span not found in %v", spans)
+	}
+	if e, g := traceID, server.SpanContext().TraceID().String(); e != g {
+		t.Errorf("server span trace id expected %v but got %v", e, g)
+	}
+	if e, g := spanID, server.Parent().SpanID().String(); e != g {
+		t.Errorf("server span parent expected %v but got %v", e, g)
+	}
+	if e, g := trace.SpanKindServer, server.SpanKind(); e != g {
+		t.Errorf("server span kind expected %v but got %v", e, g)
+	}
+	core, ok := spans["vey.GetKeys"]
+	if !ok {
+		t.Fatalf("vey.GetKeys span not found in %v", spans)
+	}
+	if e, g := server.SpanContext().SpanID(), core.Parent().SpanID(); e != g {
+		t.Errorf("vey.GetKeys parent expected %v but got %v", e, g)
+	}
+}
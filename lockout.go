@@ -0,0 +1,197 @@
+package vey
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"time"
+)
+
+// LockoutPolicy locks out the clients and the email addresses that failed too many commits,
+// to stop guessing the tokens of CommitDelete and brute forcing the signatures of CommitPut.
+//
+// The failures of the client and of the digest are counted separately.
+// The digest counts only the failures of the challenges sent to the email address,
+// so that those who never received them cannot lock out the owner, such as by CommitDeleteWithSignature.
+// After Threshold failures, each one locks it out for Backoff, doubled by each following failure up to MaxBackoff.
+// The failures are forgotten after Window since the last one, or when the digest succeeds a commit.
+type LockoutPolicy struct {
+	// Threshold is the number of failures before the lockout. Defaults to 5.
+	Threshold int `yaml:"threshold"`
+	// Backoff is the first lockout. Defaults to 1s.
+	Backoff time.Duration `yaml:"backoff"`
+	// MaxBackoff is the longest lockout. Defaults to 1h.
+	MaxBackoff time.Duration `yaml:"max_backoff"`
+	// Window is how long the failures are counted. Defaults to 24h.
+	Window time.Duration `yaml:"window"`
+}
+
+// Failures is the count of the failed attempts, returned by FailureCounter.
+type Failures struct {
+	Count int
+	Last  time.Time
+}
+
+// lockedUntil returns the end of the lockout by f, which is in the past if not locked out.
+func (p LockoutPolicy) lockedUntil(f Failures) time.Time {
+	if f.Count < p.Threshold {
+		return time.Time{}
+	}
+	backoff := p.Backoff
+	for i := p.Threshold; i < f.Count && backoff < p.MaxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > p.MaxBackoff {
+		backoff = p.MaxBackoff
+	}
+	return f.Last.Add(backoff)
+}
+
+// WithLockout makes the commits return ErrLocked while the client or the email address is locked out by p.
+// The Cache should implement FailureCounter, and the clients are told by WithClient.
+func WithLockout(p LockoutPolicy) Option {
+	return func(k *vey) {
+		if p.Threshold <= 0 {
+			p.Threshold = 5
+		}
+		if p.Backoff <= 0 {
+			p.Backoff = time.Second
+		}
+		if p.MaxBackoff <= 0 {
+			p.MaxBackoff = time.Hour
+		}
+		if p.Window <= 0 {
+			p.Window = 24 * time.Hour
+		}
+		k.lockout = &p
+	}
+}
+
+type clientKey struct{}
+
+// WithClient returns the context that tells the client, such as its IP address, to count its failures. See WithLockout.
+func WithClient(ctx context.Context, client string) context.Context {
+	return context.WithValue(ctx, clientKey{}, client)
+}
+
+func clientFrom(ctx context.Context) string {
+	client, _ := ctx.Value(clientKey{}).(string)
+	return client
+}
+
+// The keys of the failures in the Cache do not collide with the random tokens and the signed payloads.
+func clientFailuresKey(client string) []byte {
+	return []byte("failures/client/" + client)
+}
+
+func digestFailuresKey(digest EmailDigest) []byte {
+	return append([]byte("failures/digest/"), digest...)
+}
+
+// checkLocked returns ErrLocked if the digest, or the client of ctx if digest is nil, is locked out.
+func (k vey) checkLocked(ctx context.Context, op string, digest EmailDigest) error {
+	if k.lockout == nil || k.failures == nil {
+		return nil
+	}
+	ev := SecurityEvent{Type: SecurityLockedOut, Operation: op, Client: clientFrom(ctx), EmailDigest: digest}
+	var key []byte
+	if digest != nil {
+		key = digestFailuresKey(digest)
+	} else if ev.Client != "" {
+		key = clientFailuresKey(ev.Client)
+	} else {
+		return nil
+	}
+	f, err := k.failures.Failures(ctx, key)
+	if err != nil {
+		return err
+	}
+	if until := k.lockout.lockedUntil(f); time.Now().Before(until) {
+		ev.Failures, ev.LockedUntil = f.Count, until
+		logSecurity(ev)
+		return ErrLocked
+	}
+	return nil
+}
+
+// fail counts the failure of the client of ctx, and of the digest if not nil.
+// The errors are logged, and do not change the error of the commit.
+func (k vey) fail(ctx context.Context, op string, digest EmailDigest) {
+	if k.lockout == nil || k.failures == nil {
+		return
+	}
+	ev := SecurityEvent{Type: SecurityCommitFailed, Operation: op, Client: clientFrom(ctx), EmailDigest: digest}
+	add := func(key []byte) {
+		f, err := k.failures.AddFailure(ctx, key, k.lockout.Window)
+		if err != nil {
+			Log.Error(fmt.Errorf("AddFailure: %w", err))
+			return
+		}
+		if f.Count > ev.Failures {
+			ev.Failures = f.Count
+		}
+		if until := k.lockout.lockedUntil(f); until.After(ev.LockedUntil) {
+			ev.LockedUntil = until
+		}
+	}
+	if ev.Client != "" {
+		add(clientFailuresKey(ev.Client))
+	}
+	if digest != nil {
+		add(digestFailuresKey(digest))
+	}
+	logSecurity(ev)
+}
+
+// succeed forgets the failures of the digest.
+func (k vey) succeed(ctx context.Context, digest EmailDigest) {
+	if k.lockout == nil || k.failures == nil {
+		return
+	}
+	if err := k.failures.ResetFailures(ctx, digestFailuresKey(digest)); err != nil {
+		Log.Error(fmt.Errorf("ResetFailures: %w", err))
+	}
+}
+
+const (
+	// SecurityCommitFailed is the event of a failed commit, with an unknown token or an invalid signature.
+	SecurityCommitFailed = "commit_failed"
+	// SecurityLockedOut is the event of a commit refused by the lockout.
+	SecurityLockedOut = "locked_out"
+)
+
+// SecurityEvent is logged by SecurityLogger, or by Logger.Error if Log does not implement it.
+type SecurityEvent struct {
+	Type string
+	// Operation is the name of the commit, such as "CommitPut".
+	Operation   string
+	Client      string
+	EmailDigest EmailDigest
+	// Failures is the count of the failures of the client or the digest, whichever is larger.
+	Failures    int
+	LockedUntil time.Time
+}
+
+func (e SecurityEvent) String() string {
+	s := fmt.Sprintf("security: %s %s client=%q failures=%d", e.Type, e.Operation, e.Client, e.Failures)
+	if e.EmailDigest != nil {
+		s += " digest=" + base64.StdEncoding.EncodeToString(e.EmailDigest)
+	}
+	if !e.LockedUntil.IsZero() {
+		s += " lockedUntil=" + e.LockedUntil.Format(time.RFC3339)
+	}
+	return s
+}
+
+// SecurityLogger is implemented by the Loggers that log the SecurityEvents, such as to alert on them.
+type SecurityLogger interface {
+	Security(e SecurityEvent)
+}
+
+func logSecurity(e SecurityEvent) {
+	if l, ok := Log.(SecurityLogger); ok {
+		l.Security(e)
+		return
+	}
+	Log.Error(fmt.Errorf("%s", e))
+}
@@ -22,3 +22,8 @@ func NewLogger() Logger {
 func (l logger) Error(err error) {
 	log.Printf("error: %v", err)
 }
+
+// Security implements SecurityLogger.
+func (l logger) Security(e SecurityEvent) {
+	log.Print(e)
+}
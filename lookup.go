@@ -0,0 +1,123 @@
+package vey
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"time"
+)
+
+// lookupHeader is the HMAC input prefix of the lookup tokens, so that they are not the MACs of anything else.
+const lookupHeader = "vey-lookup/1\n"
+
+// LookupPolicy stops GetKeys from telling anyone whether an email address has keys.
+//
+// With Secret, GetKeys requires the lookup token of the email address, which is a capability that the owner
+// gets by CommitPut, and shares with those who should find the keys, such as in a URL.
+// GetKeys returns no keys for the wrong tokens, as for the email addresses without keys.
+// Changing Secret revokes all the tokens.
+//
+// With Secret, the other requests do not tell either: BeginDeleteWithSignature returns the challenges for the keys
+// that are not stored, which fail at CommitDeleteWithSignature, and BeginPut returns ErrIgnored
+// instead of ErrTooManyKeys and ErrRevoked.
+type LookupPolicy struct {
+	// Secret is the HMAC key of the lookup tokens. GetKeys does not require the tokens if empty.
+	Secret []byte `yaml:"-"`
+	// MinDuration delays the responses of GetKeys to take at least this long,
+	// so that the time to read the Store does not tell whether the email address has keys.
+	// It should be longer than most reads of the Store.
+	MinDuration time.Duration `yaml:"min_duration"`
+}
+
+// WithLookupPolicy makes GetKeys follow p, and return ErrLookupTokenRequired without the lookup token.
+// The Vey implements Lookuper.
+func WithLookupPolicy(p LookupPolicy) Option {
+	return func(k *vey) {
+		k.lookup = &p
+	}
+}
+
+type lookupTokenKey struct{}
+
+// WithLookupToken returns the context that carries the lookup token to GetKeys.
+func WithLookupToken(ctx context.Context, token []byte) context.Context {
+	return context.WithValue(ctx, lookupTokenKey{}, token)
+}
+
+func (p LookupPolicy) token(digest EmailDigest) []byte {
+	mac := hmac.New(sha256.New, p.Secret)
+	mac.Write([]byte(lookupHeader))
+	mac.Write(digest)
+	return mac.Sum(nil)
+}
+
+// LookupToken returns the lookup token of the email address. Give it only to the owner of the email address.
+func (k vey) LookupToken(email string) ([]byte, error) {
+	if !k.hidesKeys() {
+		return nil, ErrNoLookupSecret
+	}
+	if err := validateEmail(email); err != nil {
+		return nil, ErrInvalidEmail
+	}
+	return k.lookup.token(k.digest.Of(email)), nil
+}
+
+// CommitPutLookupContext is CommitPutContext that also returns the lookup token of the email address,
+// which the caller proved to own by signing the challenge sent to it.
+// The token is nil if the LookupPolicy has no Secret.
+func (k vey) CommitPutLookupContext(ctx context.Context, challenge, signature []byte) (_ []byte, err error) {
+	ctx, span := startSpan(ctx, "vey.CommitPut")
+	defer func() { endSpan(span, err) }()
+
+	cached, err := k.commitPut(ctx, challenge, signature)
+	if err != nil {
+		return nil, err
+	}
+	if !k.hidesKeys() {
+		return nil, nil
+	}
+	return k.lookup.token(cached.EmailDigest), nil
+}
+
+// hidesKeys reports whether the LookupPolicy has the Secret, and the requests should not tell whether the keys are stored.
+func (k vey) hidesKeys() bool {
+	return k.lookup != nil && len(k.lookup.Secret) > 0
+}
+
+// requireLookupToken returns ErrLookupTokenRequired if the LookupPolicy requires the token and ctx does not carry it.
+func (k vey) requireLookupToken(ctx context.Context) error {
+	if !k.hidesKeys() {
+		return nil
+	}
+	if token, _ := ctx.Value(lookupTokenKey{}).([]byte); len(token) == 0 {
+		return ErrLookupTokenRequired
+	}
+	return nil
+}
+
+// validLookupToken reports whether ctx carries the lookup token of digest, or the LookupPolicy does not require it.
+// The tokens are compared in constant time.
+func (k vey) validLookupToken(ctx context.Context, digest EmailDigest) bool {
+	if !k.hidesKeys() {
+		return true
+	}
+	token, _ := ctx.Value(lookupTokenKey{}).([]byte)
+	return hmac.Equal(token, k.lookup.token(digest))
+}
+
+// padLookup waits until MinDuration has passed since start, or ctx is done.
+func (k vey) padLookup(ctx context.Context, start time.Time) {
+	if k.lookup == nil || k.lookup.MinDuration <= 0 {
+		return
+	}
+	d := k.lookup.MinDuration - time.Since(start)
+	if d <= 0 {
+		return
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+	case <-ctx.Done():
+	}
+}
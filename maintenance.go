@@ -0,0 +1,213 @@
+package vey
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// StalePolicy drops the keys that have not been verified for a while, such as the keys of the closed mailboxes,
+// unless their owners reconfirm them.
+//
+// Maintain sends a reconfirm challenge to the email address of each key that was last verified more than After ago,
+// and drops the key if it is not put again within Grace.
+// The reconfirm challenge is valid for Grace, and the owners who miss it can also reconfirm by putting the key again.
+//
+// The Store keeps only the digests of the email addresses, so the address of each key is stored as its SealedEmail,
+// encrypted with Key, which is kept out of the Store like the salt of the Digester.
+type StalePolicy struct {
+	// After is how long after the last verification a key becomes stale.
+	After time.Duration `yaml:"after"`
+	// Grace is how long the owner has to reconfirm the stale key.
+	Grace time.Duration `yaml:"grace"`
+	// Key is the AES key of 16, 24 or 32 bytes to seal the email addresses of the keys.
+	// The keys sealed with another Key are Unreachable.
+	Key []byte `yaml:"-"`
+}
+
+// MaintenanceReport counts the keys handled by Maintain.
+type MaintenanceReport struct {
+	// Keys is the number of the scanned keys.
+	Keys int
+	// Reconfirming is the number of the keys that became stale, and were sent the reconfirm challenges.
+	Reconfirming int
+	// Dropped is the number of the stale keys deleted, because they were not reconfirmed by the deadline.
+	Dropped int
+	// Unreachable is the number of the stale keys that are kept, because they were added without WithStalePolicy
+	// or sealed with another Key, and the email address is unknown. They become reachable when their owners put them again.
+	Unreachable int
+	// Failed is the number of the keys that could not be handled, which are retried in the next Maintain.
+	Failed int
+}
+
+// WithStalePolicy seals the email address of the keys added by CommitPut as SealedEmail, and enables Maintain.
+// The Store should implement KeyScanner, and the Cache ExpiryCache.
+// WithStalePolicy panics if p.Key is not a valid AES key.
+func WithStalePolicy(p StalePolicy) Option {
+	block, err := aes.NewCipher(p.Key)
+	if err != nil {
+		panic(fmt.Sprintf("StalePolicy.Key: %v", err))
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		panic(fmt.Sprintf("StalePolicy.Key: %v", err))
+	}
+	return func(k *vey) {
+		k.stalePolicy = &p
+		k.sealer = aead
+	}
+}
+
+// sealEmail encrypts the email address of the digest, which is authenticated so that it cannot be moved to another digest.
+func (k vey) sealEmail(email string, digest EmailDigest) ([]byte, error) {
+	nonce := make([]byte, k.sealer.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return k.sealer.Seal(nonce, nonce, []byte(email), digest), nil
+}
+
+// openEmail decrypts the email address sealed by sealEmail.
+func (k vey) openEmail(sealed []byte, digest EmailDigest) (string, error) {
+	n := k.sealer.NonceSize()
+	if len(sealed) < n {
+		return "", errors.New("sealed email is too short")
+	}
+	email, err := k.sealer.Open(nil, sealed[:n], sealed[n:], digest)
+	if err != nil {
+		return "", err
+	}
+	return string(email), nil
+}
+
+// reconfirmExpiry is the expiry of the reconfirm challenges, which is Grace unless it is shorter than the others.
+func (k vey) reconfirmExpiry() time.Duration {
+	expiry := k.challengeExpiry
+	if expiry <= 0 {
+		expiry = defaultChallengeExpiry
+	}
+	if k.stalePolicy.Grace > expiry {
+		expiry = k.stalePolicy.Grace
+	}
+	return expiry
+}
+
+// Maintain applies the StalePolicy to all the keys in the Store. Run it periodically, such as daily.
+// The reconfirm challenges are sent with s, and the deleted keys are revoked with RevokeStale and notified.
+// The email addresses in the SuppressionList or refused by the DomainPolicy cannot receive the challenges,
+// and their stale keys are dropped after Grace.
+// Errors of each key are logged and counted as Failed, and Maintain only returns the error that stops the scan.
+func (k vey) Maintain(ctx context.Context, s ChallengeSender) (report MaintenanceReport, err error) {
+	ctx, span := startSpan(ctx, "vey.Maintain")
+	defer func() { endSpan(span, err) }()
+
+	if k.stalePolicy == nil {
+		return report, ErrNoStalePolicy
+	}
+	if k.scanner == nil {
+		return report, ErrNoKeyScanner
+	}
+	if k.expiryCache == nil {
+		return report, ErrNoExpiryCache
+	}
+	now := time.Now()
+	err = k.scanner.ScanKeys(ctx, func(digest EmailDigest, keys []PublicKey) error {
+		for _, key := range keys {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			report.Keys++
+			if err := k.maintainKey(ctx, s, digest, key, now, &report); err != nil {
+				Log.Error(fmt.Errorf("Maintain %s: %w", key.Fingerprint(), err))
+				report.Failed++
+			}
+		}
+		return nil
+	})
+	return report, err
+}
+
+func (k vey) maintainKey(ctx context.Context, s ChallengeSender, digest EmailDigest, key PublicKey, now time.Time, report *MaintenanceReport) error {
+	if key.Expired(now) {
+		// not returned by GetKeys anyway
+		return nil
+	}
+	if key.ReconfirmBy != nil {
+		if now.Before(*key.ReconfirmBy) {
+			return nil
+		}
+		return k.dropStale(ctx, digest, key, report)
+	}
+	verifiedAt := key.LastVerifiedAt
+	if verifiedAt == nil {
+		verifiedAt = key.CreatedAt
+	}
+	if verifiedAt == nil || now.Sub(*verifiedAt) < k.stalePolicy.After {
+		// the keys without the times are migrated by DynamoDbStore.MigrateMetadata
+		return nil
+	}
+	if len(key.SealedEmail) == 0 {
+		report.Unreachable++
+		return nil
+	}
+	email, err := k.openEmail(key.SealedEmail, digest)
+	if err != nil {
+		Log.Error(fmt.Errorf("Maintain %s: open sealed email: %w", key.Fingerprint(), err))
+		report.Unreachable++
+		return nil
+	}
+
+	challenge, err := k.beginPut(ctx, email, key, true)
+	if errors.Is(err, ErrSuppressed) || errors.Is(err, ErrDomainNotAllowed) || errors.Is(err, ErrIgnored) {
+		// the mailbox is gone or no longer accepted, which is what the policy is for
+		challenge, err = nil, nil
+	}
+	if err != nil {
+		return err
+	}
+	if challenge != nil {
+		if err := s.SendChallengeContext(ctx, email, base64.StdEncoding.EncodeToString(challenge)); err != nil {
+			return err
+		}
+	}
+	deadline := now.Add(k.stalePolicy.Grace).UTC()
+	key.ReconfirmBy = &deadline
+	if err := k.store.PutContext(ctx, digest, key); err != nil {
+		return err
+	}
+	report.Reconfirming++
+	return nil
+}
+
+// dropStale deletes the stale key, unless it has been reconfirmed since it was scanned.
+func (k vey) dropStale(ctx context.Context, digest EmailDigest, key PublicKey, report *MaintenanceReport) error {
+	keys, err := k.store.GetContext(ctx, digest)
+	if err != nil {
+		return err
+	}
+	for _, current := range keys {
+		if !current.Equal(key) {
+			continue
+		}
+		if current.ReconfirmBy == nil || time.Now().Before(*current.ReconfirmBy) {
+			return nil
+		}
+		if err := k.store.DeleteContext(ctx, digest, key); err != nil {
+			return err
+		}
+		cached := Cached{EmailDigest: digest, PublicKey: key}
+		if email, err := k.openEmail(key.SealedEmail, digest); err == nil {
+			cached.Email = email
+		}
+		k.revoke(detach(ctx), cached, RevokeStale)
+		k.notify(detach(ctx), KeyDeleted, cached)
+		report.Dropped++
+		return nil
+	}
+	return nil
+}
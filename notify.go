@@ -0,0 +1,211 @@
+package vey
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// KeyAdded is the KeyChange type after CommitPut.
+	KeyAdded = "key.added"
+	// KeyDeleted is the KeyChange type after CommitDelete.
+	KeyDeleted = "key.deleted"
+)
+
+// WebhookSignatureHeader is the header of the webhook request that has the signature. See VerifyWebhook.
+const WebhookSignatureHeader = "Vey-Signature"
+
+// KeyChange is a change of the keys of an email address.
+type KeyChange struct {
+	// ID is unique to the change, for the receivers to ignore the duplicates.
+	ID string `json:"id"`
+	// Type is KeyAdded or KeyDeleted.
+	Type        string    `json:"type"`
+	Email       string    `json:"email"`
+	PublicKey   PublicKey `json:"publicKey"`
+	Fingerprint string    `json:"fingerprint"`
+	Time        time.Time `json:"time"`
+}
+
+// WithNotifier makes CommitPut and CommitDelete notify n.
+// BeginPut and BeginDelete keep the email address in the Cache to notify it.
+func WithNotifier(n Notifier) Option {
+	return func(k *vey) {
+		k.notifier = n
+	}
+}
+
+// notify notifies the change of the cached key. The error is logged, because the commit has succeeded.
+func (k vey) notify(ctx context.Context, typ string, cached Cached) {
+	if k.notifier == nil || cached.Email == "" {
+		return
+	}
+	ctx, span := startSpan(ctx, "vey.notify")
+	id := make([]byte, 16)
+	_, err := rand.Read(id)
+	if err == nil {
+		err = k.notifier.Notify(ctx, KeyChange{
+			ID:          hex.EncodeToString(id),
+			Type:        typ,
+			Email:       cached.Email,
+			PublicKey:   cached.PublicKey,
+			Fingerprint: cached.PublicKey.Fingerprint(),
+			Time:        time.Now(),
+		})
+	}
+	if err != nil {
+		Log.Error(fmt.Errorf("Notify: %w", err))
+	}
+	endSpan(span, err)
+}
+
+// Notifiers implements Notifier interface by notifying all of them.
+type Notifiers []Notifier
+
+func (ns Notifiers) Notify(ctx context.Context, c KeyChange) error {
+	var errs []string
+	for _, n := range ns {
+		if err := n.Notify(ctx, c); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, ", "))
+	}
+	return nil
+}
+
+// MemNotifier implements Notifier interface.
+// MemNotifier is for testing purposes only.
+type MemNotifier struct {
+	m       sync.Mutex
+	changes []KeyChange
+}
+
+func NewMemNotifier() Notifier {
+	return &MemNotifier{}
+}
+
+func (n *MemNotifier) Notify(ctx context.Context, c KeyChange) error {
+	n.m.Lock()
+	defer n.m.Unlock()
+	n.changes = append(n.changes, c)
+	return nil
+}
+
+// Changes returns the notified changes.
+func (n *MemNotifier) Changes() []KeyChange {
+	n.m.Lock()
+	defer n.m.Unlock()
+	return append([]KeyChange(nil), n.changes...)
+}
+
+// WebhookNotifier implements Notifier interface by posting the KeyChange in JSON to URL,
+// signed with Secret in the Vey-Signature header.
+// The receiver verifies the request with VerifyWebhook, and may relay it to Slack, Matrix or others.
+type WebhookNotifier struct {
+	URL    string
+	Secret []byte
+	// Client defaults to a client with 10s timeout.
+	Client *http.Client
+}
+
+func NewWebhookNotifier(url string, secret []byte) Notifier {
+	return WebhookNotifier{
+		URL:    url,
+		Secret: secret,
+	}
+}
+
+func (n WebhookNotifier) Notify(ctx context.Context, c KeyChange) error {
+	body, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, n.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(WebhookSignatureHeader, SignWebhook(n.Secret, time.Now(), body))
+
+	client := n.Client
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("webhook: %w", err)
+	}
+	defer res.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(res.Body, 4096))
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return fmt.Errorf("webhook: %s", res.Status)
+	}
+	return nil
+}
+
+// SignWebhook returns the Vey-Signature header value for the body sent at t,
+// which is "t=<unix seconds>,v1=<hex HMAC-SHA256 of "<unix seconds>.<body>">".
+func SignWebhook(secret []byte, t time.Time, body []byte) string {
+	ts := strconv.FormatInt(t.Unix(), 10)
+	return "t=" + ts + ",v1=" + hex.EncodeToString(webhookMAC(secret, ts, body))
+}
+
+// ErrWebhookSignature indicates that the webhook request is not signed with the secret, or is too old.
+var ErrWebhookSignature = errors.New("invalid webhook signature")
+
+// VerifyWebhook verifies the Vey-Signature header value of the webhook request with body.
+// The requests signed more than tolerance ago are rejected, to prevent replays.
+func VerifyWebhook(secret []byte, header string, body []byte, tolerance time.Duration) error {
+	var ts string
+	var sigs [][]byte
+	for _, part := range strings.Split(header, ",") {
+		kv := strings.SplitN(strings.TrimSpace(part), "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		switch kv[0] {
+		case "t":
+			ts = kv[1]
+		case "v1":
+			if sig, err := hex.DecodeString(kv[1]); err == nil {
+				sigs = append(sigs, sig)
+			}
+		}
+	}
+	sec, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return ErrWebhookSignature
+	}
+	if d := time.Since(time.Unix(sec, 0)); d > tolerance || d < -tolerance {
+		return ErrWebhookSignature
+	}
+	expected := webhookMAC(secret, ts, body)
+	for _, sig := range sigs {
+		if hmac.Equal(sig, expected) {
+			return nil
+		}
+	}
+	return ErrWebhookSignature
+}
+
+func webhookMAC(secret []byte, ts string, body []byte) []byte {
+	m := hmac.New(sha256.New, secret)
+	m.Write([]byte(ts + "."))
+	m.Write(body)
+	return m.Sum(nil)
+}
@@ -0,0 +1,179 @@
+package vey
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The challenge returned by BeginPut is a SignedPayload, unless WithLegacyChallenge is set.
+// It is UTF-8 text with a header line followed by "name:value" lines in this order, separated by "\n":
+//
+//	vey-signed-payload/1
+//	purpose:put
+//	origin:https://vey.example.com
+//	challenge:<32 random bytes, base64url encoded without padding>
+//	email-digest:<EmailDigest, base64url encoded without padding>
+//	key:<PublicKey.Fingerprint>
+//	expires:<unix seconds>
+//
+// The clients sign the payload as is. They may parse it to show or check the origin, purpose and key before signing.
+// Because the signature covers the origin and the purpose, it cannot be replayed to another server or operation.
+const payloadHeader = "vey-signed-payload/1"
+
+const (
+	// PurposePut is the purpose of the payload signed to add the key.
+	PurposePut = "put"
+	// PurposeDelete is the purpose of the payload signed to delete the key.
+	PurposeDelete = "delete"
+)
+
+// defaultChallengeExpiry matches the default cache expiry of the challenges.
+const defaultChallengeExpiry = 15 * time.Minute
+
+// ErrInvalidPayload indicates that the signed payload is malformed.
+var ErrInvalidPayload = errors.New("invalid signed payload")
+
+var payloadFields = []string{"purpose", "origin", "challenge", "email-digest", "key", "expires"}
+
+// SignedPayload is the structured, domain separated content of the challenge that the clients sign.
+type SignedPayload struct {
+	Purpose string
+	// Origin identifies the Vey server, such as its public URL. See WithOrigin.
+	Origin string
+	// Challenge is the random bytes that make the payload unique.
+	Challenge      []byte
+	EmailDigest    EmailDigest
+	KeyFingerprint string
+	Expires        time.Time
+}
+
+// Bytes returns the canonical encoding of p, which is what is signed.
+func (p SignedPayload) Bytes() []byte {
+	values := []string{
+		p.Purpose,
+		p.Origin,
+		base64.RawURLEncoding.EncodeToString(p.Challenge),
+		base64.RawURLEncoding.EncodeToString(p.EmailDigest),
+		p.KeyFingerprint,
+		strconv.FormatInt(p.Expires.Unix(), 10),
+	}
+	var b bytes.Buffer
+	b.WriteString(payloadHeader)
+	for i, name := range payloadFields {
+		b.WriteString("\n" + name + ":" + values[i])
+	}
+	return b.Bytes()
+}
+
+// ParseSignedPayload parses the payload encoded by SignedPayload.Bytes.
+// Payloads that are not in the canonical encoding are invalid, so that a payload has only one signed form.
+func ParseSignedPayload(b []byte) (SignedPayload, error) {
+	lines := strings.Split(string(b), "\n")
+	if len(lines) != len(payloadFields)+1 || lines[0] != payloadHeader {
+		return SignedPayload{}, ErrInvalidPayload
+	}
+	values := make([]string, len(payloadFields))
+	for i, name := range payloadFields {
+		v := strings.TrimPrefix(lines[i+1], name+":")
+		if v == lines[i+1] {
+			return SignedPayload{}, ErrInvalidPayload
+		}
+		values[i] = v
+	}
+	if values[0] != PurposePut && values[0] != PurposeDelete {
+		return SignedPayload{}, ErrInvalidPayload
+	}
+	challenge, err := base64.RawURLEncoding.DecodeString(values[2])
+	if err != nil || len(challenge) == 0 {
+		return SignedPayload{}, ErrInvalidPayload
+	}
+	digest, err := base64.RawURLEncoding.DecodeString(values[3])
+	if err != nil {
+		return SignedPayload{}, ErrInvalidPayload
+	}
+	expires, err := strconv.ParseInt(values[5], 10, 64)
+	if err != nil {
+		return SignedPayload{}, ErrInvalidPayload
+	}
+	p := SignedPayload{
+		Purpose:        values[0],
+		Origin:         values[1],
+		Challenge:      challenge,
+		EmailDigest:    digest,
+		KeyFingerprint: values[4],
+		Expires:        time.Unix(expires, 0),
+	}
+	if !bytes.Equal(p.Bytes(), b) {
+		return SignedPayload{}, ErrInvalidPayload
+	}
+	return p, nil
+}
+
+// WithOrigin sets the origin in the signed payloads, such as the public URL of the server.
+// Servers that share the clients should have distinct origins, so that a signature for one is not accepted by another.
+// The origin should not contain a newline.
+func WithOrigin(origin string) Option {
+	return func(k *vey) {
+		k.origin = origin
+	}
+}
+
+// WithChallengeExpiry sets the expiry in the signed payloads. It should match the expiry of the Cache.
+// Defaults to 15m.
+func WithChallengeExpiry(d time.Duration) Option {
+	return func(k *vey) {
+		k.challengeExpiry = d
+	}
+}
+
+// WithLegacyChallenge makes BeginPut return 32 random bytes as the challenge, and CommitPut verify the signature over them,
+// for the clients that assume the challenge is 32 bytes.
+// The legacy challenge does not bind the signature to the server, the email address and the key. Prefer the signed payload.
+func WithLegacyChallenge() Option {
+	return func(k *vey) {
+		k.legacyChallenge = true
+	}
+}
+
+// newPayload returns the signed payload for purpose, the digest and the key, which expires after expiry,
+// or the challenge expiry if 0.
+func (k vey) newPayload(purpose string, digest EmailDigest, publicKey PublicKey, expiry time.Duration) ([]byte, error) {
+	challenge, err := NewChallenge()
+	if err != nil {
+		return nil, err
+	}
+	if expiry <= 0 {
+		expiry = k.challengeExpiry
+	}
+	if expiry <= 0 {
+		expiry = defaultChallengeExpiry
+	}
+	return SignedPayload{
+		Purpose:        purpose,
+		Origin:         k.origin,
+		Challenge:      challenge,
+		EmailDigest:    digest,
+		KeyFingerprint: publicKey.Fingerprint(),
+		Expires:        time.Now().Add(expiry),
+	}.Bytes(), nil
+}
+
+// checkPayload returns nil if b is the payload for purpose and cached, issued by this server and not expired.
+func (k vey) checkPayload(b []byte, purpose string, cached Cached) error {
+	p, err := ParseSignedPayload(b)
+	if err != nil {
+		return ErrVerifyFailed
+	}
+	if p.Purpose != purpose || p.Origin != k.origin ||
+		!bytes.Equal(p.EmailDigest, cached.EmailDigest) || p.KeyFingerprint != cached.PublicKey.Fingerprint() {
+		return ErrVerifyFailed
+	}
+	if !time.Now().Before(p.Expires) {
+		return ErrNotFound
+	}
+	return nil
+}
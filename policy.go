@@ -0,0 +1,151 @@
+package vey
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"io"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// KeyPolicy restricts the keys that BeginPut and CommitPut accept.
+// The zero value accepts any key.
+type KeyPolicy struct {
+	// MaxKeys is the maximum number of the keys of an email address, including the expired ones.
+	// Putting a key that is already stored does not count. 0 is unlimited.
+	MaxKeys int `yaml:"max_keys"`
+	// AllowedTypes are the accepted PublicKeyTypes. Any type is accepted if empty.
+	AllowedTypes []PublicKeyType `yaml:"allowed_types"`
+	// MinBits is the minimum size of the keys in bits, as shown by ssh-keygen -l, such as 256 for ssh-ed25519.
+	MinBits int `yaml:"min_bits"`
+	// DenyList is the list of the keys known to be weak or leaked.
+	DenyList KeyDenyList `yaml:"-"`
+}
+
+// keyAlgorithms are the SSH key algorithms of the PublicKeyTypes.
+var keyAlgorithms = map[PublicKeyType]string{
+	SSHEd25519: ssh.KeyAlgoED25519,
+}
+
+// WithKeyPolicy makes BeginPut and CommitPut refuse the keys that p does not accept,
+// with ErrTooManyKeys, ErrKeyTypeNotAllowed, ErrWeakKey or ErrDeniedKey.
+func WithKeyPolicy(p KeyPolicy) Option {
+	return func(k *vey) {
+		k.keyPolicy = &p
+	}
+}
+
+// checkKey returns the error of the first rule of the KeyPolicy that publicKey breaks.
+func (k vey) checkKey(ctx context.Context, digest EmailDigest, publicKey PublicKey) error {
+	p := k.keyPolicy
+	if p == nil {
+		return nil
+	}
+	if p.MaxKeys > 0 {
+		keys, err := k.store.GetContext(ctx, digest)
+		if err != nil {
+			return err
+		}
+		if len(keys) >= p.MaxKeys && !containsKey(keys, publicKey) {
+			return ErrTooManyKeys
+		}
+	}
+	if len(p.AllowedTypes) > 0 || p.MinBits > 0 {
+		algo, bits := keySize(publicKey)
+		if algo == "" || algo != keyAlgorithms[publicKey.Type] || !allowedType(p.AllowedTypes, publicKey.Type) {
+			return ErrKeyTypeNotAllowed
+		}
+		if bits < p.MinBits {
+			return ErrWeakKey
+		}
+	}
+	if p.DenyList != nil {
+		denied, err := p.DenyList.IsDenied(ctx, publicKey)
+		if err != nil {
+			return err
+		}
+		if denied {
+			return ErrDeniedKey
+		}
+	}
+	return nil
+}
+
+func allowedType(types []PublicKeyType, t PublicKeyType) bool {
+	if len(types) == 0 {
+		return true
+	}
+	for _, allowed := range types {
+		if allowed == t {
+			return true
+		}
+	}
+	return false
+}
+
+// keySize returns the SSH key algorithm and the size in bits of the key.
+// The algorithm is empty if the key is not in the authorized_keys format.
+func keySize(pub PublicKey) (string, int) {
+	out, _, _, _, err := ssh.ParseAuthorizedKey(pub.Key)
+	if err != nil {
+		return "", 0
+	}
+	c, ok := out.(ssh.CryptoPublicKey)
+	if !ok {
+		return out.Type(), 0
+	}
+	switch key := c.CryptoPublicKey().(type) {
+	case ed25519.PublicKey:
+		return out.Type(), len(key) * 8
+	case *rsa.PublicKey:
+		return out.Type(), key.N.BitLen()
+	case *ecdsa.PublicKey:
+		return out.Type(), key.Curve.Params().BitSize
+	default:
+		return out.Type(), 0
+	}
+}
+
+// FingerprintDenyList implements KeyDenyList with a set of the key fingerprints.
+type FingerprintDenyList map[string]struct{}
+
+// NewFingerprintDenyList returns a KeyDenyList that denies the keys with the fingerprints, such as "SHA256:...".
+func NewFingerprintDenyList(fingerprints ...string) KeyDenyList {
+	l := make(FingerprintDenyList, len(fingerprints))
+	for _, f := range fingerprints {
+		l[f] = struct{}{}
+	}
+	return l
+}
+
+// ReadFingerprintDenyList reads a fingerprint per line. The empty lines and the lines starting with "#" are ignored.
+func ReadFingerprintDenyList(r io.Reader) (KeyDenyList, error) {
+	fingerprints, err := readList(r)
+	if err != nil {
+		return nil, err
+	}
+	return NewFingerprintDenyList(fingerprints...), nil
+}
+
+// readList reads the trimmed lines except the empty ones and the comments starting with "#".
+func readList(r io.Reader) ([]string, error) {
+	var lines []string
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		lines = append(lines, line)
+	}
+	return lines, s.Err()
+}
+
+func (l FingerprintDenyList) IsDenied(ctx context.Context, publicKey PublicKey) (bool, error) {
+	_, ok := l[publicKey.Fingerprint()]
+	return ok, nil
+}
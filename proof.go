@@ -0,0 +1,85 @@
+package vey
+
+import (
+	"context"
+	"strconv"
+	"time"
+)
+
+// proofHeader starts the payload of PossessionProof, which is distinct from the SignedPayload,
+// so that a proof cannot be used as the signature of a challenge, and vice versa.
+const proofHeader = "vey-possession-proof/1"
+
+// PossessionProof proves that the caller of BeginPut has the private key of the key to put,
+// so that nobody can have the challenges sent for the keys of others, such as the public keys found on the web.
+// It does not prove anything about the email address. See WithProofOfPossession.
+type PossessionProof struct {
+	// Time is when the proof was made. The clients use their clock, and the server accepts it within the skew.
+	Time time.Time
+	// Signature is the signature by the key over ProofPayload.
+	Signature []byte
+}
+
+// ProofPayload returns the payload that the clients sign with the key to put, to make the PossessionProof.
+// It is UTF-8 text with the lines separated by "\n":
+//
+//	vey-possession-proof/1
+//	origin:https://vey.example.com
+//	email:<the email address as passed to BeginPut>
+//	key:<PublicKey.Fingerprint>
+//	time:<unix seconds>
+func ProofPayload(origin, email string, publicKey PublicKey, t time.Time) []byte {
+	return []byte(proofHeader +
+		"\norigin:" + origin +
+		"\nemail:" + email +
+		"\nkey:" + publicKey.Fingerprint() +
+		"\ntime:" + strconv.FormatInt(t.Unix(), 10))
+}
+
+type proofKey struct{}
+
+// WithPossessionProof returns the context that carries the PossessionProof to BeginPut.
+func WithPossessionProof(ctx context.Context, p PossessionProof) context.Context {
+	return context.WithValue(ctx, proofKey{}, p)
+}
+
+// WithProofOfPossession makes BeginPut require the PossessionProof made within skew of the server time,
+// and return ErrProofRequired without it, or ErrInvalidProof if it is invalid.
+// A proof can be used again within skew, for the same email address and key.
+//
+// The proof does not stop the challenges sent to someone else's email address: anyone can generate a fresh key,
+// and prove the possession of it. It only adds the cost of a signature to each BeginPut,
+// and refuses the keys that the caller does not own. Only the invalid proofs count for WithLockout,
+// so limit the rate of BeginPut by the client and by the email address in front of the Vey,
+// and see SuppressionList for the addresses that complain.
+func WithProofOfPossession(skew time.Duration) Option {
+	return func(k *vey) {
+		k.proofSkew = skew
+	}
+}
+
+// checkProof verifies the PossessionProof in ctx, if required.
+func (k vey) checkProof(ctx context.Context, email string, publicKey PublicKey) error {
+	if k.proofSkew <= 0 {
+		return nil
+	}
+	if err := k.checkLocked(ctx, "BeginPut", nil); err != nil {
+		return err
+	}
+	p, ok := ctx.Value(proofKey{}).(PossessionProof)
+	if !ok || p.Signature == nil {
+		return ErrProofRequired
+	}
+	if d := time.Since(p.Time); d > k.proofSkew || d < -k.proofSkew {
+		return ErrInvalidProof
+	}
+	if _, ok := keyAlgorithms[publicKey.Type]; !ok {
+		// NewVerifier does not support it
+		return ErrInvalidProof
+	}
+	if !NewVerifier(publicKey.Type).Verify(publicKey, p.Signature, ProofPayload(k.origin, email, publicKey, p.Time)) {
+		k.fail(ctx, "BeginPut", nil)
+		return ErrInvalidProof
+	}
+	return nil
+}
@@ -0,0 +1,404 @@
+package vey
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+)
+
+const (
+	// RevokeDeleted is the reason of the keys deleted by CommitDelete.
+	RevokeDeleted = "deleted"
+	// RevokeRetired is the reason of the keys deleted by CommitDeleteWithSignature.
+	RevokeRetired = "retired"
+	// RevokeCompromised is the reason of the keys revoked by the operator, because their private keys have leaked.
+	RevokeCompromised = "compromised"
+	// RevokeStale is the reason of the stale keys dropped by Maintain, because they were not reconfirmed.
+	RevokeStale = "stale"
+)
+
+// Revocation records that a key was removed from an email address.
+// Revocations are appended to the RevocationList and never changed, so that the relying parties that cached the keys
+// can learn about them from the feed.
+type Revocation struct {
+	// Seq is the position in the RevocationList, assigned by Append. It starts from 1.
+	Seq int64 `json:"seq"`
+	// EmailDigest is not published in the feed.
+	EmailDigest    EmailDigest `json:"-"`
+	KeyFingerprint string      `json:"keyFingerprint"`
+	Reason         string      `json:"reason"`
+	Time           time.Time   `json:"time"`
+}
+
+// WithRevocationList makes CommitDelete and CommitDeleteWithSignature append the Revocations of the deleted keys to l.
+func WithRevocationList(l RevocationList) Option {
+	return func(k *vey) {
+		k.revocations = l
+	}
+}
+
+// WithRefuseRevoked makes BeginPut and CommitPut return ErrRevoked for the keys revoked from the email address
+// with RevokeCompromised. The keys deleted by their owners, or dropped as stale, can be added again.
+// It requires WithRevocationList.
+func WithRefuseRevoked() Option {
+	return func(k *vey) {
+		k.refuseRevoked = true
+	}
+}
+
+// Revoke deletes the key from the email address, and appends the Revocation with reason.
+// Revoke returns ErrNotFound if the key is not stored for the email address.
+// Unlike the deletes, Revoke does not need the access to the email address nor the private key,
+// and is for the operators to revoke the compromised keys.
+func (k vey) Revoke(ctx context.Context, email string, publicKey PublicKey, reason string) (err error) {
+	ctx, span := startSpan(ctx, "vey.Revoke")
+	defer func() { endSpan(span, err) }()
+
+	if k.revocations == nil {
+		return ErrNoRevocationList
+	}
+	if err := validateEmail(email); err != nil {
+		return ErrInvalidEmail
+	}
+	digest := k.digest.Of(email)
+	keys, err := k.store.GetContext(ctx, digest)
+	if err != nil {
+		return err
+	}
+	if !containsKey(keys, publicKey) {
+		return ErrNotFound
+	}
+	if err := k.store.DeleteContext(ctx, digest, publicKey); err != nil {
+		return err
+	}
+	_, err = k.revocations.Append(ctx, Revocation{
+		EmailDigest:    digest,
+		KeyFingerprint: publicKey.Fingerprint(),
+		Reason:         reason,
+		Time:           time.Now(),
+	})
+	return err
+}
+
+// revoke appends the Revocation of the deleted key. The error is logged, because the delete has succeeded.
+func (k vey) revoke(ctx context.Context, cached Cached, reason string) {
+	if k.revocations == nil {
+		return
+	}
+	_, err := k.revocations.Append(ctx, Revocation{
+		EmailDigest:    cached.EmailDigest,
+		KeyFingerprint: cached.PublicKey.Fingerprint(),
+		Reason:         reason,
+		Time:           time.Now(),
+	})
+	if err != nil {
+		Log.Error(fmt.Errorf("Append revocation: %w", err))
+	}
+}
+
+// checkRevoked returns ErrRevoked if the key is revoked from the digest as compromised and WithRefuseRevoked is set.
+func (k vey) checkRevoked(ctx context.Context, digest EmailDigest, publicKey PublicKey) error {
+	if !k.refuseRevoked || k.revocations == nil {
+		return nil
+	}
+	revoked, reason, err := k.revocations.IsRevoked(ctx, digest, publicKey.Fingerprint())
+	if err != nil {
+		return err
+	}
+	if revoked && reason == RevokeCompromised {
+		return ErrRevoked
+	}
+	return nil
+}
+
+// MemRevocationList implements RevocationList interface.
+// MemRevocationList is for testing purposes only.
+type MemRevocationList struct {
+	m           sync.Mutex
+	revocations []Revocation
+	// revoked is the reason of the last Revocation by the digest and the fingerprint,
+	// but RevokeCompromised is never overwritten.
+	revoked map[string]string
+}
+
+func NewMemRevocationList() RevocationList {
+	return &MemRevocationList{
+		revoked: make(map[string]string),
+	}
+}
+
+func (l *MemRevocationList) Append(ctx context.Context, r Revocation) (Revocation, error) {
+	l.m.Lock()
+	defer l.m.Unlock()
+	r.Seq = int64(len(l.revocations)) + 1
+	l.revocations = append(l.revocations, r)
+	id := base64.StdEncoding.EncodeToString(r.EmailDigest) + " " + r.KeyFingerprint
+	if l.revoked[id] != RevokeCompromised {
+		l.revoked[id] = r.Reason
+	}
+	return r, nil
+}
+
+func (l *MemRevocationList) IsRevoked(ctx context.Context, d EmailDigest, fingerprint string) (bool, string, error) {
+	l.m.Lock()
+	defer l.m.Unlock()
+	reason, ok := l.revoked[base64.StdEncoding.EncodeToString(d)+" "+fingerprint]
+	return ok, reason, nil
+}
+
+func (l *MemRevocationList) Since(ctx context.Context, seq int64, limit int) ([]Revocation, error) {
+	l.m.Lock()
+	defer l.m.Unlock()
+	if seq < 0 {
+		seq = 0
+	}
+	ret := []Revocation{}
+	for i := seq; i < int64(len(l.revocations)) && len(ret) < limit; i++ {
+		ret = append(ret, l.revocations[i])
+	}
+	return ret, nil
+}
+
+// DynamoDbRevocationList implements RevocationList interface backed by DynamoDB.
+// The table has the same key schema as the Store table, and has three kinds of items:
+// the counter of Seq, the Revocations by Seq for the feed, and the index by the digest and the fingerprint.
+// The index keeps the compromised flag once set, not to let a later Revocation of the same key downgrade it.
+type DynamoDbRevocationList struct {
+	TableName string
+	D         *dynamodb.DynamoDB
+}
+
+// DynamoDbRevocationItem represents a Revocation in the DynamoDB revocation list table.
+type DynamoDbRevocationItem struct {
+	ID          []byte
+	Seq         int64     `dynamodbav:"seq"`
+	Digest      []byte    `dynamodbav:"digest"`
+	Fingerprint string    `dynamodbav:"fingerprint"`
+	Reason      string    `dynamodbav:"reason,omitempty"`
+	RevokedAt   time.Time `dynamodbav:"revoked_at,unixtime"`
+	// Compromised is set only on the index, and only by RevokeCompromised.
+	Compromised bool `dynamodbav:"compromised,omitempty"`
+}
+
+var revocationCounterID = []byte("seq")
+
+// NewDynamoDbRevocationList creates a new RevocationList implementation that is backed by DynamoDB.
+func NewDynamoDbRevocationList(tableName string, svc *dynamodb.DynamoDB) RevocationList {
+	return &DynamoDbRevocationList{
+		TableName: tableName,
+		D:         svc,
+	}
+}
+
+func (l *DynamoDbRevocationList) Append(ctx context.Context, r Revocation) (_ Revocation, err error) {
+	ctx, span := startDynamoDbSpan(ctx, "DynamoDbRevocationList.Append", "TransactWriteItems", l.TableName)
+	defer func() { endSpan(span, err) }()
+
+	// a failed append leaves a gap in Seq, which Since skips
+	out, err := l.D.UpdateItemWithContext(ctx, &dynamodb.UpdateItemInput{
+		TableName:                 aws.String(l.TableName),
+		Key:                       l.key(revocationCounterID),
+		UpdateExpression:          aws.String("ADD seq :one"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{":one": {N: aws.String("1")}},
+		ReturnValues:              aws.String(dynamodb.ReturnValueUpdatedNew),
+	})
+	if err != nil {
+		Log.Error(fmt.Errorf("UpdateItem: err: %w", err))
+		return r, fmt.Errorf("UpdateItem: %w", err)
+	}
+	if r.Seq, err = strconv.ParseInt(aws.StringValue(out.Attributes["seq"].N), 10, 64); err != nil {
+		return r, fmt.Errorf("seq: %w", err)
+	}
+
+	revocation := DynamoDbRevocationItem{
+		ID:          revocationSeqID(r.Seq),
+		Seq:         r.Seq,
+		Digest:      r.EmailDigest,
+		Fingerprint: r.KeyFingerprint,
+		Reason:      r.Reason,
+		RevokedAt:   r.Time,
+	}
+	item, err := dynamodbattribute.MarshalMap(revocation)
+	if err != nil {
+		return r, fmt.Errorf("MarshalMap: %w", err)
+	}
+	revocation.Compromised = r.Reason == RevokeCompromised
+	index, err := dynamodbattribute.MarshalMap(revocation)
+	if err != nil {
+		return r, fmt.Errorf("MarshalMap: %w", err)
+	}
+	delete(index, "ID")
+	// update the index instead of putting it, not to clear the compromised flag
+	var sets []string
+	names := map[string]*string{}
+	values := map[string]*dynamodb.AttributeValue{}
+	for name, value := range index {
+		sets = append(sets, "#"+name+" = :"+name)
+		names["#"+name] = aws.String(name)
+		values[":"+name] = value
+	}
+	sort.Strings(sets)
+	items := []*dynamodb.TransactWriteItem{
+		{
+			Put: &dynamodb.Put{
+				TableName: aws.String(l.TableName),
+				Item:      item,
+			},
+		},
+		{
+			Update: &dynamodb.Update{
+				TableName:                 aws.String(l.TableName),
+				Key:                       l.key(revocationIndexID(r.EmailDigest, r.KeyFingerprint)),
+				UpdateExpression:          aws.String("SET " + strings.Join(sets, ", ")),
+				ExpressionAttributeNames:  names,
+				ExpressionAttributeValues: values,
+			},
+		},
+	}
+	input := &dynamodb.TransactWriteItemsInput{TransactItems: items}
+	if _, err := l.D.TransactWriteItemsWithContext(ctx, input); err != nil {
+		Log.Error(fmt.Errorf("TransactWriteItems: input: %v, err: %w", input, err))
+		return r, fmt.Errorf("TransactWriteItems: %w", err)
+	}
+	return r, nil
+}
+
+func (l *DynamoDbRevocationList) IsRevoked(ctx context.Context, d EmailDigest, fingerprint string) (_ bool, _ string, err error) {
+	ctx, span := startDynamoDbSpan(ctx, "DynamoDbRevocationList.IsRevoked", "GetItem", l.TableName)
+	defer func() { endSpan(span, err) }()
+
+	input := &dynamodb.GetItemInput{
+		TableName: aws.String(l.TableName),
+		Key:       l.key(revocationIndexID(d, fingerprint)),
+	}
+	result, err := l.D.GetItemWithContext(ctx, input)
+	if err != nil {
+		Log.Error(fmt.Errorf("GetItem: input: %v, err: %w", input, err))
+		return false, "", fmt.Errorf("GetItem: %w", err)
+	}
+	if result.Item == nil {
+		return false, "", nil
+	}
+	var item DynamoDbRevocationItem
+	if err := dynamodbattribute.UnmarshalMap(result.Item, &item); err != nil {
+		return false, "", fmt.Errorf("UnmarshalMap: %w", err)
+	}
+	if item.Compromised {
+		return true, RevokeCompromised, nil
+	}
+	return true, item.Reason, nil
+}
+
+func (l *DynamoDbRevocationList) Since(ctx context.Context, seq int64, limit int) (_ []Revocation, err error) {
+	ctx, span := startDynamoDbSpan(ctx, "DynamoDbRevocationList.Since", "BatchGetItem", l.TableName)
+	defer func() { endSpan(span, err) }()
+
+	counter, err := l.D.GetItemWithContext(ctx, &dynamodb.GetItemInput{
+		TableName:      aws.String(l.TableName),
+		Key:            l.key(revocationCounterID),
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		Log.Error(fmt.Errorf("GetItem: err: %w", err))
+		return nil, fmt.Errorf("GetItem: %w", err)
+	}
+	var last int64
+	if v, ok := counter.Item["seq"]; ok {
+		if last, err = strconv.ParseInt(aws.StringValue(v.N), 10, 64); err != nil {
+			return nil, fmt.Errorf("seq: %w", err)
+		}
+	}
+	if seq < 0 {
+		seq = 0
+	}
+
+	ret := []Revocation{}
+	// BatchGetItem gets at most 100 items
+	for from := seq + 1; from <= last && len(ret) < limit; from += 100 {
+		var keys []map[string]*dynamodb.AttributeValue
+		for s := from; s < from+100 && s <= last; s++ {
+			keys = append(keys, l.key(revocationSeqID(s)))
+		}
+		items, err := l.batchGet(ctx, keys)
+		if err != nil {
+			return nil, err
+		}
+		sort.Slice(items, func(i, j int) bool { return items[i].Seq < items[j].Seq })
+		for _, item := range items {
+			if len(ret) == limit {
+				break
+			}
+			ret = append(ret, Revocation{
+				Seq:            item.Seq,
+				EmailDigest:    item.Digest,
+				KeyFingerprint: item.Fingerprint,
+				Reason:         item.Reason,
+				Time:           item.RevokedAt,
+			})
+		}
+	}
+	return ret, nil
+}
+
+func (l *DynamoDbRevocationList) batchGet(ctx context.Context, keys []map[string]*dynamodb.AttributeValue) ([]DynamoDbRevocationItem, error) {
+	var items []DynamoDbRevocationItem
+	for len(keys) > 0 {
+		input := &dynamodb.BatchGetItemInput{
+			RequestItems: map[string]*dynamodb.KeysAndAttributes{
+				l.TableName: {Keys: keys, ConsistentRead: aws.Bool(true)},
+			},
+		}
+		out, err := l.D.BatchGetItemWithContext(ctx, input)
+		if err != nil {
+			Log.Error(fmt.Errorf("BatchGetItem: err: %w", err))
+			return nil, fmt.Errorf("BatchGetItem: %w", err)
+		}
+		for _, av := range out.Responses[l.TableName] {
+			var item DynamoDbRevocationItem
+			if err := dynamodbattribute.UnmarshalMap(av, &item); err != nil {
+				return nil, fmt.Errorf("UnmarshalMap: %w", err)
+			}
+			items = append(items, item)
+		}
+		keys = nil
+		if u, ok := out.UnprocessedKeys[l.TableName]; ok {
+			keys = u.Keys
+		}
+	}
+	return items, nil
+}
+
+// Ping checks that the table exists and is active.
+func (l *DynamoDbRevocationList) Ping(ctx context.Context) error {
+	return pingDynamoDb(ctx, l.D, l.TableName)
+}
+
+func (l *DynamoDbRevocationList) key(id []byte) map[string]*dynamodb.AttributeValue {
+	return map[string]*dynamodb.AttributeValue{
+		"ID": {
+			B: id,
+		},
+	}
+}
+
+func revocationSeqID(seq int64) []byte {
+	id := make([]byte, 9)
+	id[0] = 'r'
+	binary.BigEndian.PutUint64(id[1:], uint64(seq))
+	return id
+}
+
+func revocationIndexID(d EmailDigest, fingerprint string) []byte {
+	id := append([]byte{'k'}, d...)
+	return append(id, fingerprint...)
+}
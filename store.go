@@ -1,10 +1,14 @@
 package vey
 
 import (
+	"context"
+	"crypto/sha256"
 	"encoding/base64"
 	"errors"
 	"fmt"
+	"strconv"
 	"sync"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/dynamodb"
@@ -27,11 +31,8 @@ func (s *MemStore) Get(d EmailDigest) ([]PublicKey, error) {
 	defer s.m.Unlock()
 
 	key := base64.StdEncoding.EncodeToString(d)
-	ret := s.values[key]
-	if ret == nil {
-		return []PublicKey{}, nil
-	}
-	return ret, nil
+	// copy, so that the following Puts do not change the returned keys
+	return append([]PublicKey{}, s.values[key]...), nil
 }
 
 func (s *MemStore) Delete(d EmailDigest, publicKey PublicKey) error {
@@ -53,8 +54,12 @@ func (s *MemStore) Put(d EmailDigest, publicKey PublicKey) error {
 	defer s.m.Unlock()
 
 	key := base64.StdEncoding.EncodeToString(d)
-	for _, v := range s.values[key] {
+	for i, v := range s.values[key] {
 		if v.Equal(publicKey) {
+			if v.CreatedAt != nil {
+				publicKey.CreatedAt = v.CreatedAt
+			}
+			s.values[key][i] = publicKey
 			return nil
 		}
 	}
@@ -62,12 +67,50 @@ func (s *MemStore) Put(d EmailDigest, publicKey PublicKey) error {
 	return nil
 }
 
+// ScanKeys calls fn with a copy of the keys of each digest, so that fn can Put and Delete them.
+func (s *MemStore) ScanKeys(ctx context.Context, fn func(EmailDigest, []PublicKey) error) error {
+	s.m.Lock()
+	digests := make([]EmailDigest, 0, len(s.values))
+	for key := range s.values {
+		d, err := base64.StdEncoding.DecodeString(key)
+		if err != nil {
+			s.m.Unlock()
+			return err
+		}
+		digests = append(digests, d)
+	}
+	s.m.Unlock()
+
+	for _, d := range digests {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		keys, err := s.Get(d)
+		if err != nil {
+			return err
+		}
+		if len(keys) == 0 {
+			continue
+		}
+		if err := fn(d, keys); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 type DynamoDbStore struct {
 	TableName string
 	D         *dynamodb.DynamoDB
 }
 
 // DynamoDbStoreItem represents a single item in the DynamoDB store table.
+//
+// The metadata of each key is in the attributes named after the key, because the binary set cannot have it:
+// "meta_<id>" is a DynamoDbKeyMetadata map, and "created_<id>" is the unix time when the key was first added,
+// where <id> is the unpadded base64url SHA-256 of the encoded key.
+// The items written before the metadata was introduced only have PublicKeys, and their keys have no metadata
+// until they are put again, or MigrateMetadata sets their CreatedAt.
 type DynamoDbStoreItem struct {
 	ID []byte
 	// PublicKeys is a set of PublicKeys marshalled into []byte.
@@ -75,6 +118,47 @@ type DynamoDbStoreItem struct {
 	PublicKeys [][]byte `dynamodbav:"publickeys,omitempty,binaryset"`
 }
 
+// DynamoDbKeyMetadata is the metadata of a key in DynamoDbStoreItem.
+type DynamoDbKeyMetadata struct {
+	Comment        string     `dynamodbav:"comment,omitempty"`
+	LastVerifiedAt *time.Time `dynamodbav:"last_verified_at,omitempty,unixtime"`
+	ExpiresAt      *time.Time `dynamodbav:"expires_at,omitempty,unixtime"`
+	ReconfirmBy    *time.Time `dynamodbav:"reconfirm_by,omitempty,unixtime"`
+	SealedEmail    []byte     `dynamodbav:"sealed_email,omitempty"`
+}
+
+func dynamoDbKeyID(k PublicKey) string {
+	h := sha256.Sum256(encodeDynamoDb(k))
+	return base64.RawURLEncoding.EncodeToString(h[:])
+}
+
+// withMetadata returns the keys with the metadata in the raw item.
+func withMetadata(keys []PublicKey, item map[string]*dynamodb.AttributeValue) ([]PublicKey, error) {
+	for i, k := range keys {
+		id := dynamoDbKeyID(k)
+		if av, ok := item["meta_"+id]; ok {
+			var m DynamoDbKeyMetadata
+			if err := dynamodbattribute.Unmarshal(av, &m); err != nil {
+				return nil, fmt.Errorf("Unmarshal: %w", err)
+			}
+			keys[i].Comment = m.Comment
+			keys[i].LastVerifiedAt = m.LastVerifiedAt
+			keys[i].ExpiresAt = m.ExpiresAt
+			keys[i].ReconfirmBy = m.ReconfirmBy
+			keys[i].SealedEmail = m.SealedEmail
+		}
+		if av, ok := item["created_"+id]; ok {
+			sec, err := strconv.ParseInt(aws.StringValue(av.N), 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("created_%s: %w", id, err)
+			}
+			t := time.Unix(sec, 0).UTC()
+			keys[i].CreatedAt = &t
+		}
+	}
+	return keys, nil
+}
+
 func NewDynamoDbStore(tableName string, svc *dynamodb.DynamoDB) Store {
 	return &DynamoDbStore{
 		TableName: tableName,
@@ -95,6 +179,13 @@ func (item DynamoDbStoreItem) Keys() ([]PublicKey, error) {
 }
 
 func (s *DynamoDbStore) Get(d EmailDigest) ([]PublicKey, error) {
+	return s.GetContext(context.Background(), d)
+}
+
+func (s *DynamoDbStore) GetContext(ctx context.Context, d EmailDigest) (_ []PublicKey, err error) {
+	ctx, span := startDynamoDbSpan(ctx, "DynamoDbStore.Get", "GetItem", s.TableName)
+	defer func() { endSpan(span, err) }()
+
 	key := DynamoDbStoreItem{
 		ID: d,
 	}
@@ -106,7 +197,7 @@ func (s *DynamoDbStore) Get(d EmailDigest) ([]PublicKey, error) {
 		TableName: aws.String(s.TableName),
 		Key:       k,
 	}
-	result, err := s.D.GetItem(input)
+	result, err := s.D.GetItemWithContext(ctx, input)
 	if err != nil {
 		Log.Error(fmt.Errorf("GetItem: input: %v, err: %w", input, err))
 		return nil, fmt.Errorf("GetItem: %w", err)
@@ -122,11 +213,18 @@ func (s *DynamoDbStore) Get(d EmailDigest) ([]PublicKey, error) {
 	if err != nil {
 		return nil, err
 	}
-	return ret, nil
+	return withMetadata(ret, result.Item)
 }
 
 // Delete atomically deletes the public key from the set of public keys for the email digest.
 func (s *DynamoDbStore) Delete(d EmailDigest, publicKey PublicKey) error {
+	return s.DeleteContext(context.Background(), d, publicKey)
+}
+
+func (s *DynamoDbStore) DeleteContext(ctx context.Context, d EmailDigest, publicKey PublicKey) (err error) {
+	ctx, span := startDynamoDbSpan(ctx, "DynamoDbStore.Delete", "UpdateItem", s.TableName)
+	defer func() { endSpan(span, err) }()
+
 	key := DynamoDbStoreItem{
 		ID: d,
 	}
@@ -137,14 +235,18 @@ func (s *DynamoDbStore) Delete(d EmailDigest, publicKey PublicKey) error {
 	input := &dynamodb.UpdateItemInput{
 		TableName:        aws.String(s.TableName),
 		Key:              k,
-		UpdateExpression: aws.String("DELETE publickeys :publickey"),
+		UpdateExpression: aws.String("DELETE publickeys :publickey REMOVE #meta, #created"),
+		ExpressionAttributeNames: map[string]*string{
+			"#meta":    aws.String("meta_" + dynamoDbKeyID(publicKey)),
+			"#created": aws.String("created_" + dynamoDbKeyID(publicKey)),
+		},
 		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
 			":publickey": {
 				BS: [][]byte{encodeDynamoDb(publicKey)},
 			},
 		},
 	}
-	_, err = s.D.UpdateItem(input)
+	_, err = s.D.UpdateItemWithContext(ctx, input)
 	if err != nil {
 		Log.Error(fmt.Errorf("UpdateItem: input: %v, err: %w", input, err))
 		return fmt.Errorf("UpdateItem: %w", err)
@@ -154,6 +256,13 @@ func (s *DynamoDbStore) Delete(d EmailDigest, publicKey PublicKey) error {
 
 // Put atomically adds the public key in the set of public keys for the email digest.
 func (s *DynamoDbStore) Put(d EmailDigest, publicKey PublicKey) error {
+	return s.PutContext(context.Background(), d, publicKey)
+}
+
+func (s *DynamoDbStore) PutContext(ctx context.Context, d EmailDigest, publicKey PublicKey) (err error) {
+	ctx, span := startDynamoDbSpan(ctx, "DynamoDbStore.Put", "UpdateItem", s.TableName)
+	defer func() { endSpan(span, err) }()
+
 	key := DynamoDbStoreItem{
 		ID: d,
 	}
@@ -161,17 +270,39 @@ func (s *DynamoDbStore) Put(d EmailDigest, publicKey PublicKey) error {
 	if err != nil {
 		return fmt.Errorf("MarshalMap: %w", err)
 	}
+	meta, err := dynamodbattribute.Marshal(DynamoDbKeyMetadata{
+		Comment:        publicKey.Comment,
+		LastVerifiedAt: publicKey.LastVerifiedAt,
+		ExpiresAt:      publicKey.ExpiresAt,
+		ReconfirmBy:    publicKey.ReconfirmBy,
+		SealedEmail:    publicKey.SealedEmail,
+	})
+	if err != nil {
+		return fmt.Errorf("Marshal: %w", err)
+	}
+	createdAt := time.Now()
+	if publicKey.CreatedAt != nil {
+		createdAt = *publicKey.CreatedAt
+	}
+	created := unixTime(createdAt)
 	input := &dynamodb.UpdateItemInput{
-		TableName:        aws.String(s.TableName),
-		Key:              k,
-		UpdateExpression: aws.String("ADD publickeys :publickey"),
+		TableName: aws.String(s.TableName),
+		Key:       k,
+		// created_<id> is kept if the key is already stored
+		UpdateExpression: aws.String("ADD publickeys :publickey SET #meta = :meta, #created = if_not_exists(#created, :created)"),
+		ExpressionAttributeNames: map[string]*string{
+			"#meta":    aws.String("meta_" + dynamoDbKeyID(publicKey)),
+			"#created": aws.String("created_" + dynamoDbKeyID(publicKey)),
+		},
 		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
 			":publickey": {
 				BS: [][]byte{encodeDynamoDb(publicKey)},
 			},
+			":meta":    meta,
+			":created": created,
 		},
 	}
-	_, err = s.D.UpdateItem(input)
+	_, err = s.D.UpdateItemWithContext(ctx, input)
 	if err != nil {
 		Log.Error(fmt.Errorf("UpdateItem: input: %v, err: %w", input, err))
 		return fmt.Errorf("UpdateItem: %w", err)
@@ -179,6 +310,116 @@ func (s *DynamoDbStore) Put(d EmailDigest, publicKey PublicKey) error {
 	return nil
 }
 
+// MigrateMetadata sets CreatedAt of the keys that do not have it to createdAt, such as the time of the migration,
+// so that the keys written before the metadata was introduced can be told by their age.
+// It scans the whole table, and returns the number of the migrated keys.
+func (s *DynamoDbStore) MigrateMetadata(ctx context.Context, createdAt time.Time) (migrated int, err error) {
+	ctx, span := startDynamoDbSpan(ctx, "DynamoDbStore.MigrateMetadata", "Scan", s.TableName)
+	defer func() { endSpan(span, err) }()
+
+	created := unixTime(createdAt)
+	var scanErr error
+	err = s.D.ScanPagesWithContext(ctx, &dynamodb.ScanInput{
+		TableName: aws.String(s.TableName),
+	}, func(out *dynamodb.ScanOutput, last bool) bool {
+		for _, raw := range out.Items {
+			var item DynamoDbStoreItem
+			if scanErr = dynamodbattribute.UnmarshalMap(raw, &item); scanErr != nil {
+				return false
+			}
+			for _, b := range item.PublicKeys {
+				id := dynamoDbKeyID(PublicKey{Type: PublicKeyType(b[0]), Key: b[1:]})
+				if _, ok := raw["created_"+id]; ok {
+					continue
+				}
+				_, scanErr = s.D.UpdateItemWithContext(ctx, &dynamodb.UpdateItemInput{
+					TableName:                 aws.String(s.TableName),
+					Key:                       map[string]*dynamodb.AttributeValue{"ID": {B: item.ID}},
+					UpdateExpression:          aws.String("SET #created = if_not_exists(#created, :created)"),
+					ExpressionAttributeNames:  map[string]*string{"#created": aws.String("created_" + id)},
+					ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{":created": created},
+				})
+				if scanErr != nil {
+					return false
+				}
+				migrated++
+			}
+		}
+		return true
+	})
+	if err == nil {
+		err = scanErr
+	}
+	if err != nil {
+		Log.Error(fmt.Errorf("MigrateMetadata: %w", err))
+		return migrated, fmt.Errorf("MigrateMetadata: %w", err)
+	}
+	return migrated, nil
+}
+
+// ScanKeys scans the whole table, and calls fn with the keys of each item.
+func (s *DynamoDbStore) ScanKeys(ctx context.Context, fn func(EmailDigest, []PublicKey) error) (err error) {
+	ctx, span := startDynamoDbSpan(ctx, "DynamoDbStore.ScanKeys", "Scan", s.TableName)
+	defer func() { endSpan(span, err) }()
+
+	var fnErr error
+	err = s.D.ScanPagesWithContext(ctx, &dynamodb.ScanInput{
+		TableName: aws.String(s.TableName),
+	}, func(out *dynamodb.ScanOutput, last bool) bool {
+		for _, raw := range out.Items {
+			var item DynamoDbStoreItem
+			if fnErr = dynamodbattribute.UnmarshalMap(raw, &item); fnErr != nil {
+				return false
+			}
+			if len(item.PublicKeys) == 0 {
+				continue
+			}
+			var keys []PublicKey
+			if keys, fnErr = item.Keys(); fnErr != nil {
+				return false
+			}
+			if keys, fnErr = withMetadata(keys, raw); fnErr != nil {
+				return false
+			}
+			if fnErr = fn(item.ID, keys); fnErr != nil {
+				return false
+			}
+		}
+		return true
+	})
+	if err != nil {
+		Log.Error(fmt.Errorf("Scan: %w", err))
+		return fmt.Errorf("Scan: %w", err)
+	}
+	return fnErr
+}
+
+// Ping checks that the table exists and is active.
+func (s *DynamoDbStore) Ping(ctx context.Context) error {
+	return pingDynamoDb(ctx, s.D, s.TableName)
+}
+
+func pingDynamoDb(ctx context.Context, svc *dynamodb.DynamoDB, tableName string) (err error) {
+	ctx, span := startDynamoDbSpan(ctx, "DynamoDb.Ping", "DescribeTable", tableName)
+	defer func() { endSpan(span, err) }()
+
+	out, err := svc.DescribeTableWithContext(ctx, &dynamodb.DescribeTableInput{
+		TableName: aws.String(tableName),
+	})
+	if err != nil {
+		return fmt.Errorf("DescribeTable: %w", err)
+	}
+	if status := aws.StringValue(out.Table.TableStatus); status != dynamodb.TableStatusActive {
+		return fmt.Errorf("table %s is %s", tableName, status)
+	}
+	return nil
+}
+
+// unixTime is the same as the unixtime option of dynamodbattribute.
+func unixTime(t time.Time) *dynamodb.AttributeValue {
+	return &dynamodb.AttributeValue{N: aws.String(strconv.FormatInt(t.Unix(), 10))}
+}
+
 func encodeDynamoDb(k PublicKey) []byte {
 	ret := make([]byte, 1+len(k.Key))
 	ret[0] = byte(k.Type)
@@ -0,0 +1,142 @@
+package vey
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+)
+
+// MemSuppressionList implements SuppressionList interface.
+// MemSuppressionList is for testing purposes only.
+type MemSuppressionList struct {
+	m       sync.Mutex
+	reasons map[string]string
+}
+
+func NewMemSuppressionList() SuppressionList {
+	return &MemSuppressionList{
+		reasons: make(map[string]string),
+	}
+}
+
+func (l *MemSuppressionList) Suppress(ctx context.Context, d EmailDigest, reason string) error {
+	l.m.Lock()
+	defer l.m.Unlock()
+	l.reasons[base64.StdEncoding.EncodeToString(d)] = reason
+	return nil
+}
+
+func (l *MemSuppressionList) Unsuppress(ctx context.Context, d EmailDigest) error {
+	l.m.Lock()
+	defer l.m.Unlock()
+	delete(l.reasons, base64.StdEncoding.EncodeToString(d))
+	return nil
+}
+
+func (l *MemSuppressionList) IsSuppressed(ctx context.Context, d EmailDigest) (bool, string, error) {
+	l.m.Lock()
+	defer l.m.Unlock()
+	reason, ok := l.reasons[base64.StdEncoding.EncodeToString(d)]
+	return ok, reason, nil
+}
+
+type DynamoDbSuppressionList struct {
+	TableName string
+	D         *dynamodb.DynamoDB
+}
+
+// DynamoDbSuppressionItem represents a single item in the DynamoDB suppression list table.
+type DynamoDbSuppressionItem struct {
+	ID           []byte
+	Reason       string    `dynamodbav:"reason,omitempty"`
+	SuppressedAt time.Time `dynamodbav:"suppressed_at,unixtime"`
+}
+
+// NewDynamoDbSuppressionList creates a new SuppressionList implementation that is backed by DynamoDB.
+// The table has the same key schema as the Store table.
+func NewDynamoDbSuppressionList(tableName string, svc *dynamodb.DynamoDB) SuppressionList {
+	return &DynamoDbSuppressionList{
+		TableName: tableName,
+		D:         svc,
+	}
+}
+
+func (l *DynamoDbSuppressionList) Suppress(ctx context.Context, d EmailDigest, reason string) (err error) {
+	ctx, span := startDynamoDbSpan(ctx, "DynamoDbSuppressionList.Suppress", "PutItem", l.TableName)
+	defer func() { endSpan(span, err) }()
+
+	item, err := dynamodbattribute.MarshalMap(DynamoDbSuppressionItem{
+		ID:           d,
+		Reason:       reason,
+		SuppressedAt: time.Now(),
+	})
+	if err != nil {
+		return fmt.Errorf("MarshalMap: %w", err)
+	}
+	input := &dynamodb.PutItemInput{
+		TableName: aws.String(l.TableName),
+		Item:      item,
+	}
+	if _, err := l.D.PutItemWithContext(ctx, input); err != nil {
+		Log.Error(fmt.Errorf("PutItem: input: %v, err: %w", input, err))
+		return fmt.Errorf("PutItem: %w", err)
+	}
+	return nil
+}
+
+func (l *DynamoDbSuppressionList) Unsuppress(ctx context.Context, d EmailDigest) (err error) {
+	ctx, span := startDynamoDbSpan(ctx, "DynamoDbSuppressionList.Unsuppress", "DeleteItem", l.TableName)
+	defer func() { endSpan(span, err) }()
+
+	input := &dynamodb.DeleteItemInput{
+		TableName: aws.String(l.TableName),
+		Key:       l.key(d),
+	}
+	if _, err := l.D.DeleteItemWithContext(ctx, input); err != nil {
+		Log.Error(fmt.Errorf("DeleteItem: input: %v, err: %w", input, err))
+		return fmt.Errorf("DeleteItem: %w", err)
+	}
+	return nil
+}
+
+func (l *DynamoDbSuppressionList) IsSuppressed(ctx context.Context, d EmailDigest) (_ bool, _ string, err error) {
+	ctx, span := startDynamoDbSpan(ctx, "DynamoDbSuppressionList.IsSuppressed", "GetItem", l.TableName)
+	defer func() { endSpan(span, err) }()
+
+	input := &dynamodb.GetItemInput{
+		TableName: aws.String(l.TableName),
+		Key:       l.key(d),
+	}
+	result, err := l.D.GetItemWithContext(ctx, input)
+	if err != nil {
+		Log.Error(fmt.Errorf("GetItem: input: %v, err: %w", input, err))
+		return false, "", fmt.Errorf("GetItem: %w", err)
+	}
+	if result.Item == nil {
+		return false, "", nil
+	}
+	var item DynamoDbSuppressionItem
+	if err := dynamodbattribute.UnmarshalMap(result.Item, &item); err != nil {
+		return false, "", fmt.Errorf("UnmarshalMap: %w", err)
+	}
+	return true, item.Reason, nil
+}
+
+// Ping checks that the table exists and is active.
+func (l *DynamoDbSuppressionList) Ping(ctx context.Context) error {
+	return pingDynamoDb(ctx, l.D, l.TableName)
+}
+
+func (l *DynamoDbSuppressionList) key(d EmailDigest) map[string]*dynamodb.AttributeValue {
+	return map[string]*dynamodb.AttributeValue{
+		"ID": {
+			B: d,
+		},
+	}
+}
@@ -13,6 +13,8 @@ import (
 const (
 	validEmail   = "test@example.com"
 	invalidEmail = ".test.@example.com"
+	// metadataEmail is used by testMetadata, which leaves the keys
+	metadataEmail = "metadata@example.com"
 )
 
 // VeyTest tests the Vey interface.
@@ -29,6 +31,12 @@ func VeyTest(t *testing.T, v Vey) {
 	testDelete(t, v, pub)
 
 	testGetKeys(t, v, validEmail, []PublicKey{})
+
+	testDeleteWithSignature(t, v)
+
+	testGetKeys(t, v, validEmail, []PublicKey{})
+
+	testMetadata(t, v)
 }
 
 func testPut(t *testing.T, v Vey, edpriv ed25519.PrivateKey, pub []byte) {
@@ -110,6 +118,140 @@ func testDelete(t *testing.T, v Vey, pub []byte) {
 	}
 }
 
+func testDeleteWithSignature(t *testing.T, v Vey) {
+	edpriv, pub := testKeygen(t)
+	publicKey := PublicKey{Type: SSHEd25519, Key: pub}
+
+	// the key should be stored
+	if _, err := v.BeginDeleteWithSignature(validEmail, publicKey); !IsNotFound(err) {
+		t.Fatalf("BeginDeleteWithSignature: expected not found but got %#v", err)
+	}
+
+	challenge := testBeginPut(t, v, validEmail, publicKey)
+	if err := v.CommitPut(challenge, ed25519.Sign(edpriv, challenge)); err != nil {
+		t.Fatalf("CommitPut: %v", err)
+	}
+
+	// the put challenge cannot delete the key
+	challenge = testBeginPut(t, v, validEmail, publicKey)
+	if err := v.CommitDeleteWithSignature(challenge, ed25519.Sign(edpriv, challenge)); !IsNotFound(err) {
+		t.Fatalf("CommitDeleteWithSignature: expected not found but got %#v", err)
+	}
+
+	challenge, err := v.BeginDeleteWithSignature(validEmail, publicKey)
+	if err != nil {
+		t.Fatalf("BeginDeleteWithSignature: %v", err)
+	}
+	if len(challenge) == 0 {
+		t.Fatalf("challenge is empty")
+	}
+
+	// the challenge is not a token to delete without the signature
+	if err := v.CommitDelete(challenge); !IsNotFound(err) {
+		t.Fatalf("CommitDelete: expected not found but got %#v", err)
+	}
+
+	// signed with another key
+	otherpriv, _ := testKeygen(t)
+	err = v.CommitDeleteWithSignature(challenge, ed25519.Sign(otherpriv, challenge))
+	if err == nil {
+		t.Fatal("CommitDeleteWithSignature: expected ErrVerifyFailed but got nil")
+	}
+	if e, g := ErrVerifyFailed.Error(), err.Error(); e != g {
+		t.Fatalf("CommitDeleteWithSignature: expected %#v but got %#v", e, g)
+	}
+	testGetKeys(t, v, validEmail, []PublicKey{publicKey})
+
+	// the challenge is removed after used
+	if err := v.CommitDeleteWithSignature(challenge, ed25519.Sign(edpriv, challenge)); !IsNotFound(err) {
+		t.Fatalf("CommitDeleteWithSignature: expected not found but got %#v", err)
+	}
+
+	challenge, err = v.BeginDeleteWithSignature(validEmail, publicKey)
+	if err != nil {
+		t.Fatalf("BeginDeleteWithSignature: %v", err)
+	}
+	if err := v.CommitDeleteWithSignature(challenge, ed25519.Sign(edpriv, challenge)); err != nil {
+		t.Fatalf("CommitDeleteWithSignature: %v", err)
+	}
+}
+
+// testMetadata uses metadataEmail, and leaves the keys that expire in an hour.
+func testMetadata(t *testing.T, v Vey) {
+	edpriv, pub := testKeygen(t)
+	expires := time.Now().Add(time.Hour).Truncate(time.Second)
+	publicKey := PublicKey{Type: SSHEd25519, Key: pub, Comment: "work laptop", ExpiresAt: &expires}
+
+	past := time.Now().Add(-time.Second)
+	if _, err := v.BeginPut(metadataEmail, PublicKey{Type: SSHEd25519, Key: pub, ExpiresAt: &past}); err == nil || err.Error() != ErrInvalidMetadata.Error() {
+		t.Fatalf("BeginPut: expected %v but got %v", ErrInvalidMetadata, err)
+	}
+
+	put := func(publicKey PublicKey) PublicKey {
+		challenge := testBeginPut(t, v, metadataEmail, publicKey)
+		if err := v.CommitPut(challenge, ed25519.Sign(edpriv, challenge)); err != nil {
+			t.Fatalf("CommitPut: %v", err)
+		}
+		keys, err := v.GetKeys(metadataEmail)
+		if err != nil {
+			t.Fatalf("GetKeys: %v", err)
+		}
+		for _, k := range keys {
+			if k.Equal(publicKey) {
+				return k
+			}
+		}
+		t.Fatalf("GetKeys: %v not found in %v", publicKey, keys)
+		return PublicKey{}
+	}
+
+	got := put(publicKey)
+	if e, g := "work laptop", got.Comment; e != g {
+		t.Errorf("Comment expected %v but got %v", e, g)
+	}
+	if got.ExpiresAt == nil || !got.ExpiresAt.Equal(expires) {
+		t.Errorf("ExpiresAt expected %v but got %v", expires, got.ExpiresAt)
+	}
+	if got.CreatedAt == nil || got.LastVerifiedAt == nil {
+		t.Fatalf("CreatedAt and LastVerifiedAt should be set but got %v and %v", got.CreatedAt, got.LastVerifiedAt)
+	}
+	if d := time.Since(*got.CreatedAt); d < -time.Second || d > time.Minute {
+		t.Errorf("CreatedAt expected now but got %v", got.CreatedAt)
+	}
+
+	// putting again updates the metadata but CreatedAt
+	publicKey.Comment = "home laptop"
+	again := put(publicKey)
+	if e, g := "home laptop", again.Comment; e != g {
+		t.Errorf("Comment expected %v but got %v", e, g)
+	}
+	if again.CreatedAt == nil || !again.CreatedAt.Equal(*got.CreatedAt) {
+		t.Errorf("CreatedAt expected %v but got %v", got.CreatedAt, again.CreatedAt)
+	}
+	if again.LastVerifiedAt == nil || again.LastVerifiedAt.Before(*got.LastVerifiedAt) {
+		t.Errorf("LastVerifiedAt expected after %v but got %v", got.LastVerifiedAt, again.LastVerifiedAt)
+	}
+
+	// the expired keys are not returned
+	expiringPriv, expiringPub := testKeygen(t)
+	soon := time.Now().Add(2 * time.Second)
+	expiring := PublicKey{Type: SSHEd25519, Key: expiringPub, ExpiresAt: &soon}
+	challenge := testBeginPut(t, v, metadataEmail, expiring)
+	if err := v.CommitPut(challenge, ed25519.Sign(expiringPriv, challenge)); err != nil {
+		t.Fatalf("CommitPut: %v", err)
+	}
+	time.Sleep(time.Until(soon) + time.Second)
+	keys, err := v.GetKeys(metadataEmail)
+	if err != nil {
+		t.Fatalf("GetKeys: %v", err)
+	}
+	for _, k := range keys {
+		if k.Equal(expiring) {
+			t.Errorf("GetKeys: expected the expired key to be filtered but got %v", k)
+		}
+	}
+}
+
 func testKeygen(t *testing.T) (ed25519.PrivateKey, []byte) {
 	edpub, edpriv, err := ed25519.GenerateKey(rand.Reader)
 	if err != nil {
@@ -0,0 +1,102 @@
+// Package tracing configures OpenTelemetry tracing for Vey.
+// The vey, http and email packages create spans using the global TracerProvider,
+// which is a no-op until Setup is called.
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.12.0"
+)
+
+const (
+	// ExporterNone disables tracing.
+	ExporterNone = "none"
+	// ExporterStdout writes spans to stdout as JSON.
+	ExporterStdout = "stdout"
+	// ExporterFile writes spans to Config.File as JSON.
+	ExporterFile = "file"
+)
+
+// Config configures the span exporter.
+type Config struct {
+	// Exporter is one of "none", "stdout" or "file". Empty is the same as "none".
+	Exporter string `yaml:"exporter"`
+	// File is the path spans are appended to when Exporter is "file".
+	File string `yaml:"file"`
+	// ServiceName is set as the service.name resource attribute. Defaults to "vey".
+	ServiceName string `yaml:"serviceName"`
+}
+
+// Provider wraps the sdk TracerProvider to close the exporter's output on Shutdown.
+type Provider struct {
+	*sdktrace.TracerProvider
+	out io.Closer
+}
+
+// Shutdown flushes the remaining spans and closes the output file if any.
+func (p *Provider) Shutdown(ctx context.Context) error {
+	err := p.TracerProvider.Shutdown(ctx)
+	if p.out != nil {
+		if er := p.out.Close(); err == nil {
+			err = er
+		}
+	}
+	return err
+}
+
+// Setup installs the global TracerProvider and the W3C Trace Context propagator.
+// Setup returns a nil Provider if the exporter is "none".
+// Callers should call Provider.Shutdown before exiting to flush spans.
+func Setup(c Config) (*Provider, error) {
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+
+	var (
+		w   io.Writer
+		out io.Closer
+	)
+	switch c.Exporter {
+	case "", ExporterNone:
+		return nil, nil
+	case ExporterStdout:
+		w = os.Stdout
+	case ExporterFile:
+		if c.File == "" {
+			return nil, fmt.Errorf("tracing: file exporter requires a file")
+		}
+		f, err := os.OpenFile(c.File, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, err
+		}
+		w, out = f, f
+	default:
+		return nil, fmt.Errorf("tracing: unknown exporter: %s", c.Exporter)
+	}
+
+	exp, err := stdouttrace.New(stdouttrace.WithWriter(w))
+	if err != nil {
+		if out != nil {
+			out.Close()
+		}
+		return nil, err
+	}
+
+	name := c.ServiceName
+	if name == "" {
+		name = "vey"
+	}
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exp),
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceNameKey.String(name))),
+	)
+	otel.SetTracerProvider(tp)
+	return &Provider{TracerProvider: tp, out: out}, nil
+}
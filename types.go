@@ -1,6 +1,14 @@
 package vey
 
-import "bytes"
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
 
 // Vey represent the public API of Email Verifying Keyserver.
 // Structs that implement Vey interface may use Cache, Verifier, Store interface to implement the API.
@@ -10,6 +18,23 @@ type Vey interface {
 	CommitDelete(token []byte) error
 	BeginPut(email string, publicKey PublicKey) (challenge []byte, err error)
 	CommitPut(challenge, signature []byte) error
+	// BeginDeleteWithSignature returns the challenge to be signed with the key to delete, without sending an email.
+	BeginDeleteWithSignature(email string, publicKey PublicKey) (challenge []byte, err error)
+	// CommitDeleteWithSignature deletes the key if the signature of the challenge is made with it.
+	CommitDeleteWithSignature(challenge, signature []byte) error
+}
+
+// ContextVey is the context aware version of Vey.
+// The context carries the trace span, the request deadline and cancellation down to Cache and Store.
+// Use VeyWithContext to adapt a Vey that does not implement ContextVey.
+type ContextVey interface {
+	GetKeysContext(ctx context.Context, email string) ([]PublicKey, error)
+	BeginDeleteContext(ctx context.Context, email string, publicKey PublicKey) (token []byte, err error)
+	CommitDeleteContext(ctx context.Context, token []byte) error
+	BeginPutContext(ctx context.Context, email string, publicKey PublicKey) (challenge []byte, err error)
+	CommitPutContext(ctx context.Context, challenge, signature []byte) error
+	BeginDeleteWithSignatureContext(ctx context.Context, email string, publicKey PublicKey) (challenge []byte, err error)
+	CommitDeleteWithSignatureContext(ctx context.Context, challenge, signature []byte) error
 }
 
 // Cache is a short-term key value store.
@@ -19,24 +44,140 @@ type Cache interface {
 	Del([]byte) error
 }
 
+// ContextCache is the context aware version of Cache.
+// Use CacheWithContext to adapt a Cache that does not implement ContextCache.
+type ContextCache interface {
+	SetContext(context.Context, []byte, Cached) error
+	GetContext(context.Context, []byte) (Cached, error)
+	DelContext(context.Context, []byte) error
+}
+
 type Cached struct {
 	EmailDigest
 	PublicKey
+	// Email is kept only when a Notifier or the StalePolicy is configured,
+	// to notify the address on commit, or to seal it as the SealedEmail of the key.
+	Email string `dynamodbav:",omitempty"`
+	// Purpose is PurposeDelete for the challenges of BeginDeleteWithSignature,
+	// and empty for the challenges and tokens sent in the emails.
+	Purpose string `dynamodbav:",omitempty"`
+}
+
+// ExpiryCache is implemented by Caches that can keep a value longer than their expiry,
+// for the reconfirm challenges that are valid for the Grace of the StalePolicy.
+type ExpiryCache interface {
+	SetWithExpiry(ctx context.Context, key []byte, val Cached, expiresIn time.Duration) error
+}
+
+// FailureCounter is implemented by Caches that count the failed attempts for the lockouts. See WithLockout.
+type FailureCounter interface {
+	// AddFailure counts a failure of key, and returns the failures including it.
+	// The failures are forgotten after window since the last one.
+	AddFailure(ctx context.Context, key []byte, window time.Duration) (Failures, error)
+	// Failures returns the failures of key, which are zero if forgotten.
+	Failures(ctx context.Context, key []byte) (Failures, error)
+	// ResetFailures forgets the failures of key.
+	ResetFailures(ctx context.Context, key []byte) error
 }
 
 // Verifier verifies the signature with the public key.
+// challenge is the SignedPayload returned by BeginPut, or the raw challenge with WithLegacyChallenge.
 type Verifier interface {
 	Verify(publicKey PublicKey, signature, challenge []byte) bool
 }
 
 // Store stores a unique set of public keys for a given email address hash.
 // We do not have to store the email. The hash of it is enough.
+// Put of a key that is already stored updates its metadata, except CreatedAt.
 type Store interface {
 	Get(EmailDigest) ([]PublicKey, error)
 	Delete(EmailDigest, PublicKey) error
 	Put(EmailDigest, PublicKey) error
 }
 
+// KeyScanner is implemented by Stores that can iterate over all the keys, which Maintain requires.
+type KeyScanner interface {
+	// ScanKeys calls fn with the keys of each digest. ScanKeys stops and returns the error returned by fn.
+	// fn may Put and Delete the keys of the digest.
+	ScanKeys(ctx context.Context, fn func(EmailDigest, []PublicKey) error) error
+}
+
+// ContextStore is the context aware version of Store.
+// Use StoreWithContext to adapt a Store that does not implement ContextStore.
+type ContextStore interface {
+	GetContext(context.Context, EmailDigest) ([]PublicKey, error)
+	DeleteContext(context.Context, EmailDigest, PublicKey) error
+	PutContext(context.Context, EmailDigest, PublicKey) error
+}
+
+// SuppressionList stores the digests of the email addresses that should not receive emails,
+// because they have bounced or complained.
+// Like Store, SuppressionList does not store the email addresses.
+type SuppressionList interface {
+	// Suppress adds the digest with the reason, such as "bounce" or "complaint".
+	Suppress(ctx context.Context, d EmailDigest, reason string) error
+	Unsuppress(ctx context.Context, d EmailDigest) error
+	// IsSuppressed returns whether the digest is in the list, and the reason if it is.
+	IsSuppressed(ctx context.Context, d EmailDigest) (bool, string, error)
+}
+
+// Suppressor is implemented by the Vey returned by NewVey, to maintain the SuppressionList by email addresses.
+type Suppressor interface {
+	Suppress(ctx context.Context, email, reason string) error
+	Unsuppress(ctx context.Context, email string) error
+}
+
+// RevocationList is an append-only list of the Revocations of the keys.
+type RevocationList interface {
+	// Append appends r, and returns it with its Seq.
+	Append(ctx context.Context, r Revocation) (Revocation, error)
+	// IsRevoked returns whether the key with the fingerprint has been revoked from the digest,
+	// and the reason of the last Revocation if it has.
+	IsRevoked(ctx context.Context, d EmailDigest, fingerprint string) (bool, string, error)
+	// Since returns at most limit Revocations after seq, in the appended order.
+	Since(ctx context.Context, seq int64, limit int) ([]Revocation, error)
+}
+
+// Revoker is implemented by the Vey returned by NewVey, to revoke the compromised keys.
+type Revoker interface {
+	Revoke(ctx context.Context, email string, publicKey PublicKey, reason string) error
+}
+
+// Maintainer is implemented by the Vey returned by NewVey, to drop the stale keys. See WithStalePolicy.
+type Maintainer interface {
+	Maintain(ctx context.Context, s ChallengeSender) (MaintenanceReport, error)
+}
+
+// Lookuper is implemented by the Vey returned by NewVey, to hand the lookup tokens to the owners of the email addresses.
+// See WithLookupPolicy.
+type Lookuper interface {
+	LookupToken(email string) ([]byte, error)
+	CommitPutLookupContext(ctx context.Context, challenge, signature []byte) ([]byte, error)
+}
+
+// ChallengeSender sends the challenge returned by BeginPut, base64 encoded, to the email address.
+// email.ContextSender implements it.
+type ChallengeSender interface {
+	SendChallengeContext(ctx context.Context, email, challenge string) error
+}
+
+// KeyDenyList is the list of the keys that cannot be added, because they are known to be weak or leaked. See KeyPolicy.
+type KeyDenyList interface {
+	IsDenied(ctx context.Context, publicKey PublicKey) (bool, error)
+}
+
+// Notifier notifies the owner of the email address that its keys changed.
+// Notify is called after CommitPut and CommitDelete succeeded, and its error is logged but does not fail the commit.
+type Notifier interface {
+	Notify(ctx context.Context, c KeyChange) error
+}
+
+// Pinger is implemented by Stores and Caches that can check the connectivity to their backends.
+// Pinger is optional, and used by the readiness check.
+type Pinger interface {
+	Ping(context.Context) error
+}
+
 type PublicKeyType int
 
 const (
@@ -48,6 +189,23 @@ type PublicKey struct {
 	// SSHEd25519 is only supported now, so Key should start with "ssh-ed25519 ".
 	Key  []byte        `json:"key"`
 	Type PublicKeyType `json:"type"`
+
+	// The metadata below does not identify the key. See Equal.
+
+	// Comment names the device that has the private key, such as "work laptop". It is set by the client in BeginPut.
+	Comment string `json:"comment,omitempty" dynamodbav:",omitempty"`
+	// CreatedAt is when the key was first added. It is set by CommitPut.
+	// The keys added before the metadata was introduced do not have it.
+	CreatedAt *time.Time `json:"createdAt,omitempty" dynamodbav:",omitempty"`
+	// LastVerifiedAt is when the signature with the key was last verified by CommitPut.
+	LastVerifiedAt *time.Time `json:"lastVerifiedAt,omitempty" dynamodbav:",omitempty"`
+	// ExpiresAt is set by the client in BeginPut to expire the key. GetKeys does not return the expired keys.
+	ExpiresAt *time.Time `json:"expiresAt,omitempty" dynamodbav:",omitempty"`
+	// ReconfirmBy is set by Maintain when the key became stale. The key is dropped unless it is put again by then.
+	ReconfirmBy *time.Time `json:"reconfirmBy,omitempty" dynamodbav:",omitempty"`
+	// SealedEmail is the email address to send the reconfirm challenge to, encrypted with StalePolicy.Key.
+	// It is kept only with WithStalePolicy, and not in the JSON.
+	SealedEmail []byte `json:"-" dynamodbav:",omitempty"`
 }
 
 // EmailDigest is a hash of an email address.
@@ -59,7 +217,22 @@ type Digester interface {
 	Of(email string) EmailDigest
 }
 
-// Equal reports whether priv and x have the same value.
+// Fingerprint returns the SHA256 fingerprint of the key, as shown by ssh-keygen -l.
+// Keys that are not in the authorized_keys format are hashed as is.
+func (pub PublicKey) Fingerprint() string {
+	if k, _, _, _, err := ssh.ParseAuthorizedKey(pub.Key); err == nil {
+		return ssh.FingerprintSHA256(k)
+	}
+	h := sha256.Sum256(pub.Key)
+	return "SHA256:" + base64.RawStdEncoding.EncodeToString(h[:])
+}
+
+// Expired reports whether the key has expired at now.
+func (pub PublicKey) Expired(now time.Time) bool {
+	return pub.ExpiresAt != nil && !now.Before(*pub.ExpiresAt)
+}
+
+// Equal reports whether pub and x are the same key. The metadata is not compared.
 func (pub PublicKey) Equal(x PublicKey) bool {
 	return pub.Type == x.Type && bytes.Equal(pub.Key, x.Key)
 }
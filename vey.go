@@ -1,20 +1,74 @@
 package vey
 
-import "net/mail"
+import (
+	"context"
+	"crypto/cipher"
+	"errors"
+	"net/mail"
+	"strings"
+	"time"
+)
 
-// vey implements Vey interface.
+// vey implements Vey, ContextVey, Suppressor, Revoker, Maintainer and Lookuper interface.
 type vey struct {
-	digest Digester
-	cache  Cache
-	store  Store
+	digest       Digester
+	cache        ContextCache
+	store        ContextStore
+	suppressions SuppressionList
+	notifier     Notifier
+	// origin, challengeExpiry and legacyChallenge configure the signed payloads.
+	origin          string
+	challengeExpiry time.Duration
+	legacyChallenge bool
+	revocations     RevocationList
+	refuseRevoked   bool
+	stalePolicy     *StalePolicy
+	keyPolicy       *KeyPolicy
+	domains         *domainPolicy
+	lockout         *LockoutPolicy
+	proofSkew       time.Duration
+	lookup          *LookupPolicy
+	// sealer seals the email addresses of the keys with StalePolicy.Key.
+	sealer cipher.AEAD
+	// failures is the cache, if it implements FailureCounter.
+	failures FailureCounter
+	// scanner is the store, if it implements KeyScanner.
+	scanner KeyScanner
+	// expiryCache is the cache, if it implements ExpiryCache.
+	expiryCache ExpiryCache
 }
 
-func NewVey(digest Digester, cache Cache, store Store) Vey {
-	return vey{
+// Option configures the Vey in NewVey.
+type Option func(*vey)
+
+// WithSuppressionList makes BeginDelete and BeginPut return ErrSuppressed for the email addresses in l.
+func WithSuppressionList(l SuppressionList) Option {
+	return func(k *vey) {
+		k.suppressions = l
+	}
+}
+
+// NewVey returns a Vey which also implements ContextVey, Suppressor, Revoker, Maintainer and Lookuper.
+// cache and store that do not implement ContextCache and ContextStore are adapted.
+func NewVey(digest Digester, cache Cache, store Store, opts ...Option) Vey {
+	k := vey{
 		digest: digest,
-		cache:  cache,
-		store:  store,
+		cache:  CacheWithContext(cache),
+		store:  StoreWithContext(store),
+	}
+	if s, ok := store.(KeyScanner); ok {
+		k.scanner = s
+	}
+	if c, ok := cache.(FailureCounter); ok {
+		k.failures = c
 	}
+	if c, ok := cache.(ExpiryCache); ok {
+		k.expiryCache = c
+	}
+	for _, opt := range opts {
+		opt(&k)
+	}
+	return k
 }
 
 func validateEmail(email string) error {
@@ -22,84 +76,477 @@ func validateEmail(email string) error {
 	return err
 }
 
+// maxComment is the maximum length of PublicKey.Comment in bytes.
+const maxComment = 256
+
+func validateMetadata(publicKey PublicKey) error {
+	if len(publicKey.Comment) > maxComment || strings.ContainsAny(publicKey.Comment, "\r\n") {
+		return ErrInvalidMetadata
+	}
+	if publicKey.Expired(time.Now()) {
+		return ErrInvalidMetadata
+	}
+	return nil
+}
+
 func (k vey) GetKeys(email string) ([]PublicKey, error) {
+	return k.GetKeysContext(context.Background(), email)
+}
+
+func (k vey) GetKeysContext(ctx context.Context, email string) (_ []PublicKey, err error) {
+	ctx, span := startSpan(ctx, "vey.GetKeys")
+	defer func() { endSpan(span, err) }()
+	defer k.padLookup(ctx, time.Now())
+
 	if err := validateEmail(email); err != nil {
 		return nil, ErrInvalidEmail
 	}
+	if err := k.requireLookupToken(ctx); err != nil {
+		return nil, err
+	}
+	if err := k.checkDomain(email); err == ErrIgnored {
+		return []PublicKey{}, nil
+	} else if err != nil {
+		return nil, err
+	}
 
 	digest := k.digest.Of(email)
-	return k.store.Get(digest)
+	if !k.validLookupToken(ctx, digest) {
+		// as if the email address has no keys
+		return []PublicKey{}, nil
+	}
+	keys, err := k.store.GetContext(ctx, digest)
+	if err != nil {
+		return nil, err
+	}
+	// the expired keys are kept in the Store, but not returned
+	now := time.Now()
+	ret := make([]PublicKey, 0, len(keys))
+	for _, key := range keys {
+		if !key.Expired(now) {
+			ret = append(ret, key)
+		}
+	}
+	return ret, nil
 }
 
 func (k vey) BeginDelete(email string, publicKey PublicKey) ([]byte, error) {
+	return k.BeginDeleteContext(context.Background(), email, publicKey)
+}
+
+func (k vey) BeginDeleteContext(ctx context.Context, email string, publicKey PublicKey) (_ []byte, err error) {
+	ctx, span := startSpan(ctx, "vey.BeginDelete")
+	defer func() { endSpan(span, err) }()
+
 	if err := validateEmail(email); err != nil {
 		return nil, ErrInvalidEmail
 	}
+	if err := k.checkDomain(email); err != nil {
+		return nil, err
+	}
 
 	digest := k.digest.Of(email)
+	if err := k.checkSuppressed(ctx, digest); err != nil {
+		return nil, err
+	}
 	token, err := NewToken()
 	if err != nil {
 		return nil, err
 	}
-	if err := k.cache.Set(token, Cached{
-		EmailDigest: digest,
-		PublicKey:   publicKey,
-	}); err != nil {
+	if err := k.cache.SetContext(ctx, token, k.cached(email, digest, publicKey)); err != nil {
 		return nil, err
 	}
 	return token, nil
 }
 
 func (k vey) CommitDelete(token []byte) error {
-	cached, err := k.cache.Get(token)
+	return k.CommitDeleteContext(context.Background(), token)
+}
+
+func (k vey) CommitDeleteContext(ctx context.Context, token []byte) (err error) {
+	ctx, span := startSpan(ctx, "vey.CommitDelete")
+	defer func() { endSpan(span, err) }()
+
+	if err := k.checkLocked(ctx, "CommitDelete", nil); err != nil {
+		return err
+	}
+	cached, err := k.cache.GetContext(ctx, token)
+	if errors.Is(err, ErrNotFound) {
+		k.fail(ctx, "CommitDelete", nil)
+	}
 	if err != nil {
 		return err
 	}
-	return k.store.Delete(cached.EmailDigest, cached.PublicKey)
+	if cached.Purpose != "" {
+		// the challenges of BeginDeleteWithSignature are not sent to the email address
+		k.fail(ctx, "CommitDelete", nil)
+		return ErrNotFound
+	}
+	// not to revoke nor notify the key not stored, or deleted since
+	keys, err := k.store.GetContext(ctx, cached.EmailDigest)
+	if err != nil {
+		return err
+	}
+	if !containsKey(keys, cached.PublicKey) {
+		return ErrNotFound
+	}
+	if err := k.store.DeleteContext(ctx, cached.EmailDigest, cached.PublicKey); err != nil {
+		return err
+	}
+	k.revoke(detach(ctx), cached, RevokeDeleted)
+	k.notify(detach(ctx), KeyDeleted, cached)
+	return nil
 }
 
 func (k vey) BeginPut(email string, publicKey PublicKey) ([]byte, error) {
+	return k.BeginPutContext(context.Background(), email, publicKey)
+}
+
+// BeginPutContext returns the challenge to be sent to the email address.
+// With the Secret of the LookupPolicy, it returns ErrIgnored instead of ErrTooManyKeys and ErrRevoked,
+// which tell that the email address has keys. See LookupPolicy.
+func (k vey) BeginPutContext(ctx context.Context, email string, publicKey PublicKey) (_ []byte, err error) {
+	ctx, span := startSpan(ctx, "vey.BeginPut")
+	defer func() { endSpan(span, err) }()
+
+	challenge, err := k.beginPut(ctx, email, publicKey, false)
+	if (err == ErrTooManyKeys || err == ErrRevoked) && k.hidesKeys() {
+		return nil, ErrIgnored
+	}
+	return challenge, err
+}
+
+// beginPut begins the put. The reconfirmations begun by Maintain do not require the PossessionProof,
+// and their challenges expire after the Grace of the StalePolicy.
+func (k vey) beginPut(ctx context.Context, email string, publicKey PublicKey, reconfirm bool) (_ []byte, err error) {
 	if err := validateEmail(email); err != nil {
 		return nil, ErrInvalidEmail
 	}
+	if err := k.checkDomain(email); err != nil {
+		return nil, err
+	}
+	if err := validateMetadata(publicKey); err != nil {
+		return nil, err
+	}
+	if !reconfirm {
+		if err := k.checkProof(ctx, email, publicKey); err != nil {
+			return nil, err
+		}
+	}
+	// the times and the reconfirmation are set by CommitPut and Maintain
+	publicKey.CreatedAt, publicKey.LastVerifiedAt = nil, nil
+	publicKey.ReconfirmBy, publicKey.SealedEmail = nil, nil
 
 	digest := k.digest.Of(email)
-	challenge, err := NewChallenge()
+	if err := k.checkSuppressed(ctx, digest); err != nil {
+		return nil, err
+	}
+	if err := k.checkRevoked(ctx, digest, publicKey); err != nil {
+		return nil, err
+	}
+	if err := k.checkKey(ctx, digest, publicKey); err != nil {
+		return nil, err
+	}
+	var expiry time.Duration
+	if reconfirm {
+		expiry = k.reconfirmExpiry()
+	}
+	var challenge []byte
+	if k.legacyChallenge {
+		challenge, err = NewChallenge()
+	} else {
+		challenge, err = k.newPayload(PurposePut, digest, publicKey, expiry)
+	}
 	if err != nil {
 		return nil, err
 	}
-	if err := k.cache.Set(challenge, Cached{
-		EmailDigest: digest,
-		PublicKey:   publicKey,
-	}); err != nil {
+	if reconfirm {
+		err = k.expiryCache.SetWithExpiry(ctx, challenge, k.cached(email, digest, publicKey), expiry)
+	} else {
+		err = k.cache.SetContext(ctx, challenge, k.cached(email, digest, publicKey))
+	}
+	if err != nil {
 		return nil, err
 	}
 	return challenge, nil
 }
 
-// CommitPut verifies the signature with the public key.
-// CommitPut returns ErrVerifyFailed if the signature is invalid.
-// The challenge is deleted whether or not verify succeeds.
-func (k vey) CommitPut(challenge, signature []byte) (err error) {
-	var cached Cached
-	cached, err = k.cache.Get(challenge)
+func (k vey) CommitPut(challenge, signature []byte) error {
+	return k.CommitPutContext(context.Background(), challenge, signature)
+}
+
+// CommitPutContext verifies the signature with the public key.
+// CommitPutContext returns ErrVerifyFailed if the signature is invalid,
+// or the signed payload is not the one for the cached email address and key. See SignedPayload.
+// The challenge is deleted whether or not verify succeeds,
+// but kept if CommitPutContext returns ErrLocked for the locked out client or email address. See WithLockout.
+func (k vey) CommitPutContext(ctx context.Context, challenge, signature []byte) (err error) {
+	ctx, span := startSpan(ctx, "vey.CommitPut")
+	defer func() { endSpan(span, err) }()
+
+	_, err = k.commitPut(ctx, challenge, signature)
+	return
+}
+
+// commitPut commits the put, and returns the Cached of the challenge.
+func (k vey) commitPut(ctx context.Context, challenge, signature []byte) (cached Cached, err error) {
+	if err = k.checkLocked(ctx, "CommitPut", nil); err != nil {
+		return
+	}
+	cached, err = k.cache.GetContext(ctx, challenge)
+	if errors.Is(err, ErrNotFound) {
+		k.fail(ctx, "CommitPut", nil)
+	}
 	if err != nil {
 		return
 	}
-	// challenge is only valid once
+	if cached.Purpose != "" {
+		k.fail(ctx, "CommitPut", nil)
+		err = ErrNotFound
+		return
+	}
+	// the challenge is kept for after the lockout
+	if err = k.checkLocked(ctx, "CommitPut", cached.EmailDigest); err != nil {
+		return
+	}
+	// challenge is only valid once, even if ctx is canceled while verifying
 	defer func() {
-		er := k.cache.Del(challenge)
+		er := k.cache.DelContext(detach(ctx), challenge)
 		if err == nil {
 			err = er
 		}
 	}()
 
+	if !k.legacyChallenge {
+		if err = k.checkPayload(challenge, PurposePut, cached); err != nil {
+			if err == ErrVerifyFailed {
+				k.fail(ctx, "CommitPut", cached.EmailDigest)
+			}
+			return
+		}
+	}
 	publicKey := cached.PublicKey
 	verifier := NewVerifier(publicKey.Type)
 	if !verifier.Verify(publicKey, signature, challenge) {
+		k.fail(ctx, "CommitPut", cached.EmailDigest)
+		err = ErrVerifyFailed
+		return
+	}
+	k.succeed(ctx, cached.EmailDigest)
+	// the key may have been revoked after BeginPut
+	if err = k.checkRevoked(ctx, cached.EmailDigest, publicKey); err != nil {
+		return
+	}
+	// other keys may have been added after BeginPut
+	if err = k.checkKey(ctx, cached.EmailDigest, publicKey); err != nil {
+		return
+	}
+	now := time.Now().UTC()
+	publicKey.CreatedAt, publicKey.LastVerifiedAt = &now, &now
+	if k.stalePolicy != nil {
+		if publicKey.SealedEmail, err = k.sealEmail(cached.Email, cached.EmailDigest); err != nil {
+			return
+		}
+	}
+	if err = k.store.PutContext(ctx, cached.EmailDigest, publicKey); err != nil {
+		return
+	}
+	k.notify(detach(ctx), KeyAdded, cached)
+	return
+}
+
+func (k vey) BeginDeleteWithSignature(email string, publicKey PublicKey) ([]byte, error) {
+	return k.BeginDeleteWithSignatureContext(context.Background(), email, publicKey)
+}
+
+// BeginDeleteWithSignatureContext returns the challenge to be signed with the key to delete.
+// Unlike BeginDelete, no email is sent, so that the key can be deleted without the access to the email address.
+// BeginDeleteWithSignatureContext returns ErrNotFound if the key is not stored for the email address,
+// or the email address is ignored by the DomainPolicy, as GetKeys returns no keys for it,
+// or the type of the key is not supported.
+// With the Secret of the LookupPolicy, it returns the challenge anyway, not to tell whether the key is stored,
+// and the response is delayed as GetKeys. See LookupPolicy.
+// The SuppressionList does not apply, because no email is sent.
+func (k vey) BeginDeleteWithSignatureContext(ctx context.Context, email string, publicKey PublicKey) (_ []byte, err error) {
+	ctx, span := startSpan(ctx, "vey.BeginDeleteWithSignature")
+	defer func() { endSpan(span, err) }()
+	defer k.padLookup(ctx, time.Now())
+
+	if err := validateEmail(email); err != nil {
+		return nil, ErrInvalidEmail
+	}
+	if _, ok := keyAlgorithms[publicKey.Type]; !ok {
+		// NewVerifier does not support it, so it is never stored
+		return nil, ErrNotFound
+	}
+	digest := k.digest.Of(email)
+	if err := k.checkDomain(email); err == ErrIgnored {
+		if !k.hidesKeys() {
+			return nil, ErrNotFound
+		}
+	} else if err != nil {
+		return nil, err
+	} else {
+		keys, err := k.store.GetContext(ctx, digest)
+		if err != nil {
+			return nil, err
+		}
+		if !containsKey(keys, publicKey) && !k.hidesKeys() {
+			return nil, ErrNotFound
+		}
+	}
+	var challenge []byte
+	if k.legacyChallenge {
+		challenge, err = NewChallenge()
+	} else {
+		challenge, err = k.newPayload(PurposeDelete, digest, publicKey, 0)
+	}
+	if err != nil {
+		return nil, err
+	}
+	cached := k.cached(email, digest, publicKey)
+	cached.Purpose = PurposeDelete
+	if err := k.cache.SetContext(ctx, challenge, cached); err != nil {
+		return nil, err
+	}
+	return challenge, nil
+}
+
+func (k vey) CommitDeleteWithSignature(challenge, signature []byte) error {
+	return k.CommitDeleteWithSignatureContext(context.Background(), challenge, signature)
+}
+
+// CommitDeleteWithSignatureContext verifies the signature with the key to delete, and deletes it.
+// CommitDeleteWithSignatureContext returns ErrVerifyFailed if the signature is invalid,
+// or ErrNotFound if the key is not stored.
+// The challenge is deleted whether or not verify succeeds.
+func (k vey) CommitDeleteWithSignatureContext(ctx context.Context, challenge, signature []byte) (err error) {
+	ctx, span := startSpan(ctx, "vey.CommitDeleteWithSignature")
+	defer func() { endSpan(span, err) }()
+
+	if err = k.checkLocked(ctx, "CommitDeleteWithSignature", nil); err != nil {
+		return
+	}
+	var cached Cached
+	cached, err = k.cache.GetContext(ctx, challenge)
+	if errors.Is(err, ErrNotFound) {
+		k.fail(ctx, "CommitDeleteWithSignature", nil)
+	}
+	if err != nil {
+		return
+	}
+	defer func() {
+		er := k.cache.DelContext(detach(ctx), challenge)
+		if err == nil {
+			err = er
+		}
+	}()
+	if cached.Purpose != PurposeDelete {
+		// the put challenges and the delete tokens are not for this
+		k.fail(ctx, "CommitDeleteWithSignature", nil)
+		err = ErrNotFound
+		return
+	}
+	if !k.legacyChallenge {
+		if err = k.checkPayload(challenge, PurposeDelete, cached); err != nil {
+			if err == ErrVerifyFailed {
+				k.fail(ctx, "CommitDeleteWithSignature", nil)
+			}
+			return
+		}
+	}
+	// Anyone gets the challenges without the email loop, so the failures count only for the client,
+	// not to lock out the owner of the email address. Each challenge allows a single attempt.
+	publicKey := cached.PublicKey
+	if _, ok := keyAlgorithms[publicKey.Type]; !ok {
+		// NewVerifier does not support it
+		k.fail(ctx, "CommitDeleteWithSignature", nil)
+		err = ErrVerifyFailed
+		return
+	}
+	if !NewVerifier(publicKey.Type).Verify(publicKey, signature, challenge) {
+		k.fail(ctx, "CommitDeleteWithSignature", nil)
 		err = ErrVerifyFailed
 		return
 	}
-	err = k.store.Put(cached.EmailDigest, publicKey)
+	// the challenge may be for the key not stored, or deleted since. See LookupPolicy.
+	var keys []PublicKey
+	if keys, err = k.store.GetContext(ctx, cached.EmailDigest); err != nil {
+		return
+	}
+	if !containsKey(keys, publicKey) {
+		err = ErrNotFound
+		return
+	}
+	if err = k.store.DeleteContext(ctx, cached.EmailDigest, publicKey); err != nil {
+		return
+	}
+	k.revoke(detach(ctx), cached, RevokeRetired)
+	k.notify(detach(ctx), KeyDeleted, cached)
 	return
 }
+
+func containsKey(keys []PublicKey, publicKey PublicKey) bool {
+	for _, key := range keys {
+		if key.Equal(publicKey) {
+			return true
+		}
+	}
+	return false
+}
+
+// Suppress adds the email address to the SuppressionList.
+func (k vey) Suppress(ctx context.Context, email, reason string) (err error) {
+	ctx, span := startSpan(ctx, "vey.Suppress")
+	defer func() { endSpan(span, err) }()
+
+	if k.suppressions == nil {
+		return ErrNoSuppressionList
+	}
+	if err := validateEmail(email); err != nil {
+		return ErrInvalidEmail
+	}
+	return k.suppressions.Suppress(ctx, k.digest.Of(email), reason)
+}
+
+// Unsuppress removes the email address from the SuppressionList.
+func (k vey) Unsuppress(ctx context.Context, email string) (err error) {
+	ctx, span := startSpan(ctx, "vey.Unsuppress")
+	defer func() { endSpan(span, err) }()
+
+	if k.suppressions == nil {
+		return ErrNoSuppressionList
+	}
+	if err := validateEmail(email); err != nil {
+		return ErrInvalidEmail
+	}
+	return k.suppressions.Unsuppress(ctx, k.digest.Of(email))
+}
+
+// cached returns the Cached for the begun put or delete.
+// The email address is kept only if it is notified on commit, or kept for the reconfirmation.
+func (k vey) cached(email string, digest EmailDigest, publicKey PublicKey) Cached {
+	c := Cached{
+		EmailDigest: digest,
+		PublicKey:   publicKey,
+	}
+	if k.notifier != nil || k.stalePolicy != nil {
+		c.Email = email
+	}
+	return c
+}
+
+// checkSuppressed returns ErrSuppressed if the digest is in the SuppressionList.
+func (k vey) checkSuppressed(ctx context.Context, digest EmailDigest) error {
+	if k.suppressions == nil {
+		return nil
+	}
+	suppressed, _, err := k.suppressions.IsSuppressed(ctx, digest)
+	if err != nil {
+		return err
+	}
+	if suppressed {
+		return ErrSuppressed
+	}
+	return nil
+}
@@ -1,6 +1,17 @@
 package vey
 
 import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
 	"time"
 )
@@ -9,3 +20,930 @@ func TestMemKeys(t *testing.T) {
 	salt := []byte("salt")
 	VeyTest(t, NewVey(NewDigester(salt), NewMemCache(time.Second), NewMemStore()))
 }
+
+func TestContextCanceled(t *testing.T) {
+	salt := []byte("salt")
+	v := VeyWithContext(NewVey(NewDigester(salt), NewMemCache(time.Second), NewMemStore()))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if _, err := v.GetKeysContext(ctx, validEmail); !errors.Is(err, context.Canceled) {
+		t.Errorf("GetKeysContext: expected context.Canceled but got %v", err)
+	}
+	if _, err := v.BeginPutContext(ctx, validEmail, PublicKey{Type: SSHEd25519, Key: []byte("key")}); !errors.Is(err, context.Canceled) {
+		t.Errorf("BeginPutContext: expected context.Canceled but got %v", err)
+	}
+	if _, err := v.BeginDeleteContext(ctx, validEmail, PublicKey{Type: SSHEd25519, Key: []byte("key")}); !errors.Is(err, context.Canceled) {
+		t.Errorf("BeginDeleteContext: expected context.Canceled but got %v", err)
+	}
+
+	// Vey implementations without ContextVey are adapted
+	a := VeyWithContext(struct{ Vey }{NewVey(NewDigester(salt), NewMemCache(time.Second), NewMemStore())})
+	if _, err := a.GetKeysContext(ctx, validEmail); !errors.Is(err, context.Canceled) {
+		t.Errorf("adapted GetKeysContext: expected context.Canceled but got %v", err)
+	}
+	if _, err := a.GetKeysContext(context.Background(), validEmail); err != nil {
+		t.Errorf("adapted GetKeysContext: %v", err)
+	}
+}
+
+func TestSuppressionList(t *testing.T) {
+	salt := []byte("salt")
+	v := NewVey(NewDigester(salt), NewMemCache(time.Second), NewMemStore(), WithSuppressionList(NewMemSuppressionList()))
+	s := v.(Suppressor)
+	ctx := context.Background()
+	publicKey := PublicKey{Type: SSHEd25519, Key: []byte("key")}
+
+	if err := s.Suppress(ctx, validEmail, "bounce"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := v.BeginPut(validEmail, publicKey); !errors.Is(err, ErrSuppressed) {
+		t.Errorf("BeginPut: expected %v but got %v", ErrSuppressed, err)
+	}
+	if _, err := v.BeginDelete(validEmail, publicKey); !errors.Is(err, ErrSuppressed) {
+		t.Errorf("BeginDelete: expected %v but got %v", ErrSuppressed, err)
+	}
+	// only the suppressed address is refused
+	if _, err := v.BeginPut("other@example.com", publicKey); err != nil {
+		t.Errorf("BeginPut: %v", err)
+	}
+	if _, err := v.GetKeys(validEmail); err != nil {
+		t.Errorf("GetKeys: %v", err)
+	}
+
+	if err := s.Unsuppress(ctx, validEmail); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := v.BeginPut(validEmail, publicKey); err != nil {
+		t.Errorf("BeginPut: %v", err)
+	}
+
+	// without SuppressionList
+	n := NewVey(NewDigester(salt), NewMemCache(time.Second), NewMemStore()).(Suppressor)
+	if err := n.Suppress(ctx, validEmail, "bounce"); !errors.Is(err, ErrNoSuppressionList) {
+		t.Errorf("expected %v but got %v", ErrNoSuppressionList, err)
+	}
+}
+
+func TestNotifier(t *testing.T) {
+	salt := []byte("salt")
+	n := NewMemNotifier().(*MemNotifier)
+	VeyTest(t, NewVey(NewDigester(salt), NewMemCache(time.Second), NewMemStore(), WithNotifier(n)))
+
+	changes := n.Changes()
+	expected := []struct {
+		typ   string
+		email string
+	}{
+		{KeyAdded, validEmail},
+		{KeyAdded, validEmail},
+		{KeyDeleted, validEmail},
+		{KeyAdded, validEmail},
+		{KeyDeleted, validEmail},
+		{KeyAdded, metadataEmail},
+		{KeyAdded, metadataEmail},
+		{KeyAdded, metadataEmail},
+	}
+	if e, g := len(expected), len(changes); e != g {
+		t.Fatalf("changes expected %v but got %v", e, g)
+	}
+	for i, x := range expected {
+		c := changes[i]
+		if e, g := x.typ, c.Type; e != g {
+			t.Errorf("changes[%d].Type expected %v but got %v", i, e, g)
+		}
+		if e, g := x.email, c.Email; e != g {
+			t.Errorf("changes[%d].Email expected %v but got %v", i, e, g)
+		}
+		if e, g := c.PublicKey.Fingerprint(), c.Fingerprint; e != g || g == "" {
+			t.Errorf("changes[%d].Fingerprint expected %v but got %v", i, e, g)
+		}
+	}
+	if changes[0].ID == changes[1].ID {
+		t.Errorf("changes should have unique IDs but got %v", changes[0].ID)
+	}
+}
+
+func TestWebhookNotifier(t *testing.T) {
+	secret := []byte("secret")
+	received := make(chan KeyChange, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if err := VerifyWebhook(secret, r.Header.Get(WebhookSignatureHeader), body, time.Minute); err != nil {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		var c KeyChange
+		if err := json.Unmarshal(body, &c); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		received <- c
+	}))
+	defer ts.Close()
+
+	c := KeyChange{ID: "id", Type: KeyAdded, Email: validEmail, Fingerprint: "SHA256:x"}
+	if err := NewWebhookNotifier(ts.URL, secret).Notify(context.Background(), c); err != nil {
+		t.Fatal(err)
+	}
+	g := <-received
+	if e, g := c.Email, g.Email; e != g {
+		t.Errorf("email expected %v but got %v", e, g)
+	}
+
+	// the receiver rejects the other secrets
+	if err := NewWebhookNotifier(ts.URL, []byte("other")).Notify(context.Background(), c); err == nil {
+		t.Error("expected an error for the unauthorized response but got nil")
+	}
+
+	body := []byte(`{}`)
+	old := SignWebhook(secret, time.Now().Add(-time.Hour), body)
+	if e, g := ErrWebhookSignature, VerifyWebhook(secret, old, body, time.Minute); e != g {
+		t.Errorf("old signature expected %v but got %v", e, g)
+	}
+	if e, g := ErrWebhookSignature, VerifyWebhook(secret, SignWebhook(secret, time.Now(), body), []byte(`{"a":1}`), time.Minute); e != g {
+		t.Errorf("modified body expected %v but got %v", e, g)
+	}
+}
+
+func TestSignedPayload(t *testing.T) {
+	p := SignedPayload{
+		Purpose:        PurposePut,
+		Origin:         "https://vey.example.com",
+		Challenge:      []byte("challenge"),
+		EmailDigest:    EmailDigest("digest"),
+		KeyFingerprint: "SHA256:fp",
+		Expires:        time.Unix(1700000000, 0),
+	}
+	b := p.Bytes()
+	if !bytes.HasPrefix(b, []byte("vey-signed-payload/1\npurpose:put\norigin:https://vey.example.com\n")) {
+		t.Errorf("unexpected payload: %s", b)
+	}
+	parsed, err := ParseSignedPayload(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e, g := string(b), string(parsed.Bytes()); e != g {
+		t.Errorf("expected %v but got %v", e, g)
+	}
+	for _, invalid := range [][]byte{
+		[]byte("challenge"),
+		append(b, '\n'),
+		bytes.Replace(b, []byte("purpose:"), []byte("purpose: "), 1),
+		bytes.Replace(b, []byte("\nkey:"), []byte("\nfingerprint:"), 1),
+	} {
+		if _, err := ParseSignedPayload(invalid); err != ErrInvalidPayload {
+			t.Errorf("%q: expected %v but got %v", invalid, ErrInvalidPayload, err)
+		}
+	}
+}
+
+func TestSignedPayloadOrigin(t *testing.T) {
+	salt := []byte("salt")
+	cache, store := NewMemCache(time.Second), NewMemStore()
+	VeyTest(t, NewVey(NewDigester(salt), cache, store, WithOrigin("https://a.example.com")))
+
+	// a payload signed for a is not accepted by b, even if b finds it
+	a := NewVey(NewDigester(salt), cache, store, WithOrigin("https://a.example.com"))
+	b := NewVey(NewDigester(salt), cache, store, WithOrigin("https://b.example.com"))
+	edpriv, pub := testKeygen(t)
+	challenge := testBeginPut(t, a, validEmail, PublicKey{Type: SSHEd25519, Key: pub})
+	p, err := ParseSignedPayload(challenge)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e, g := "https://a.example.com", p.Origin; e != g {
+		t.Errorf("origin expected %v but got %v", e, g)
+	}
+	if e, g := (PublicKey{Type: SSHEd25519, Key: pub}).Fingerprint(), p.KeyFingerprint; e != g {
+		t.Errorf("key expected %v but got %v", e, g)
+	}
+	if e, g := ErrVerifyFailed, b.CommitPut(challenge, ed25519.Sign(edpriv, challenge)); e != g {
+		t.Errorf("CommitPut: expected %v but got %v", e, g)
+	}
+}
+
+func TestLegacyChallenge(t *testing.T) {
+	salt := []byte("salt")
+	v := NewVey(NewDigester(salt), NewMemCache(time.Second), NewMemStore(), WithLegacyChallenge())
+	VeyTest(t, v)
+
+	challenge := testBeginPut(t, v, validEmail, PublicKey{Type: SSHEd25519, Key: []byte("key")})
+	if e, g := 32, len(challenge); e != g {
+		t.Errorf("challenge length expected %v but got %v", e, g)
+	}
+}
+
+func TestRevocationList(t *testing.T) {
+	salt := []byte("salt")
+	l := NewMemRevocationList()
+	store := NewMemStore()
+	v := NewVey(NewDigester(salt), NewMemCache(time.Second), store, WithRevocationList(l), WithRefuseRevoked())
+	VeyTest(t, v)
+	ctx := context.Background()
+
+	rs, err := l.Since(ctx, 0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e, g := 2, len(rs); e != g {
+		t.Fatalf("revocations expected %v but got %v", e, g)
+	}
+	for i, reason := range []string{RevokeDeleted, RevokeRetired} {
+		if e, g := int64(i+1), rs[i].Seq; e != g {
+			t.Errorf("revocations[%d].Seq expected %v but got %v", i, e, g)
+		}
+		if e, g := reason, rs[i].Reason; e != g {
+			t.Errorf("revocations[%d].Reason expected %v but got %v", i, e, g)
+		}
+	}
+	if rs, _ := l.Since(ctx, 1, 10); len(rs) != 1 || rs[0].Seq != 2 {
+		t.Errorf("revocations since 1 expected [2] but got %v", rs)
+	}
+
+	// the deleted keys can be put again
+	edpriv, pub := testKeygen(t)
+	publicKey := PublicKey{Type: SSHEd25519, Key: pub}
+	challenge := testBeginPut(t, v, validEmail, publicKey)
+	if err := v.CommitPut(challenge, ed25519.Sign(edpriv, challenge)); err != nil {
+		t.Fatal(err)
+	}
+	token, err := v.BeginDelete(validEmail, publicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := v.CommitDelete(token); err != nil {
+		t.Fatal(err)
+	}
+	if revoked, reason, _ := l.IsRevoked(ctx, NewDigester(salt).Of(validEmail), publicKey.Fingerprint()); !revoked || reason != RevokeDeleted {
+		t.Errorf("IsRevoked expected %v but got %v, %v", RevokeDeleted, revoked, reason)
+	}
+	challenge = testBeginPut(t, v, validEmail, publicKey)
+	if err := v.CommitPut(challenge, ed25519.Sign(edpriv, challenge)); err != nil {
+		t.Errorf("CommitPut: the deleted key should be put again but got %v", err)
+	}
+
+	// the compromised keys are refused
+	challenge = testBeginPut(t, v, validEmail, publicKey)
+	if err := v.(Revoker).Revoke(ctx, validEmail, publicKey, RevokeCompromised); err != nil {
+		t.Fatal(err)
+	}
+	if e, g := ErrRevoked, v.CommitPut(challenge, ed25519.Sign(edpriv, challenge)); e != g {
+		t.Errorf("CommitPut: expected %v but got %v", e, g)
+	}
+	if _, err := v.BeginPut(validEmail, publicKey); err != ErrRevoked {
+		t.Errorf("BeginPut: expected %v but got %v", ErrRevoked, err)
+	}
+	// only from the email address it was revoked from
+	testBeginPut(t, v, "other@example.com", publicKey)
+
+	rs, _ = l.Since(ctx, 3, 10)
+	if len(rs) != 1 || rs[0].Reason != RevokeCompromised || rs[0].KeyFingerprint != publicKey.Fingerprint() {
+		t.Errorf("unexpected revocations: %v", rs)
+	}
+
+	// deleting the compromised key, stored before it was revoked, does not downgrade it
+	if err := store.Put(NewDigester(salt).Of(validEmail), publicKey); err != nil {
+		t.Fatal(err)
+	}
+	token, err = v.BeginDelete(validEmail, publicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := v.CommitDelete(token); err != nil {
+		t.Fatal(err)
+	}
+	if revoked, reason, _ := l.IsRevoked(ctx, NewDigester(salt).Of(validEmail), publicKey.Fingerprint()); !revoked || reason != RevokeCompromised {
+		t.Errorf("IsRevoked expected %v but got %v, %v", RevokeCompromised, revoked, reason)
+	}
+	if _, err := v.BeginPut(validEmail, publicKey); err != ErrRevoked {
+		t.Errorf("BeginPut: expected %v but got %v", ErrRevoked, err)
+	}
+
+	// Revoke requires the RevocationList
+	if e, g := ErrNoRevocationList, NewVey(NewDigester(salt), NewMemCache(time.Second), NewMemStore()).(Revoker).Revoke(ctx, validEmail, publicKey, RevokeCompromised); e != g {
+		t.Errorf("Revoke: expected %v but got %v", e, g)
+	}
+}
+
+func TestDeleteNotStored(t *testing.T) {
+	l := NewMemRevocationList()
+	n := NewMemNotifier().(*MemNotifier)
+	v := NewVey(NewDigester([]byte("salt")), NewMemCache(time.Second), NewMemStore(), WithRevocationList(l), WithNotifier(n))
+	ctx := context.Background()
+	_, pub := testKeygen(t)
+	publicKey := PublicKey{Type: SSHEd25519, Key: pub}
+
+	token, err := v.BeginDelete(validEmail, publicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e, g := ErrNotFound, v.CommitDelete(token); e != g {
+		t.Errorf("CommitDelete: expected %v but got %v", e, g)
+	}
+	if e, g := ErrNotFound, v.(Revoker).Revoke(ctx, validEmail, publicKey, RevokeCompromised); e != g {
+		t.Errorf("Revoke: expected %v but got %v", e, g)
+	}
+	// neither revoked nor notified
+	if rs, _ := l.Since(ctx, 0, 10); len(rs) != 0 {
+		t.Errorf("expected no revocations but got %v", rs)
+	}
+	if changes := n.Changes(); len(changes) != 0 {
+		t.Errorf("expected no changes but got %v", changes)
+	}
+}
+
+type challengeRecorder struct {
+	email, challenge string
+}
+
+func (r *challengeRecorder) SendChallengeContext(ctx context.Context, email, challenge string) error {
+	r.email, r.challenge = email, challenge
+	return nil
+}
+
+func TestStalePolicy(t *testing.T) {
+	salt := []byte("salt")
+	ctx := context.Background()
+	store := NewMemStore()
+	l := NewMemRevocationList()
+	staleKey := bytes.Repeat([]byte("k"), 32)
+	// the reconfirm challenges outlive the other cached values
+	v := NewVey(NewDigester(salt), NewMemCache(100*time.Millisecond), store, WithRevocationList(l), WithStalePolicy(StalePolicy{After: time.Hour, Grace: time.Hour, Key: staleKey}))
+	m := v.(Maintainer)
+	digest := NewDigester(salt).Of(validEmail)
+	sender := &challengeRecorder{}
+
+	edpriv, pub := testKeygen(t)
+	challenge := testBeginPut(t, v, validEmail, PublicKey{Type: SSHEd25519, Key: pub, Comment: "laptop"})
+	if err := v.CommitPut(challenge, ed25519.Sign(edpriv, challenge)); err != nil {
+		t.Fatal(err)
+	}
+	stored := func() PublicKey {
+		keys, err := store.Get(digest)
+		if err != nil || len(keys) != 1 {
+			t.Fatalf("Get: expected a key but got %v, %v", keys, err)
+		}
+		return keys[0]
+	}
+	if sealed := stored().SealedEmail; len(sealed) == 0 || bytes.Contains(sealed, []byte(validEmail)) {
+		t.Errorf("SealedEmail expected the sealed email address but got %q", sealed)
+	}
+	// stale is the key last verified after ago
+	stale := func() {
+		key := stored()
+		old := time.Now().Add(-2 * time.Hour)
+		key.LastVerifiedAt = &old
+		if err := store.Put(digest, key); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	report, err := m.Maintain(ctx, sender)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e, g := (MaintenanceReport{Keys: 1}), report; e != g {
+		t.Errorf("Maintain expected %+v but got %+v", e, g)
+	}
+
+	// the stale key is reconfirmed by the owner
+	stale()
+	report, _ = m.Maintain(ctx, sender)
+	if e, g := (MaintenanceReport{Keys: 1, Reconfirming: 1}), report; e != g {
+		t.Errorf("Maintain expected %+v but got %+v", e, g)
+	}
+	if e, g := validEmail, sender.email; e != g {
+		t.Errorf("reconfirm email expected %v but got %v", e, g)
+	}
+	if stored().ReconfirmBy == nil {
+		t.Errorf("ReconfirmBy should be set")
+	}
+	challenge, err = base64.StdEncoding.DecodeString(sender.challenge)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p, err := ParseSignedPayload(challenge); err != nil || p.Expires.Before(time.Now().Add(59*time.Minute)) {
+		t.Errorf("reconfirm challenge expected to expire after the grace but got %v, %v", p.Expires, err)
+	}
+	time.Sleep(200 * time.Millisecond)
+	if err := v.CommitPut(challenge, ed25519.Sign(edpriv, challenge)); err != nil {
+		t.Fatal(err)
+	}
+	if key := stored(); key.ReconfirmBy != nil || key.Comment != "laptop" {
+		t.Errorf("reconfirmed key expected without ReconfirmBy and with the comment but got %+v", key)
+	}
+
+	// the stale key is dropped after the grace
+	stale()
+	if _, err := m.Maintain(ctx, sender); err != nil {
+		t.Fatal(err)
+	}
+	key := stored()
+	past := time.Now().Add(-time.Second)
+	key.ReconfirmBy = &past
+	if err := store.Put(digest, key); err != nil {
+		t.Fatal(err)
+	}
+	report, _ = m.Maintain(ctx, sender)
+	if e, g := (MaintenanceReport{Keys: 1, Dropped: 1}), report; e != g {
+		t.Errorf("Maintain expected %+v but got %+v", e, g)
+	}
+	testGetKeys(t, v, validEmail, []PublicKey{})
+	if rs, _ := l.Since(ctx, 0, 10); len(rs) != 1 || rs[0].Reason != RevokeStale {
+		t.Errorf("revocations expected [%v] but got %v", RevokeStale, rs)
+	}
+
+	// the keys added without the policy have no email address to reconfirm
+	created := time.Now().Add(-2 * time.Hour)
+	if err := store.Put(digest, PublicKey{Type: SSHEd25519, Key: pub, CreatedAt: &created}); err != nil {
+		t.Fatal(err)
+	}
+	report, _ = m.Maintain(ctx, sender)
+	if e, g := (MaintenanceReport{Keys: 1, Unreachable: 1}), report; e != g {
+		t.Errorf("Maintain expected %+v but got %+v", e, g)
+	}
+
+	// nor the keys sealed with another key
+	other := NewVey(NewDigester(salt), NewMemCache(time.Minute), NewMemStore(), WithStalePolicy(StalePolicy{Key: bytes.Repeat([]byte("o"), 32)})).(vey)
+	sealed, err := other.sealEmail(validEmail, digest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Put(digest, PublicKey{Type: SSHEd25519, Key: pub, CreatedAt: &created, SealedEmail: sealed}); err != nil {
+		t.Fatal(err)
+	}
+	report, _ = m.Maintain(ctx, sender)
+	if e, g := (MaintenanceReport{Keys: 1, Unreachable: 1}), report; e != g {
+		t.Errorf("Maintain expected %+v but got %+v", e, g)
+	}
+
+	if _, err := NewVey(NewDigester(salt), NewMemCache(time.Second), NewMemStore()).(Maintainer).Maintain(ctx, sender); err != ErrNoStalePolicy {
+		t.Errorf("Maintain: expected %v but got %v", ErrNoStalePolicy, err)
+	}
+}
+
+func TestKeyPolicy(t *testing.T) {
+	salt := []byte("salt")
+	ctx := context.Background()
+	_, denied := testKeygen(t)
+	deniedKey := PublicKey{Type: SSHEd25519, Key: denied}
+	l, err := ReadFingerprintDenyList(strings.NewReader("# weak keys\n\n" + deniedKey.Fingerprint() + "\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	v := NewVey(NewDigester(salt), NewMemCache(time.Second), NewMemStore(), WithKeyPolicy(KeyPolicy{MaxKeys: 2, MinBits: 256, DenyList: l}))
+
+	put := func() PublicKey {
+		edpriv, pub := testKeygen(t)
+		publicKey := PublicKey{Type: SSHEd25519, Key: pub}
+		challenge := testBeginPut(t, v, validEmail, publicKey)
+		if err := v.CommitPut(challenge, ed25519.Sign(edpriv, challenge)); err != nil {
+			t.Fatal(err)
+		}
+		return publicKey
+	}
+	first := put()
+
+	_, pub := testKeygen(t)
+	tests := []struct {
+		name      string
+		publicKey PublicKey
+		expected  error
+	}{
+		{"not authorized_keys", PublicKey{Type: SSHEd25519, Key: []byte("key")}, ErrKeyTypeNotAllowed},
+		{"unknown type", PublicKey{Type: PublicKeyType(9), Key: pub}, ErrKeyTypeNotAllowed},
+		{"denied", deniedKey, ErrDeniedKey},
+	}
+	for _, tt := range tests {
+		if _, err := v.BeginPut(validEmail, tt.publicKey); err != tt.expected {
+			t.Errorf("%s: expected %v but got %v", tt.name, tt.expected, err)
+		}
+	}
+	strict := NewVey(NewDigester(salt), NewMemCache(time.Second), NewMemStore(), WithKeyPolicy(KeyPolicy{MinBits: 384}))
+	if _, err := strict.BeginPut(validEmail, PublicKey{Type: SSHEd25519, Key: pub}); err != ErrWeakKey {
+		t.Errorf("expected %v but got %v", ErrWeakKey, err)
+	}
+
+	// the challenge begun before the limit is reached is refused on commit
+	edpriv, pub := testKeygen(t)
+	pending := testBeginPut(t, v, validEmail, PublicKey{Type: SSHEd25519, Key: pub})
+	put()
+	if err := v.CommitPut(pending, ed25519.Sign(edpriv, pending)); err != ErrTooManyKeys {
+		t.Errorf("CommitPut: expected %v but got %v", ErrTooManyKeys, err)
+	}
+	if _, err := v.BeginPut(validEmail, PublicKey{Type: SSHEd25519, Key: pub}); err != ErrTooManyKeys {
+		t.Errorf("BeginPut: expected %v but got %v", ErrTooManyKeys, err)
+	}
+	// the stored keys can be put again
+	testBeginPut(t, v, validEmail, first)
+
+	if denied, err := NewFingerprintDenyList().IsDenied(ctx, first); err != nil || denied {
+		t.Errorf("empty deny list should not deny but got %v, %v", denied, err)
+	}
+}
+
+func TestDomainPolicy(t *testing.T) {
+	salt := []byte("salt")
+	blocklist, err := ReadDomainList(strings.NewReader("# disposable\nmailinator.com\n*.Disposable.example\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	policy := DomainPolicy{Allow: []string{"ourcompany.com", "*.ourcompany.com", "subsidiary.example", "disposable.example"}, Deny: blocklist}
+	v := NewVey(NewDigester(salt), NewMemCache(time.Second), NewMemStore(), WithDomainPolicy(policy)).(vey)
+
+	tests := []struct {
+		email    string
+		expected error
+	}{
+		{"test@ourcompany.com", nil},
+		{"test@OurCompany.com", nil},
+		{"test@tokyo.ourcompany.com", nil},
+		{"test@subsidiary.example", nil},
+		{"test@sub.subsidiary.example", ErrDomainNotAllowed},
+		{"test@example.com", ErrDomainNotAllowed},
+		{"test@notourcompany.com", ErrDomainNotAllowed},
+		{"test@mailinator.com", ErrDomainNotAllowed},
+		{"test@disposable.example", nil},
+		{"test@x.disposable.example", ErrDomainNotAllowed},
+	}
+	for _, tt := range tests {
+		if e, g := tt.expected, v.checkDomain(tt.email); e != g {
+			t.Errorf("%s expected %v but got %v", tt.email, e, g)
+		}
+	}
+
+	_, pub := testKeygen(t)
+	publicKey := PublicKey{Type: SSHEd25519, Key: pub}
+	if _, err := v.BeginPut(validEmail, publicKey); err != ErrDomainNotAllowed {
+		t.Errorf("BeginPut: expected %v but got %v", ErrDomainNotAllowed, err)
+	}
+	if _, err := v.BeginDelete(validEmail, publicKey); err != ErrDomainNotAllowed {
+		t.Errorf("BeginDelete: expected %v but got %v", ErrDomainNotAllowed, err)
+	}
+	if _, err := v.BeginDeleteWithSignature(validEmail, publicKey); err != ErrDomainNotAllowed {
+		t.Errorf("BeginDeleteWithSignature: expected %v but got %v", ErrDomainNotAllowed, err)
+	}
+	testGetKeysError(t, v, validEmail, ErrDomainNotAllowed)
+	testBeginPut(t, v, "test@ourcompany.com", publicKey)
+
+	policy.Ignore = true
+	ignoring := NewVey(NewDigester(salt), NewMemCache(time.Second), NewMemStore(), WithDomainPolicy(policy))
+	if _, err := ignoring.BeginPut(validEmail, publicKey); err != ErrIgnored {
+		t.Errorf("BeginPut: expected %v but got %v", ErrIgnored, err)
+	}
+	if _, err := ignoring.BeginDelete(validEmail, publicKey); err != ErrIgnored {
+		t.Errorf("BeginDelete: expected %v but got %v", ErrIgnored, err)
+	}
+	if _, err := ignoring.BeginDeleteWithSignature(validEmail, publicKey); err != ErrNotFound {
+		t.Errorf("BeginDeleteWithSignature: expected %v but got %v", ErrNotFound, err)
+	}
+	testGetKeys(t, ignoring, validEmail, []PublicKey{})
+}
+
+type securityRecorder struct {
+	Logger
+	events []SecurityEvent
+}
+
+func (l *securityRecorder) Security(e SecurityEvent) {
+	l.events = append(l.events, e)
+}
+
+func TestLockout(t *testing.T) {
+	recorder := &securityRecorder{Logger: Log}
+	Log = recorder
+	defer func() { Log = recorder.Logger }()
+
+	salt := []byte("salt")
+	v := NewVey(NewDigester(salt), NewMemCache(time.Minute), NewMemStore(), WithLockout(LockoutPolicy{Threshold: 3, Backoff: time.Hour}))
+	attacker := WithClient(context.Background(), "192.0.2.1")
+	user := WithClient(context.Background(), "198.51.100.1")
+	cv := v.(ContextVey)
+
+	// an attacker probes the tokens of CommitDelete
+	for i := 0; i < 3; i++ {
+		token, _ := NewToken()
+		if err := cv.CommitDeleteContext(attacker, token); err != ErrNotFound {
+			t.Fatalf("probe %d: expected %v but got %v", i, ErrNotFound, err)
+		}
+	}
+	token, _ := NewToken()
+	if err := cv.CommitDeleteContext(attacker, token); err != ErrLocked {
+		t.Errorf("expected %v but got %v", ErrLocked, err)
+	}
+	if err := cv.CommitPutContext(attacker, token, nil); err != ErrLocked {
+		t.Errorf("the client should be locked out of all the commits but got %v", err)
+	}
+	if err := cv.CommitDeleteContext(user, token); err != ErrNotFound {
+		t.Errorf("the other clients should not be locked out but got %v", err)
+	}
+
+	// attackers from many addresses brute force the signature of the put challenges for an email address
+	edpriv, pub := testKeygen(t)
+	publicKey := PublicKey{Type: SSHEd25519, Key: pub}
+	for i := 0; i < 3; i++ {
+		challenge := testBeginPut(t, v, validEmail, publicKey)
+		ctx := WithClient(context.Background(), fmt.Sprintf("203.0.113.%d", i))
+		if err := cv.CommitPutContext(ctx, challenge, make([]byte, ed25519.SignatureSize)); err != ErrVerifyFailed {
+			t.Fatalf("attempt %d: expected %v but got %v", i, ErrVerifyFailed, err)
+		}
+	}
+	challenge := testBeginPut(t, v, validEmail, publicKey)
+	if err := cv.CommitPutContext(user, challenge, ed25519.Sign(edpriv, challenge)); err != ErrLocked {
+		t.Errorf("the email address should be locked out but got %v", err)
+	}
+	if err := cv.CommitPutContext(user, challenge, ed25519.Sign(edpriv, challenge)); err != ErrLocked {
+		t.Errorf("the challenge should be kept during the lockout but got %v", err)
+	}
+
+	// the failures of the email address are forgotten on success
+	other := "other@example.com"
+	for i := 0; i < 5; i++ {
+		challenge := testBeginPut(t, v, other, publicKey)
+		var signature []byte
+		if i == 2 {
+			signature = ed25519.Sign(edpriv, challenge)
+		}
+		err := cv.CommitPutContext(context.Background(), challenge, signature)
+		if i == 2 && err != nil {
+			t.Errorf("attempt %d: expected success but got %v", i, err)
+		} else if i != 2 && err != ErrVerifyFailed {
+			t.Errorf("attempt %d: expected %v but got %v", i, ErrVerifyFailed, err)
+		}
+	}
+
+	types := map[string]int{}
+	for _, e := range recorder.events {
+		types[e.Type]++
+	}
+	if types[SecurityCommitFailed] != 11 || types[SecurityLockedOut] != 4 {
+		t.Errorf("security events expected 11 %s and 4 %s but got %v", SecurityCommitFailed, SecurityLockedOut, types)
+	}
+	if e := recorder.events[3]; e.Type != SecurityLockedOut || e.Client != "192.0.2.1" || e.Failures != 3 || e.LockedUntil.IsZero() {
+		t.Errorf("unexpected security event: %v", e)
+	}
+}
+
+func TestLockoutDeleteWithSignature(t *testing.T) {
+	v := NewVey(NewDigester([]byte("salt")), NewMemCache(time.Minute), NewMemStore(), WithLockout(LockoutPolicy{Threshold: 3, Backoff: time.Hour}))
+	cv := v.(ContextVey)
+	edpriv, pub := testKeygen(t)
+	publicKey := PublicKey{Type: SSHEd25519, Key: pub}
+	challenge := testBeginPut(t, v, validEmail, publicKey)
+	if err := v.CommitPut(challenge, ed25519.Sign(edpriv, challenge)); err != nil {
+		t.Fatal(err)
+	}
+
+	// attackers from many addresses get the delete challenges of the stored key, and sign them with garbage
+	for i := 0; i < 5; i++ {
+		ctx := WithClient(context.Background(), fmt.Sprintf("203.0.113.%d", i))
+		challenge, err := cv.BeginDeleteWithSignatureContext(ctx, validEmail, publicKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := cv.CommitDeleteWithSignatureContext(ctx, challenge, make([]byte, ed25519.SignatureSize)); err != ErrVerifyFailed {
+			t.Fatalf("attempt %d: expected %v but got %v", i, ErrVerifyFailed, err)
+		}
+	}
+	// each attacker is locked out
+	attacker := WithClient(context.Background(), "192.0.2.1")
+	for i := 0; i < 3; i++ {
+		challenge, _ := cv.BeginDeleteWithSignatureContext(attacker, validEmail, publicKey)
+		cv.CommitDeleteWithSignatureContext(attacker, challenge, nil)
+	}
+	challenge, _ = cv.BeginDeleteWithSignatureContext(attacker, validEmail, publicKey)
+	if err := cv.CommitDeleteWithSignatureContext(attacker, challenge, ed25519.Sign(edpriv, challenge)); err != ErrLocked {
+		t.Errorf("expected %v but got %v", ErrLocked, err)
+	}
+
+	// but the owner of the email address is not
+	user := WithClient(context.Background(), "198.51.100.1")
+	otherpriv, other := testKeygen(t)
+	challenge = testBeginPut(t, v, validEmail, PublicKey{Type: SSHEd25519, Key: other})
+	if err := cv.CommitPutContext(user, challenge, ed25519.Sign(otherpriv, challenge)); err != nil {
+		t.Errorf("CommitPut: expected success but got %v", err)
+	}
+	token, err := v.BeginDelete(validEmail, publicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cv.CommitDeleteContext(user, token); err != nil {
+		t.Errorf("CommitDelete: expected success but got %v", err)
+	}
+}
+
+func TestLockoutBackoff(t *testing.T) {
+	p := LockoutPolicy{Threshold: 3, Backoff: time.Second, MaxBackoff: 10 * time.Second}
+	last := time.Now()
+	tests := []struct {
+		count    int
+		expected time.Duration
+	}{
+		{2, 0},
+		{3, time.Second},
+		{4, 2 * time.Second},
+		{6, 8 * time.Second},
+		{7, 10 * time.Second},
+		{100, 10 * time.Second},
+	}
+	for _, tt := range tests {
+		until := p.lockedUntil(Failures{Count: tt.count, Last: last})
+		if tt.expected == 0 {
+			if !until.IsZero() {
+				t.Errorf("%d failures expected no lockout but got %v", tt.count, until)
+			}
+			continue
+		}
+		if e, g := tt.expected, until.Sub(last); e != g {
+			t.Errorf("%d failures expected %v but got %v", tt.count, e, g)
+		}
+	}
+}
+
+func TestProofOfPossession(t *testing.T) {
+	salt := []byte("salt")
+	origin := "https://vey.example.com"
+	store := NewMemStore()
+	v := NewVey(NewDigester(salt), NewMemCache(time.Minute), store, WithOrigin(origin),
+		WithProofOfPossession(time.Minute), WithStalePolicy(StalePolicy{After: time.Hour, Grace: time.Hour, Key: bytes.Repeat([]byte("k"), 32)}))
+	cv := v.(ContextVey)
+	edpriv, pub := testKeygen(t)
+	publicKey := PublicKey{Type: SSHEd25519, Key: pub}
+	otherpriv, _ := testKeygen(t)
+
+	now := time.Now()
+	prove := func(priv ed25519.PrivateKey, origin, email string, at time.Time) context.Context {
+		return WithPossessionProof(context.Background(), PossessionProof{
+			Time:      at,
+			Signature: ed25519.Sign(priv, ProofPayload(origin, email, publicKey, at)),
+		})
+	}
+	tests := []struct {
+		name     string
+		ctx      context.Context
+		expected error
+	}{
+		{"no proof", context.Background(), ErrProofRequired},
+		{"other key", prove(otherpriv, origin, validEmail, now), ErrInvalidProof},
+		{"other email", prove(edpriv, origin, "other@example.com", now), ErrInvalidProof},
+		{"other origin", prove(edpriv, "https://other.example.com", validEmail, now), ErrInvalidProof},
+		{"stale", prove(edpriv, origin, validEmail, now.Add(-2*time.Minute)), ErrInvalidProof},
+		{"future", prove(edpriv, origin, validEmail, now.Add(2*time.Minute)), ErrInvalidProof},
+		{"valid", prove(edpriv, origin, validEmail, now), nil},
+	}
+	var challenge []byte
+	for _, tt := range tests {
+		c, err := cv.BeginPutContext(tt.ctx, validEmail, publicKey)
+		if e, g := tt.expected, err; e != g {
+			t.Errorf("%s: expected %v but got %v", tt.name, e, g)
+		}
+		if err == nil {
+			challenge = c
+		}
+	}
+	if err := v.CommitPut(challenge, ed25519.Sign(edpriv, challenge)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Maintain sends the reconfirm challenges without the proof
+	digest := NewDigester(salt).Of(validEmail)
+	keys, err := store.Get(digest)
+	if err != nil || len(keys) != 1 {
+		t.Fatalf("Get: expected a key but got %v, %v", keys, err)
+	}
+	old := now.Add(-2 * time.Hour)
+	keys[0].LastVerifiedAt = &old
+	if err := store.Put(digest, keys[0]); err != nil {
+		t.Fatal(err)
+	}
+	report, err := v.(Maintainer).Maintain(context.Background(), &challengeRecorder{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e, g := (MaintenanceReport{Keys: 1, Reconfirming: 1}), report; e != g {
+		t.Errorf("Maintain expected %+v but got %+v", e, g)
+	}
+}
+
+func TestLookupPolicy(t *testing.T) {
+	v := NewVey(NewDigester([]byte("salt")), NewMemCache(time.Minute), NewMemStore(),
+		WithLookupPolicy(LookupPolicy{Secret: []byte("secret"), MinDuration: 50 * time.Millisecond}))
+	cv := v.(ContextVey)
+	l := v.(Lookuper)
+
+	if _, err := v.GetKeys(validEmail); err != ErrLookupTokenRequired {
+		t.Errorf("expected %v but got %v", ErrLookupTokenRequired, err)
+	}
+
+	edpriv, pub := testKeygen(t)
+	challenge := testBeginPut(t, v, validEmail, PublicKey{Type: SSHEd25519, Key: pub})
+	token, err := l.CommitPutLookupContext(context.Background(), challenge, ed25519.Sign(edpriv, challenge))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected, err := l.LookupToken(validEmail)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(expected, token) {
+		t.Errorf("CommitPutLookupContext expected %v but got %v", expected, token)
+	}
+	other, err := l.LookupToken("other@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		email string
+		token []byte
+		keys  int
+	}{
+		{"valid", validEmail, token, 1},
+		{"wrong token", validEmail, []byte("wrong"), 0},
+		{"token of another address", validEmail, other, 0},
+		{"address without keys", "other@example.com", other, 0},
+	}
+	for _, tt := range tests {
+		start := time.Now()
+		keys, err := cv.GetKeysContext(WithLookupToken(context.Background(), tt.token), tt.email)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if e, g := tt.keys, len(keys); e != g {
+			t.Errorf("%s: expected %v keys but got %v", tt.name, e, g)
+		}
+		if d := time.Since(start); d < 50*time.Millisecond {
+			t.Errorf("%s: expected to take at least the MinDuration but took %v", tt.name, d)
+		}
+	}
+
+	open := NewVey(NewDigester([]byte("salt")), NewMemCache(time.Minute), NewMemStore())
+	if _, err := open.(Lookuper).LookupToken(validEmail); err != ErrNoLookupSecret {
+		t.Errorf("expected %v but got %v", ErrNoLookupSecret, err)
+	}
+}
+
+func TestLookupPolicyHidesKeys(t *testing.T) {
+	v := NewVey(NewDigester([]byte("salt")), NewMemCache(time.Minute), NewMemStore(),
+		WithLookupPolicy(LookupPolicy{Secret: []byte("secret"), MinDuration: 50 * time.Millisecond}),
+		WithKeyPolicy(KeyPolicy{MaxKeys: 1}), WithRevocationList(NewMemRevocationList()), WithRefuseRevoked())
+	cv := v.(ContextVey)
+	edpriv, pub := testKeygen(t)
+	stored := PublicKey{Type: SSHEd25519, Key: pub}
+	challenge := testBeginPut(t, v, validEmail, stored)
+	if err := v.CommitPut(challenge, ed25519.Sign(edpriv, challenge)); err != nil {
+		t.Fatal(err)
+	}
+	otherpriv, other := testKeygen(t)
+	notStored := PublicKey{Type: SSHEd25519, Key: other}
+
+	// BeginDeleteWithSignature does not tell whether the key is stored
+	tests := []struct {
+		name      string
+		email     string
+		publicKey PublicKey
+	}{
+		{"stored", validEmail, stored},
+		{"not stored", validEmail, notStored},
+		{"address without keys", "other@example.com", stored},
+	}
+	for _, tt := range tests {
+		start := time.Now()
+		challenge, err := v.BeginDeleteWithSignature(tt.email, tt.publicKey)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if d := time.Since(start); d < 50*time.Millisecond {
+			t.Errorf("%s: expected to take at least the MinDuration but took %v", tt.name, d)
+		}
+		if e, g := ErrVerifyFailed, v.CommitDeleteWithSignature(challenge, make([]byte, ed25519.SignatureSize)); e != g {
+			t.Errorf("%s: expected %v but got %v", tt.name, e, g)
+		}
+	}
+	// and the commit fails for the key not stored, even signed by it
+	challenge, err := v.BeginDeleteWithSignature(validEmail, notStored)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e, g := ErrNotFound, v.CommitDeleteWithSignature(challenge, ed25519.Sign(otherpriv, challenge)); e != g {
+		t.Errorf("expected %v but got %v", e, g)
+	}
+	// nor returns the challenge for the key of the type not supported, which is never stored
+	if _, err := v.BeginDeleteWithSignature(validEmail, PublicKey{Type: PublicKeyType(7), Key: pub}); err != ErrNotFound {
+		t.Errorf("unsupported type: expected %v but got %v", ErrNotFound, err)
+	}
+
+	// BeginPut does not tell that the email address has the keys
+	if _, err := v.BeginPut(validEmail, notStored); err != ErrIgnored {
+		t.Errorf("too many keys: expected %v but got %v", ErrIgnored, err)
+	}
+	if err := v.(Revoker).Revoke(context.Background(), validEmail, stored, RevokeCompromised); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cv.BeginPutContext(context.Background(), validEmail, stored); err != ErrIgnored {
+		t.Errorf("revoked: expected %v but got %v", ErrIgnored, err)
+	}
+}